@@ -3,20 +3,27 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
-	"net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/patrickmn/go-cache"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	jaegercfg "github.com/uber/jaeger-client-go/config"
 
 	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/accesslog"
+	"github.com/Lookyan/netramesh/pkg/admin"
+	"github.com/Lookyan/netramesh/pkg/capture"
+	"github.com/Lookyan/netramesh/pkg/connlimit"
 	"github.com/Lookyan/netramesh/pkg/estabcache"
 	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
 	"github.com/Lookyan/netramesh/pkg/protocol"
+	"github.com/Lookyan/netramesh/pkg/stats"
 	"github.com/Lookyan/netramesh/pkg/transport"
 )
 
@@ -36,22 +43,42 @@ func main() {
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
+	config.WatchReload(logger)
+
+	if config.GetNetraConfig().AccessLogEnabled {
+		accessLogWriter := os.Stdout
+		if path := config.GetNetraConfig().AccessLogFile; path != "" {
+			accessLogWriter, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				logger.Fatalf("Could not open access log file: %s", err.Error())
+			}
+			defer accessLogWriter.Close()
+		}
+		accesslog.Init(accessLogWriter)
+	}
+	// sink is always enabled, captured paths can be configured on reload
+	var captureWriter io.Writer
+	if path := config.GetNetraConfig().CaptureFile; path != "" {
+		captureFile, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			logger.Fatalf("Could not open capture file: %s", err.Error())
+		}
+		defer captureFile.Close()
+		captureWriter = captureFile
+	}
+	capture.Init(captureWriter, config.GetNetraConfig().CaptureBufferSize)
+	stats.Init(config.GetNetraConfig().StatsMaxOperations, config.GetNetraConfig().StatsWindow)
 
 	go func() {
-		mux := http.NewServeMux()
-		mux.HandleFunc("/debug/pprof/", pprof.Index)
-		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 		logger.Error(
 			http.ListenAndServe(
-				fmt.Sprintf("0.0.0.0:%d", config.GetNetraConfig().PprofPort), mux))
+				fmt.Sprintf("0.0.0.0:%d", config.GetNetraConfig().PrometheusPort), metrics.Handler()))
 	}()
 	go func() {
 		logger.Error(
 			http.ListenAndServe(
-				fmt.Sprintf("0.0.0.0:%d", config.GetNetraConfig().PrometheusPort), promhttp.Handler()))
+				fmt.Sprintf("0.0.0.0:%d", config.GetNetraConfig().AdminPort),
+				admin.Handler(config.GetNetraConfig().AdminConfigToken, config.GetNetraConfig().AdminPprofEnabled)))
 	}()
 
 	os.Setenv("JAEGER_SERVICE_NAME", *serviceName)
@@ -60,7 +87,14 @@ func main() {
 		// parsing errors might happen here, such as when we get a string where we expect a number
 		logger.Fatalf("Could not parse Jaeger env vars: %s", err.Error())
 	}
-	tracer, closer, err := cfg.NewTracer()
+	// netra settings take precedence over jaeger ones
+	if size := config.GetNetraConfig().TracerReporterQueueSize; size > 0 {
+		cfg.Reporter.QueueSize = size
+	}
+	if interval := config.GetNetraConfig().TracerReporterFlushInterval; interval > 0 {
+		cfg.Reporter.BufferFlushInterval = interval
+	}
+	tracer, closer, err := cfg.NewTracer(jaegercfg.Metrics(metrics.JaegerFactory()))
 	if err != nil {
 		logger.Fatalf("Could not initialize jaeger tracer: %s", err.Error())
 	}
@@ -90,19 +124,54 @@ func main() {
 		config.GetNetraConfig().RoutingContextCleanupInterval,
 	)
 
+	metrics.ObserveContextMapping("tracing", tracingContextMapping.ItemCount)
+	metrics.ObserveContextMapping("routing", routingInfoContextMapping.ItemCount)
+
 	protocol.InitHandlerRequest(logger, tracingContextMapping, routingInfoContextMapping)
+	admin.SetReady(true)
 
+	// on shutdown listener is closed to stop accepting connections, accepted ones are drained
+	shutdownCh := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		logger.Infof("Got %s, draining connections", sig.String())
+		admin.SetReady(false)
+		close(shutdownCh)
+		ln.Close()
+	}()
+
+	connLimiter := connlimit.New(config.GetNetraConfig().MaxConnections, metrics.AddActiveConnections)
 	for {
 		conn, err := ln.AcceptTCP()
 		if err != nil {
+			select {
+			case <-shutdownCh:
+				if !protocol.Drain(config.GetNetraConfig().DrainTimeout) {
+					logger.Warning("Drain timeout is exceeded, remaining connections are closed")
+				}
+				// deferred tracer closer flushes pending spans
+				return
+			default:
+			}
 			logger.Warning(err.Error())
 			continue
 		}
-		go transport.HandleConnection(
-			logger,
-			conn,
-			establishedCache,
-			tracingContextMapping,
-			routingInfoContextMapping)
+		// connection over limit waits for free slot, so new connections stay in listen backlog meanwhile
+		if !connLimiter.Acquire(config.GetNetraConfig().MaxConnectionsQueueTimeout) {
+			metrics.ObserveRejectedConnection()
+			go transport.RejectConnection(logger, conn)
+			continue
+		}
+		go func() {
+			transport.HandleConnection(
+				logger,
+				conn,
+				establishedCache,
+				tracingContextMapping,
+				routingInfoContextMapping)
+			connLimiter.Release()
+		}()
 	}
 }
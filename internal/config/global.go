@@ -1,9 +1,16 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/textproto"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/Lookyan/netramesh/pkg/log"
@@ -15,12 +22,36 @@ const (
 	defaultRoutingHeaderName   = "X-Route"
 	defaultXSourceValue        = "netra"
 	defaultRoutingCookieName   = "X-Route"
+	defaultHopsHeaderName      = "X-Mesh-Hops"
+	defaultViaPseudonym        = "netramesh"
+	defaultRetryMaxBodyBytes   = 64 * 1024
+	defaultMaxBodyInspectBytes = 4 * 1024
+	defaultCaptureMaxBodyBytes = 4 * 1024
+	defaultWSSampleMaxBytes    = 256
+	defaultCaptureBufferSize   = 100
+	defaultStatsMaxOperations  = 1000
+	defaultMirrorMaxBodyBytes  = 64 * 1024
+	defaultMirrorMaxInflight   = 100
+	defaultCoalesceBodyBytes   = 64 * 1024
+	defaultBufioSize           = 4 * 1024
+	defaultMaxRequestLineBytes = 16 * 1024
+	defaultMaxHeaderBytes      = 1024 * 1024
+	defaultCopyBufferSize      = 64 * 1024
+	defaultBreakerMinRequests  = 20
+	defaultBreakerWindow       = 10 * time.Second
+	defaultBreakerOpenTimeout  = 10 * time.Second
+	defaultOutlierEjectionTime = 30 * time.Second
+	defaultPoolIdleTimeout     = 90 * time.Second
+	defaultPoolWaitTimeout     = 1 * time.Second
+	defaultDNSCacheNegativeTTL = 1 * time.Second
 )
 
 type NetraConfig struct {
 	Port                          uint16
-	PprofPort                     uint16
 	PrometheusPort                uint16
+	AdminPort                     uint16
+	AdminConfigToken              string
+	AdminPprofEnabled             bool
 	ServiceName                   string
 	TracingContextExpiration      time.Duration
 	TracingContextCleanupInterval time.Duration
@@ -28,17 +59,58 @@ type NetraConfig struct {
 	RoutingContextCleanupInterval time.Duration
 	LoggerLevel                   log.Level
 	HTTPProtoPorts                map[string]struct{}
+	GRPCProtoPorts                map[string]struct{}
+	PassthroughProtoPorts         map[string]struct{}
+	MySQLProtoPorts               map[string]struct{}
+	MySQLStatementMaxLength       int
+	MySQLSanitizeStatements       bool
+	RedisProtoPorts               map[string]struct{}
+	RedisKeysEnabled              bool
+	KafkaProtoPorts               map[string]struct{}
+	AMQPProtoPorts                map[string]struct{}
+	MongoDBProtoPorts             map[string]struct{}
+	ThriftProtoPorts              map[string]struct{}
+	TLSProtoPorts                 map[string]struct{}
+	TLSSNIRoutes                  string
+	AccessLogEnabled              bool
+	AccessLogFile                 string
+	CaptureFile                   string
+	CaptureBufferSize             int
+	StatsMaxOperations            int
+	StatsWindow                   time.Duration
+	TracerReporterQueueSize       int
+	TracerReporterFlushInterval   time.Duration
+	DrainTimeout                  time.Duration
+	MaxTagValueLength             int
+	ProtocolSniffTimeout          time.Duration
+	MaxConnections                int
+	MaxConnectionsQueueTimeout    time.Duration
 }
 
 var netraConfig = NetraConfig{
 	Port:                          14956,
-	PprofPort:                     14957,
 	PrometheusPort:                14958,
+	AdminPort:                     14959,
 	TracingContextExpiration:      5 * time.Second,
 	TracingContextCleanupInterval: 1 * time.Second,
 	RoutingContextExpiration:      5 * time.Second,
 	RoutingContextCleanupInterval: 1 * time.Second,
 	HTTPProtoPorts:                make(map[string]struct{}),
+	GRPCProtoPorts:                make(map[string]struct{}),
+	PassthroughProtoPorts:         make(map[string]struct{}),
+	MySQLProtoPorts:               make(map[string]struct{}),
+	MySQLStatementMaxLength:       1024,
+	MySQLSanitizeStatements:       true,
+	RedisProtoPorts:               make(map[string]struct{}),
+	KafkaProtoPorts:               make(map[string]struct{}),
+	AMQPProtoPorts:                make(map[string]struct{}),
+	MongoDBProtoPorts:             make(map[string]struct{}),
+	ThriftProtoPorts:              make(map[string]struct{}),
+	TLSProtoPorts:                 make(map[string]struct{}),
+	CaptureBufferSize:             defaultCaptureBufferSize,
+	StatsMaxOperations:            defaultStatsMaxOperations,
+	StatsWindow:                   time.Minute,
+	DrainTimeout:                  20 * time.Second,
 }
 
 func GetNetraConfig() NetraConfig {
@@ -49,162 +121,1621 @@ func SetServiceName(serviceName string) {
 	netraConfig.ServiceName = serviceName
 }
 
+// connectionTags are semantic tags of connection metadata which can be taken from headers
+// set by TLS terminating proxy
+var connectionTags = map[string]struct{}{
+	"http.scheme":           {},
+	"tls.version":           {},
+	"tls.cipher":            {},
+	"peer.cert.subject":     {},
+	"peer.cert.issuer":      {},
+	"peer.cert.fingerprint": {},
+}
+
+func connectionTagNames() string {
+	names := make([]string, 0, len(connectionTags))
+	for name := range connectionTags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// framingHeaders can't be set on responses, they are written according to response body
+var framingHeaders = map[string]struct{}{
+	"Content-Length":    {},
+	"Transfer-Encoding": {},
+	"Trailer":           {},
+	"Connection":        {},
+	"Keep-Alive":        {},
+	"Upgrade":           {},
+}
+
+// formats of generated request ids
+const (
+	RequestIdFormatUUID = "uuid"
+	RequestIdFormatHex  = "hex"
+	RequestIdFormatULID = "ulid"
+)
+
+// formats of outbound span operation, path is normalized according to the config
+const (
+	OperationFormatHostPath    = "host_path"
+	OperationFormatPath        = "path"
+	OperationFormatPeerService = "peer_service"
+)
+
+// modes of injecting trace context to outbound requests which already carry one
+const (
+	TraceContextInjectionOverride = "override"
+	TraceContextInjectionPreserve = "preserve"
+)
+
+// StatusRange is inclusive range of HTTP status codes
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// RateLimit is token bucket parameters: Rate tokens per second and Burst capacity
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// FaultRule is fault injected into requests: AbortPercent of them are answered with AbortStatus
+// and DelayPercent of them are delayed by Delay before being forwarded
+type FaultRule struct {
+	AbortStatus  int
+	AbortPercent float64
+	Delay        time.Duration
+	DelayPercent float64
+}
+
+// HedgeRule is hedging of requests: up to MaxHedges copies of request are sent one by one
+// while response isn't received, each after Delay or after Percentile of observed latencies if it's set
+type HedgeRule struct {
+	Delay      time.Duration
+	Percentile float64
+	MaxHedges  int
+}
+
+// InheritTimeout is value of RouteTimeouts field which keeps global timeout
+const InheritTimeout time.Duration = -1
+
+// RouteTimeouts overrides timeouts of requests with path prefix, zero value means no timeout.
+// Total is time from request start till the whole response is read, there is no global one
+type RouteTimeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Total time.Duration
+}
+
+// HeaderRule removes Headers from messages of requests with path Prefix, or keeps only them if Keep is set.
+// Header names are canonical, framing headers are always kept
+type HeaderRule struct {
+	Prefix  string
+	Keep    bool
+	Headers map[string]struct{}
+}
+
+// PathRewriteRule replaces path Prefix with Replacement, or substitutes matches of Pattern with it if Pattern is set.
+// Replacement of pattern may refer to its groups as $1
+type PathRewriteRule struct {
+	Prefix      string
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
 type HTTPConfig struct {
-	HeadersMap           map[string]string
-	CookiesMap           map[string]string
-	RequestIdHeaderName  string
-	XSourceHeaderName    string
-	XSourceValue         string
-	RoutingEnabled       bool
-	RoutingHeaderName    string
-	RoutingCookieEnabled bool
-	RoutingCookieName    string
-}
-
-var httpConfig = HTTPConfig{
-	HeadersMap:           map[string]string{},
-	CookiesMap:           map[string]string{},
-	RequestIdHeaderName:  defaultRequestIdHeaderName,
-	XSourceHeaderName:    defaultXSourceName,
-	XSourceValue:         defaultXSourceValue,
-	RoutingEnabled:       false,
-	RoutingHeaderName:    defaultRoutingHeaderName,
-	RoutingCookieEnabled: false,
-	RoutingCookieName:    defaultRoutingCookieName,
+	HeadersMap                 map[string]string
+	CookiesMap                 map[string]string
+	QueryParamsMap             map[string]string
+	ConnectionHeadersMap       map[string]string
+	ResponseBodyFieldsMap      map[string]string
+	ResponseHeaders            map[string]string
+	SensitiveHeaders           map[string]struct{}
+	BaggageHeadersMap          map[string]string
+	BaggageTags                []string
+	SamplingRates              map[string]float64
+	ForceSampleHeaderName      string
+	CaptureRates               map[string]int
+	UntracedPathPrefixes       []string
+	CoalescePathPrefixes       []string
+	CoalesceMaxBodyBytes       int
+	UntracedHosts              map[string]struct{}
+	AllowedHosts               map[string]struct{}
+	RateLimits                 map[string]RateLimit
+	FaultRules                 map[string]FaultRule
+	HedgeRules                 map[string]HedgeRule
+	RouteTimeouts              map[string]RouteTimeouts
+	RequestHeaderRules         []HeaderRule
+	ResponseHeaderRules        []HeaderRule
+	PathRewriteRules           []PathRewriteRule
+	ErrorStatuses              []StatusRange
+	ErrorStatusesByPath        map[string][]StatusRange
+	RequestIdHeaderName        string
+	RequestIdHeaderNames       []string
+	RequestIdFormat            string
+	XSourceHeaderName          string
+	XSourceValue               string
+	XForwardedForEnabled       bool
+	XForwardedTrustedCIDRs     []*net.IPNet
+	RoutingEnabled             bool
+	RoutingHeaderName          string
+	RoutingCookieEnabled       bool
+	RoutingCookieName          string
+	RoutingStickyCookieEnabled bool
+	RoutingStickyCookieTTL     time.Duration
+	RoutingStickyCookiePath    string
+	MaxHops                    int
+	HopsHeaderName             string
+	ViaEnabled                 bool
+	ViaPseudonym               string
+	W3CPropagationEnabled      bool
+	B3PropagationEnabled       bool
+	DatadogPropagationEnabled  bool
+	TraceContextInjection      string
+	StripHopByHopHeaders       bool
+	StrictFraming              bool
+	StrictResponseLength       bool
+	SpanLogsEnabled            bool
+	WebSocketFramesEnabled     bool
+	WebSocketSamplePaths       []string
+	WebSocketSampleMaxBytes    int
+	ProxyProtocol              bool
+	ObserveOnly                bool
+	PeerServicePattern         *regexp.Regexp
+	OperationNormalizePath     bool
+	OperationMethodPrefix      bool
+	OutboundOperationFormat    string
+	ConnectTimeout             time.Duration
+	ReadTimeout                time.Duration
+	WriteTimeout               time.Duration
+	IdleTimeout                time.Duration
+	MaxRetries                 int
+	MaxInflightRequests        int
+	RetryMaxBodyBytes          int64
+	MaxBodyInspectBytes        int
+	CaptureMaxBodyBytes        int
+	MirrorMaxBodyBytes         int64
+	MirrorMaxInflight          int
+	BufioSize                  int
+	MaxRequestLineBytes        int
+	MaxHeaderBytes             int
+	CopyBufferSize             int
+	BreakerMaxFailures         int
+	BreakerFailureRatio        float64
+	BreakerMinRequests         int
+	BreakerWindow              time.Duration
+	BreakerOpenTimeout         time.Duration
+	OutlierFailures            int
+	OutlierEjectionTime        time.Duration
+	PoolMaxIdlePerHost         int
+	PoolIdleTimeout            time.Duration
+	PoolMaxConnsPerHost        int
+	PoolWaitTimeout            time.Duration
+	DNSCacheTTL                time.Duration
+	DNSCacheNegativeTTL        time.Duration
+	UpstreamResetBadGateway    bool
 }
 
+// MarshalJSON encodes config with peer service pattern and CIDRs as their sources, it's used to show effective config
+func (c HTTPConfig) MarshalJSON() ([]byte, error) {
+	type plainHTTPConfig HTTPConfig
+	pattern := ""
+	if c.PeerServicePattern != nil {
+		pattern = c.PeerServicePattern.String()
+	}
+	cidrs := make([]string, 0, len(c.XForwardedTrustedCIDRs))
+	for _, cidr := range c.XForwardedTrustedCIDRs {
+		cidrs = append(cidrs, cidr.String())
+	}
+	return json.Marshal(struct {
+		plainHTTPConfig
+		PeerServicePattern     string
+		XForwardedTrustedCIDRs []string
+	}{plainHTTPConfig(c), pattern, cidrs})
+}
+
+// newHTTPConfig returns HTTP config with default values
+func newHTTPConfig() HTTPConfig {
+	return HTTPConfig{
+		HeadersMap:            map[string]string{},
+		CookiesMap:            map[string]string{},
+		QueryParamsMap:        map[string]string{},
+		ConnectionHeadersMap:  map[string]string{},
+		ResponseBodyFieldsMap: map[string]string{},
+		ResponseHeaders:       map[string]string{},
+		SensitiveHeaders: map[string]struct{}{
+			"authorization":       {},
+			"proxy-authorization": {},
+		},
+		BaggageHeadersMap:          map[string]string{},
+		SamplingRates:              map[string]float64{},
+		CaptureRates:               map[string]int{},
+		UntracedHosts:              map[string]struct{}{},
+		AllowedHosts:               map[string]struct{}{},
+		RateLimits:                 map[string]RateLimit{},
+		FaultRules:                 map[string]FaultRule{},
+		HedgeRules:                 map[string]HedgeRule{},
+		RouteTimeouts:              map[string]RouteTimeouts{},
+		ErrorStatuses:              []StatusRange{{Min: 500, Max: 599}},
+		ErrorStatusesByPath:        map[string][]StatusRange{},
+		RequestIdHeaderName:        defaultRequestIdHeaderName,
+		RequestIdHeaderNames:       []string{defaultRequestIdHeaderName},
+		RequestIdFormat:            RequestIdFormatUUID,
+		OutboundOperationFormat:    OperationFormatHostPath,
+		XSourceHeaderName:          defaultXSourceName,
+		XSourceValue:               defaultXSourceValue,
+		XForwardedForEnabled:       false,
+		RoutingEnabled:             false,
+		RoutingHeaderName:          defaultRoutingHeaderName,
+		RoutingCookieEnabled:       false,
+		RoutingCookieName:          defaultRoutingCookieName,
+		RoutingStickyCookieEnabled: false,
+		RoutingStickyCookiePath:    "/",
+		MaxHops:                    0,
+		HopsHeaderName:             defaultHopsHeaderName,
+		ViaEnabled:                 false,
+		ViaPseudonym:               defaultViaPseudonym,
+		W3CPropagationEnabled:      false,
+		B3PropagationEnabled:       false,
+		DatadogPropagationEnabled:  false,
+		TraceContextInjection:      TraceContextInjectionOverride,
+		StripHopByHopHeaders:       true,
+		StrictFraming:              true,
+		StrictResponseLength:       true,
+		SpanLogsEnabled:            false,
+		WebSocketFramesEnabled:     false,
+		WebSocketSampleMaxBytes:    defaultWSSampleMaxBytes,
+		ProxyProtocol:              false,
+		ObserveOnly:                false,
+		ConnectTimeout:             0,
+		ReadTimeout:                0,
+		WriteTimeout:               0,
+		IdleTimeout:                0,
+		MaxRetries:                 0,
+		MaxInflightRequests:        0,
+		RetryMaxBodyBytes:          defaultRetryMaxBodyBytes,
+		MaxBodyInspectBytes:        defaultMaxBodyInspectBytes,
+		CaptureMaxBodyBytes:        defaultCaptureMaxBodyBytes,
+		MirrorMaxBodyBytes:         defaultMirrorMaxBodyBytes,
+		MirrorMaxInflight:          defaultMirrorMaxInflight,
+		CoalesceMaxBodyBytes:       defaultCoalesceBodyBytes,
+		BufioSize:                  defaultBufioSize,
+		MaxRequestLineBytes:        defaultMaxRequestLineBytes,
+		MaxHeaderBytes:             defaultMaxHeaderBytes,
+		CopyBufferSize:             defaultCopyBufferSize,
+		BreakerMaxFailures:         0,
+		BreakerFailureRatio:        0,
+		BreakerMinRequests:         defaultBreakerMinRequests,
+		BreakerWindow:              defaultBreakerWindow,
+		BreakerOpenTimeout:         defaultBreakerOpenTimeout,
+		OutlierFailures:            0,
+		OutlierEjectionTime:        defaultOutlierEjectionTime,
+		PoolMaxIdlePerHost:         0,
+		PoolIdleTimeout:            defaultPoolIdleTimeout,
+		PoolMaxConnsPerHost:        0,
+		PoolWaitTimeout:            defaultPoolWaitTimeout,
+		DNSCacheNegativeTTL:        defaultDNSCacheNegativeTTL,
+		UpstreamResetBadGateway:    false,
+	}
+}
+
+// httpConfig keeps current HTTPConfig, it's replaced as a whole on reload
+var httpConfig atomic.Value
+
+func init() {
+	httpConfig.Store(newHTTPConfig())
+}
+
+// GetHTTPConfig returns current HTTP config snapshot, snapshot isn't changed by reload
 func GetHTTPConfig() HTTPConfig {
-	return httpConfig
+	return httpConfig.Load().(HTTPConfig)
+}
+
+// SetHTTPConfig replaces current HTTP config, config is expected to be got from GetHTTPConfig and modified
+func SetHTTPConfig(cfg HTTPConfig) {
+	httpConfig.Store(cfg)
 }
 
 const (
 	envNetraPort                          = "NETRA_PORT"
-	envNetraPprofPort                     = "NETRA_PPROF_PORT"
 	envNetraPrometheusPort                = "NETRA_PROMETHEUS_PORT"
+	envNetraAdminPort                     = "NETRA_ADMIN_PORT"
+	envNetraAdminConfigToken              = "NETRA_ADMIN_CONFIG_TOKEN"
+	envNetraAdminPprofEnabled             = "NETRA_ADMIN_PPROF_ENABLED"
 	envNetraTracingContextExpiration      = "NETRA_TRACING_CONTEXT_EXPIRATION_MILLISECONDS"
 	envNetraTracingContextCleanupInterval = "NETRA_TRACING_CONTEXT_CLEANUP_INTERVAL"
 	envNetraRoutingContextExpiration      = "NETRA_ROUTING_CONTEXT_EXPIRATION_MILLISECONDS"
 	envNetraRoutingContextCleanupInterval = "NETRA_ROUTING_CONTEXT_CLEANUP_INTERVAL"
 	envNetraHTTPPorts                     = "NETRA_HTTP_PORTS"
+	envNetraGRPCPorts                     = "NETRA_GRPC_PORTS"
+	envNetraPassthroughPorts              = "NETRA_PASSTHROUGH_PORTS"
+	envNetraMySQLPorts                    = "NETRA_MYSQL_PORTS"
+	envNetraMySQLStatementMaxLength       = "NETRA_MYSQL_STATEMENT_MAX_LENGTH"
+	envNetraMySQLSanitizeStatements       = "NETRA_MYSQL_SANITIZE_STATEMENTS"
+	envNetraRedisPorts                    = "NETRA_REDIS_PORTS"
+	envNetraRedisKeysEnabled              = "NETRA_REDIS_KEYS_ENABLED"
+	envNetraKafkaPorts                    = "NETRA_KAFKA_PORTS"
+	envNetraAMQPPorts                     = "NETRA_AMQP_PORTS"
+	envNetraMongoDBPorts                  = "NETRA_MONGODB_PORTS"
+	envNetraThriftPorts                   = "NETRA_THRIFT_PORTS"
+	envNetraTLSPorts                      = "NETRA_TLS_PORTS"
+	envNetraTLSSNIRoutes                  = "NETRA_TLS_SNI_ROUTES"
+	envNetraAccessLogEnabled              = "NETRA_ACCESS_LOG_ENABLED"
+	envNetraAccessLogFile                 = "NETRA_ACCESS_LOG_FILE"
+	envNetraCaptureFile                   = "NETRA_CAPTURE_FILE"
+	envNetraCaptureBufferSize             = "NETRA_CAPTURE_BUFFER_SIZE"
+	envNetraStatsMaxOperations            = "NETRA_STATS_MAX_OPERATIONS"
+	envNetraStatsWindow                   = "NETRA_STATS_WINDOW_MILLISECONDS"
+	envNetraTracerReporterQueueSize       = "NETRA_TRACER_REPORTER_QUEUE_SIZE"
+	envNetraTracerReporterFlushInterval   = "NETRA_TRACER_REPORTER_FLUSH_INTERVAL_MILLISECONDS"
+	envNetraDrainTimeout                  = "NETRA_DRAIN_TIMEOUT_MILLISECONDS"
+	envNetraMaxTagValueLength             = "NETRA_MAX_TAG_VALUE_LENGTH"
+	envNetraProtocolSniffTimeout          = "NETRA_PROTOCOL_SNIFF_TIMEOUT_MILLISECONDS"
+	envNetraMaxConnections                = "NETRA_MAX_CONNECTIONS"
+	envNetraMaxConnectionsQueueTimeout    = "NETRA_MAX_CONNECTIONS_QUEUE_TIMEOUT_MILLISECONDS"
 	envHttpHeaderTagMap                   = "HTTP_HEADER_TAG_MAP"
 	envHttpCookieTagMap                   = "HTTP_COOKIE_TAG_MAP"
+	envHttpQueryTagMap                    = "HTTP_QUERY_TAG_MAP"
+	envHTTPConnectionTagMap               = "NETRA_HTTP_CONNECTION_TAG_MAP"
+	envHttpResponseBodyTagMap             = "HTTP_RESPONSE_BODY_TAG_MAP"
+	envHTTPResponseHeaders                = "NETRA_HTTP_RESPONSE_HEADERS"
+	envHTTPSensitiveHeaders               = "NETRA_HTTP_SENSITIVE_HEADERS"
+	envHTTPSamplingRates                  = "NETRA_HTTP_SAMPLING_RATES"
+	envHTTPForceSampleHeaderName          = "NETRA_HTTP_FORCE_SAMPLE_HEADER_NAME"
+	envHTTPCapturePaths                   = "NETRA_HTTP_CAPTURE_PATHS"
+	envHTTPUntracedPaths                  = "NETRA_HTTP_UNTRACED_PATHS"
+	envHTTPCoalescePaths                  = "NETRA_HTTP_COALESCE_PATHS"
+	envHTTPCoalesceMaxBodyBytes           = "NETRA_HTTP_COALESCE_MAX_BODY_BYTES"
+	envHTTPUntracedHosts                  = "NETRA_HTTP_UNTRACED_HOSTS"
+	envHTTPAllowedHosts                   = "NETRA_HTTP_ALLOWED_HOSTS"
+	envHTTPBaggageHeaderMap               = "NETRA_HTTP_BAGGAGE_HEADER_MAP"
+	envHTTPBaggageTags                    = "NETRA_HTTP_BAGGAGE_TAGS"
+	envHTTPRateLimits                     = "NETRA_HTTP_RATE_LIMITS"
+	envHTTPFaultAborts                    = "NETRA_HTTP_FAULT_ABORTS"
+	envHTTPFaultDelays                    = "NETRA_HTTP_FAULT_DELAYS"
+	envHTTPHedgeRules                     = "NETRA_HTTP_HEDGE_RULES"
+	envHTTPRequestHeaderRules             = "NETRA_HTTP_REQUEST_HEADER_RULES"
+	envHTTPResponseHeaderRules            = "NETRA_HTTP_RESPONSE_HEADER_RULES"
+	envHTTPPathRewrites                   = "NETRA_HTTP_PATH_REWRITES"
+	envHTTPErrorStatuses                  = "NETRA_HTTP_ERROR_STATUSES"
+	envHTTPErrorStatusesByPath            = "NETRA_HTTP_ERROR_STATUSES_BY_PATH"
 	envHttpRequestIdHeaderName            = "NETRA_HTTP_REQUEST_ID_HEADER_NAME"
+	envHTTPRequestIdFormat                = "NETRA_HTTP_REQUEST_ID_FORMAT"
 	envHttpXSourceHeaderName              = "NETRA_HTTP_X_SOURCE_HEADER_NAME"
 	envHTTPXSourceValue                   = "NETRA_HTTP_X_SOURCE_VALUE"
+	envHTTPXForwardedForEnabled           = "NETRA_HTTP_X_FORWARDED_FOR_ENABLED"
+	envHTTPXForwardedTrustedCIDRs         = "NETRA_HTTP_X_FORWARDED_TRUSTED_CIDRS"
 	envHTTPRoutingEnabled                 = "NETRA_HTTP_ROUTING_ENABLED"
 	envHTTPRoutingHeader                  = "NETRA_HTTP_ROUTING_HEADER_NAME"
 	envHTTPRoutingCookieEnabled           = "NETRA_HTTP_ROUTING_COOKIE_ENABLED"
 	envHTTPRoutingCookieName              = "NETRA_HTTP_ROUTING_COOKIE_NAME"
+	envHTTPMaxHops                        = "NETRA_HTTP_MAX_HOPS"
+	envHTTPHopsHeaderName                 = "NETRA_HTTP_HOPS_HEADER_NAME"
+	envHTTPViaEnabled                     = "NETRA_HTTP_VIA_ENABLED"
+	envHTTPViaPseudonym                   = "NETRA_HTTP_VIA_PSEUDONYM"
+	envHTTPRoutingStickyCookieEnabled     = "NETRA_HTTP_ROUTING_STICKY_COOKIE_ENABLED"
+	envHTTPRoutingStickyCookieTTL         = "NETRA_HTTP_ROUTING_STICKY_COOKIE_TTL_MILLISECONDS"
+	envHTTPRoutingStickyCookiePath        = "NETRA_HTTP_ROUTING_STICKY_COOKIE_PATH"
+	envHTTPW3CPropagationEnabled          = "NETRA_HTTP_W3C_PROPAGATION_ENABLED"
+	envHTTPB3PropagationEnabled           = "NETRA_HTTP_B3_PROPAGATION_ENABLED"
+	envHTTPDatadogPropagationEnabled      = "NETRA_HTTP_DATADOG_PROPAGATION_ENABLED"
+	envHTTPTraceContextInjection          = "NETRA_HTTP_TRACE_CONTEXT_INJECTION"
+	envHTTPStripHopByHopHeaders           = "NETRA_HTTP_STRIP_HOP_BY_HOP_HEADERS"
+	envHTTPStrictFraming                  = "NETRA_HTTP_STRICT_FRAMING"
+	envHTTPStrictResponseLength           = "NETRA_HTTP_STRICT_RESPONSE_LENGTH"
+	envHTTPSpanLogsEnabled                = "NETRA_HTTP_SPAN_LOGS_ENABLED"
+	envHTTPWebSocketFramesEnabled         = "NETRA_HTTP_WEBSOCKET_FRAMES_ENABLED"
+	envHTTPWebSocketSamplePaths           = "NETRA_HTTP_WEBSOCKET_SAMPLE_PATHS"
+	envHTTPWebSocketSampleMaxBytes        = "NETRA_HTTP_WEBSOCKET_SAMPLE_MAX_BYTES"
+	envHTTPProxyProtocol                  = "NETRA_HTTP_PROXY_PROTOCOL"
+	envHTTPObserveOnly                    = "NETRA_HTTP_OBSERVE_ONLY"
+	envHTTPPeerServicePattern             = "NETRA_HTTP_PEER_SERVICE_PATTERN"
+	envHTTPOperationNormalizePath         = "NETRA_HTTP_OPERATION_NORMALIZE_PATH"
+	envHTTPOperationMethodPrefix          = "NETRA_HTTP_OPERATION_METHOD_PREFIX"
+	envHTTPOutboundOperationFormat        = "NETRA_HTTP_OUTBOUND_OPERATION_FORMAT"
+	envHTTPConnectTimeout                 = "NETRA_HTTP_CONNECT_TIMEOUT_MILLISECONDS"
+	envHTTPReadTimeout                    = "NETRA_HTTP_READ_TIMEOUT_MILLISECONDS"
+	envHTTPWriteTimeout                   = "NETRA_HTTP_WRITE_TIMEOUT_MILLISECONDS"
+	envHTTPIdleTimeout                    = "NETRA_HTTP_IDLE_TIMEOUT_MILLISECONDS"
+	envHTTPRouteTimeouts                  = "NETRA_HTTP_ROUTE_TIMEOUTS"
+	envHTTPMaxRetries                     = "NETRA_HTTP_MAX_RETRIES"
+	envHTTPMaxInflightRequests            = "NETRA_HTTP_MAX_INFLIGHT_REQUESTS"
+	envHTTPRetryMaxBodyBytes              = "NETRA_HTTP_RETRY_MAX_BODY_BYTES"
+	envHTTPMaxBodyInspectBytes            = "NETRA_HTTP_MAX_BODY_INSPECT_BYTES"
+	envHTTPCaptureMaxBodyBytes            = "NETRA_HTTP_CAPTURE_MAX_BODY_BYTES"
+	envHTTPMirrorMaxBodyBytes             = "NETRA_HTTP_MIRROR_MAX_BODY_BYTES"
+	envHTTPMirrorMaxInflight              = "NETRA_HTTP_MIRROR_MAX_INFLIGHT"
+	envHTTPBufioSize                      = "NETRA_HTTP_BUFIO_SIZE"
+	envHTTPMaxRequestLineBytes            = "NETRA_HTTP_MAX_REQUEST_LINE_BYTES"
+	envHTTPMaxHeaderBytes                 = "NETRA_HTTP_MAX_HEADER_BYTES"
+	envHTTPCopyBufferSize                 = "NETRA_HTTP_COPY_BUFFER_SIZE"
+	envHTTPBreakerMaxFailures             = "NETRA_HTTP_BREAKER_MAX_FAILURES"
+	envHTTPBreakerFailureRatio            = "NETRA_HTTP_BREAKER_FAILURE_RATIO"
+	envHTTPBreakerMinRequests             = "NETRA_HTTP_BREAKER_MIN_REQUESTS"
+	envHTTPBreakerWindow                  = "NETRA_HTTP_BREAKER_WINDOW_MILLISECONDS"
+	envHTTPBreakerOpenTimeout             = "NETRA_HTTP_BREAKER_OPEN_TIMEOUT_MILLISECONDS"
+	envHTTPOutlierFailures                = "NETRA_HTTP_OUTLIER_CONSECUTIVE_FAILURES"
+	envHTTPOutlierEjectionTime            = "NETRA_HTTP_OUTLIER_EJECTION_TIME_MILLISECONDS"
+	envHTTPPoolMaxIdlePerHost             = "NETRA_HTTP_POOL_MAX_IDLE_PER_HOST"
+	envHTTPPoolIdleTimeout                = "NETRA_HTTP_POOL_IDLE_TIMEOUT_MILLISECONDS"
+	envHTTPPoolMaxConnsPerHost            = "NETRA_HTTP_POOL_MAX_CONNS_PER_HOST"
+	envHTTPPoolWaitTimeout                = "NETRA_HTTP_POOL_WAIT_TIMEOUT_MILLISECONDS"
+	envHTTPDNSCacheTTL                    = "NETRA_HTTP_DNS_CACHE_TTL_MILLISECONDS"
+	envHTTPDNSCacheNegativeTTL            = "NETRA_HTTP_DNS_CACHE_NEGATIVE_TTL_MILLISECONDS"
+	envHTTPUpstreamResetBadGateway        = "NETRA_HTTP_UPSTREAM_RESET_BAD_GATEWAY_ENABLED"
 )
 
 func GlobalConfigFromENV(logger *log.Logger) error {
-	if v := os.Getenv(envHttpHeaderTagMap); v != "" {
-		pairs := strings.Split(v, ",")
-		for _, pair := range pairs {
-			kv := strings.SplitN(pair, ":", 2)
-			if len(kv) < 2 {
-				continue
-			}
-			httpConfig.HeadersMap[kv[0]] = kv[1]
-			logger.Infof("loaded header to tag mapping: %s => %s", kv[0], kv[1])
-		}
+	getenv, err := configLookup()
+	if err != nil {
+		return err
 	}
-	if v := os.Getenv(envHttpCookieTagMap); v != "" {
-		pairs := strings.Split(v, ",")
-		for _, pair := range pairs {
-			kv := strings.SplitN(pair, ":", 2)
-			if len(kv) < 2 {
-				continue
-			}
-			httpConfig.CookiesMap[kv[0]] = kv[1]
-			logger.Infof("loaded cookie to tag mapping: %s => %s", kv[0], kv[1])
-		}
-	}
-	if v := os.Getenv(envNetraPort); v != "" {
+	if v := getenv(envNetraPort); v != "" {
 		p, err := strconv.ParseUint(v, 10, 16)
 		if err != nil {
 			return err
 		}
 		netraConfig.Port = uint16(p)
 	}
-	if v := os.Getenv(envNetraPprofPort); v != "" {
+	if v := getenv(envNetraPrometheusPort); v != "" {
 		p, err := strconv.ParseUint(v, 10, 16)
 		if err != nil {
 			return err
 		}
-		netraConfig.PprofPort = uint16(p)
+		netraConfig.PrometheusPort = uint16(p)
 	}
-	if v := os.Getenv(envNetraPrometheusPort); v != "" {
+	if v := getenv(envNetraAdminPort); v != "" {
 		p, err := strconv.ParseUint(v, 10, 16)
 		if err != nil {
 			return err
 		}
-		netraConfig.PrometheusPort = uint16(p)
+		netraConfig.AdminPort = uint16(p)
+	}
+	if v := getenv(envNetraAdminConfigToken); v != "" {
+		netraConfig.AdminConfigToken = v
 	}
-	if v := os.Getenv(envNetraTracingContextExpiration); v != "" {
+	if v := getenv(envNetraAdminPprofEnabled); v != "" {
+		if v == "true" {
+			netraConfig.AdminPprofEnabled = true
+		}
+	}
+	if v := getenv(envNetraTracingContextExpiration); v != "" {
 		exp, err := strconv.Atoi(v)
 		if err != nil {
 			return err
 		}
+		// context mapping without expiration or cleanup grows with every request id
+		if exp <= 0 {
+			return fmt.Errorf("%s should be positive: '%s'", envNetraTracingContextExpiration, v)
+		}
 		netraConfig.TracingContextExpiration = time.Duration(exp) * time.Millisecond
 	}
-	if v := os.Getenv(envNetraTracingContextCleanupInterval); v != "" {
+	if v := getenv(envNetraTracingContextCleanupInterval); v != "" {
 		c, err := strconv.Atoi(v)
 		if err != nil {
 			return err
 		}
+		if c <= 0 {
+			return fmt.Errorf("%s should be positive: '%s'", envNetraTracingContextCleanupInterval, v)
+		}
 		netraConfig.TracingContextCleanupInterval = time.Duration(c) * time.Millisecond
 	}
-	if v := os.Getenv(envNetraRoutingContextExpiration); v != "" {
+	if v := getenv(envNetraRoutingContextExpiration); v != "" {
 		exp, err := strconv.Atoi(v)
 		if err != nil {
 			return err
 		}
+		if exp <= 0 {
+			return fmt.Errorf("%s should be positive: '%s'", envNetraRoutingContextExpiration, v)
+		}
 		netraConfig.RoutingContextExpiration = time.Duration(exp) * time.Millisecond
 	}
-	if v := os.Getenv(envNetraRoutingContextCleanupInterval); v != "" {
+	if v := getenv(envNetraRoutingContextCleanupInterval); v != "" {
 		c, err := strconv.Atoi(v)
 		if err != nil {
 			return err
 		}
+		if c <= 0 {
+			return fmt.Errorf("%s should be positive: '%s'", envNetraRoutingContextCleanupInterval, v)
+		}
 		netraConfig.RoutingContextCleanupInterval = time.Duration(c) * time.Millisecond
 	}
-	if v := os.Getenv(envNetraHTTPPorts); v != "" {
-		ports := strings.Split(v, ",")
-		for _, port := range ports {
-			// check whether port is valid
-			_, err := strconv.ParseUint(port, 10, 16)
+	if err := parsePorts(getenv, envNetraHTTPPorts, netraConfig.HTTPProtoPorts); err != nil {
+		return err
+	}
+	if err := parsePorts(getenv, envNetraGRPCPorts, netraConfig.GRPCProtoPorts); err != nil {
+		return err
+	}
+	if err := parsePorts(getenv, envNetraPassthroughPorts, netraConfig.PassthroughProtoPorts); err != nil {
+		return err
+	}
+	if err := parsePorts(getenv, envNetraMySQLPorts, netraConfig.MySQLProtoPorts); err != nil {
+		return err
+	}
+	if v := getenv(envNetraMySQLStatementMaxLength); v != "" {
+		maxLength, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if maxLength <= 0 {
+			return fmt.Errorf("%s should be positive: '%s'", envNetraMySQLStatementMaxLength, v)
+		}
+		netraConfig.MySQLStatementMaxLength = maxLength
+	}
+	if v := getenv(envNetraMySQLSanitizeStatements); v != "" {
+		netraConfig.MySQLSanitizeStatements = v != "false"
+	}
+	if err := parsePorts(getenv, envNetraRedisPorts, netraConfig.RedisProtoPorts); err != nil {
+		return err
+	}
+	if v := getenv(envNetraRedisKeysEnabled); v != "" {
+		if v == "true" {
+			netraConfig.RedisKeysEnabled = true
+		}
+	}
+	if err := parsePorts(getenv, envNetraKafkaPorts, netraConfig.KafkaProtoPorts); err != nil {
+		return err
+	}
+	if err := parsePorts(getenv, envNetraAMQPPorts, netraConfig.AMQPProtoPorts); err != nil {
+		return err
+	}
+	if err := parsePorts(getenv, envNetraMongoDBPorts, netraConfig.MongoDBProtoPorts); err != nil {
+		return err
+	}
+	if err := parsePorts(getenv, envNetraThriftPorts, netraConfig.ThriftProtoPorts); err != nil {
+		return err
+	}
+	if err := parsePorts(getenv, envNetraTLSPorts, netraConfig.TLSProtoPorts); err != nil {
+		return err
+	}
+	if v := getenv(envNetraTLSSNIRoutes); v != "" {
+		netraConfig.TLSSNIRoutes = v
+	}
+	if v := getenv(envNetraAccessLogEnabled); v != "" {
+		if v == "true" {
+			netraConfig.AccessLogEnabled = true
+		}
+	}
+	if v := getenv(envNetraAccessLogFile); v != "" {
+		netraConfig.AccessLogFile = v
+	}
+	if v := getenv(envNetraCaptureFile); v != "" {
+		netraConfig.CaptureFile = v
+	}
+	if v := getenv(envNetraCaptureBufferSize); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if size < 0 {
+			return fmt.Errorf("%s should not be negative: '%s'", envNetraCaptureBufferSize, v)
+		}
+		netraConfig.CaptureBufferSize = size
+	}
+	if v := getenv(envNetraStatsMaxOperations); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("%s should not be negative: '%s'", envNetraStatsMaxOperations, v)
+		}
+		netraConfig.StatsMaxOperations = n
+	}
+	if v := getenv(envNetraStatsWindow); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if t <= 0 {
+			return fmt.Errorf("%s should be positive: '%s'", envNetraStatsWindow, v)
+		}
+		netraConfig.StatsWindow = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envNetraTracerReporterQueueSize); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if size <= 0 {
+			return fmt.Errorf("%s should be positive: '%s'", envNetraTracerReporterQueueSize, v)
+		}
+		netraConfig.TracerReporterQueueSize = size
+	}
+	if v := getenv(envNetraTracerReporterFlushInterval); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if t <= 0 {
+			return fmt.Errorf("%s should be positive: '%s'", envNetraTracerReporterFlushInterval, v)
+		}
+		netraConfig.TracerReporterFlushInterval = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envNetraDrainTimeout); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		netraConfig.DrainTimeout = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envNetraMaxTagValueLength); v != "" {
+		maxLength, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if maxLength < 0 {
+			return fmt.Errorf("%s should not be negative: '%s'", envNetraMaxTagValueLength, v)
+		}
+		netraConfig.MaxTagValueLength = maxLength
+	}
+	if v := getenv(envNetraProtocolSniffTimeout); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		netraConfig.ProtocolSniffTimeout = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envNetraMaxConnections); v != "" {
+		maxConnections, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if maxConnections < 0 {
+			return fmt.Errorf("%s should not be negative: '%s'", envNetraMaxConnections, v)
+		}
+		netraConfig.MaxConnections = maxConnections
+	}
+	if v := getenv(envNetraMaxConnectionsQueueTimeout); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		netraConfig.MaxConnectionsQueueTimeout = time.Duration(t) * time.Millisecond
+	}
+	if err := netraConfig.Validate(); err != nil {
+		return err
+	}
+	cfg, err := httpConfigFromENV(getenv, logger)
+	if err != nil {
+		return err
+	}
+	httpConfig.Store(cfg)
+
+	return nil
+}
+
+// parsePorts adds comma separated ports of env variable name to dst
+func parsePorts(getenv func(string) string, name string, dst map[string]struct{}) error {
+	v := getenv(name)
+	if v == "" {
+		return nil
+	}
+	for _, port := range strings.Split(v, ",") {
+		// check whether port is valid
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("%s has invalid port '%s': %s", name, port, err.Error())
+		}
+		dst[port] = struct{}{}
+	}
+	return nil
+}
+
+// httpConfigFromENV builds HTTP config from default values and getenv ones
+func httpConfigFromENV(getenv func(string) string, logger *log.Logger) (HTTPConfig, error) {
+	cfg := newHTTPConfig()
+	if v := getenv(envHttpHeaderTagMap); v != "" {
+		pairs := strings.Split(v, ",")
+		for _, pair := range pairs {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) < 2 {
+				continue
+			}
+			cfg.HeadersMap[kv[0]] = kv[1]
+			logger.Infof("loaded header to tag mapping: %s => %s", kv[0], kv[1])
+		}
+	}
+	if v := getenv(envHttpCookieTagMap); v != "" {
+		pairs := strings.Split(v, ",")
+		for _, pair := range pairs {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) < 2 {
+				continue
+			}
+			cfg.CookiesMap[kv[0]] = kv[1]
+			logger.Infof("loaded cookie to tag mapping: %s => %s", kv[0], kv[1])
+		}
+	}
+	if v := getenv(envHttpQueryTagMap); v != "" {
+		pairs := strings.Split(v, ",")
+		for _, pair := range pairs {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) < 2 {
+				continue
+			}
+			cfg.QueryParamsMap[kv[0]] = kv[1]
+			logger.Infof("loaded query param to tag mapping: %s => %s", kv[0], kv[1])
+		}
+	}
+	if v := getenv(envHTTPConnectionTagMap); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) < 2 {
+				return cfg, fmt.Errorf("malformed connection header mapping: '%s'", pair)
+			}
+			if _, ok := connectionTags[kv[1]]; !ok {
+				return cfg, fmt.Errorf("unknown connection tag '%s', it should be one of %s", kv[1], connectionTagNames())
+			}
+			cfg.ConnectionHeadersMap[kv[0]] = kv[1]
+			logger.Infof("loaded connection header to tag mapping: %s => %s", kv[0], kv[1])
+		}
+	}
+	if v := getenv(envHTTPBaggageHeaderMap); v != "" {
+		pairs := strings.Split(v, ",")
+		for _, pair := range pairs {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) < 2 {
+				continue
+			}
+			cfg.BaggageHeadersMap[kv[0]] = kv[1]
+			logger.Infof("loaded header to baggage mapping: %s => %s", kv[0], kv[1])
+		}
+	}
+	if v := getenv(envHTTPBaggageTags); v != "" {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				cfg.BaggageTags = append(cfg.BaggageTags, key)
+			}
+		}
+	}
+	if v := getenv(envHttpResponseBodyTagMap); v != "" {
+		pairs := strings.Split(v, ",")
+		for _, pair := range pairs {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) < 2 {
+				continue
+			}
+			cfg.ResponseBodyFieldsMap[kv[0]] = kv[1]
+			logger.Infof("loaded response body field to tag mapping: %s => %s", kv[0], kv[1])
+		}
+	}
+	if v := getenv(envHTTPResponseHeaders); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) < 2 || strings.TrimSpace(kv[0]) == "" {
+				return cfg, fmt.Errorf("malformed response header: '%s'", pair)
+			}
+			name := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(kv[0]))
+			if _, ok := framingHeaders[name]; ok {
+				return cfg, fmt.Errorf("response framing header can't be set: '%s'", pair)
+			}
+			cfg.ResponseHeaders[name] = strings.TrimSpace(kv[1])
+			logger.Infof("loaded response header: %s => %s", name, cfg.ResponseHeaders[name])
+		}
+	}
+	if v := getenv(envHTTPSensitiveHeaders); v != "" {
+		// names are matched case-insensitively
+		cfg.SensitiveHeaders = make(map[string]struct{})
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				cfg.SensitiveHeaders[name] = struct{}{}
+			}
+		}
+	}
+	if v := getenv(envHTTPUntracedPaths); v != "" {
+		for _, prefix := range strings.Split(v, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				cfg.UntracedPathPrefixes = append(cfg.UntracedPathPrefixes, prefix)
+			}
+		}
+	}
+	if v := getenv(envHTTPCoalescePaths); v != "" {
+		for _, prefix := range strings.Split(v, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				cfg.CoalescePathPrefixes = append(cfg.CoalescePathPrefixes, prefix)
+			}
+		}
+	}
+	if v := getenv(envHTTPCoalesceMaxBodyBytes); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		if b <= 0 {
+			return cfg, fmt.Errorf("coalesce max body bytes should be positive, got %d", b)
+		}
+		cfg.CoalesceMaxBodyBytes = b
+	}
+	if v := getenv(envHTTPUntracedHosts); v != "" {
+		for _, host := range strings.Split(v, ",") {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				cfg.UntracedHosts[host] = struct{}{}
+			}
+		}
+	}
+	if v := getenv(envHTTPAllowedHosts); v != "" {
+		for _, host := range strings.Split(v, ",") {
+			// hosts of requests are compared without trailing dot
+			if host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), "."); host != "" {
+				cfg.AllowedHosts[host] = struct{}{}
+			}
+		}
+	}
+	if v := getenv(envHTTPSamplingRates); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			// path may contain colons, rate is after the last one
+			i := strings.LastIndex(pair, ":")
+			if i < 0 {
+				return cfg, fmt.Errorf("malformed sampling rate: '%s'", pair)
+			}
+			rate, err := strconv.ParseFloat(pair[i+1:], 64)
 			if err != nil {
-				return err
+				return cfg, err
+			}
+			if rate < 0 || rate > 1 {
+				return cfg, fmt.Errorf("sampling rate should be in [0, 1]: '%s'", pair)
 			}
-			netraConfig.HTTPProtoPorts[port] = struct{}{}
+			cfg.SamplingRates[pair[:i]] = rate
+			logger.Infof("loaded sampling rate: %s => %g", pair[:i], rate)
 		}
 	}
-	if v := os.Getenv(envHttpRequestIdHeaderName); v != "" {
-		httpConfig.RequestIdHeaderName = v
+	if v := getenv(envHTTPForceSampleHeaderName); v != "" {
+		cfg.ForceSampleHeaderName = v
 	}
-	if v := os.Getenv(envHttpXSourceHeaderName); v != "" {
-		httpConfig.XSourceHeaderName = v
+	if v := getenv(envHTTPCapturePaths); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			// path may contain colons, rate is after the last one
+			i := strings.LastIndex(pair, ":")
+			if i < 0 {
+				return cfg, fmt.Errorf("malformed capture path: '%s'", pair)
+			}
+			n, err := strconv.Atoi(pair[i+1:])
+			if err != nil {
+				return cfg, err
+			}
+			if n <= 0 {
+				return cfg, fmt.Errorf("capture rate should be positive: '%s'", pair)
+			}
+			cfg.CaptureRates[pair[:i]] = n
+			logger.Infof("loaded capture path: %s => 1 in %d", pair[:i], n)
+		}
 	}
-	if v := os.Getenv(envHTTPXSourceValue); v != "" {
-		httpConfig.XSourceValue = v
+	if v := getenv(envHTTPRateLimits); v != "" {
+		for _, limit := range strings.Split(v, ",") {
+			// path may contain colons, rate and burst are after the last ones
+			parts := strings.Split(limit, ":")
+			if len(parts) < 3 {
+				return cfg, fmt.Errorf("malformed rate limit: '%s'", limit)
+			}
+			prefix := strings.Join(parts[:len(parts)-2], ":")
+			rate, err := strconv.ParseFloat(parts[len(parts)-2], 64)
+			if err != nil {
+				return cfg, err
+			}
+			burst, err := strconv.Atoi(parts[len(parts)-1])
+			if err != nil {
+				return cfg, err
+			}
+			if rate <= 0 || burst < 1 {
+				return cfg, fmt.Errorf("rate limit should have positive rate and burst: '%s'", limit)
+			}
+			cfg.RateLimits[prefix] = RateLimit{Rate: rate, Burst: burst}
+			logger.Infof("loaded rate limit: %s => %g/s, burst %d", prefix, rate, burst)
+		}
+	}
+	if v := getenv(envHTTPFaultAborts); v != "" {
+		for _, abort := range strings.Split(v, ",") {
+			prefix, status, percent, err := parseFault(abort)
+			if err != nil {
+				return cfg, err
+			}
+			if status < 100 || status > 599 {
+				return cfg, fmt.Errorf("fault abort status should be valid HTTP status: '%s'", abort)
+			}
+			rule := cfg.FaultRules[prefix]
+			rule.AbortStatus, rule.AbortPercent = status, percent
+			cfg.FaultRules[prefix] = rule
+			logger.Infof("loaded fault abort: %s => %d for %g%%", prefix, status, percent)
+		}
+	}
+	if v := getenv(envHTTPFaultDelays); v != "" {
+		for _, delay := range strings.Split(v, ",") {
+			prefix, ms, percent, err := parseFault(delay)
+			if err != nil {
+				return cfg, err
+			}
+			rule := cfg.FaultRules[prefix]
+			rule.Delay, rule.DelayPercent = time.Duration(ms)*time.Millisecond, percent
+			cfg.FaultRules[prefix] = rule
+			logger.Infof("loaded fault delay: %s => %s for %g%%", prefix, rule.Delay, percent)
+		}
 	}
-	if v := os.Getenv(envHTTPRoutingEnabled); v != "" {
+	if v := getenv(envHTTPHedgeRules); v != "" {
+		for _, hedge := range strings.Split(v, ",") {
+			prefix, rule, err := parseHedgeRule(hedge)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.HedgeRules[prefix] = rule
+			logger.Infof("loaded hedge rule: %s => %s", prefix, hedge[len(prefix)+1:])
+		}
+	}
+	if v := getenv(envHTTPRequestHeaderRules); v != "" {
+		rules, err := parseHeaderRules(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.RequestHeaderRules = rules
+		logger.Infof("loaded request header rules: %s", v)
+	}
+	if v := getenv(envHTTPResponseHeaderRules); v != "" {
+		rules, err := parseHeaderRules(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ResponseHeaderRules = rules
+		logger.Infof("loaded response header rules: %s", v)
+	}
+	if v := getenv(envHTTPPathRewrites); v != "" {
+		rules, err := parsePathRewriteRules(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.PathRewriteRules = rules
+		logger.Infof("loaded path rewrites: %s", v)
+	}
+	if v := getenv(envHTTPErrorStatuses); v != "" {
+		ranges, err := parseStatusRanges(v, ",")
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ErrorStatuses = ranges
+	}
+	if v := getenv(envHTTPErrorStatusesByPath); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			// path may contain colons, statuses are after the last one
+			i := strings.LastIndex(pair, ":")
+			if i < 0 {
+				return cfg, fmt.Errorf("malformed error statuses of path: '%s'", pair)
+			}
+			ranges, err := parseStatusRanges(pair[i+1:], ";")
+			if err != nil {
+				return cfg, err
+			}
+			cfg.ErrorStatusesByPath[pair[:i]] = ranges
+			logger.Infof("loaded error statuses: %s => %s", pair[:i], pair[i+1:])
+		}
+	}
+	if v := getenv(envHttpRequestIdHeaderName); v != "" {
+		// names are listed by priority, the first one is primary
+		var names []string
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return cfg, fmt.Errorf("invalid request id header names '%s'", v)
+		}
+		cfg.RequestIdHeaderName = names[0]
+		cfg.RequestIdHeaderNames = names
+	}
+	if v := getenv(envHTTPRequestIdFormat); v != "" {
+		switch v {
+		case RequestIdFormatUUID, RequestIdFormatHex, RequestIdFormatULID:
+			cfg.RequestIdFormat = v
+		default:
+			return cfg, fmt.Errorf("request id format should be one of uuid, hex or ulid: '%s'", v)
+		}
+	}
+	if v := getenv(envHttpXSourceHeaderName); v != "" {
+		cfg.XSourceHeaderName = v
+	}
+	if v := getenv(envHTTPXSourceValue); v != "" {
+		cfg.XSourceValue = expandNodeTemplate(v, os.LookupEnv, os.Hostname, logger)
+	}
+	if v := getenv(envHTTPXForwardedForEnabled); v != "" {
+		if v == "true" {
+			cfg.XForwardedForEnabled = true
+		}
+	}
+	if v := getenv(envHTTPXForwardedTrustedCIDRs); v != "" {
+		for _, cidr := range strings.Split(v, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr == "" {
+				continue
+			}
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.XForwardedTrustedCIDRs = append(cfg.XForwardedTrustedCIDRs, ipNet)
+		}
+	}
+	if v := getenv(envHTTPRoutingEnabled); v != "" {
+		if v == "true" {
+			cfg.RoutingEnabled = true
+		}
+	}
+	if v := getenv(envHTTPRoutingHeader); v != "" {
+		cfg.RoutingHeaderName = v
+	}
+	if v := getenv(envHTTPRoutingCookieEnabled); v != "" {
+		if v == "true" {
+			cfg.RoutingCookieEnabled = true
+		}
+	}
+	if v := getenv(envHTTPRoutingCookieName); v != "" {
+		cfg.RoutingCookieName = v
+	}
+	if v := getenv(envHTTPRoutingStickyCookieEnabled); v != "" {
+		if v == "true" {
+			cfg.RoutingStickyCookieEnabled = true
+		}
+	}
+	if v := getenv(envHTTPRoutingStickyCookieTTL); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.RoutingStickyCookieTTL = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPRoutingStickyCookiePath); v != "" {
+		cfg.RoutingStickyCookiePath = v
+	}
+	if v := getenv(envHTTPMaxHops); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MaxHops = n
+	}
+	if v := getenv(envHTTPHopsHeaderName); v != "" {
+		cfg.HopsHeaderName = v
+	}
+	if v := getenv(envHTTPViaEnabled); v != "" {
+		if v == "true" {
+			cfg.ViaEnabled = true
+		}
+	}
+	if v := getenv(envHTTPViaPseudonym); v != "" {
+		cfg.ViaPseudonym = v
+	}
+	if v := getenv(envHTTPW3CPropagationEnabled); v != "" {
+		if v == "true" {
+			cfg.W3CPropagationEnabled = true
+		}
+	}
+	if v := getenv(envHTTPB3PropagationEnabled); v != "" {
+		if v == "true" {
+			cfg.B3PropagationEnabled = true
+		}
+	}
+	if v := getenv(envHTTPDatadogPropagationEnabled); v != "" {
+		if v == "true" {
+			cfg.DatadogPropagationEnabled = true
+		}
+	}
+	if v := getenv(envHTTPTraceContextInjection); v != "" {
+		switch v {
+		case TraceContextInjectionOverride, TraceContextInjectionPreserve:
+			cfg.TraceContextInjection = v
+		default:
+			return cfg, fmt.Errorf("trace context injection should be one of override or preserve: '%s'", v)
+		}
+	}
+	if v := getenv(envHTTPStripHopByHopHeaders); v != "" {
+		if v == "false" {
+			cfg.StripHopByHopHeaders = false
+		}
+	}
+	if v := getenv(envHTTPStrictFraming); v != "" {
+		if v == "false" {
+			cfg.StrictFraming = false
+		}
+	}
+	if v := getenv(envHTTPStrictResponseLength); v != "" {
+		if v == "false" {
+			cfg.StrictResponseLength = false
+		}
+	}
+	if v := getenv(envHTTPSpanLogsEnabled); v != "" {
+		if v == "true" {
+			cfg.SpanLogsEnabled = true
+		}
+	}
+	if v := getenv(envHTTPWebSocketFramesEnabled); v != "" {
 		if v == "true" {
-			httpConfig.RoutingEnabled = true
+			cfg.WebSocketFramesEnabled = true
+		}
+	}
+	if v := getenv(envHTTPWebSocketSamplePaths); v != "" {
+		for _, prefix := range strings.Split(v, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				cfg.WebSocketSamplePaths = append(cfg.WebSocketSamplePaths, prefix)
+			}
+		}
+	}
+	if v := getenv(envHTTPWebSocketSampleMaxBytes); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
 		}
+		if b <= 0 {
+			return cfg, fmt.Errorf("websocket sample max bytes should be positive, got %d", b)
+		}
+		cfg.WebSocketSampleMaxBytes = b
 	}
-	if v := os.Getenv(envHTTPRoutingHeader); v != "" {
-		httpConfig.RoutingHeaderName = v
+	if v := getenv(envHTTPProxyProtocol); v != "" {
+		if v == "true" {
+			cfg.ProxyProtocol = true
+		}
 	}
-	if v := os.Getenv(envHTTPRoutingCookieEnabled); v != "" {
+	if v := getenv(envHTTPObserveOnly); v != "" {
 		if v == "true" {
-			httpConfig.RoutingCookieEnabled = true
+			cfg.ObserveOnly = true
+		}
+	}
+	if v := getenv(envHTTPPeerServicePattern); v != "" {
+		pattern, err := regexp.Compile(v)
+		if err != nil {
+			return cfg, err
 		}
+		if pattern.NumSubexp() < 1 {
+			return cfg, fmt.Errorf("peer service pattern '%s' should have capturing group", v)
+		}
+		cfg.PeerServicePattern = pattern
 	}
-	if v := os.Getenv(envHTTPRoutingCookieName); v != "" {
-		httpConfig.RoutingCookieName = v
+	if v := getenv(envHTTPOperationNormalizePath); v != "" {
+		if v == "true" {
+			cfg.OperationNormalizePath = true
+		}
+	}
+	if v := getenv(envHTTPOperationMethodPrefix); v != "" {
+		if v == "true" {
+			cfg.OperationMethodPrefix = true
+		}
+	}
+	if v := getenv(envHTTPOutboundOperationFormat); v != "" {
+		switch v {
+		case OperationFormatHostPath, OperationFormatPath, OperationFormatPeerService:
+			cfg.OutboundOperationFormat = v
+		default:
+			return cfg, fmt.Errorf("outbound operation format should be one of host_path, path or peer_service: '%s'", v)
+		}
+	}
+	if v := getenv(envHTTPConnectTimeout); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ConnectTimeout = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPReadTimeout); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ReadTimeout = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPWriteTimeout); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.WriteTimeout = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPIdleTimeout); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.IdleTimeout = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPRouteTimeouts); v != "" {
+		for _, route := range strings.Split(v, ",") {
+			prefix, timeouts, err := parseRouteTimeouts(route)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.RouteTimeouts[prefix] = timeouts
+			logger.Infof("loaded route timeouts: %s => %s", prefix, route[len(prefix)+1:])
+		}
+	}
+	if v := getenv(envHTTPMaxRetries); v != "" {
+		r, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MaxRetries = r
+	}
+	if v := getenv(envHTTPMaxInflightRequests); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MaxInflightRequests = n
+	}
+	if v := getenv(envHTTPRetryMaxBodyBytes); v != "" {
+		b, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.RetryMaxBodyBytes = b
+	}
+	if v := getenv(envHTTPMaxBodyInspectBytes); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MaxBodyInspectBytes = b
+	}
+	if v := getenv(envHTTPCaptureMaxBodyBytes); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		if b <= 0 {
+			return cfg, fmt.Errorf("capture max body bytes should be positive, got %d", b)
+		}
+		cfg.CaptureMaxBodyBytes = b
+	}
+	if v := getenv(envHTTPMirrorMaxBodyBytes); v != "" {
+		b, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MirrorMaxBodyBytes = b
+	}
+	if v := getenv(envHTTPMirrorMaxInflight); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MirrorMaxInflight = n
+	}
+	if v := getenv(envHTTPBufioSize); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		if b <= 0 {
+			return cfg, fmt.Errorf("bufio size should be positive, got %d", b)
+		}
+		cfg.BufioSize = b
+	}
+	if v := getenv(envHTTPMaxRequestLineBytes); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		if b <= 0 {
+			return cfg, fmt.Errorf("max request line bytes should be positive, got %d", b)
+		}
+		cfg.MaxRequestLineBytes = b
+	}
+	if v := getenv(envHTTPMaxHeaderBytes); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		if b <= 0 {
+			return cfg, fmt.Errorf("max header bytes should be positive, got %d", b)
+		}
+		cfg.MaxHeaderBytes = b
+	}
+	if v := getenv(envHTTPCopyBufferSize); v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		if b <= 0 {
+			return cfg, fmt.Errorf("copy buffer size should be positive, got %d", b)
+		}
+		cfg.CopyBufferSize = b
+	}
+	if v := getenv(envHTTPBreakerMaxFailures); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.BreakerMaxFailures = n
+	}
+	if v := getenv(envHTTPBreakerFailureRatio); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return cfg, err
+		}
+		if ratio < 0 || ratio > 1 {
+			return cfg, fmt.Errorf("breaker failure ratio should be in [0, 1], got %g", ratio)
+		}
+		cfg.BreakerFailureRatio = ratio
+	}
+	if v := getenv(envHTTPBreakerMinRequests); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.BreakerMinRequests = n
+	}
+	if v := getenv(envHTTPBreakerWindow); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.BreakerWindow = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPBreakerOpenTimeout); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.BreakerOpenTimeout = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPOutlierFailures); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.OutlierFailures = n
+	}
+	if v := getenv(envHTTPOutlierEjectionTime); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		if t <= 0 {
+			return cfg, fmt.Errorf("%s should be positive: '%s'", envHTTPOutlierEjectionTime, v)
+		}
+		cfg.OutlierEjectionTime = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPPoolMaxIdlePerHost); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.PoolMaxIdlePerHost = n
+	}
+	if v := getenv(envHTTPPoolIdleTimeout); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.PoolIdleTimeout = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPPoolMaxConnsPerHost); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.PoolMaxConnsPerHost = n
+	}
+	if v := getenv(envHTTPPoolWaitTimeout); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.PoolWaitTimeout = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPDNSCacheTTL); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.DNSCacheTTL = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPDNSCacheNegativeTTL); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.DNSCacheNegativeTTL = time.Duration(t) * time.Millisecond
+	}
+	if v := getenv(envHTTPUpstreamResetBadGateway); v != "" {
+		if v == "true" {
+			cfg.UpstreamResetBadGateway = true
+		}
 	}
 
-	return nil
+	return cfg, cfg.Validate()
+}
+
+// parseFault parses fault in format `prefix:value:percent`, path prefix may contain colons
+func parseFault(fault string) (string, int, float64, error) {
+	parts := strings.Split(fault, ":")
+	if len(parts) < 3 {
+		return "", 0, 0, fmt.Errorf("malformed fault: '%s'", fault)
+	}
+	value, err := strconv.Atoi(parts[len(parts)-2])
+	if err != nil || value < 0 {
+		return "", 0, 0, fmt.Errorf("malformed fault: '%s'", fault)
+	}
+	percent, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return "", 0, 0, fmt.Errorf("fault percent should be in [0, 100]: '%s'", fault)
+	}
+	return strings.Join(parts[:len(parts)-2], ":"), value, percent, nil
+}
+
+// parseStatusRanges parses sep separated statuses and ranges of statuses, e.g. 429,500-599.
+// Empty value is empty list
+func parseStatusRanges(value string, sep string) ([]StatusRange, error) {
+	ranges := []StatusRange{}
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed status range: '%s'", item)
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("malformed status range: '%s'", item)
+			}
+		}
+		if low < 100 || high > 599 || low > high {
+			return nil, fmt.Errorf("status range should be within [100, 599]: '%s'", item)
+		}
+		ranges = append(ranges, StatusRange{Min: low, Max: high})
+	}
+	return ranges, nil
+}
+
+// expandNodeTemplate replaces $VAR and ${VAR} of value with environment variables identifying node,
+// HOSTNAME falls back to host name. Unresolved variables are left as is
+func expandNodeTemplate(
+	value string,
+	lookupEnv func(string) (string, bool),
+	hostname func() (string, error),
+	logger *log.Logger) string {
+	return os.Expand(value, func(name string) string {
+		if v, ok := lookupEnv(name); ok {
+			return v
+		}
+		if name == "HOSTNAME" {
+			if h, err := hostname(); err == nil {
+				return h
+			}
+		}
+		logger.Warningf("Variable %s of '%s' isn't set, it's left as is", name, value)
+		return "${" + name + "}"
+	})
+}
+
+// parseHeaderRules parses comma separated header rules in format prefix:action:headers,
+// action is remove or keep and headers are separated with ;. Rules are sorted from the longest prefix,
+// so the first matching rule is the most specific one
+func parseHeaderRules(value string) ([]HeaderRule, error) {
+	var rules []HeaderRule
+	prefixes := make(map[string]struct{})
+	for _, r := range strings.Split(value, ",") {
+		parts := strings.Split(r, ":")
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("malformed header rule: '%s'", r)
+		}
+		rule := HeaderRule{
+			Prefix:  strings.Join(parts[:len(parts)-2], ":"),
+			Headers: make(map[string]struct{}),
+		}
+		switch parts[len(parts)-2] {
+		case "remove":
+		case "keep":
+			rule.Keep = true
+			for name := range framingHeaders {
+				rule.Headers[name] = struct{}{}
+			}
+		default:
+			return nil, fmt.Errorf("header rule action should be remove or keep: '%s'", r)
+		}
+		if _, ok := prefixes[rule.Prefix]; ok {
+			return nil, fmt.Errorf("duplicate header rule prefix: '%s'", r)
+		}
+		prefixes[rule.Prefix] = struct{}{}
+		for _, name := range strings.Split(parts[len(parts)-1], ";") {
+			if name = strings.TrimSpace(name); name != "" {
+				rule.Headers[textproto.CanonicalMIMEHeaderKey(name)] = struct{}{}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Prefix) > len(rules[j].Prefix)
+	})
+	return rules, nil
+}
+
+// parsePathRewriteRules parses comma separated path rewrites in format prefix=replacement or ~pattern=replacement.
+// Prefix rules are sorted from the longest prefix and followed by pattern ones in the given order,
+// so the first matching rule is the most specific one
+func parsePathRewriteRules(value string) ([]PathRewriteRule, error) {
+	var prefixRules, patternRules []PathRewriteRule
+	prefixes := make(map[string]struct{})
+	for _, r := range strings.Split(value, ",") {
+		i := strings.Index(r, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("malformed path rewrite: '%s'", r)
+		}
+		rule := PathRewriteRule{Replacement: r[i+1:]}
+		if strings.HasPrefix(r, "~") {
+			pattern, err := regexp.Compile(r[1:i])
+			if err != nil {
+				return nil, fmt.Errorf("malformed path rewrite pattern '%s': %s", r, err.Error())
+			}
+			rule.Pattern = pattern
+			patternRules = append(patternRules, rule)
+			continue
+		}
+		rule.Prefix = r[:i]
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			return nil, fmt.Errorf("path rewrite prefix should start with /: '%s'", r)
+		}
+		if _, ok := prefixes[rule.Prefix]; ok {
+			return nil, fmt.Errorf("duplicate path rewrite prefix: '%s'", r)
+		}
+		prefixes[rule.Prefix] = struct{}{}
+		prefixRules = append(prefixRules, rule)
+	}
+	sort.SliceStable(prefixRules, func(i, j int) bool {
+		return len(prefixRules[i].Prefix) > len(prefixRules[j].Prefix)
+	})
+	return append(prefixRules, patternRules...), nil
+}
+
+// parseRouteTimeouts parses route timeouts in format prefix:read:write:total in milliseconds,
+// empty read or write keeps global timeout and empty total means there is no total timeout
+func parseRouteTimeouts(route string) (string, RouteTimeouts, error) {
+	timeouts := RouteTimeouts{Read: InheritTimeout, Write: InheritTimeout}
+	parts := strings.Split(route, ":")
+	if len(parts) < 4 {
+		return "", timeouts, fmt.Errorf("malformed route timeouts: '%s'", route)
+	}
+	// path may contain colons, timeouts are the last three parts
+	values := parts[len(parts)-3:]
+	for i, field := range []*time.Duration{&timeouts.Read, &timeouts.Write, &timeouts.Total} {
+		if values[i] == "" {
+			continue
+		}
+		t, err := strconv.Atoi(values[i])
+		if err != nil || t < 0 {
+			return "", timeouts, fmt.Errorf("route timeout should be non-negative number of milliseconds: '%s'", route)
+		}
+		*field = time.Duration(t) * time.Millisecond
+	}
+	return strings.Join(parts[:len(parts)-3], ":"), timeouts, nil
+}
+
+// parseHedgeRule parses hedge rule in format prefix:delay:maxHedges,
+// delay is either milliseconds or percentile of latencies, e.g. p95
+func parseHedgeRule(hedge string) (string, HedgeRule, error) {
+	var rule HedgeRule
+	parts := strings.Split(hedge, ":")
+	if len(parts) < 3 {
+		return "", rule, fmt.Errorf("malformed hedge rule: '%s'", hedge)
+	}
+	delay := parts[len(parts)-2]
+	if strings.HasPrefix(delay, "p") {
+		percentile, err := strconv.ParseFloat(delay[1:], 64)
+		if err != nil || percentile <= 0 || percentile >= 100 {
+			return "", rule, fmt.Errorf("hedge percentile should be in (0, 100): '%s'", hedge)
+		}
+		rule.Percentile = percentile
+	} else {
+		ms, err := strconv.Atoi(delay)
+		if err != nil || ms <= 0 {
+			return "", rule, fmt.Errorf("hedge delay should be positive: '%s'", hedge)
+		}
+		rule.Delay = time.Duration(ms) * time.Millisecond
+	}
+	maxHedges, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil || maxHedges <= 0 {
+		return "", rule, fmt.Errorf("max hedges should be positive: '%s'", hedge)
+	}
+	rule.MaxHedges = maxHedges
+	return strings.Join(parts[:len(parts)-2], ":"), rule, nil
 }
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestExpandNodeTemplate(t *testing.T) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"POD_NAME": "api-7f9c", "ZONE": "eu-1"}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	hostname := func() (string, error) { return "node-3", nil }
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"netra", "netra"},
+		{"mesh/${POD_NAME}", "mesh/api-7f9c"},
+		{"$ZONE/${HOSTNAME}", "eu-1/node-3"},
+		{"mesh/${MISSING}/$POD_NAME", "mesh/${MISSING}/api-7f9c"},
+	}
+	for _, tt := range tests {
+		if actual := expandNodeTemplate(tt.value, lookupEnv, hostname, logger); actual != tt.expected {
+			t.Fatalf("%q: expected %q, got %q", tt.value, tt.expected, actual)
+		}
+	}
+
+	failingHostname := func() (string, error) { return "", errors.New("no hostname") }
+	if actual := expandNodeTemplate("${HOSTNAME}", lookupEnv, failingHostname, logger); actual != "${HOSTNAME}" {
+		t.Fatalf("expected unresolved host name to be left as is, got %q", actual)
+	}
+}
+
+func TestParseRouteTimeouts(t *testing.T) {
+	tests := []struct {
+		route    string
+		prefix   string
+		timeouts RouteTimeouts
+	}{
+		{"/reports:120000::300000", "/reports", RouteTimeouts{Read: 120 * time.Second, Write: InheritTimeout, Total: 300 * time.Second}},
+		{"/poll:0::", "/poll", RouteTimeouts{Read: 0, Write: InheritTimeout}},
+		{"/a:b:100:200:", "/a:b", RouteTimeouts{Read: 100 * time.Millisecond, Write: 200 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		prefix, timeouts, err := parseRouteTimeouts(tt.route)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.route, err.Error())
+		}
+		if prefix != tt.prefix || timeouts != tt.timeouts {
+			t.Fatalf("%s: expected %s %+v, got %s %+v", tt.route, tt.prefix, tt.timeouts, prefix, timeouts)
+		}
+	}
+	for _, route := range []string{"/reports:1000", "/reports:-1::", "/reports:soon::"} {
+		if _, _, err := parseRouteTimeouts(route); err == nil {
+			t.Fatalf("%s: expected error", route)
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	env := map[string]string{
+		envNetraHTTPPorts:  "80,8080",
+		envNetraRedisPorts: "6379,redis",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	ports := make(map[string]struct{})
+	if err := parsePorts(getenv, envNetraHTTPPorts, ports); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ports["8080"]; !ok || len(ports) != 2 {
+		t.Fatalf("unexpected ports %v", ports)
+	}
+	if err := parsePorts(getenv, envNetraGRPCPorts, ports); err != nil || len(ports) != 2 {
+		t.Fatalf("expected unset variable to be skipped, got %v (%v)", ports, err)
+	}
+	err := parsePorts(getenv, envNetraRedisPorts, make(map[string]struct{}))
+	if err == nil || !strings.Contains(err.Error(), envNetraRedisPorts) {
+		t.Fatalf("expected error naming variable, got %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestParseHeaderRules(t *testing.T) {
+	rules, err := parseHeaderRules("/:remove:x-debug,/api/public:keep:accept;content-type,/api:remove:X-Internal-Secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes := []string{"/api/public", "/api", "/"}
+	if len(rules) != len(prefixes) {
+		t.Fatalf("expected %d rules, got %#v", len(prefixes), rules)
+	}
+	for i, prefix := range prefixes {
+		if rules[i].Prefix != prefix {
+			t.Fatalf("expected rule %d of prefix %s, got %s", i, prefix, rules[i].Prefix)
+		}
+	}
+	if _, ok := rules[0].Headers["Content-Type"]; !ok || !rules[0].Keep {
+		t.Fatalf("expected keep rule with canonical names, got %#v", rules[0])
+	}
+	if _, ok := rules[0].Headers["Content-Length"]; !ok {
+		t.Fatal("expected framing headers to be kept")
+	}
+	if _, ok := rules[1].Headers["X-Internal-Secret"]; !ok || rules[1].Keep {
+		t.Fatalf("expected remove rule, got %#v", rules[1])
+	}
+
+	for _, value := range []string{"/api:X-Debug", "/api:drop:X-Debug", "/api:remove:X-A,/api:keep:X-B"} {
+		if _, err := parseHeaderRules(value); err == nil {
+			t.Fatalf("expected error for %q", value)
+		}
+	}
+}
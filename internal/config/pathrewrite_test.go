@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestParsePathRewriteRules(t *testing.T) {
+	rules, err := parsePathRewriteRules("~^/users/([0-9]+)$=/v2/users/$1,/old=/new,/old/admin=/admin,/api/v1=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes := []string{"/old/admin", "/api/v1", "/old", ""}
+	if len(rules) != len(prefixes) {
+		t.Fatalf("expected %d rules, got %#v", len(prefixes), rules)
+	}
+	for i, prefix := range prefixes {
+		if rules[i].Prefix != prefix {
+			t.Fatalf("expected rule %d of prefix %s, got %s", i, prefix, rules[i].Prefix)
+		}
+	}
+	if rules[1].Replacement != "" {
+		t.Fatalf("expected empty replacement, got %s", rules[1].Replacement)
+	}
+	if rules[3].Pattern == nil || rules[3].Pattern.String() != "^/users/([0-9]+)$" || rules[3].Replacement != "/v2/users/$1" {
+		t.Fatalf("unexpected pattern rule %#v", rules[3])
+	}
+
+	for _, value := range []string{"/old", "old=/new", "/old=/new,/old=/newer", "~^/users/([0-9]+=/v2"} {
+		if _, err := parsePathRewriteRules(value); err == nil {
+			t.Fatalf("expected error for '%s'", value)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// envNetraConfigFile is path to file with config values in KEY=VALUE format,
+// they override environment variables and are re-read on reload
+const envNetraConfigFile = "NETRA_CONFIG_FILE"
+
+// configLookup returns function looking config value up in config file first and in environment then
+func configLookup() (func(string) string, error) {
+	path := os.Getenv(envNetraConfigFile)
+	if path == "" {
+		return os.Getenv, nil
+	}
+	values, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return func(key string) string {
+		if v, ok := values[key]; ok {
+			return v
+		}
+		return os.Getenv(key)
+	}, nil
+}
+
+// readConfigFile reads KEY=VALUE lines, empty lines and lines started with # are skipped
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) < 2 {
+			return nil, fmt.Errorf("malformed config file line: '%s'", line)
+		}
+		values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return values, scanner.Err()
+}
+
+// ReloadHTTPConfig reads HTTP config again and replaces current one as a whole,
+// current config is kept if new one is invalid
+func ReloadHTTPConfig(logger *log.Logger) error {
+	getenv, err := configLookup()
+	if err != nil {
+		return err
+	}
+	cfg, err := httpConfigFromENV(getenv, logger)
+	if err != nil {
+		return err
+	}
+	httpConfig.Store(cfg)
+	return nil
+}
+
+// WatchReload reloads HTTP config on SIGHUP
+func WatchReload(logger *log.Logger) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			if err := ReloadHTTPConfig(logger); err != nil {
+				logger.Errorf("Error while reloading config: %s", err.Error())
+				continue
+			}
+			logger.Info("HTTP config is reloaded")
+		}
+	}()
+}
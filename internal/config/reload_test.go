@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestReloadHTTPConfigConcurrently(t *testing.T) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "netra-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "netra.env")
+	os.Setenv(envNetraConfigFile, path)
+	defer os.Unsetenv(envNetraConfigFile)
+
+	writeVersion := func(version int) {
+		content := fmt.Sprintf(
+			"%s=X-Version:v%d\n%s=v%d\n",
+			envHttpHeaderTagMap, version, envHTTPXSourceValue, version,
+		)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion(0)
+	if err := ReloadHTTPConfig(logger); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// both values come from the same file version
+				cfg := GetHTTPConfig()
+				if cfg.HeadersMap["X-Version"] != cfg.XSourceValue {
+					t.Errorf("inconsistent config: %s != %s", cfg.HeadersMap["X-Version"], cfg.XSourceValue)
+					return
+				}
+			}
+		}()
+	}
+	for version := 1; version <= 100; version++ {
+		writeVersion(version)
+		if err := ReloadHTTPConfig(logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if v := GetHTTPConfig().XSourceValue; v != "v100" {
+		t.Fatalf("expected last config version, got %s", v)
+	}
+}
+
+func TestReloadHTTPConfigKeepsCurrentOnError(t *testing.T) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := GetHTTPConfig()
+	os.Setenv(envNetraConfigFile, filepath.Join(os.TempDir(), "netra-config-does-not-exist"))
+	defer os.Unsetenv(envNetraConfigFile)
+	if err := ReloadHTTPConfig(logger); err == nil {
+		t.Fatal("expected error for missing config file")
+	}
+	if GetHTTPConfig().XSourceValue != before.XSourceValue {
+		t.Fatal("config shouldn't be changed by failed reload")
+	}
+}
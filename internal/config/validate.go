@@ -0,0 +1,203 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ValidationError is list of config problems, all of them are reported at once
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid HTTP config: " + strings.Join(e, "; ")
+}
+
+// Validate checks values which are parsed fine one by one but don't make sense together
+func (c HTTPConfig) Validate() error {
+	var problems ValidationError
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.RoutingEnabled && !isHeaderName(c.RoutingHeaderName) {
+		addProblem("routing header name '%s' is not valid header name", c.RoutingHeaderName)
+	}
+	if c.RoutingCookieEnabled {
+		if !c.RoutingEnabled {
+			addProblem("routing cookie requires routing to be enabled")
+		}
+		if c.RoutingCookieName == "" {
+			addProblem("routing cookie name should not be empty")
+		}
+	}
+	if c.RoutingStickyCookieEnabled && !c.RoutingCookieEnabled {
+		addProblem("sticky routing cookie requires routing cookie to be enabled")
+	}
+	for _, name := range c.RequestIdHeaderNames {
+		if !isHeaderName(name) {
+			addProblem("request id header name '%s' is not valid header name", name)
+		}
+	}
+	if c.MaxHops > 0 && !isHeaderName(c.HopsHeaderName) {
+		addProblem("hops header name '%s' is not valid header name", c.HopsHeaderName)
+	}
+	// pseudonym is a single token of Via header entry
+	if c.ViaEnabled && !isHeaderName(c.ViaPseudonym) {
+		addProblem("via pseudonym '%s' is not valid token", c.ViaPseudonym)
+	}
+	if c.ForceSampleHeaderName != "" && !isHeaderName(c.ForceSampleHeaderName) {
+		addProblem("force sample header name '%s' is not valid header name", c.ForceSampleHeaderName)
+	}
+	if !isHeaderName(c.XSourceHeaderName) {
+		addProblem("source header name '%s' is not valid header name", c.XSourceHeaderName)
+	}
+	for _, name := range sortedKeys(c.HeadersMap) {
+		if !isHeaderName(name) {
+			addProblem("tagged header name '%s' is not valid header name", name)
+		}
+	}
+	for _, rule := range append(append([]HeaderRule{}, c.RequestHeaderRules...), c.ResponseHeaderRules...) {
+		var invalid []string
+		for name := range rule.Headers {
+			if !isHeaderName(name) {
+				invalid = append(invalid, name)
+			}
+		}
+		sort.Strings(invalid)
+		for _, name := range invalid {
+			addProblem("header name '%s' of header rule '%s' is not valid header name", name, rule.Prefix)
+		}
+	}
+
+	// values of all tag mappings end up in the same span, so one tag would silently overwrite another
+	tagSources := make(map[string]string)
+	for _, mapping := range []struct {
+		source string
+		tags   map[string]string
+	}{
+		{"header", c.HeadersMap},
+		{"cookie", c.CookiesMap},
+		{"query param", c.QueryParamsMap},
+		{"response body field", c.ResponseBodyFieldsMap},
+	} {
+		for _, name := range sortedKeys(mapping.tags) {
+			tag := mapping.tags[name]
+			if tag == "" {
+				addProblem("%s '%s' is mapped to empty tag name", mapping.source, name)
+				continue
+			}
+			source := mapping.source + " '" + name + "'"
+			if other, ok := tagSources[tag]; ok {
+				addProblem("tag '%s' is mapped from both %s and %s", tag, other, source)
+				continue
+			}
+			tagSources[tag] = source
+		}
+	}
+
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"connect timeout", c.ConnectTimeout},
+		{"read timeout", c.ReadTimeout},
+		{"write timeout", c.WriteTimeout},
+		{"idle timeout", c.IdleTimeout},
+		{"sticky routing cookie ttl", c.RoutingStickyCookieTTL},
+		{"breaker window", c.BreakerWindow},
+		{"breaker open timeout", c.BreakerOpenTimeout},
+		{"outlier ejection time", c.OutlierEjectionTime},
+		{"pool idle timeout", c.PoolIdleTimeout},
+		{"pool wait timeout", c.PoolWaitTimeout},
+		{"dns cache ttl", c.DNSCacheTTL},
+		{"dns cache negative ttl", c.DNSCacheNegativeTTL},
+	} {
+		if timeout.value < 0 {
+			addProblem("%s should not be negative: %s", timeout.name, timeout.value)
+		}
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"max retries", c.MaxRetries},
+		{"max hops", c.MaxHops},
+		{"max inflight requests", c.MaxInflightRequests},
+		{"mirror max inflight requests", c.MirrorMaxInflight},
+		{"pool max idle connections", c.PoolMaxIdlePerHost},
+		{"pool max connections", c.PoolMaxConnsPerHost},
+	} {
+		if limit.value < 0 {
+			addProblem("%s should not be negative: %d", limit.name, limit.value)
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// Validate checks that every port is claimed by single protocol, otherwise protocol detection would pick one of them
+func (c NetraConfig) Validate() error {
+	var problems []string
+	portProtocols := make(map[string]string)
+	for _, protocol := range []struct {
+		name  string
+		ports map[string]struct{}
+	}{
+		{"HTTP", c.HTTPProtoPorts},
+		{"gRPC", c.GRPCProtoPorts},
+		{"passthrough", c.PassthroughProtoPorts},
+		{"MySQL", c.MySQLProtoPorts},
+		{"Redis", c.RedisProtoPorts},
+		{"Kafka", c.KafkaProtoPorts},
+		{"AMQP", c.AMQPProtoPorts},
+		{"MongoDB", c.MongoDBProtoPorts},
+		{"Thrift", c.ThriftProtoPorts},
+		{"TLS", c.TLSProtoPorts},
+	} {
+		ports := make([]string, 0, len(protocol.ports))
+		for port := range protocol.ports {
+			ports = append(ports, port)
+		}
+		sort.Strings(ports)
+		for _, port := range ports {
+			if other, ok := portProtocols[port]; ok {
+				problems = append(problems, fmt.Sprintf("port %s is claimed by both %s and %s", port, other, protocol.name))
+				continue
+			}
+			portProtocols[port] = protocol.name
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid netra config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isHeaderName reports whether name is non-empty token as defined by RFC 7230
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedKeys returns map keys in stable order, so problems are reported the same way each time
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(cfg *HTTPConfig)
+		problems []string
+	}{
+		{
+			name:   "defaults",
+			modify: func(cfg *HTTPConfig) {},
+		},
+		{
+			name: "routing cookie without routing",
+			modify: func(cfg *HTTPConfig) {
+				cfg.RoutingCookieEnabled = true
+			},
+			problems: []string{"routing cookie requires routing to be enabled"},
+		},
+		{
+			name: "empty routing cookie name",
+			modify: func(cfg *HTTPConfig) {
+				cfg.RoutingEnabled = true
+				cfg.RoutingCookieEnabled = true
+				cfg.RoutingCookieName = ""
+			},
+			problems: []string{"routing cookie name should not be empty"},
+		},
+		{
+			name: "sticky cookie without routing cookie",
+			modify: func(cfg *HTTPConfig) {
+				cfg.RoutingEnabled = true
+				cfg.RoutingStickyCookieEnabled = true
+			},
+			problems: []string{"sticky routing cookie requires routing cookie to be enabled"},
+		},
+		{
+			name: "malformed routing header name",
+			modify: func(cfg *HTTPConfig) {
+				cfg.RoutingEnabled = true
+				cfg.RoutingHeaderName = "X Route"
+			},
+			problems: []string{"routing header name 'X Route' is not valid header name"},
+		},
+		{
+			name: "malformed request id header name",
+			modify: func(cfg *HTTPConfig) {
+				cfg.RequestIdHeaderNames = []string{"X-Request-Id", "X-Trace:Id"}
+			},
+			problems: []string{"request id header name 'X-Trace:Id' is not valid header name"},
+		},
+		{
+			name: "malformed tagged header name",
+			modify: func(cfg *HTTPConfig) {
+				cfg.HeadersMap = map[string]string{"x-session ": "http.session"}
+			},
+			problems: []string{"tagged header name 'x-session ' is not valid header name"},
+		},
+		{
+			name: "duplicate tag names",
+			modify: func(cfg *HTTPConfig) {
+				cfg.HeadersMap = map[string]string{"X-A": "tag", "X-B": "tag"}
+				cfg.QueryParamsMap = map[string]string{"a": "tag"}
+			},
+			problems: []string{
+				"tag 'tag' is mapped from both header 'X-A' and header 'X-B'",
+				"tag 'tag' is mapped from both header 'X-A' and query param 'a'",
+			},
+		},
+		{
+			name: "empty tag name",
+			modify: func(cfg *HTTPConfig) {
+				cfg.CookiesMap = map[string]string{"sess": ""}
+			},
+			problems: []string{"cookie 'sess' is mapped to empty tag name"},
+		},
+		{
+			name: "negative timeouts",
+			modify: func(cfg *HTTPConfig) {
+				cfg.ReadTimeout = -time.Second
+				cfg.PoolWaitTimeout = -time.Millisecond
+			},
+			problems: []string{
+				"read timeout should not be negative: -1s",
+				"pool wait timeout should not be negative: -1ms",
+			},
+		},
+		{
+			name: "negative limits",
+			modify: func(cfg *HTTPConfig) {
+				cfg.MaxRetries = -1
+			},
+			problems: []string{"max retries should not be negative: -1"},
+		},
+		{
+			name: "via pseudonym with space",
+			modify: func(cfg *HTTPConfig) {
+				cfg.ViaEnabled = true
+				cfg.ViaPseudonym = "net ramesh"
+			},
+			problems: []string{"via pseudonym 'net ramesh' is not valid token"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newHTTPConfig()
+			tt.modify(&cfg)
+			err := cfg.Validate()
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Fatalf("expected valid config, got %s", err.Error())
+				}
+				return
+			}
+			problems, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+			if strings.Join(problems, "\n") != strings.Join(tt.problems, "\n") {
+				t.Fatalf("expected problems %q, got %q", tt.problems, problems)
+			}
+		})
+	}
+}
+
+func TestNetraConfigValidate(t *testing.T) {
+	cfg := NetraConfig{
+		HTTPProtoPorts: map[string]struct{}{"80": {}, "8080": {}},
+		GRPCProtoPorts: map[string]struct{}{"9090": {}},
+		TLSProtoPorts:  map[string]struct{}{"443": {}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected valid config, got %s", err.Error())
+	}
+	cfg.GRPCProtoPorts["8080"] = struct{}{}
+	cfg.TLSProtoPorts["80"] = struct{}{}
+	err := cfg.Validate()
+	expected := "invalid netra config: port 8080 is claimed by both HTTP and gRPC; port 80 is claimed by both HTTP and TLS"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestHTTPConfigFromENVValidated(t *testing.T) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		envHTTPRoutingCookieEnabled: "true",
+		envHttpHeaderTagMap:         "x-a:tag,x-b:tag",
+	}
+	_, err = httpConfigFromENV(func(key string) string { return env[key] }, logger)
+	problems, ok := err.(ValidationError)
+	if !ok || len(problems) != 2 {
+		t.Fatalf("expected two problems, got %v", err)
+	}
+}
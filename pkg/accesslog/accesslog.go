@@ -0,0 +1,56 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Entry is a single access log record
+type Entry struct {
+	Direction    string  `json:"direction"`
+	Method       string  `json:"method"`
+	Host         string  `json:"host"`
+	Path         string  `json:"path"`
+	StatusCode   int     `json:"status_code"`
+	RequestSize  int64   `json:"request_size"`
+	ResponseSize int64   `json:"response_size"`
+	Duration     float64 `json:"duration"`
+	RemoteAddr   string  `json:"remote_addr"`
+	RequestID    string  `json:"request_id,omitempty"`
+}
+
+var (
+	mu     sync.Mutex
+	output io.Writer
+)
+
+// Init enables access log written to w, entries are written as JSON lines
+func Init(w io.Writer) {
+	mu.Lock()
+	output = w
+	mu.Unlock()
+}
+
+// Enabled reports whether access log is enabled
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return output != nil
+}
+
+// Write writes entry if access log is enabled
+func Write(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	mu.Lock()
+	defer mu.Unlock()
+	if output == nil {
+		return nil
+	}
+	_, err = output.Write(line)
+	return err
+}
@@ -0,0 +1,89 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/capture"
+	"github.com/Lookyan/netramesh/pkg/stats"
+)
+
+// ready is set when netra is able to proxy and trace traffic
+var ready int32
+
+// SetReady changes readiness reported by /readyz
+func SetReady(isReady bool) {
+	if isReady {
+		atomic.StoreInt32(&ready, 1)
+	} else {
+		atomic.StoreInt32(&ready, 0)
+	}
+}
+
+// Handler returns HTTP handler serving probes, latency stats, effective HTTP config and captured request bodies,
+// config and captures are shown only to requests with configToken bearer token and are disabled if token is empty.
+// Profiles are served under /debug/pprof/ if pprofEnabled is set
+func Handler(configToken string, pprofEnabled bool) http.Handler {
+	mux := http.NewServeMux()
+	if pprofEnabled {
+		// handlers are registered on admin mux only, default mux isn't served anywhere
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, stats.Snapshot())
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if authorize(w, r, configToken) {
+			writeJSON(w, config.GetHTTPConfig())
+		}
+	})
+	mux.HandleFunc("/debug/captures", func(w http.ResponseWriter, r *http.Request) {
+		if authorize(w, r, configToken) {
+			writeJSON(w, capture.Recent())
+		}
+	})
+	return mux
+}
+
+// authorize reports whether request has token bearer token, otherwise error response is written
+func authorize(w http.ResponseWriter, r *http.Request, token string) bool {
+	if token == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,171 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// State is circuit breaker state
+type State int
+
+const (
+	// Closed breaker passes requests and counts their failures
+	Closed State = iota
+	// Open breaker rejects requests till open timeout is over
+	Open
+	// HalfOpen breaker passes single probe request deciding whether it should be closed or opened again
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+// Settings are breaker trip conditions, zero MaxFailures and FailureRatio disable breaker
+type Settings struct {
+	// Window is period failures are counted within
+	Window time.Duration
+	// MaxFailures trips breaker when failures count within window reaches it
+	MaxFailures int
+	// FailureRatio trips breaker when failures share within window reaches it,
+	// it's applied when there are at least MinRequests results
+	FailureRatio float64
+	MinRequests  int
+	// OpenTimeout is how long breaker stays open before probe request is passed
+	OpenTimeout time.Duration
+}
+
+func (s Settings) enabled() bool {
+	return s.MaxFailures > 0 || s.FailureRatio > 0
+}
+
+type breaker struct {
+	state       State
+	windowStart time.Time
+	requests    int
+	failures    int
+	// openedAt is time breaker was opened or probe request was passed
+	openedAt time.Time
+}
+
+// Set keeps breaker per key (e.g. destination address), settings are passed on each call,
+// so they can be changed without losing breakers state
+type Set struct {
+	mu       sync.Mutex
+	breakers map[string]*breaker
+	// onStateChange is called on every transition, from is -1 for new breaker
+	onStateChange func(from State, to State)
+}
+
+// NewSet returns empty breakers set, onStateChange may be nil
+func NewSet(onStateChange func(from State, to State)) *Set {
+	return &Set{
+		breakers:      make(map[string]*breaker),
+		onStateChange: onStateChange,
+	}
+}
+
+// Allow reports whether request to key may be made
+func (s *Set) Allow(key string, settings Settings) bool {
+	if !settings.enabled() {
+		return true
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.breaker(key, now)
+	switch b.state {
+	case Open:
+		if now.Sub(b.openedAt) < settings.OpenTimeout {
+			return false
+		}
+		s.setState(b, HalfOpen, now)
+		b.openedAt = now
+		return true
+	case HalfOpen:
+		// probe without result (e.g. lost connection) doesn't block breaker forever
+		if now.Sub(b.openedAt) < settings.OpenTimeout {
+			return false
+		}
+		b.openedAt = now
+		return true
+	default:
+		return true
+	}
+}
+
+// Done records result of request to key
+func (s *Set) Done(key string, settings Settings, success bool) {
+	if !settings.enabled() {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.breaker(key, now)
+	switch b.state {
+	case HalfOpen:
+		if success {
+			s.setState(b, Closed, now)
+		} else {
+			s.setState(b, Open, now)
+		}
+	case Closed:
+		if now.Sub(b.windowStart) >= settings.Window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if settings.tripped(b.requests, b.failures) {
+			s.setState(b, Open, now)
+		}
+	}
+}
+
+func (s Settings) tripped(requests int, failures int) bool {
+	if s.MaxFailures > 0 && failures >= s.MaxFailures {
+		return true
+	}
+	return s.FailureRatio > 0 && requests >= s.MinRequests &&
+		float64(failures)/float64(requests) >= s.FailureRatio
+}
+
+func (s *Set) breaker(key string, now time.Time) *breaker {
+	b, ok := s.breakers[key]
+	if !ok {
+		b = &breaker{state: Closed, windowStart: now}
+		s.breakers[key] = b
+		if s.onStateChange != nil {
+			s.onStateChange(-1, Closed)
+		}
+	}
+	return b
+}
+
+func (s *Set) setState(b *breaker, state State, now time.Time) {
+	if s.onStateChange != nil {
+		s.onStateChange(b.state, state)
+	}
+	b.state = state
+	switch state {
+	case Open:
+		b.openedAt = now
+	case Closed:
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+}
@@ -0,0 +1,138 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		results  []bool
+		open     bool
+	}{
+		{
+			name:     "disabled",
+			settings: Settings{Window: time.Minute, OpenTimeout: time.Minute},
+			results:  []bool{false, false, false},
+		},
+		{
+			name:     "failures below threshold",
+			settings: Settings{Window: time.Minute, MaxFailures: 3, OpenTimeout: time.Minute},
+			results:  []bool{false, true, false},
+		},
+		{
+			name:     "failures reach threshold",
+			settings: Settings{Window: time.Minute, MaxFailures: 3, OpenTimeout: time.Minute},
+			results:  []bool{false, true, false, false},
+			open:     true,
+		},
+		{
+			name:     "window is over for every result",
+			settings: Settings{MaxFailures: 2, OpenTimeout: time.Minute},
+			results:  []bool{false, false, false},
+		},
+		{
+			name:     "failure ratio below min requests",
+			settings: Settings{Window: time.Minute, FailureRatio: 0.5, MinRequests: 4, OpenTimeout: time.Minute},
+			results:  []bool{false, false, false},
+		},
+		{
+			name:     "failure ratio reached",
+			settings: Settings{Window: time.Minute, FailureRatio: 0.5, MinRequests: 4, OpenTimeout: time.Minute},
+			results:  []bool{true, false, true, false},
+			open:     true,
+		},
+		{
+			name:     "failure ratio not reached",
+			settings: Settings{Window: time.Minute, FailureRatio: 0.5, MinRequests: 4, OpenTimeout: time.Minute},
+			results:  []bool{true, false, true, true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var transitions []State
+			s := NewSet(func(from State, to State) {
+				transitions = append(transitions, to)
+			})
+			for _, success := range tt.results {
+				if !s.Allow("a:80", tt.settings) {
+					t.Fatal("expected request to be allowed before breaker is open")
+				}
+				s.Done("a:80", tt.settings, success)
+			}
+			if s.Allow("a:80", tt.settings) == tt.open {
+				t.Fatalf("expected open to be %v", tt.open)
+			}
+			if tt.open && transitions[len(transitions)-1] != Open {
+				t.Fatalf("unexpected transitions %v", transitions)
+			}
+			if !s.Allow("b:80", tt.settings) {
+				t.Fatal("expected other key to be allowed")
+			}
+		})
+	}
+}
+
+func TestHalfOpen(t *testing.T) {
+	settings := Settings{Window: time.Minute, MaxFailures: 1, OpenTimeout: 50 * time.Millisecond}
+	var transitions []string
+	s := NewSet(func(from State, to State) {
+		if from < 0 {
+			transitions = append(transitions, "new")
+			return
+		}
+		transitions = append(transitions, from.String()+"->"+to.String())
+	})
+
+	s.Done("a:80", settings, false)
+	if s.Allow("a:80", settings) {
+		t.Fatal("expected open breaker to reject request")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !s.Allow("a:80", settings) {
+		t.Fatal("expected probe request after open timeout")
+	}
+	if s.Allow("a:80", settings) {
+		t.Fatal("expected single probe request in half-open state")
+	}
+	// failed probe opens breaker again
+	s.Done("a:80", settings, false)
+	if s.Allow("a:80", settings) {
+		t.Fatal("expected breaker to be opened by failed probe")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !s.Allow("a:80", settings) {
+		t.Fatal("expected probe request after open timeout")
+	}
+	s.Done("a:80", settings, true)
+	if !s.Allow("a:80", settings) || !s.Allow("a:80", settings) {
+		t.Fatal("expected breaker to be closed by successful probe")
+	}
+
+	expected := []string{"new", "closed->open", "open->half_open", "half_open->open", "open->half_open", "half_open->closed"}
+	if len(transitions) != len(expected) {
+		t.Fatalf("unexpected transitions %v", transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Fatalf("unexpected transitions %v", transitions)
+		}
+	}
+}
+
+func TestLostProbe(t *testing.T) {
+	settings := Settings{Window: time.Minute, MaxFailures: 1, OpenTimeout: 50 * time.Millisecond}
+	s := NewSet(nil)
+	s.Done("a:80", settings, false)
+	time.Sleep(60 * time.Millisecond)
+	if !s.Allow("a:80", settings) {
+		t.Fatal("expected probe request after open timeout")
+	}
+	// probe result is never reported
+	time.Sleep(60 * time.Millisecond)
+	if !s.Allow("a:80", settings) {
+		t.Fatal("expected another probe request after lost one")
+	}
+}
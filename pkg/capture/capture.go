@@ -0,0 +1,113 @@
+package capture
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// queueSize is number of entries waiting to be written, entries captured above it are dropped
+const queueSize = 64
+
+// Entry is a captured request with size-capped copies of its bodies
+type Entry struct {
+	Time                  time.Time `json:"time"`
+	RequestID             string    `json:"request_id,omitempty"`
+	Direction             string    `json:"direction"`
+	Method                string    `json:"method"`
+	Host                  string    `json:"host"`
+	Path                  string    `json:"path"`
+	StatusCode            int       `json:"status_code"`
+	RequestBody           string    `json:"request_body"`
+	RequestBodyTruncated  bool      `json:"request_body_truncated,omitempty"`
+	ResponseBody          string    `json:"response_body"`
+	ResponseBodyTruncated bool      `json:"response_body_truncated,omitempty"`
+}
+
+var (
+	mu     sync.Mutex
+	output io.Writer
+	queue  chan Entry
+	// recent keeps last captured entries, next is index of the oldest one when buffer is full
+	recent []Entry
+	next   int
+	size   int
+)
+
+// Init enables capture sink, entries are kept in ring buffer of bufferSize entries and
+// written to w as JSON lines if w isn't nil. Entries are written by background goroutine
+func Init(w io.Writer, bufferSize int) {
+	mu.Lock()
+	defer mu.Unlock()
+	if queue != nil {
+		return
+	}
+	output = w
+	size = bufferSize
+	recent = make([]Entry, 0, bufferSize)
+	queue = make(chan Entry, queueSize)
+	go run(queue)
+}
+
+// Enabled reports whether capture sink is enabled
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return queue != nil
+}
+
+// Write queues entry without blocking, it's dropped if sink isn't enabled or lags behind
+func Write(entry Entry) bool {
+	mu.Lock()
+	q := queue
+	mu.Unlock()
+	if q == nil {
+		return false
+	}
+	select {
+	case q <- entry:
+		return true
+	default:
+		return false
+	}
+}
+
+// Recent returns captured entries kept in ring buffer, the oldest first
+func Recent() []Entry {
+	mu.Lock()
+	defer mu.Unlock()
+	entries := make([]Entry, 0, len(recent))
+	entries = append(entries, recent[next:]...)
+	return append(entries, recent[:next]...)
+}
+
+func run(q chan Entry) {
+	for entry := range q {
+		mu.Lock()
+		keep(entry)
+		w := output
+		mu.Unlock()
+		if w == nil {
+			continue
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		w.Write(append(line, '\n'))
+	}
+}
+
+// keep puts entry to ring buffer replacing the oldest one, mu is held
+func keep(entry Entry) {
+	if size <= 0 {
+		return
+	}
+	if len(recent) < size {
+		recent = append(recent, entry)
+		return
+	}
+	recent[next] = entry
+	next = (next + 1) % size
+}
@@ -0,0 +1,54 @@
+package connlimit
+
+import (
+	"time"
+)
+
+// Limiter limits number of concurrently handled connections,
+// connection over limit waits for free slot until queue timeout passes
+type Limiter struct {
+	// slots is nil for unlimited number of connections
+	slots   chan struct{}
+	observe func(delta int)
+}
+
+// New returns limiter of max connections, zero max doesn't limit them.
+// observe is called on every change of number of handled connections
+func New(max int, observe func(delta int)) *Limiter {
+	l := &Limiter{observe: observe}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// Acquire takes slot for new connection waiting for free one up to timeout,
+// it reports whether slot is taken. Connection which took slot should release it when it's closed
+func (l *Limiter) Acquire(timeout time.Duration) bool {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if timeout <= 0 {
+				return false
+			}
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case l.slots <- struct{}{}:
+			case <-timer.C:
+				return false
+			}
+		}
+	}
+	l.observe(1)
+	return true
+}
+
+// Release frees slot of closed connection
+func (l *Limiter) Release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+	l.observe(-1)
+}
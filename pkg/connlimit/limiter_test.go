@@ -0,0 +1,46 @@
+package connlimit
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	var active int64
+	l := New(2, func(delta int) { atomic.AddInt64(&active, int64(delta)) })
+	if !l.Acquire(0) || !l.Acquire(0) {
+		t.Fatal("expected connections within limit to be accepted")
+	}
+	if l.Acquire(0) {
+		t.Fatal("expected connection over limit to be rejected")
+	}
+	if l.Acquire(10 * time.Millisecond) {
+		t.Fatal("expected queued connection to be rejected after timeout")
+	}
+	if active := atomic.LoadInt64(&active); active != 2 {
+		t.Fatalf("expected 2 active connections, got %d", active)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Release()
+	}()
+	if !l.Acquire(5 * time.Second) {
+		t.Fatal("expected queued connection to take released slot")
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	active := 0
+	l := New(0, func(delta int) { active += delta })
+	for i := 0; i < 100; i++ {
+		if !l.Acquire(0) {
+			t.Fatal("expected connection to be accepted")
+		}
+	}
+	l.Release()
+	if active != 99 {
+		t.Fatalf("expected 99 active connections, got %d", active)
+	}
+}
@@ -0,0 +1,24 @@
+package connpool
+
+import (
+	"net"
+	"syscall"
+)
+
+// isAlive reports whether idle connection isn't closed by server, server doesn't send anything to idle connection.
+// Socket is peeked without waiting, read with expired deadline would fail before socket is checked
+func isAlive(conn *net.TCPConn) bool {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	alive := false
+	err = rawConn.Read(func(fd uintptr) bool {
+		var b [1]byte
+		_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		// EOF and unexpected bytes make connection not reusable
+		alive = err == syscall.EAGAIN
+		return true
+	})
+	return err == nil && alive
+}
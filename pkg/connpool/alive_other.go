@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package connpool
+
+import (
+	"net"
+	"time"
+)
+
+// aliveCheckTimeout is how long idle connection is read to find out whether it's closed by server
+const aliveCheckTimeout = time.Millisecond
+
+// isAlive reports whether idle connection isn't closed by server, server doesn't send anything to idle connection
+func isAlive(conn *net.TCPConn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(aliveCheckTimeout)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
@@ -0,0 +1,192 @@
+package connpool
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrPoolExhausted is returned when connection isn't released within wait timeout
+var ErrPoolExhausted = errors.New("connection pool is exhausted")
+
+// Settings are pool limits, zero MaxIdle disables pooling
+type Settings struct {
+	// MaxIdle is max number of idle connections kept per address
+	MaxIdle int
+	// IdleTimeout closes connection idle for longer, zero keeps idle connections until they're broken
+	IdleTimeout time.Duration
+	// MaxConns is max number of open connections per address, zero means no limit
+	MaxConns int
+	// WaitTimeout is how long connection is waited for when MaxConns are open
+	WaitTimeout time.Duration
+}
+
+// Enabled reports whether connections are pooled
+func (s Settings) Enabled() bool {
+	return s.MaxIdle > 0
+}
+
+type idleConn struct {
+	conn  *net.TCPConn
+	since time.Time
+}
+
+type host struct {
+	idle []idleConn
+	// open is number of borrowed, idle and being dialed connections
+	open int
+	// waiters are woken up when connection is released
+	waiters []chan struct{}
+}
+
+// Pool keeps idle keep-alive connections per address, settings are passed on each call,
+// so they can be changed without dropping pooled connections
+type Pool struct {
+	dial  func(addr string) (*net.TCPConn, error)
+	mu    sync.Mutex
+	hosts map[string]*host
+}
+
+// NewPool returns empty pool dialing new connections with dial
+func NewPool(dial func(addr string) (*net.TCPConn, error)) *Pool {
+	return &Pool{
+		dial:  dial,
+		hosts: make(map[string]*host),
+	}
+}
+
+func (p *Pool) host(addr string) *host {
+	h, ok := p.hosts[addr]
+	if !ok {
+		h = &host{}
+		p.hosts[addr] = h
+	}
+	return h
+}
+
+// Get borrows idle connection to addr or dials new one, borrowed connection should be returned with Put
+func (p *Pool) Get(addr string, settings Settings) (*net.TCPConn, error) {
+	deadline := time.Now().Add(settings.WaitTimeout)
+	for {
+		p.mu.Lock()
+		h := p.host(addr)
+		if n := len(h.idle); n > 0 {
+			// the most recently used connection is the least likely to be closed by server
+			ic := h.idle[n-1]
+			h.idle = h.idle[:n-1]
+			p.mu.Unlock()
+			if (settings.IdleTimeout <= 0 || time.Since(ic.since) < settings.IdleTimeout) && isAlive(ic.conn) {
+				return ic.conn, nil
+			}
+			p.discard(addr, ic.conn)
+			continue
+		}
+		if settings.MaxConns <= 0 || h.open < settings.MaxConns {
+			h.open++
+			p.mu.Unlock()
+			conn, err := p.dial(addr)
+			if err != nil {
+				p.release(addr)
+				return nil, err
+			}
+			return conn, nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			p.mu.Unlock()
+			return nil, ErrPoolExhausted
+		}
+		released := make(chan struct{})
+		h.waiters = append(h.waiters, released)
+		p.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-released:
+			timer.Stop()
+		case <-timer.C:
+			p.mu.Lock()
+			h.removeWaiter(released)
+			p.mu.Unlock()
+		}
+	}
+}
+
+// Put returns borrowed connection, connection which can't be reused (e.g. closed by server) is closed
+func (p *Pool) Put(addr string, conn *net.TCPConn, reusable bool, settings Settings) {
+	if !reusable || !settings.Enabled() || conn.SetDeadline(time.Time{}) != nil {
+		p.discard(addr, conn)
+		return
+	}
+	p.mu.Lock()
+	h := p.host(addr)
+	if len(h.idle) >= settings.MaxIdle {
+		p.mu.Unlock()
+		p.discard(addr, conn)
+		return
+	}
+	since := time.Now()
+	h.idle = append(h.idle, idleConn{conn: conn, since: since})
+	h.wakeUp()
+	p.mu.Unlock()
+	if settings.IdleTimeout > 0 {
+		time.AfterFunc(settings.IdleTimeout, func() {
+			p.expire(addr, conn, since)
+		})
+	}
+}
+
+// expire closes connection idle since given time
+func (p *Pool) expire(addr string, conn *net.TCPConn, since time.Time) {
+	p.mu.Lock()
+	h, ok := p.hosts[addr]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	for i, ic := range h.idle {
+		if ic.conn == conn && ic.since.Equal(since) {
+			h.idle = append(h.idle[:i], h.idle[i+1:]...)
+			p.mu.Unlock()
+			p.discard(addr, conn)
+			return
+		}
+	}
+	p.mu.Unlock()
+}
+
+// discard closes pooled connection
+func (p *Pool) discard(addr string, conn *net.TCPConn) {
+	conn.Close()
+	p.release(addr)
+}
+
+// release frees slot of closed connection
+func (p *Pool) release(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.host(addr)
+	h.open--
+	h.wakeUp()
+	if h.open == 0 && len(h.waiters) == 0 {
+		delete(p.hosts, addr)
+	}
+}
+
+// wakeUp wakes up the oldest waiter, p.mu is held
+func (h *host) wakeUp() {
+	if len(h.waiters) == 0 {
+		return
+	}
+	close(h.waiters[0])
+	h.waiters = h.waiters[1:]
+}
+
+func (h *host) removeWaiter(waiter chan struct{}) {
+	for i, w := range h.waiters {
+		if w == waiter {
+			h.waiters = append(h.waiters[:i], h.waiters[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package connpool
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer accepts connections to pool, accepted ones are sent to channel
+type testServer struct {
+	addr     string
+	accepted chan net.Conn
+	dials    int64
+}
+
+func newTestServer(t *testing.T) (*testServer, *Pool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &testServer{addr: ln.Addr().String(), accepted: make(chan net.Conn, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.accepted <- conn
+		}
+	}()
+	pool := NewPool(func(addr string) (*net.TCPConn, error) {
+		atomic.AddInt64(&s.dials, 1)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*net.TCPConn), nil
+	})
+	return s, pool
+}
+
+func (s *testServer) dialed() int64 {
+	return atomic.LoadInt64(&s.dials)
+}
+
+func get(t *testing.T, pool *Pool, addr string, settings Settings) *net.TCPConn {
+	conn, err := pool.Get(addr, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestPoolReusesIdleConnection(t *testing.T) {
+	s, pool := newTestServer(t)
+	settings := Settings{MaxIdle: 1}
+	conn := get(t, pool, s.addr, settings)
+	pool.Put(s.addr, conn, true, settings)
+	if reused := get(t, pool, s.addr, settings); reused != conn || s.dialed() != 1 {
+		t.Fatalf("expected idle connection to be reused, dialed %d", s.dialed())
+	}
+
+	// connection which can't be reused is closed
+	pool.Put(s.addr, conn, false, settings)
+	if get(t, pool, s.addr, settings) == conn || s.dialed() != 2 {
+		t.Fatalf("expected new connection to be dialed, dialed %d", s.dialed())
+	}
+}
+
+func TestPoolKeepsMaxIdle(t *testing.T) {
+	s, pool := newTestServer(t)
+	settings := Settings{MaxIdle: 1}
+	first := get(t, pool, s.addr, settings)
+	second := get(t, pool, s.addr, settings)
+	pool.Put(s.addr, first, true, settings)
+	pool.Put(s.addr, second, true, settings)
+	if _, err := second.Write([]byte("x")); err == nil {
+		t.Fatal("expected connection over max idle to be closed")
+	}
+	if get(t, pool, s.addr, settings) != first {
+		t.Fatal("expected idle connection to be reused")
+	}
+}
+
+func TestPoolIdleExpiry(t *testing.T) {
+	s, pool := newTestServer(t)
+	settings := Settings{MaxIdle: 1, IdleTimeout: 50 * time.Millisecond}
+	conn := get(t, pool, s.addr, settings)
+	pool.Put(s.addr, conn, true, settings)
+	time.Sleep(100 * time.Millisecond)
+	if get(t, pool, s.addr, settings) == conn || s.dialed() != 2 {
+		t.Fatalf("expected expired connection to be closed, dialed %d", s.dialed())
+	}
+}
+
+func TestPoolDropsConnectionClosedByServer(t *testing.T) {
+	s, pool := newTestServer(t)
+	settings := Settings{MaxIdle: 1}
+	conn := get(t, pool, s.addr, settings)
+	pool.Put(s.addr, conn, true, settings)
+	(<-s.accepted).Close()
+	time.Sleep(20 * time.Millisecond)
+	if get(t, pool, s.addr, settings) == conn || s.dialed() != 2 {
+		t.Fatalf("expected connection closed by server to be dropped, dialed %d", s.dialed())
+	}
+}
+
+func TestPoolMaxConnsWaitTimeout(t *testing.T) {
+	s, pool := newTestServer(t)
+	settings := Settings{MaxIdle: 1, MaxConns: 1, WaitTimeout: 50 * time.Millisecond}
+	get(t, pool, s.addr, settings)
+	start := time.Now()
+	if _, err := pool.Get(s.addr, settings); err != ErrPoolExhausted {
+		t.Fatalf("expected pool to be exhausted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("expected connection to be waited for wait timeout, it took %s", elapsed)
+	}
+	if s.dialed() != 1 {
+		t.Fatalf("expected no connections over max conns, dialed %d", s.dialed())
+	}
+}
+
+func TestPoolHandsOffToWaiter(t *testing.T) {
+	s, pool := newTestServer(t)
+	settings := Settings{MaxIdle: 1, MaxConns: 1, WaitTimeout: 5 * time.Second}
+	conn := get(t, pool, s.addr, settings)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pool.Put(s.addr, conn, true, settings)
+	}()
+	if get(t, pool, s.addr, settings) != conn {
+		t.Fatal("expected released connection to be handed off to waiter")
+	}
+
+	// slot of discarded connection is handed off as well
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pool.Put(s.addr, conn, false, settings)
+	}()
+	if get(t, pool, s.addr, settings) == conn || s.dialed() != 2 {
+		t.Fatalf("expected waiter to dial new connection, dialed %d", s.dialed())
+	}
+}
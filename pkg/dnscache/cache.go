@@ -0,0 +1,122 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Settings are cache TTLs, zero TTL disables caching
+type Settings struct {
+	// TTL is how long resolved addresses are kept
+	TTL time.Duration
+	// NegativeTTL is how long missing host (NXDOMAIN) is remembered, zero doesn't cache it
+	NegativeTTL time.Duration
+}
+
+type entry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// Cache resolves host of host:port address and keeps its addresses until TTL passes.
+// System resolver doesn't expose record TTL, so addresses are kept for configured TTL.
+// Settings are passed on each call, so they can be changed without dropping cached entries
+type Cache struct {
+	lookup  func(host string) ([]net.IP, error)
+	observe func(hit bool)
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+// New returns empty cache looking hosts up with lookup, observe is called on each lookup of cacheable host
+func New(lookup func(host string) ([]net.IP, error), observe func(hit bool)) *Cache {
+	return &Cache{
+		lookup:  lookup,
+		observe: observe,
+		entries: make(map[string]entry),
+	}
+}
+
+// LookupIP looks host up with default resolver
+func LookupIP(host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// Resolve returns TCP address of host:port address, IPv4 address of host is preferred
+func (c *Cache) Resolve(addr string, settings Settings) (*net.TCPAddr, error) {
+	host, portName, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portName)
+	if err != nil {
+		if port, err = net.LookupPort("tcp", portName); err != nil {
+			return nil, err
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil || settings.TTL <= 0 {
+		return net.ResolveTCPAddr("tcp", addr)
+	}
+
+	ips, err := c.lookupHost(host, settings)
+	if err != nil {
+		return nil, err
+	}
+	ip := ips[0]
+	for _, candidate := range ips {
+		if candidate.To4() != nil {
+			ip = candidate
+			break
+		}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func (c *Cache) lookupHost(host string, settings Settings) ([]net.IP, error) {
+	now := time.Now()
+	c.mu.Lock()
+	cached, ok := c.entries[host]
+	if ok && now.Before(cached.expires) {
+		c.mu.Unlock()
+		c.observe(true)
+		return cached.ips, cached.err
+	}
+	if ok {
+		delete(c.entries, host)
+	}
+	c.mu.Unlock()
+	c.observe(false)
+
+	// concurrent misses of the same host may look it up more than once, the last result is kept
+	ips, err := c.lookup(host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		c.store(host, entry{ips: ips, expires: now.Add(settings.TTL)})
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound && settings.NegativeTTL > 0:
+		c.store(host, entry{err: err, expires: now.Add(settings.NegativeTTL)})
+	}
+	return ips, err
+}
+
+func (c *Cache) store(host string, e entry) {
+	c.mu.Lock()
+	c.entries[host] = e
+	c.mu.Unlock()
+}
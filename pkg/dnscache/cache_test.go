@@ -0,0 +1,87 @@
+package dnscache
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCacheKeepsResolvedHost(t *testing.T) {
+	lookups := 0
+	hits := 0
+	cache := New(func(host string) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.1")}, nil
+	}, func(hit bool) {
+		if hit {
+			hits++
+		}
+	})
+	settings := Settings{TTL: 50 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		addr, err := cache.Resolve("orders.svc:8080", settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != "10.0.0.1:8080" {
+			t.Fatalf("expected IPv4 address to be preferred, got %s", addr)
+		}
+	}
+	if lookups != 1 || hits != 2 {
+		t.Fatalf("expected 1 lookup and 2 hits, got %d and %d", lookups, hits)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := cache.Resolve("orders.svc:8080", settings); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 2 {
+		t.Fatalf("expected expired host to be looked up again, got %d lookups", lookups)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	lookups := 0
+	notFound := &net.DNSError{Err: "no such host", Name: "missing.svc", IsNotFound: true}
+	failure := errors.New("resolver is down")
+	var lookupErr error = notFound
+	cache := New(func(host string) ([]net.IP, error) {
+		lookups++
+		return nil, lookupErr
+	}, func(bool) {})
+	settings := Settings{TTL: time.Minute, NegativeTTL: time.Minute}
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Resolve("missing.svc:80", settings); !errors.Is(err, notFound) {
+			t.Fatalf("expected NXDOMAIN, got %v", err)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("expected missing host to be cached, got %d lookups", lookups)
+	}
+
+	// other errors aren't cached
+	lookupErr = failure
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Resolve("down.svc:80", settings); err != failure {
+			t.Fatalf("expected resolver error, got %v", err)
+		}
+	}
+	if lookups != 3 {
+		t.Fatalf("expected failed lookups not to be cached, got %d lookups", lookups)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	cache := New(func(host string) ([]net.IP, error) {
+		t.Fatal("unexpected lookup")
+		return nil, nil
+	}, func(bool) {})
+	addr, err := cache.Resolve("127.0.0.1:80", Settings{TTL: time.Minute})
+	if err != nil || addr.String() != "127.0.0.1:80" {
+		t.Fatalf("expected IP address to be used as is, got %v %v", addr, err)
+	}
+	if _, err := cache.Resolve("localhost:80", Settings{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -65,6 +65,14 @@ var (
 	// request's Content-Type is not multipart/form-data.
 	ErrNotMultipart = &ProtocolError{"request Content-Type isn't multipart/form-data"}
 
+	// ErrRequestLineTooLong is returned by ReadRequestLimited when
+	// request line is longer than the limit.
+	ErrRequestLineTooLong = &ProtocolError{"request line too long"}
+
+	// ErrRequestHeaderTooLarge is returned by ReadRequestLimited when
+	// request header fields are larger than the limit.
+	ErrRequestHeaderTooLarge = &ProtocolError{"request header too large"}
+
 	// Deprecated: ErrHeaderTooLong is no longer returned by
 	// anything in the net/http package. Callers should not
 	// compare errors against this variable.
@@ -203,6 +211,12 @@ type Request struct {
 	// receiving requests.
 	TransferEncoding []string
 
+	// ReceivedContentLength keeps Content-Length header values of
+	// server request as they were received. Content-Length is removed
+	// from Header when Transfer-Encoding is present, so requests with
+	// both framing headers can be detected with it.
+	ReceivedContentLength []string
+
 	// Close indicates whether to close the connection after
 	// replying to this request (for servers) or after sending this
 	// request and reading its response (for clients).
@@ -505,6 +519,13 @@ func (r *Request) WriteProxy(w io.Writer) error {
 	return r.write(w, true, nil, nil)
 }
 
+// WriteContinue is like Write but it flushes request header and calls
+// waitForContinue before the body is written. If waitForContinue returns
+// false, the body is closed without being sent.
+func (r *Request) WriteContinue(w io.Writer, waitForContinue func() bool) error {
+	return r.write(w, false, nil, waitForContinue)
+}
+
 // errMissingHost is returned by Write when there is no Host or URL present in
 // the Request.
 var errMissingHost = errors.New("http: Request.Write on Request with no Host or URL set")
@@ -943,6 +964,93 @@ func ReadRequest(b *bufio.Reader) (*Request, error) {
 	return readRequest(b, deleteHostHeader)
 }
 
+// ReadRequestLimited is like ReadRequest, but request line and header
+// fields are read up to the limits: request line longer than
+// maxRequestLineBytes results in ErrRequestLineTooLong and header fields
+// larger than maxHeaderBytes in total result in ErrRequestHeaderTooLarge.
+// Line endings aren't counted. Reading stops as soon as a limit is
+// exceeded, so the rest of the oversized request is left unread in b.
+func ReadRequestLimited(b *bufio.Reader, maxRequestLineBytes, maxHeaderBytes int) (*Request, error) {
+	head, err := readRequestHead(b, maxRequestLineBytes, maxHeaderBytes)
+	if err != nil {
+		return nil, err
+	}
+	hb := headReaderPool.Get().(*bufio.Reader)
+	hb.Reset(bytes.NewReader(head))
+	defer func() {
+		hb.Reset(nil)
+		headReaderPool.Put(hb)
+	}()
+	return readRequestFrom(hb, b, deleteHostHeader)
+}
+
+var headReaderPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReader(nil)
+	},
+}
+
+// readRequestHead reads request line and header fields up to the empty
+// line which ends them.
+func readRequestHead(b *bufio.Reader, maxRequestLineBytes, maxHeaderBytes int) ([]byte, error) {
+	head, err := readLimitedLine(b, nil, maxRequestLineBytes, ErrRequestLineTooLong)
+	if err != nil {
+		return nil, err
+	}
+	headerBytes := 0
+	for {
+		start := len(head)
+		head, err = readLimitedLine(b, head, maxHeaderBytes-headerBytes, ErrRequestHeaderTooLarge)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		n := lineContentLen(head[start:])
+		if n == 0 {
+			return head, nil
+		}
+		headerBytes += n
+	}
+}
+
+// readLimitedLine appends line read from b to dst, errTooLong is
+// returned when line content is longer than limit. io.EOF is returned
+// only if nothing is read.
+func readLimitedLine(b *bufio.Reader, dst []byte, limit int, errTooLong error) ([]byte, error) {
+	start := len(dst)
+	for {
+		frag, err := b.ReadSlice('\n')
+		dst = append(dst, frag...)
+		if lineContentLen(dst[start:]) > limit {
+			return nil, errTooLong
+		}
+		if err == nil {
+			return dst, nil
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF && len(dst) > start {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// lineContentLen returns length of line without line ending, trailing
+// '\r' of incomplete line may be a part of line ending too.
+func lineContentLen(line []byte) int {
+	n := len(line)
+	if n > 0 && line[n-1] == '\n' {
+		n--
+	}
+	if n > 0 && line[n-1] == '\r' {
+		n--
+	}
+	return n
+}
+
 // Constants for readRequest's deleteHostHeader parameter.
 const (
 	deleteHostHeader = true
@@ -950,7 +1058,14 @@ const (
 )
 
 func readRequest(b *bufio.Reader, deleteHostHeader bool) (req *Request, err error) {
-	tp := newTextprotoReader(b)
+	return readRequestFrom(b, b, deleteHostHeader)
+}
+
+// readRequestFrom reads request line and header fields from hb and
+// request body from b, they are the same reader unless request head is
+// read in advance.
+func readRequestFrom(hb, b *bufio.Reader, deleteHostHeader bool) (req *Request, err error) {
+	tp := newTextprotoReader(hb)
 	req = new(Request)
 
 	// First line: GET /index.html HTTP/1.0
@@ -1026,6 +1141,7 @@ func readRequest(b *bufio.Reader, deleteHostHeader bool) (req *Request, err erro
 	fixPragmaCacheControl(req.Header)
 
 	req.Close = shouldClose(req.ProtoMajor, req.ProtoMinor, req.Header, false)
+	req.ReceivedContentLength = req.Header["Content-Length"]
 
 	err = readTransfer(req, b)
 	if err != nil {
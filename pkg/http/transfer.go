@@ -642,6 +642,16 @@ func (t *transferReader) fixTransferEncoding() error {
 	return nil
 }
 
+// MultipleContentLengthError is returned when message contains
+// Content-Length headers with different values.
+type MultipleContentLengthError struct {
+	Values []string
+}
+
+func (e *MultipleContentLengthError) Error() string {
+	return fmt.Sprintf("http: message cannot contain multiple Content-Length headers; got %q", e.Values)
+}
+
 // Determine the expected body length, using RFC 7230 Section 3.3. This
 // function is not a method, because ultimately it should be shared by
 // ReadResponse and ReadRequest.
@@ -658,7 +668,7 @@ func fixLength(isResponse bool, status int, requestMethod string, header Header,
 		first := strings.TrimSpace(contentLens[0])
 		for _, ct := range contentLens[1:] {
 			if first != strings.TrimSpace(ct) {
-				return 0, fmt.Errorf("http: message cannot contain multiple Content-Length headers; got %q", contentLens)
+				return 0, &MultipleContentLengthError{Values: contentLens}
 			}
 		}
 
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	jmetrics "github.com/uber/jaeger-lib/metrics"
+)
+
+// JaegerFactory returns jaeger metrics factory which reports spans dropped by tracer reporter,
+// the other tracer metrics are discarded
+func JaegerFactory() jmetrics.Factory {
+	return jaegerFactory{}
+}
+
+type jaegerFactory struct{}
+
+func (jaegerFactory) Counter(name string, tags map[string]string) jmetrics.Counter {
+	if name == "reporter_spans" && tags["result"] == "dropped" {
+		return droppedSpansCounter{}
+	}
+	return jmetrics.NullCounter
+}
+
+func (jaegerFactory) Timer(name string, tags map[string]string) jmetrics.Timer {
+	return jmetrics.NullTimer
+}
+
+func (jaegerFactory) Gauge(name string, tags map[string]string) jmetrics.Gauge {
+	return jmetrics.NullGauge
+}
+
+// Namespace returns the same factory, tracer metrics are matched by their names only
+func (f jaegerFactory) Namespace(name string, tags map[string]string) jmetrics.Factory {
+	return f
+}
+
+type droppedSpansCounter struct{}
+
+func (droppedSpansCounter) Inc(delta int64) {
+	tracerSpansDroppedTotal.Add(float64(delta))
+}
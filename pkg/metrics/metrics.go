@@ -0,0 +1,309 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "netra"
+
+// Registry keeps all netra metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Total number of proxied HTTP requests.",
+		},
+		[]string{"direction", "method", "status_code"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of proxied HTTP requests from request start till response.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"direction", "method"},
+	)
+	httpRequestBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_bytes_total",
+			Help:      "Total number of bytes of proxied HTTP requests written upstream, head included.",
+		},
+		[]string{"direction"},
+	)
+	httpResponseBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "response_bytes_total",
+			Help:      "Total number of bytes of HTTP responses written to clients, head included.",
+		},
+		[]string{"direction"},
+	)
+	httpInflightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "inflight_requests",
+			Help:      "Number of proxied HTTP requests waiting for response.",
+		},
+		[]string{"direction"},
+	)
+	httpReadErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "read_errors_total",
+			Help:      "Total number of errors while reading HTTP requests and responses by cause.",
+		},
+		[]string{"direction", "message", "cause"},
+	)
+	dnsCacheLookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "dns_cache",
+			Name:      "lookups_total",
+			Help:      "Total number of routing destination host lookups in DNS cache by result.",
+		},
+		[]string{"result"},
+	)
+	circuitBreakers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "circuit_breakers",
+			Help:      "Number of outbound destination circuit breakers by state.",
+		},
+		[]string{"state"},
+	)
+	outlierEjectionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "outlier_ejections_total",
+			Help:      "Total number of outbound destination ejections from weighted routing.",
+		},
+	)
+	mirrorDroppedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "mirror_dropped_total",
+			Help:      "Total number of mirrored requests dropped because max number of them is being sent.",
+		},
+	)
+	activeConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connections_active",
+			Help:      "Number of client connections being handled.",
+		},
+	)
+	rejectedConnectionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "connections_rejected_total",
+			Help:      "Total number of client connections rejected over max connections limit.",
+		},
+	)
+	tracerSpansDroppedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "tracer",
+			Name:      "spans_dropped_total",
+			Help:      "Total number of spans dropped by tracer reporter because its queue is full.",
+		},
+	)
+	outlierEjectedDestinations = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "outlier_ejected_destinations",
+			Help:      "Number of outbound destinations currently ejected from weighted routing.",
+		},
+	)
+)
+
+// contextMappings reports number of items in context mappings
+var contextMappings = &contextMappingsCollector{
+	desc: prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "context_mapping_items"),
+		"Number of items in context mapping including expired ones waiting for cleanup.",
+		[]string{"mapping"},
+		nil,
+	),
+	sizes: make(map[string]func() int),
+}
+
+type contextMappingsCollector struct {
+	desc  *prometheus.Desc
+	mu    sync.Mutex
+	sizes map[string]func() int
+}
+
+func (c *contextMappingsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *contextMappingsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for mapping, size := range c.sizes {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(size()), mapping)
+	}
+}
+
+// known methods, everything else is reported as OTHER to keep label cardinality bounded
+var knownMethods = map[string]struct{}{
+	"GET":     {},
+	"HEAD":    {},
+	"POST":    {},
+	"PUT":     {},
+	"PATCH":   {},
+	"DELETE":  {},
+	"CONNECT": {},
+	"OPTIONS": {},
+	"TRACE":   {},
+}
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		httpRequestBytesTotal,
+		httpResponseBytesTotal,
+		httpInflightRequests,
+		httpReadErrorsTotal,
+		dnsCacheLookupsTotal,
+		circuitBreakers,
+		outlierEjectionsTotal,
+		outlierEjectedDestinations,
+		mirrorDroppedTotal,
+		activeConnections,
+		rejectedConnectionsTotal,
+		tracerSpansDroppedTotal,
+		contextMappings,
+	)
+}
+
+// Handler returns HTTP handler exposing netra metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveHTTPRequest records finished HTTP request,
+// statusCode is 0 when request has no response
+func ObserveHTTPRequest(isInbound bool, method string, statusCode int, duration time.Duration) {
+	d := direction(isInbound)
+	m := normalizeMethod(method)
+	httpRequestsTotal.WithLabelValues(d, m, statusClass(statusCode)).Inc()
+	httpRequestDuration.WithLabelValues(d, m).Observe(duration.Seconds())
+}
+
+// ObserveHTTPRequestBytes counts bytes of request written upstream
+func ObserveHTTPRequestBytes(isInbound bool, bytes int64) {
+	httpRequestBytesTotal.WithLabelValues(direction(isInbound)).Add(float64(bytes))
+}
+
+// ObserveHTTPResponseBytes counts bytes of response written to client
+func ObserveHTTPResponseBytes(isInbound bool, bytes int64) {
+	httpResponseBytesTotal.WithLabelValues(direction(isInbound)).Add(float64(bytes))
+}
+
+// AddInflightHTTPRequests changes number of requests waiting for response
+func AddInflightHTTPRequests(isInbound bool, delta int) {
+	httpInflightRequests.WithLabelValues(direction(isInbound)).Add(float64(delta))
+}
+
+// ObserveReadError counts error of reading HTTP message, message is request or response,
+// cause is timeout or malformed
+func ObserveReadError(isInbound bool, message string, cause string) {
+	httpReadErrorsTotal.WithLabelValues(direction(isInbound), message, cause).Inc()
+}
+
+// ObserveDNSCacheLookup counts lookup of host in DNS cache
+func ObserveDNSCacheLookup(hit bool) {
+	if hit {
+		dnsCacheLookupsTotal.WithLabelValues("hit").Inc()
+		return
+	}
+	dnsCacheLookupsTotal.WithLabelValues("miss").Inc()
+}
+
+// ObserveCircuitBreakerTransition moves circuit breaker between states,
+// from is empty for new breaker
+func ObserveCircuitBreakerTransition(from string, to string) {
+	if from != "" {
+		circuitBreakers.WithLabelValues(from).Dec()
+	}
+	circuitBreakers.WithLabelValues(to).Inc()
+}
+
+// ObserveOutlierEjection records destination ejection or its return
+func ObserveOutlierEjection(ejected bool) {
+	if ejected {
+		outlierEjectionsTotal.Inc()
+		outlierEjectedDestinations.Inc()
+		return
+	}
+	outlierEjectedDestinations.Dec()
+}
+
+// ObserveMirrorDropped counts mirrored request dropped over limit
+func ObserveMirrorDropped() {
+	mirrorDroppedTotal.Inc()
+}
+
+// AddActiveConnections changes number of client connections being handled
+func AddActiveConnections(delta int) {
+	activeConnections.Add(float64(delta))
+}
+
+// ObserveRejectedConnection counts client connection rejected over limit
+func ObserveRejectedConnection() {
+	rejectedConnectionsTotal.Inc()
+}
+
+func direction(isInbound bool) string {
+	if isInbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+func normalizeMethod(method string) string {
+	if _, ok := knownMethods[method]; ok {
+		return method
+	}
+	return "OTHER"
+}
+
+// statusClass buckets status code into 1xx/2xx/3xx/4xx/5xx
+func statusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "none"
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+// ObserveContextMapping makes number of items in mapping reported on every scrape, size is called then
+func ObserveContextMapping(mapping string, size func() int) {
+	contextMappings.mu.Lock()
+	contextMappings.sizes[mapping] = size
+	contextMappings.mu.Unlock()
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/uber/jaeger-client-go"
+)
+
+// contextMappingItems returns reported number of items in mapping
+func contextMappingItems(t *testing.T, mapping string) float64 {
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "netra_context_mapping_items" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "mapping" && label.GetValue() == mapping {
+					return metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	t.Fatalf("mapping %s isn't reported", mapping)
+	return 0
+}
+
+func TestContextMappingExpiration(t *testing.T) {
+	mapping := cache.New(50*time.Millisecond, 10*time.Millisecond)
+	ObserveContextMapping("test", mapping.ItemCount)
+	mapping.SetDefault("request-id", "context")
+
+	if _, ok := mapping.Get("request-id"); !ok {
+		t.Fatal("expected entry before expiration")
+	}
+	if items := contextMappingItems(t, "test"); items != 1 {
+		t.Fatalf("expected 1 item, got %g", items)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := mapping.Get("request-id"); ok {
+		t.Fatal("expected entry to expire")
+	}
+	if items := contextMappingItems(t, "test"); items != 0 {
+		t.Fatalf("expected expired item to be cleaned up, got %g", items)
+	}
+}
+
+func TestJaegerDroppedSpans(t *testing.T) {
+	tracerMetrics := jaeger.NewMetrics(JaegerFactory(), nil)
+	tracerMetrics.ReporterDropped.Inc(2)
+	tracerMetrics.ReporterSuccess.Inc(1)
+
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "netra_tracer_spans_dropped_total" {
+			if dropped := family.GetMetric()[0].GetCounter().GetValue(); dropped != 2 {
+				t.Fatalf("expected 2 dropped spans, got %v", dropped)
+			}
+			return
+		}
+	}
+	t.Fatal("dropped spans aren't reported")
+}
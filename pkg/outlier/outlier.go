@@ -0,0 +1,99 @@
+package outlier
+
+import (
+	"sync"
+	"time"
+)
+
+// Settings are ejection conditions, zero ConsecutiveFailures disables detection
+type Settings struct {
+	// ConsecutiveFailures ejects key when its failures in a row reach it
+	ConsecutiveFailures int
+	// EjectionTime is how long key stays ejected
+	EjectionTime time.Duration
+}
+
+func (s Settings) enabled() bool {
+	return s.ConsecutiveFailures > 0
+}
+
+type host struct {
+	failures     int
+	ejectedUntil time.Time
+}
+
+// Set tracks consecutive failures per key (e.g. destination address) and ejects failing keys for a while,
+// settings are passed on each call, so they can be changed without losing ejections
+type Set struct {
+	mu    sync.Mutex
+	hosts map[string]*host
+	// onEjection is called when key is ejected and when it's returned
+	onEjection func(key string, ejected bool)
+}
+
+// NewSet returns set without ejected keys, onEjection may be nil
+func NewSet(onEjection func(key string, ejected bool)) *Set {
+	return &Set{
+		hosts:      make(map[string]*host),
+		onEjection: onEjection,
+	}
+}
+
+// Ejected reports whether key is ejected
+func (s *Set) Ejected(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[key]
+	return ok && time.Now().Before(h.ejectedUntil)
+}
+
+// Done records result of request to key
+func (s *Set) Done(key string, settings Settings, success bool) {
+	if !settings.enabled() {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[key]
+	if ok && now.Before(h.ejectedUntil) {
+		// results of requests sent before ejection don't prolong it
+		return
+	}
+	if success {
+		// only failing keys are kept
+		delete(s.hosts, key)
+		return
+	}
+	if !ok {
+		h = &host{}
+		s.hosts[key] = h
+	}
+	h.failures++
+	if h.failures < settings.ConsecutiveFailures {
+		return
+	}
+	h.failures = 0
+	h.ejectedUntil = now.Add(settings.EjectionTime)
+	if s.onEjection != nil {
+		s.onEjection(key, true)
+	}
+	ejectedUntil := h.ejectedUntil
+	time.AfterFunc(settings.EjectionTime, func() {
+		s.release(key, ejectedUntil)
+	})
+}
+
+// release returns key ejected until given time
+func (s *Set) release(key string, ejectedUntil time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.hosts[key]
+	if !ok || !h.ejectedUntil.Equal(ejectedUntil) {
+		return
+	}
+	delete(s.hosts, key)
+	if s.onEjection != nil {
+		s.onEjection(key, false)
+	}
+}
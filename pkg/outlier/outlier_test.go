@@ -0,0 +1,104 @@
+package outlier
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEjection(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		results  []bool
+		ejected  bool
+	}{
+		{
+			name:     "disabled",
+			settings: Settings{EjectionTime: time.Minute},
+			results:  []bool{false, false, false},
+		},
+		{
+			name:     "failures below threshold",
+			settings: Settings{ConsecutiveFailures: 3, EjectionTime: time.Minute},
+			results:  []bool{false, false},
+		},
+		{
+			name:     "failures reach threshold",
+			settings: Settings{ConsecutiveFailures: 3, EjectionTime: time.Minute},
+			results:  []bool{false, false, false},
+			ejected:  true,
+		},
+		{
+			name:     "success resets failures",
+			settings: Settings{ConsecutiveFailures: 3, EjectionTime: time.Minute},
+			results:  []bool{false, false, true, false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ejections []bool
+			s := NewSet(func(key string, ejected bool) {
+				if key != "a:80" {
+					t.Errorf("unexpected key %s", key)
+				}
+				ejections = append(ejections, ejected)
+			})
+			for _, success := range tt.results {
+				s.Done("a:80", tt.settings, success)
+			}
+			if s.Ejected("a:80") != tt.ejected {
+				t.Fatalf("expected ejected to be %v", tt.ejected)
+			}
+			if s.Ejected("b:80") {
+				t.Fatal("expected other key not to be ejected")
+			}
+			if tt.ejected != (len(ejections) == 1 && ejections[0]) {
+				t.Fatalf("unexpected ejection callbacks %v", ejections)
+			}
+		})
+	}
+}
+
+func TestEjectionExpires(t *testing.T) {
+	var mu sync.Mutex
+	var ejections []bool
+	s := NewSet(func(key string, ejected bool) {
+		mu.Lock()
+		ejections = append(ejections, ejected)
+		mu.Unlock()
+	})
+	settings := Settings{ConsecutiveFailures: 1, EjectionTime: 50 * time.Millisecond}
+	s.Done("a:80", settings, false)
+	if !s.Ejected("a:80") {
+		t.Fatal("expected key to be ejected")
+	}
+	// results of requests sent before ejection neither prolong nor end it
+	s.Done("a:80", settings, false)
+	s.Done("a:80", settings, true)
+	if !s.Ejected("a:80") {
+		t.Fatal("expected key to stay ejected")
+	}
+
+	for deadline := time.Now().Add(time.Second); s.Ejected("a:80"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected ejection to expire")
+		}
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(ejections)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected key to be returned, got %v", ejections)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !ejections[0] || ejections[1] {
+		t.Fatalf("unexpected ejection callbacks %v", ejections)
+	}
+}
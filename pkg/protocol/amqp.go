@@ -0,0 +1,537 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// amqpProtocolHeader is sent by AMQP 0-9-1 client before any frame
+var amqpProtocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// AMQP frame types
+const (
+	amqpFrameMethod    byte = 1
+	amqpFrameHeader    byte = 2
+	amqpFrameBody      byte = 3
+	amqpFrameHeartbeat byte = 8
+)
+
+// amqpFrameEnd closes every AMQP frame
+const amqpFrameEnd byte = 0xce
+
+// AMQP classes and methods of traced messages
+const (
+	amqpClassChannel  uint16 = 20
+	amqpChannelClose  uint16 = 40
+	amqpClassBasic    uint16 = 60
+	amqpBasicPublish  uint16 = 40
+	amqpBasicDeliver  uint16 = 60
+	amqpBasicGet      uint16 = 70
+	amqpBasicGetOk    uint16 = 71
+	amqpBasicGetEmpty uint16 = 72
+)
+
+// AMQPHandler copies AMQP 0-9-1 connection as is and reports span for every published, delivered
+// and got message. Messages are tracked per channel, as channels are multiplexed over single connection
+type AMQPHandler struct {
+	logger *log.Logger
+}
+
+// NewAMQPHandler returns AMQP handler
+func NewAMQPHandler(logger *log.Logger) *AMQPHandler {
+	return &AMQPHandler{
+		logger: logger,
+	}
+}
+
+// HandleRequest copies client frames to broker
+func (h *AMQPHandler) HandleRequest(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) *net.TCPConn {
+
+	netAMQPRequest := netRequest.(*NetAMQPRequest)
+	if w == nil {
+		defer close(addrCh)
+		addrCh <- originalDst
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+	}
+	if isInboundConn {
+		netAMQPRequest.setRemoteAddr(r.RemoteAddr().String())
+	} else {
+		netAMQPRequest.setRemoteAddr(w.RemoteAddr().String())
+	}
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(bufioReader)
+
+	err := h.copyRequests(bufioReader, bufioWriter, netAMQPRequest)
+	if err == nil || err == io.EOF {
+		err = bufioWriter.Flush()
+	}
+	if err != nil && err != io.EOF {
+		h.logger.Debugf("Err copying AMQP frames to broker: %s", err.Error())
+	}
+	return w
+}
+
+// HandleResponse copies broker frames to client
+func (h *AMQPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	netAMQPRequest := netRequest.(*NetAMQPRequest)
+	// messages left unfinished are reported when connection is closed
+	defer netAMQPRequest.StopRequest()
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(bufioReader)
+
+	err := h.copyFrames(bufioReader, bufioWriter, netAMQPRequest, false)
+	if err == nil || err == io.EOF {
+		err = bufioWriter.Flush()
+	}
+	if err != nil && err != io.EOF {
+		h.logger.Debugf("Err copying AMQP frames to client: %s", err.Error())
+	}
+}
+
+// copyRequests forwards protocol header and frames client sends, connection of other protocol
+// (e.g. TLS) is passed through
+func (h *AMQPHandler) copyRequests(r *bufio.Reader, w *bufio.Writer, nr *NetAMQPRequest) error {
+	header := make([]byte, len(amqpProtocolHeader))
+	n, err := io.ReadFull(r, header)
+	if _, err := w.Write(header[:n]); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(header, amqpProtocolHeader) {
+		return h.passThrough(r, w)
+	}
+	return h.copyFrames(r, w, nr, true)
+}
+
+// copyFrames forwards frames from r to w, frame is parsed while it's copied.
+// Frame end is written after frame is handled, so reply can't outrun it
+func (h *AMQPHandler) copyFrames(r *bufio.Reader, w *bufio.Writer, nr *NetAMQPRequest, fromClient bool) error {
+	var headerBuf [7]byte
+	var endBuf [1]byte
+	for {
+		if _, err := io.ReadFull(r, headerBuf[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(headerBuf[:]); err != nil {
+			return err
+		}
+		frameType := headerBuf[0]
+		channel := binary.BigEndian.Uint16(headerBuf[1:3])
+		size := int64(binary.BigEndian.Uint32(headerBuf[3:7]))
+		switch frameType {
+		case amqpFrameMethod, amqpFrameHeader, amqpFrameBody, amqpFrameHeartbeat:
+		default:
+			// it isn't AMQP framing, e.g. broker rejects protocol version with its own header
+			return h.passThrough(r, w)
+		}
+
+		ar := &amqpReader{r: io.TeeReader(io.LimitReader(r, size), w)}
+		switch frameType {
+		case amqpFrameMethod:
+			nr.handleMethod(ar, channel, fromClient)
+		case amqpFrameHeader:
+			// class id and weight precede body size
+			ar.uint16()
+			ar.uint16()
+			if bodySize := ar.uint64(); ar.err == nil {
+				nr.contentHeader(channel, int64(bodySize), fromClient)
+			}
+		case amqpFrameBody:
+			nr.contentBody(channel, size, fromClient)
+		}
+		if _, err := io.CopyN(w, r, size-ar.n); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(r, endBuf[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(endBuf[:]); err != nil {
+			return err
+		}
+		if endBuf[0] != amqpFrameEnd {
+			return h.passThrough(r, w)
+		}
+	}
+}
+
+func (h *AMQPHandler) passThrough(r *bufio.Reader, w *bufio.Writer) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	buf := bufferPool.Get().([]byte)
+	_, err := io.CopyBuffer(w, r, buf)
+	bufferPool.Put(buf)
+	return err
+}
+
+// isAMQPPrefix reports whether prefix starts AMQP 0-9-1 protocol header
+func isAMQPPrefix(prefix []byte) bool {
+	n := len(prefix)
+	if n > len(amqpProtocolHeader) {
+		n = len(amqpProtocolHeader)
+	}
+	return n >= len("AMQP") && bytes.Equal(prefix[:n], amqpProtocolHeader[:n])
+}
+
+// amqpMessage is traced message, its span is finished when the whole content is copied
+type amqpMessage struct {
+	operation   string
+	channel     uint16
+	exchange    string
+	routingKey  string
+	queue       string
+	consumerTag string
+	redelivered bool
+	// bodySize is known when content header is copied
+	bodySize   int64
+	headerSeen bool
+	copied     int64
+	empty      bool
+	startTime  time.Time
+}
+
+// amqpReader reads fields of AMQP method, the first error is kept and all following reads return zero values
+type amqpReader struct {
+	r   io.Reader
+	n   int64
+	err error
+	buf [8]byte
+}
+
+func (ar *amqpReader) read(p []byte) {
+	if ar.err != nil {
+		return
+	}
+	n, err := io.ReadFull(ar.r, p)
+	ar.n += int64(n)
+	ar.err = err
+}
+
+func (ar *amqpReader) uint8() uint8 {
+	ar.read(ar.buf[:1])
+	if ar.err != nil {
+		return 0
+	}
+	return ar.buf[0]
+}
+
+func (ar *amqpReader) uint16() uint16 {
+	ar.read(ar.buf[:2])
+	if ar.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(ar.buf[:2])
+}
+
+func (ar *amqpReader) uint64() uint64 {
+	ar.read(ar.buf[:8])
+	if ar.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(ar.buf[:8])
+}
+
+// shortString reads string of up to 255 bytes prefixed with its length
+func (ar *amqpReader) shortString() string {
+	n := ar.uint8()
+	if ar.err != nil || n == 0 {
+		return ""
+	}
+	b := make([]byte, n)
+	ar.read(b)
+	return string(b)
+}
+
+func (ar *amqpReader) skip(n int64) {
+	if ar.err != nil {
+		return
+	}
+	copied, err := io.CopyN(ioutil.Discard, ar.r, n)
+	ar.n += copied
+	ar.err = err
+}
+
+// NetAMQPRequest keeps state of single AMQP connection, messages are tracked per channel and direction
+type NetAMQPRequest struct {
+	isInbound bool
+	logger    *log.Logger
+
+	mu         sync.Mutex
+	remoteAddr string
+	// published are messages client sends, their content follows publish method
+	published map[uint16]*amqpMessage
+	// received are messages broker sends, their content follows deliver or get-ok method
+	received map[uint16]*amqpMessage
+	// gets wait for get-ok or get-empty reply
+	gets map[uint16]*amqpMessage
+}
+
+// NewNetAMQPRequest returns state of AMQP connection accepted now
+func NewNetAMQPRequest(logger *log.Logger, isInbound bool) *NetAMQPRequest {
+	return &NetAMQPRequest{
+		isInbound: isInbound,
+		logger:    logger,
+		published: make(map[uint16]*amqpMessage),
+		received:  make(map[uint16]*amqpMessage),
+		gets:      make(map[uint16]*amqpMessage),
+	}
+}
+
+// StartRequest does nothing, messages are started when their methods are copied
+func (nr *NetAMQPRequest) StartRequest() {}
+
+// StopRequest finishes messages whose content isn't copied completely and gets without reply
+func (nr *NetAMQPRequest) StopRequest() {
+	nr.mu.Lock()
+	var messages []*amqpMessage
+	for _, m := range nr.published {
+		messages = append(messages, m)
+	}
+	for _, m := range nr.received {
+		messages = append(messages, m)
+	}
+	gets := nr.gets
+	nr.published = make(map[uint16]*amqpMessage)
+	nr.received = make(map[uint16]*amqpMessage)
+	nr.gets = make(map[uint16]*amqpMessage)
+	nr.mu.Unlock()
+	for _, m := range messages {
+		nr.finish(m, false, 0)
+	}
+	for _, m := range gets {
+		nr.finish(m, true, 0)
+	}
+}
+
+// CleanUp does nothing, messages are finished when connection is closed
+func (nr *NetAMQPRequest) CleanUp() {}
+
+func (nr *NetAMQPRequest) setRemoteAddr(remoteAddr string) {
+	nr.mu.Lock()
+	nr.remoteAddr = remoteAddr
+	nr.mu.Unlock()
+}
+
+func (nr *NetAMQPRequest) getRemoteAddr() string {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	return nr.remoteAddr
+}
+
+// messages returns messages whose content is sent in direction
+func (nr *NetAMQPRequest) messages(fromClient bool) map[uint16]*amqpMessage {
+	if fromClient {
+		return nr.published
+	}
+	return nr.received
+}
+
+// handleMethod starts message of basic.publish, basic.deliver and basic.get methods,
+// other methods are skipped
+func (nr *NetAMQPRequest) handleMethod(ar *amqpReader, channel uint16, fromClient bool) {
+	class, method := ar.uint16(), ar.uint16()
+	if ar.err != nil {
+		return
+	}
+	switch {
+	case fromClient && class == amqpClassBasic && method == amqpBasicPublish:
+		// reserved
+		ar.uint16()
+		m := &amqpMessage{operation: "publish", channel: channel, startTime: time.Now()}
+		m.exchange = ar.shortString()
+		m.routingKey = ar.shortString()
+		if ar.err == nil {
+			nr.startContent(m, fromClient)
+		}
+	case fromClient && class == amqpClassBasic && method == amqpBasicGet:
+		// reserved
+		ar.uint16()
+		m := &amqpMessage{operation: "get", channel: channel, startTime: time.Now()}
+		m.queue = ar.shortString()
+		if ar.err == nil {
+			nr.mu.Lock()
+			nr.gets[channel] = m
+			nr.mu.Unlock()
+		}
+	case !fromClient && class == amqpClassBasic && method == amqpBasicDeliver:
+		m := &amqpMessage{operation: "deliver", channel: channel, startTime: time.Now()}
+		m.consumerTag = ar.shortString()
+		// delivery tag
+		ar.skip(8)
+		m.redelivered = ar.uint8()&1 != 0
+		m.exchange = ar.shortString()
+		m.routingKey = ar.shortString()
+		if ar.err == nil {
+			nr.startContent(m, fromClient)
+		}
+	case !fromClient && class == amqpClassBasic && method == amqpBasicGetOk:
+		m := nr.popGet(channel)
+		// delivery tag
+		ar.skip(8)
+		m.redelivered = ar.uint8()&1 != 0
+		m.exchange = ar.shortString()
+		m.routingKey = ar.shortString()
+		nr.startContent(m, fromClient)
+	case !fromClient && class == amqpClassBasic && method == amqpBasicGetEmpty:
+		m := nr.popGet(channel)
+		m.empty = true
+		nr.finish(m, false, 0)
+	case !fromClient && class == amqpClassChannel && method == amqpChannelClose:
+		// broker closes channel on error, e.g. get from missing queue
+		nr.mu.Lock()
+		m, ok := nr.gets[channel]
+		delete(nr.gets, channel)
+		nr.mu.Unlock()
+		if ok {
+			nr.finish(m, false, ar.uint16())
+		}
+	}
+}
+
+// popGet returns get waiting for reply on channel and forgets it, reply without get starts new one
+func (nr *NetAMQPRequest) popGet(channel uint16) *amqpMessage {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	m, ok := nr.gets[channel]
+	if !ok {
+		return &amqpMessage{operation: "get", channel: channel, startTime: time.Now()}
+	}
+	delete(nr.gets, channel)
+	return m
+}
+
+// startContent tracks message whose content follows, message of channel which didn't get
+// its whole content is finished as is
+func (nr *NetAMQPRequest) startContent(m *amqpMessage, fromClient bool) {
+	nr.mu.Lock()
+	messages := nr.messages(fromClient)
+	previous, ok := messages[m.channel]
+	messages[m.channel] = m
+	nr.mu.Unlock()
+	if ok {
+		nr.finish(previous, false, 0)
+	}
+}
+
+// contentHeader sets body size of message, message without body is finished right away
+func (nr *NetAMQPRequest) contentHeader(channel uint16, bodySize int64, fromClient bool) {
+	nr.mu.Lock()
+	messages := nr.messages(fromClient)
+	m, ok := messages[channel]
+	if !ok {
+		nr.mu.Unlock()
+		return
+	}
+	m.bodySize, m.headerSeen = bodySize, true
+	done := m.copied >= m.bodySize
+	if done {
+		delete(messages, channel)
+	}
+	nr.mu.Unlock()
+	if done {
+		nr.finish(m, false, 0)
+	}
+}
+
+// contentBody counts body bytes of message, message is finished when the whole body is copied
+func (nr *NetAMQPRequest) contentBody(channel uint16, size int64, fromClient bool) {
+	nr.mu.Lock()
+	messages := nr.messages(fromClient)
+	m, ok := messages[channel]
+	if !ok {
+		nr.mu.Unlock()
+		return
+	}
+	m.copied += size
+	done := m.headerSeen && m.copied >= m.bodySize
+	if done {
+		delete(messages, channel)
+	}
+	nr.mu.Unlock()
+	if done {
+		nr.finish(m, false, 0)
+	}
+}
+
+// finish reports message span, timeout is set for get without reply and reply code for get failed with channel close
+func (nr *NetAMQPRequest) finish(m *amqpMessage, timeout bool, replyCode uint16) {
+	kind := "consumer"
+	operation := "consume"
+	if m.operation == "publish" {
+		kind = "producer"
+		operation = "publish"
+	}
+	span := opentracing.StartSpan("amqp."+m.operation, opentracing.StartTime(m.startTime))
+	if nr.isInbound {
+		kind = "server"
+	}
+	span.SetTag("span.kind", kind)
+	span.SetTag("remote_addr", nr.getRemoteAddr())
+	span.SetTag("messaging.system", "rabbitmq")
+	span.SetTag("messaging.operation", operation)
+	span.SetTag("messaging.rabbitmq.channel", m.channel)
+	// default exchange has empty name
+	if m.exchange != "" {
+		setStringTag(span, "messaging.destination", m.exchange)
+	}
+	if m.routingKey != "" {
+		setStringTag(span, "messaging.rabbitmq.routing_key", m.routingKey)
+	}
+	if m.queue != "" {
+		setStringTag(span, "messaging.rabbitmq.queue", m.queue)
+	}
+	if m.consumerTag != "" {
+		setStringTag(span, "messaging.rabbitmq.consumer_tag", m.consumerTag)
+	}
+	if m.redelivered {
+		span.SetTag("messaging.rabbitmq.redelivered", true)
+	}
+	if m.headerSeen {
+		span.SetTag("messaging.message_payload_size_bytes", m.bodySize)
+	}
+	if m.empty {
+		span.SetTag("messaging.rabbitmq.empty", true)
+	}
+	if timeout {
+		span.SetTag("error", true)
+		span.SetTag("timeout", true)
+	}
+	if replyCode != 0 {
+		span.SetTag("error", true)
+		span.SetTag("messaging.rabbitmq.reply_code", replyCode)
+	}
+	span.Finish()
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func amqpFrame(frameType byte, channel uint16, payload []byte) []byte {
+	frame := []byte{frameType, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(frame[1:3], channel)
+	binary.BigEndian.PutUint32(frame[3:7], uint32(len(payload)))
+	frame = append(frame, payload...)
+	return append(frame, amqpFrameEnd)
+}
+
+func amqpMethod(class uint16, method uint16, args ...interface{}) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, class)
+	binary.Write(&b, binary.BigEndian, method)
+	for _, arg := range args {
+		if s, ok := arg.(string); ok {
+			b.WriteByte(byte(len(s)))
+			b.WriteString(s)
+			continue
+		}
+		binary.Write(&b, binary.BigEndian, arg)
+	}
+	return amqpFrame(amqpFrameMethod, 0, b.Bytes())
+}
+
+func onChannel(frame []byte, channel uint16) []byte {
+	binary.BigEndian.PutUint16(frame[1:3], channel)
+	return frame
+}
+
+func amqpContent(channel uint16, body string) []byte {
+	header := make([]byte, 14)
+	binary.BigEndian.PutUint16(header, amqpClassBasic)
+	binary.BigEndian.PutUint64(header[4:], uint64(len(body)))
+	frames := amqpFrame(amqpFrameHeader, channel, header)
+	// body is split into two frames
+	frames = append(frames, amqpFrame(amqpFrameBody, channel, []byte(body[:1]))...)
+	return append(frames, amqpFrame(amqpFrameBody, channel, []byte(body[1:]))...)
+}
+
+func TestAMQPSpans(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewAMQPHandler(logger)
+	nr := NewNetAMQPRequest(logger, false)
+
+	var client bytes.Buffer
+	client.Write(amqpProtocolHeader)
+	// publish frames of two channels are interleaved
+	client.Write(onChannel(amqpMethod(amqpClassBasic, amqpBasicPublish, uint16(0), "orders", "order.created", uint8(0)), 1))
+	client.Write(onChannel(amqpMethod(amqpClassBasic, amqpBasicPublish, uint16(0), "", "tasks", uint8(0)), 2))
+	client.Write(amqpFrame(amqpFrameHeartbeat, 0, nil))
+	client.Write(amqpContent(2, "task"))
+	client.Write(amqpContent(1, "order"))
+	client.Write(onChannel(amqpMethod(amqpClassBasic, amqpBasicGet, uint16(0), "events", uint8(0)), 3))
+	var forwarded bytes.Buffer
+	w := bufio.NewWriter(&forwarded)
+	if err := h.copyRequests(bufio.NewReader(bytes.NewReader(client.Bytes())), w, nr); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	w.Flush()
+	if !bytes.Equal(forwarded.Bytes(), client.Bytes()) {
+		t.Fatal("client frames aren't copied as is")
+	}
+
+	var broker bytes.Buffer
+	broker.Write(onChannel(amqpMethod(amqpClassBasic, amqpBasicDeliver, "ctag", uint64(7), uint8(1), "orders", "order.paid"), 4))
+	broker.Write(amqpContent(4, "paid"))
+	broker.Write(onChannel(amqpMethod(amqpClassBasic, amqpBasicGetOk, uint64(8), uint8(0), "events", "event", uint32(0)), 3))
+	broker.Write(amqpContent(3, "event"))
+	forwarded.Reset()
+	w.Reset(&forwarded)
+	if err := h.copyFrames(bufio.NewReader(bytes.NewReader(broker.Bytes())), w, nr, false); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	w.Flush()
+	if !bytes.Equal(forwarded.Bytes(), broker.Bytes()) {
+		t.Fatal("broker frames aren't copied as is")
+	}
+	nr.StopRequest()
+
+	spans := tracer.FinishedSpans()
+	expected := []struct {
+		operation  string
+		channel    uint16
+		exchange   interface{}
+		routingKey string
+		size       int64
+	}{
+		{"amqp.publish", 2, nil, "tasks", 4},
+		{"amqp.publish", 1, "orders", "order.created", 5},
+		{"amqp.deliver", 4, "orders", "order.paid", 4},
+		{"amqp.get", 3, "events", "event", 5},
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %d", len(expected), len(spans))
+	}
+	for i, e := range expected {
+		span := spans[i]
+		if span.OperationName != e.operation {
+			t.Fatalf("span %d: expected operation %s, got %s", i, e.operation, span.OperationName)
+		}
+		tags := span.Tags()
+		if tags["messaging.system"] != "rabbitmq" || tags["messaging.rabbitmq.channel"] != e.channel ||
+			tags["messaging.destination"] != e.exchange || tags["messaging.rabbitmq.routing_key"] != e.routingKey ||
+			tags["messaging.message_payload_size_bytes"] != e.size || tags["error"] != nil {
+			t.Fatalf("span %d: unexpected tags %v", i, tags)
+		}
+	}
+	if spans[2].Tag("messaging.rabbitmq.redelivered") != true || spans[2].Tag("messaging.operation") != "consume" {
+		t.Fatalf("unexpected deliver tags %v", spans[2].Tags())
+	}
+	if spans[3].Tag("messaging.rabbitmq.queue") != "events" {
+		t.Fatalf("unexpected get tags %v", spans[3].Tags())
+	}
+}
+
+func TestAMQPOtherProtocolPassedThrough(t *testing.T) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewAMQPHandler(logger)
+	data := []byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03")
+	var forwarded bytes.Buffer
+	w := bufio.NewWriter(&forwarded)
+	if err := h.copyRequests(bufio.NewReader(bytes.NewReader(data)), w, NewNetAMQPRequest(logger, false)); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if !bytes.Equal(forwarded.Bytes(), data) {
+		t.Fatalf("expected %q, got %q", data, forwarded.Bytes())
+	}
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// seedBaggage sets baggage items from configured request headers, it's used for inbound spans without parent
+func seedBaggage(httpConfig config.HTTPConfig, span opentracing.Span, header nhttp.Header) {
+	for headerName, key := range httpConfig.BaggageHeadersMap {
+		if val := header.Get(headerName); val != "" {
+			span.SetBaggageItem(key, val)
+		}
+	}
+}
+
+// tagBaggage sets configured baggage items of span as its tags to make them searchable
+func tagBaggage(httpConfig config.HTTPConfig, span opentracing.Span) {
+	for _, key := range httpConfig.BaggageTags {
+		if val := span.BaggageItem(key); val != "" {
+			setStringTag(span, key, val)
+		}
+	}
+}
+
+// injectBaggage propagates baggage of inbound request context to outbound request,
+// items already set by application are left as is
+func injectBaggage(tracingContext jaeger.SpanContext, header nhttp.Header) {
+	tracingContext.ForeachBaggageItem(func(key, val string) bool {
+		headerName := jaeger.TraceBaggageHeaderPrefix + key
+		if header.Get(headerName) == "" {
+			header.Set(headerName, val)
+		}
+		return true
+	})
+}
@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/uber/jaeger-client-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+func newTestTracer() opentracing.Tracer {
+	tracer, _ := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewInMemoryReporter())
+	return tracer
+}
+
+func TestBaggageCarriedByChildOf(t *testing.T) {
+	tracer := newTestTracer()
+	parent := tracer.StartSpan("parent")
+	parent.SetBaggageItem("tenant-id", "42")
+	header := nhttp.Header{}
+	if err := tracer.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header)); err != nil {
+		t.Fatal(err)
+	}
+
+	wireContext, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := tracer.StartSpan("child", opentracing.ChildOf(wireContext))
+	if val := span.BaggageItem("tenant-id"); val != "42" {
+		t.Fatalf("expected baggage item 42, got %q", val)
+	}
+}
+
+func TestSeedAndTagBaggage(t *testing.T) {
+	httpConfig := config.HTTPConfig{
+		BaggageHeadersMap: map[string]string{"X-Tenant-Id": "tenant-id"},
+		BaggageTags:       []string{"tenant-id", "absent"},
+	}
+	header := nhttp.Header{}
+	header.Set("X-Tenant-Id", "42")
+	span := mocktracer.New().StartSpan("inbound").(*mocktracer.MockSpan)
+
+	seedBaggage(httpConfig, span, header)
+	tagBaggage(httpConfig, span)
+
+	if val := span.BaggageItem("tenant-id"); val != "42" {
+		t.Fatalf("expected baggage item 42, got %q", val)
+	}
+	tags := span.Tags()
+	if tags["tenant-id"] != "42" {
+		t.Fatalf("expected tag 42, got %v", tags["tenant-id"])
+	}
+	if _, ok := tags["absent"]; ok {
+		t.Fatal("expected no tag for absent baggage item")
+	}
+}
+
+func TestInjectBaggage(t *testing.T) {
+	span := newTestTracer().StartSpan("inbound")
+	span.SetBaggageItem("tenant-id", "42")
+	span.SetBaggageItem("user-id", "7")
+	header := nhttp.Header{}
+	header.Set(jaeger.TraceBaggageHeaderPrefix+"user-id", "8")
+
+	injectBaggage(span.Context().(jaeger.SpanContext), header)
+
+	if val := header.Get(jaeger.TraceBaggageHeaderPrefix + "tenant-id"); val != "42" {
+		t.Fatalf("expected propagated baggage 42, got %q", val)
+	}
+	if val := header.Get(jaeger.TraceBaggageHeaderPrefix + "user-id"); val != "8" {
+		t.Fatalf("expected application baggage to be kept, got %q", val)
+	}
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/breaker"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+	"github.com/Lookyan/netramesh/pkg/outlier"
+)
+
+func breakerSettings(httpConfig config.HTTPConfig) breaker.Settings {
+	return breaker.Settings{
+		Window:       httpConfig.BreakerWindow,
+		MaxFailures:  httpConfig.BreakerMaxFailures,
+		FailureRatio: httpConfig.BreakerFailureRatio,
+		MinRequests:  httpConfig.BreakerMinRequests,
+		OpenTimeout:  httpConfig.BreakerOpenTimeout,
+	}
+}
+
+func outlierSettings(httpConfig config.HTTPConfig) outlier.Settings {
+	return outlier.Settings{
+		ConsecutiveFailures: httpConfig.OutlierFailures,
+		EjectionTime:        httpConfig.OutlierEjectionTime,
+	}
+}
+
+func observeBreakerTransition(from breaker.State, to breaker.State) {
+	if from < 0 {
+		metrics.ObserveCircuitBreakerTransition("", to.String())
+		return
+	}
+	metrics.ObserveCircuitBreakerTransition(from.String(), to.String())
+}
+
+// observeOutlierEjection reports ejection without destination, it may come from client routing header
+func observeOutlierEjection(_ string, ejected bool) {
+	metrics.ObserveOutlierEjection(ejected)
+}
+
+// breakRequest checks circuit breaker of outbound request destination, request to open one isn't forwarded:
+// it's answered with 503. It returns true if request is rejected
+func (h *HTTPHandler) breakRequest(w io.Writer, req *nhttp.Request, netHTTPRequest *NetHTTPRequest, dstAddr string) bool {
+	startTime := time.Now()
+	if h.breakers.Allow(dstAddr, breakerSettings(config.GetHTTPConfig())) {
+		return false
+	}
+	h.logger.Debugf("Circuit breaker of %s is open, rejecting request %s %s%s", dstAddr, req.Method, req.Host, req.URL.Path)
+	h.respondLocally(w, req, netHTTPRequest, nhttp.StatusServiceUnavailable, nil, opentracing.Tag{Key: "circuit_open", Value: true}, startTime)
+	return true
+}
+
+// upstreamDone records result of request to destination for circuit breaker and outlier detection,
+// upstream failures are 5xx responses and connection errors
+func (h *HTTPHandler) upstreamDone(dstAddr string, success bool) {
+	httpConfig := config.GetHTTPConfig()
+	h.breakers.Done(dstAddr, breakerSettings(httpConfig), success)
+	h.outliers.Done(dstAddr, outlierSettings(httpConfig), success)
+}
+
+// setConnDestination remembers destination upstream connection is made to,
+// it's the key of circuit breaker results of this connection
+func (nr *NetHTTPRequest) setConnDestination(conn *net.TCPConn, dstAddr string) {
+	nr.connDestinationsMu.Lock()
+	nr.connDestinations[conn] = dstAddr
+	nr.connDestinationsMu.Unlock()
+}
+
+// connDestination returns destination of upstream connection
+func (nr *NetHTTPRequest) connDestination(conn *net.TCPConn) (string, bool) {
+	nr.connDestinationsMu.Lock()
+	defer nr.connDestinationsMu.Unlock()
+	dstAddr, ok := nr.connDestinations[conn]
+	return dstAddr, ok
+}
+
+// forgetConnDestination forgets destination of closed upstream connection
+func (nr *NetHTTPRequest) forgetConnDestination(conn *net.TCPConn) {
+	nr.connDestinationsMu.Lock()
+	delete(nr.connDestinations, conn)
+	nr.connDestinationsMu.Unlock()
+}
@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+// circuitBreakers returns reported number of circuit breakers in state
+func circuitBreakers(t *testing.T, state string) float64 {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "netra_http_circuit_breakers" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "state" && label.GetValue() == state {
+					return metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestBreakRequest(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	breakerConfig := httpConfig
+	breakerConfig.BreakerMaxFailures = 2
+	breakerConfig.BreakerWindow = time.Minute
+	breakerConfig.BreakerOpenTimeout = 50 * time.Millisecond
+	config.SetHTTPConfig(breakerConfig)
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	netRequest := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+	newRequest := func() *nhttp.Request {
+		req, err := nhttp.ReadRequest(bufio.NewReader(strings.NewReader("GET /orders HTTP/1.1\r\nHost: upstream\r\n\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	closedBefore, openBefore, halfOpenBefore := circuitBreakers(t, "closed"), circuitBreakers(t, "open"), circuitBreakers(t, "half_open")
+
+	var out bytes.Buffer
+	if h.breakRequest(&out, newRequest(), netRequest, "10.0.0.1:80") {
+		t.Fatal("expected request to be forwarded while breaker is closed")
+	}
+	if closed := circuitBreakers(t, "closed"); closed != closedBefore+1 {
+		t.Fatalf("expected new closed breaker to be reported, got %g closed", closed)
+	}
+	h.upstreamDone("10.0.0.1:80", false)
+	h.upstreamDone("10.0.0.1:80", false)
+	if closed, open := circuitBreakers(t, "closed"), circuitBreakers(t, "open"); closed != closedBefore || open != openBefore+1 {
+		t.Fatalf("expected breaker to be reported open, got %g closed, %g open", closed, open)
+	}
+
+	if !h.breakRequest(&out, newRequest(), netRequest, "10.0.0.1:80") {
+		t.Fatal("expected request to be rejected by open breaker")
+	}
+	resp, err := nhttp.ReadResponse(bufio.NewReader(&out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != nhttp.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", resp.StatusCode)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 || spans[0].Tag("circuit_open") != true {
+		t.Fatalf("expected rejected request span tagged with circuit_open, got %v", spans)
+	}
+	if h.breakRequest(&out, newRequest(), netRequest, "10.0.0.2:80") {
+		t.Fatal("expected request to other destination to be forwarded")
+	}
+
+	// successful probe closes breaker
+	time.Sleep(60 * time.Millisecond)
+	if h.breakRequest(&out, newRequest(), netRequest, "10.0.0.1:80") {
+		t.Fatal("expected probe request to be forwarded")
+	}
+	if circuitBreakers(t, "half_open") != halfOpenBefore+1 {
+		t.Fatal("expected breaker to be reported half-open")
+	}
+	h.upstreamDone("10.0.0.1:80", true)
+	if closed, open := circuitBreakers(t, "closed"), circuitBreakers(t, "open"); closed != closedBefore+2 || open != openBefore {
+		t.Fatalf("expected breaker to be reported closed, got %g closed, %g open", closed, open)
+	}
+	if h.breakRequest(&out, newRequest(), netRequest, "10.0.0.1:80") {
+		t.Fatal("expected request to be forwarded by closed breaker")
+	}
+}
@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/capture"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// bodyCapture keeps size-capped copy of body streamed through it,
+// copy can be taken while body is still read by the other side of connection
+type bodyCapture struct {
+	io.ReadCloser
+	limit     int
+	mu        sync.Mutex
+	data      bytes.Buffer
+	truncated bool
+}
+
+func newBodyCapture(rc io.ReadCloser, limit int) *bodyCapture {
+	return &bodyCapture{ReadCloser: rc, limit: limit}
+}
+
+// Read reads bytes from underlying body
+func (bc *bodyCapture) Read(p []byte) (int, error) {
+	n, err := bc.ReadCloser.Read(p)
+	if n > 0 {
+		bc.mu.Lock()
+		rest := bc.limit - bc.data.Len()
+		if n > rest {
+			bc.truncated = true
+		} else {
+			rest = n
+		}
+		if rest > 0 {
+			bc.data.Write(p[:rest])
+		}
+		bc.mu.Unlock()
+	}
+	return n, err
+}
+
+// Captured returns copy of body read so far and whether body exceeded the limit
+func (bc *bodyCapture) Captured() ([]byte, bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return append([]byte(nil), bc.data.Bytes()...), bc.truncated
+}
+
+// requestCapture is bodies of request sampled for capture, body is nil if message has none
+type requestCapture struct {
+	request  *bodyCapture
+	response *bodyCapture
+}
+
+// captureRate returns N of 1 in N capture rate of the longest configured path prefix matching path
+func captureRate(httpConfig config.HTTPConfig, path string) (int, bool) {
+	var rate int
+	matched := -1
+	for prefix, prefixRate := range httpConfig.CaptureRates {
+		if len(prefix) > matched && strings.HasPrefix(path, prefix) {
+			rate = prefixRate
+			matched = len(prefix)
+		}
+	}
+	return rate, matched >= 0
+}
+
+// shouldCapture samples request for body capture, untraced requests are never captured
+func shouldCapture(httpConfig config.HTTPConfig, req *nhttp.Request) bool {
+	if len(httpConfig.CaptureRates) == 0 || !capture.Enabled() || isUntraced(httpConfig, req) {
+		return false
+	}
+	rate, ok := captureRate(httpConfig, req.URL.Path)
+	return ok && rand.Intn(rate) == 0
+}
+
+// startCapture starts capturing request body if request is sampled for capture
+func (nr *NetHTTPRequest) startCapture(req *nhttp.Request) {
+	httpConfig := config.GetHTTPConfig()
+	if !shouldCapture(httpConfig, req) {
+		return
+	}
+	rc := &requestCapture{}
+	if req.Body != nil && req.Body != nhttp.NoBody {
+		rc.request = newBodyCapture(req.Body, httpConfig.CaptureMaxBodyBytes)
+		req.Body = rc.request
+	}
+	nr.capturesMu.Lock()
+	nr.captures[req] = rc
+	nr.capturesMu.Unlock()
+}
+
+// captureResponse starts capturing body of response to request sampled for capture
+func (nr *NetHTTPRequest) captureResponse(req *nhttp.Request, resp *nhttp.Response) {
+	if resp.Body == nil || resp.Body == nhttp.NoBody {
+		return
+	}
+	nr.capturesMu.Lock()
+	defer nr.capturesMu.Unlock()
+	rc, ok := nr.captures[req]
+	if !ok {
+		return
+	}
+	rc.response = newBodyCapture(resp.Body, config.GetHTTPConfig().CaptureMaxBodyBytes)
+	resp.Body = rc.response
+}
+
+// popCapture returns capture of request and forgets it
+func (nr *NetHTTPRequest) popCapture(req *nhttp.Request) (*requestCapture, bool) {
+	nr.capturesMu.Lock()
+	defer nr.capturesMu.Unlock()
+	rc, ok := nr.captures[req]
+	if ok {
+		delete(nr.captures, req)
+	}
+	return rc, ok
+}
+
+// writeCapture passes captured bodies of finished request to capture sink,
+// resp is nil for request without response
+func (nr *NetHTTPRequest) writeCapture(req *nhttp.Request, resp *nhttp.Response) {
+	rc, ok := nr.popCapture(req)
+	if !ok {
+		return
+	}
+	entry := capture.Entry{
+		Time:      time.Now(),
+		RequestID: req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName),
+		Direction: "outbound",
+		Method:    req.Method,
+		Host:      req.Host,
+		Path:      req.URL.Path,
+	}
+	if nr.isInbound {
+		entry.Direction = "inbound"
+	}
+	if rc.request != nil {
+		body, truncated := rc.request.Captured()
+		entry.RequestBody, entry.RequestBodyTruncated = string(body), truncated
+	}
+	if resp != nil {
+		entry.StatusCode = resp.StatusCode
+	}
+	if resp != nil && rc.response != nil {
+		body, truncated := rc.response.Captured()
+		if decoded, err := decodeBody(body, resp.Header.Get("Content-Encoding"), rc.response.limit); err == nil {
+			body = decoded
+		}
+		entry.ResponseBody, entry.ResponseBodyTruncated = string(body), truncated
+	}
+	if !capture.Write(entry) {
+		nr.logger.Debugf("Capture of request %s %s%s is dropped", req.Method, req.Host, req.URL.Path)
+	}
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/capture"
+)
+
+func TestBodiesCaptured(t *testing.T) {
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	captureConfig := httpConfig
+	captureConfig.CaptureRates = map[string]int{"/orders": 1}
+	captureConfig.CaptureMaxBodyBytes = 8
+	captureConfig.UntracedPathPrefixes = []string{"/orders/secret"}
+	config.SetHTTPConfig(captureConfig)
+	capture.Init(nil, 10)
+
+	requests := []string{
+		"POST /orders/secret HTTP/1.1\r\nHost: example.com\r\nContent-Length: 6\r\n\r\nsecret",
+		"POST /users HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nuser",
+		"POST /orders HTTP/1.1\r\nHost: example.com\r\nX-Request-Id: 42\r\nContent-Length: 5\r\n\r\norder",
+	}
+	for _, request := range requests {
+		if _, ok := proxyRequest(t, request,
+			"HTTP/1.1 201 Created\r\nContent-Length: 13\r\n\r\norder created"); !ok {
+			t.Fatal("request isn't proxied")
+		}
+	}
+
+	var entries []capture.Entry
+	for deadline := time.Now().Add(time.Second); len(entries) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		entries = capture.Recent()
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected single captured request, got %#v", entries)
+	}
+	entry := entries[0]
+	if entry.Path != "/orders" || entry.RequestID != "42" || entry.StatusCode != 201 {
+		t.Fatalf("unexpected captured request: %#v", entry)
+	}
+	if entry.RequestBody != "order" || entry.RequestBodyTruncated {
+		t.Fatalf("unexpected captured request body: %#v", entry)
+	}
+	if entry.ResponseBody != "order cr" || !entry.ResponseBodyTruncated {
+		t.Fatalf("unexpected captured response body: %#v", entry)
+	}
+}
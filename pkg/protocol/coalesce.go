@@ -0,0 +1,300 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// coalesceKeyHeaders are request headers response may depend on, only requests with the same ones are coalesced
+var coalesceKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie"}
+
+// coalescedStatuses are statuses cacheable by default, responses of other statuses aren't shared
+var coalescedStatuses = map[int]struct{}{
+	nhttp.StatusOK:                   {},
+	nhttp.StatusNonAuthoritativeInfo: {},
+	nhttp.StatusNoContent:            {},
+	nhttp.StatusMultipleChoices:      {},
+	nhttp.StatusMovedPermanently:     {},
+	nhttp.StatusNotFound:             {},
+	nhttp.StatusMethodNotAllowed:     {},
+	nhttp.StatusGone:                 {},
+	nhttp.StatusRequestURITooLong:    {},
+	nhttp.StatusNotImplemented:       {},
+}
+
+// sharedResponse is buffered response of leading request, header is taken before per-request headers are added
+type sharedResponse struct {
+	statusCode int
+	protoMajor int
+	protoMinor int
+	header     nhttp.Header
+	body       []byte
+	upstream   string
+}
+
+// coalesceFlight is request in flight identical requests wait for
+type coalesceFlight struct {
+	key       string
+	coalescer *coalescer
+	once      sync.Once
+	done      chan struct{}
+	resp      *sharedResponse
+}
+
+// finish passes response to waiting requests, nil response means it isn't shared.
+// Flight is forgotten, so the next identical request leads a new one
+func (f *coalesceFlight) finish(resp *sharedResponse) {
+	f.once.Do(func() {
+		f.coalescer.mu.Lock()
+		if f.coalescer.flights[f.key] == f {
+			delete(f.coalescer.flights, f.key)
+		}
+		f.coalescer.mu.Unlock()
+		f.resp = resp
+		close(f.done)
+	})
+}
+
+// wait returns response of flight, it's nil if response isn't shared
+func (f *coalesceFlight) wait() *sharedResponse {
+	<-f.done
+	return f.resp
+}
+
+// coalescer keeps flights of requests by their keys
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*coalesceFlight
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{flights: make(map[string]*coalesceFlight)}
+}
+
+// join returns flight of key and whether caller leads it, the leader must finish flight
+func (c *coalescer) join(key string) (*coalesceFlight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+	f := &coalesceFlight{key: key, coalescer: c, done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+// coalesceKey returns key identical requests to destination share, only safe requests to configured paths
+// without body, range and cache bypass are coalesced
+func coalesceKey(httpConfig config.HTTPConfig, req *nhttp.Request, destination string) (string, bool) {
+	if req.Method != nhttp.MethodGet || req.ContentLength != 0 || len(req.TransferEncoding) > 0 ||
+		req.Header.Get("Range") != "" {
+		return "", false
+	}
+	if hasCacheDirective(req.Header, "no-cache", "no-store") ||
+		strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache") {
+		return "", false
+	}
+	matched := false
+	for _, prefix := range httpConfig.CoalescePathPrefixes {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return "", false
+	}
+	var key strings.Builder
+	key.WriteString(destination + " " + strings.ToLower(req.Host) + " " + req.URL.RequestURI())
+	for _, name := range coalesceKeyHeaders {
+		key.WriteString("\n" + name + ": " + strings.Join(req.Header[name], ", "))
+	}
+	return key.String(), true
+}
+
+// hasCacheDirective reports whether Cache-Control header has one of directives
+func hasCacheDirective(header nhttp.Header, directives ...string) bool {
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			name := strings.ToLower(strings.TrimSpace(directive))
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				name = strings.TrimSpace(name[:i])
+			}
+			for _, d := range directives {
+				if name == d {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isShareable reports whether response can be given to coalesced requests: it should be cacheable,
+// not personal and vary by key headers only
+func isShareable(resp *nhttp.Response, maxBodyBytes int) bool {
+	if _, ok := coalescedStatuses[resp.StatusCode]; !ok {
+		return false
+	}
+	if len(resp.Header["Set-Cookie"]) > 0 || len(resp.Trailer) > 0 || isEventStream(resp) ||
+		hasCacheDirective(resp.Header, "no-store", "no-cache", "private") ||
+		resp.ContentLength > int64(maxBodyBytes) {
+		return false
+	}
+	for _, value := range resp.Header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			keyed := false
+			for _, keyHeader := range coalesceKeyHeaders {
+				keyed = keyed || name == keyHeader
+			}
+			if !keyed {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// coalescingRequest is leading request of flight and its response being buffered
+type coalescingRequest struct {
+	flight *coalesceFlight
+	resp   *sharedResponse
+	body   *bodyCapture
+}
+
+// leadCoalescing remembers that request leads flight, flight of request on cleaned up connection is finished at once
+func (nr *NetHTTPRequest) leadCoalescing(req *nhttp.Request, flight *coalesceFlight) {
+	nr.coalesceMu.Lock()
+	if nr.coalesceClosed {
+		nr.coalesceMu.Unlock()
+		flight.finish(nil)
+		return
+	}
+	nr.coalescing[req] = &coalescingRequest{flight: flight}
+	nr.coalesceMu.Unlock()
+}
+
+// captureSharedResponse starts buffering response of leading request, flight is finished if response can't be shared
+func (nr *NetHTTPRequest) captureSharedResponse(req *nhttp.Request, resp *nhttp.Response, r *net.TCPConn) {
+	maxBodyBytes := config.GetHTTPConfig().CoalesceMaxBodyBytes
+	nr.coalesceMu.Lock()
+	cr, ok := nr.coalescing[req]
+	if ok && !isShareable(resp, maxBodyBytes) {
+		delete(nr.coalescing, req)
+		nr.coalesceMu.Unlock()
+		cr.flight.finish(nil)
+		return
+	}
+	defer nr.coalesceMu.Unlock()
+	if !ok {
+		return
+	}
+	upstream, ok := nr.connDestination(r)
+	if !ok {
+		upstream = r.RemoteAddr().String()
+	}
+	cr.resp = &sharedResponse{
+		statusCode: resp.StatusCode,
+		protoMajor: resp.ProtoMajor,
+		protoMinor: resp.ProtoMinor,
+		header:     cloneHeader(resp.Header),
+		upstream:   upstream,
+	}
+	cr.body = nil
+	if resp.Body != nil && resp.Body != nhttp.NoBody {
+		cr.body = newBodyCapture(resp.Body, maxBodyBytes)
+		resp.Body = cr.body
+	}
+}
+
+// finishCoalescing shares response of leading request with requests waiting for it if it's complete,
+// they're forwarded as usual otherwise
+func (nr *NetHTTPRequest) finishCoalescing(req *nhttp.Request, complete bool) {
+	nr.coalesceMu.Lock()
+	cr, ok := nr.coalescing[req]
+	delete(nr.coalescing, req)
+	nr.coalesceMu.Unlock()
+	if !ok {
+		return
+	}
+	if !complete || cr.resp == nil {
+		cr.flight.finish(nil)
+		return
+	}
+	if cr.body != nil {
+		body, truncated := cr.body.Captured()
+		if truncated {
+			cr.flight.finish(nil)
+			return
+		}
+		cr.resp.body = body
+	}
+	cr.flight.finish(cr.resp)
+}
+
+// abandonCoalescing finishes flights led by requests left on connection, their response won't come
+func (nr *NetHTTPRequest) abandonCoalescing() {
+	nr.coalesceMu.Lock()
+	nr.coalesceClosed = true
+	coalescing := nr.coalescing
+	nr.coalescing = make(map[*nhttp.Request]*coalescingRequest)
+	nr.coalesceMu.Unlock()
+	for _, cr := range coalescing {
+		cr.flight.finish(nil)
+	}
+}
+
+// respondCoalesced waits for response of identical request and answers request with it,
+// it returns false if response isn't shared and request should be forwarded
+func (h *HTTPHandler) respondCoalesced(
+	w io.Writer,
+	req *nhttp.Request,
+	netHTTPRequest *NetHTTPRequest,
+	flight *coalesceFlight) bool {
+	startTime := time.Now()
+	shared := flight.wait()
+	if shared == nil {
+		return false
+	}
+	// body is dropped to read the next request from connection
+	io.Copy(ioutil.Discard, req.Body)
+	req.Body.Close()
+
+	httpConfig := config.GetHTTPConfig()
+	header := cloneHeader(shared.header)
+	applyHeaderRules(httpConfig.ResponseHeaderRules, req.URL.Path, header)
+	if httpConfig.ViaEnabled {
+		addVia(header, shared.protoMajor, shared.protoMinor, httpConfig.ViaPseudonym)
+	}
+	setResponseHeaders(httpConfig, header, req.Header.Get(httpConfig.RequestIdHeaderName), shared.upstream)
+	resp := &nhttp.Response{
+		StatusCode:    shared.statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(shared.body)),
+		Body:          nhttp.NoBody,
+		Close:         !isKeepAlive(req),
+		Request:       req,
+	}
+	if len(shared.body) > 0 {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(shared.body))
+	}
+	h.writeLocalResponse(w, req, netHTTPRequest, resp, opentracing.Tag{Key: "coalesced", Value: true}, startTime)
+	return true
+}
@@ -0,0 +1,198 @@
+package protocol
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	httpConfig := config.HTTPConfig{CoalescePathPrefixes: []string{"/catalog"}}
+	request := func(method string, uri string, header nhttp.Header) *nhttp.Request {
+		u, err := url.ParseRequestURI(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &nhttp.Request{Method: method, URL: u, Host: "shop", Header: header}
+	}
+	key, ok := coalesceKey(httpConfig, request(nhttp.MethodGet, "/catalog?page=1", nhttp.Header{}), "10.0.0.1:80")
+	if !ok {
+		t.Fatal("expected GET to be coalesced")
+	}
+	if other, _ := coalesceKey(httpConfig, request(nhttp.MethodGet, "/catalog?page=1", nhttp.Header{}), "10.0.0.1:80"); other != key {
+		t.Fatal("expected identical requests to have the same key")
+	}
+	for _, c := range []struct {
+		name        string
+		req         *nhttp.Request
+		destination string
+	}{
+		{"other query", request(nhttp.MethodGet, "/catalog?page=2", nhttp.Header{}), "10.0.0.1:80"},
+		{"other destination", request(nhttp.MethodGet, "/catalog?page=1", nhttp.Header{}), "10.0.0.2:80"},
+		{"other user", request(nhttp.MethodGet, "/catalog?page=1", nhttp.Header{"Authorization": {"Bearer a"}}), "10.0.0.1:80"},
+	} {
+		if other, ok := coalesceKey(httpConfig, c.req, c.destination); !ok || other == key {
+			t.Fatalf("%s: expected other key", c.name)
+		}
+	}
+	for _, c := range []struct {
+		name string
+		req  *nhttp.Request
+	}{
+		{"not configured path", request(nhttp.MethodGet, "/cart", nhttp.Header{})},
+		{"unsafe method", request(nhttp.MethodPost, "/catalog", nhttp.Header{})},
+		{"range", request(nhttp.MethodGet, "/catalog", nhttp.Header{"Range": {"bytes=0-10"}})},
+		{"no-cache", request(nhttp.MethodGet, "/catalog", nhttp.Header{"Cache-Control": {"max-age=0, no-cache"}})},
+		{"pragma", request(nhttp.MethodGet, "/catalog", nhttp.Header{"Pragma": {"no-cache"}})},
+	} {
+		if _, ok := coalesceKey(httpConfig, c.req, "10.0.0.1:80"); ok {
+			t.Fatalf("%s: unexpected coalescing", c.name)
+		}
+	}
+}
+
+func TestIsShareable(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		resp     *nhttp.Response
+		expected bool
+	}{
+		{"ok", &nhttp.Response{StatusCode: 200, Header: nhttp.Header{"Vary": {"accept-encoding"}}, ContentLength: 10}, true},
+		{"not found", &nhttp.Response{StatusCode: 404, Header: nhttp.Header{}, ContentLength: -1}, true},
+		{"server error", &nhttp.Response{StatusCode: 503, Header: nhttp.Header{}}, false},
+		{"cookie", &nhttp.Response{StatusCode: 200, Header: nhttp.Header{"Set-Cookie": {"a=b"}}}, false},
+		{"private", &nhttp.Response{StatusCode: 200, Header: nhttp.Header{"Cache-Control": {"private, max-age=60"}}}, false},
+		{"vary", &nhttp.Response{StatusCode: 200, Header: nhttp.Header{"Vary": {"Accept, X-Tenant"}}}, false},
+		{"vary all", &nhttp.Response{StatusCode: 200, Header: nhttp.Header{"Vary": {"*"}}}, false},
+		{"too big", &nhttp.Response{StatusCode: 200, Header: nhttp.Header{}, ContentLength: 101}, false},
+	} {
+		if actual := isShareable(c.resp, 100); actual != c.expected {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestCoalescedRequestsShareResponse(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	coalesceConfig := httpConfig
+	coalesceConfig.CoalescePathPrefixes = []string{"/catalog"}
+	config.SetHTTPConfig(coalesceConfig)
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+
+	// every client has its own upstream connection
+	proxy := func() (client *bufio.ReadWriter, upstream *bufio.ReadWriter, closeAll func()) {
+		clientConn, proxyIn := tcpConnPair(t)
+		proxyOut, upstreamConn := tcpConnPair(t)
+		netRequest := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+		go func() {
+			handler.HandleRequest(proxyIn, proxyOut, nil, nil, netRequest, false, "127.0.0.1:80")
+			proxyOut.Close()
+		}()
+		go func() {
+			handler.HandleResponse(proxyOut, proxyIn, netRequest, false, false)
+			proxyIn.Close()
+		}()
+		clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		upstreamConn.SetDeadline(time.Now().Add(5 * time.Second))
+		return bufio.NewReadWriter(bufio.NewReader(clientConn), bufio.NewWriter(clientConn)),
+			bufio.NewReadWriter(bufio.NewReader(upstreamConn), bufio.NewWriter(upstreamConn)),
+			func() {
+				clientConn.Close()
+				upstreamConn.Close()
+			}
+	}
+	leader, leaderUpstream, closeLeader := proxy()
+	defer closeLeader()
+	follower, followerUpstream, closeFollower := proxy()
+	defer closeFollower()
+
+	send := func(client *bufio.ReadWriter) {
+		client.WriteString("GET /catalog?page=1 HTTP/1.1\r\nHost: shop\r\n\r\n")
+		client.Flush()
+	}
+	send(leader)
+	if _, err := nhttp.ReadRequest(leaderUpstream.Reader); err != nil {
+		t.Fatal(err)
+	}
+	send(follower)
+	// follower waits for leader response instead of being forwarded
+	time.Sleep(100 * time.Millisecond)
+	leaderUpstream.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbook\r\n0\r\n\r\n")
+	leaderUpstream.Flush()
+
+	for i, client := range []*bufio.ReadWriter{leader, follower} {
+		resp, err := nhttp.ReadResponse(client.Reader, &nhttp.Request{Method: nhttp.MethodGet})
+		if err != nil {
+			t.Fatalf("response %d: %s", i, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != nhttp.StatusOK || string(body) != "book" {
+			t.Fatalf("response %d: unexpected response %d %q", i, resp.StatusCode, body)
+		}
+	}
+
+	// the next request isn't coalesced since nothing is in flight
+	send(follower)
+	if _, err := nhttp.ReadRequest(followerUpstream.Reader); err != nil {
+		t.Fatal(err)
+	}
+	followerUpstream.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	followerUpstream.Flush()
+	if _, err := nhttp.ReadResponse(follower.Reader, &nhttp.Request{Method: nhttp.MethodGet}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tracer.FinishedSpans()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	coalesced := 0
+	for _, span := range tracer.FinishedSpans() {
+		if span.Tag("coalesced") == true {
+			coalesced++
+		}
+	}
+	if len(tracer.FinishedSpans()) != 3 || coalesced != 1 {
+		t.Fatalf("expected 3 spans with 1 coalesced one, got %d spans with %d coalesced", len(tracer.FinishedSpans()), coalesced)
+	}
+}
+
+func TestCoalescedRequestForwardedIfResponseIsNotShared(t *testing.T) {
+	c := newCoalescer()
+	flight, leader := c.join("key")
+	if !leader {
+		t.Fatal("expected the first request to lead")
+	}
+	if _, leader := c.join("key"); leader {
+		t.Fatal("expected identical request to follow")
+	}
+	done := make(chan *sharedResponse)
+	go func() { done <- flight.wait() }()
+	flight.finish(nil)
+	if resp := <-done; resp != nil {
+		t.Fatalf("unexpected shared response %v", resp)
+	}
+	// finished flight is forgotten
+	if _, leader := c.join("key"); !leader {
+		t.Fatal("expected request after finished flight to lead")
+	}
+}
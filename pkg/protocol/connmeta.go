@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// tagConnectionMetadata sets connection metadata tags from headers of TLS terminating proxy,
+// scheme is taken from the first hop and normalized to lower case since proxies disagree on it
+func tagConnectionMetadata(httpConfig config.HTTPConfig, span opentracing.Span, header nhttp.Header) {
+	for headerName, tagName := range httpConfig.ConnectionHeadersMap {
+		val := strings.TrimSpace(header.Get(headerName))
+		if val == "" {
+			continue
+		}
+		if tagName == "http.scheme" {
+			val = strings.ToLower(strings.TrimSpace(strings.Split(val, ",")[0]))
+		}
+		setStringTag(span, tagName, maskSensitive(httpConfig, headerName, val))
+	}
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// countingWriter passes writes through to the underlying writer and accumulates written bytes in n
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func newCountingWriter(w io.Writer, n *int64) *countingWriter {
+	return &countingWriter{w: w, n: n}
+}
+
+// Write writes bytes into underlying writer
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+// countingReadCloser counts bytes read from the underlying body
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func newCountingReadCloser(rc io.ReadCloser) *countingReadCloser {
+	return &countingReadCloser{ReadCloser: rc}
+}
+
+// Read reads bytes from underlying body
+func (rc *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := rc.ReadCloser.Read(p)
+	atomic.AddInt64(&rc.n, int64(n))
+	return n, err
+}
+
+// Count returns number of bytes read so far
+func (rc *countingReadCloser) Count() int64 {
+	return atomic.LoadInt64(&rc.n)
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// setReadDeadline sets conn read deadline in timeout from now, zero timeout removes deadline
+func setReadDeadline(conn *net.TCPConn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// setWriteDeadline sets conn write deadline in timeout from now, zero timeout removes deadline
+func setWriteDeadline(conn *net.TCPConn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	} else {
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"bytes"
+	"net"
 	"strings"
 
 	"github.com/Lookyan/netramesh/internal/config"
@@ -9,15 +11,97 @@ import (
 type Proto string
 
 const (
-	HTTPProto Proto = "http"
-	TCPProto  Proto = "tcp"
+	HTTPProto        Proto = "http"
+	GRPCProto        Proto = "grpc"
+	PassthroughProto Proto = "passthrough"
+	MySQLProto       Proto = "mysql"
+	RedisProto       Proto = "redis"
+	KafkaProto       Proto = "kafka"
+	AMQPProto        Proto = "amqp"
+	MongoDBProto     Proto = "mongodb"
+	ThriftProto      Proto = "thrift"
+	TLSProto         Proto = "tls"
+	TCPProto         Proto = "tcp"
 )
 
+// sniffPrefixLength is max number of first connection bytes protocols are recognized by
+const sniffPrefixLength = 16
+
+// Determine returns protocol of registered ones configured for port of addr, it's TCP if there is no such one
 func Determine(addr string) Proto {
-	httpPorts := config.GetNetraConfig().HTTPProtoPorts
+	netraConfig := config.GetNetraConfig()
 	port := strings.Split(addr, ":")[1]
-	if _, ok := httpPorts[port]; ok {
-		return HTTPProto
+	for _, p := range registry.protocols {
+		if p.factory.Ports == nil {
+			continue
+		}
+		if _, ok := p.factory.Ports(netraConfig)[port]; ok {
+			return p.proto
+		}
+	}
+	return TCPProto
+}
+
+// DetectProtocol returns protocol of connection configured for port of original destination,
+// protocol of connection to other ports is recognized by first bytes client sends if sniffing is enabled.
+// Connection is proxied as TCP if its prefix is still ambiguous by sniff timeout
+func DetectProtocol(conn *net.TCPConn, originalDst string) Proto {
+	if proto := Determine(originalDst); proto != TCPProto {
+		return proto
+	}
+	timeout := config.GetNetraConfig().ProtocolSniffTimeout
+	if timeout <= 0 {
+		return TCPProto
+	}
+	prefix, err := peekConn(conn, sniffPrefixLength, timeout, sniffIncomplete)
+	if err != nil || len(prefix) == 0 {
+		return TCPProto
+	}
+	for _, p := range registry.protocols {
+		if p.factory.Sniff != nil && p.factory.Sniff(prefix) {
+			return p.proto
+		}
 	}
 	return TCPProto
 }
+
+// sniffIncomplete reports whether prefix is too short to tell if it starts HTTP/1.x request,
+// HTTP/2 preface or TLS ClientHello, i.e. it's a proper prefix of one of them
+func sniffIncomplete(prefix []byte) bool {
+	for _, method := range httpMethodPrefixes {
+		if len(prefix) < len(method) && bytes.HasPrefix([]byte(method), prefix) {
+			return true
+		}
+	}
+	if len(prefix) < len("PRI * HTTP/2.0") && bytes.HasPrefix(http2ClientPreface, prefix) {
+		return true
+	}
+	// handshake type follows record header
+	if len(prefix) == 0 || len(prefix) > tlsRecordHeaderLength || prefix[0] != tlsRecordHandshake {
+		return false
+	}
+	return (len(prefix) < 2 || prefix[1] == 0x03) && (len(prefix) < 3 || prefix[2] <= 0x04)
+}
+
+// httpMethodPrefixes start HTTP/1.x requests
+var httpMethodPrefixes = []string{"GET ", "HEAD ", "POST ", "PUT ", "PATCH ", "DELETE ", "OPTIONS ", "TRACE ", "CONNECT "}
+
+// isHTTPPrefix reports whether prefix starts HTTP/1.x request, partial method isn't enough
+func isHTTPPrefix(prefix []byte) bool {
+	for _, method := range httpMethodPrefixes {
+		if bytes.HasPrefix(prefix, []byte(method)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHTTP2Prefix reports whether prefix starts HTTP/2 client connection preface
+func isHTTP2Prefix(prefix []byte) bool {
+	n := len(prefix)
+	if n > len(http2ClientPreface) {
+		n = len(http2ClientPreface)
+	}
+	// preface is recognized by its request line at least
+	return n >= len("PRI * HTTP/2.0") && bytes.Equal(prefix[:n], http2ClientPreface[:n])
+}
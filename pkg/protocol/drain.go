@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainPollInterval is how often draining checks whether request loops are finished
+const drainPollInterval = 50 * time.Millisecond
+
+var (
+	errShuttingDown = errors.New("netra is shutting down")
+	errIdleTimeout  = errors.New("connection is idle for too long")
+)
+
+// drainState tracks request loops to be stopped on shutdown
+var drainState = struct {
+	mu       sync.Mutex
+	draining bool
+	deadline time.Time
+	active   int
+	// connections waiting for the next request
+	idle map[*net.TCPConn]struct{}
+}{
+	idle: make(map[*net.TCPConn]struct{}),
+}
+
+// Drain makes request loops stop between requests and waits for them to finish up to timeout,
+// it returns false if some of them are still running after timeout
+func Drain(timeout time.Duration) bool {
+	drainState.mu.Lock()
+	drainState.draining = true
+	drainState.deadline = time.Now().Add(timeout)
+	deadline := drainState.deadline
+	// idle connections don't have request to finish, their reads are interrupted
+	for conn := range drainState.idle {
+		conn.SetReadDeadline(time.Now())
+	}
+	drainState.mu.Unlock()
+
+	for {
+		drainState.mu.Lock()
+		active := drainState.active
+		drainState.mu.Unlock()
+		if active == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// startLoop registers running request loop
+func startLoop() {
+	drainState.mu.Lock()
+	drainState.active++
+	drainState.mu.Unlock()
+}
+
+// stopLoop unregisters finished request loop
+func stopLoop() {
+	drainState.mu.Lock()
+	drainState.active--
+	drainState.mu.Unlock()
+}
+
+// waitRequest waits for the first byte of the next request from r until deadline returned by idleDeadline,
+// zero deadline means no limit. It returns errShuttingDown if netra is shutting down and connection shouldn't
+// serve requests anymore and errIdleTimeout if connection is idle for too long, read errors are left to caller
+func waitRequest(r *net.TCPConn, reader *bufio.Reader, idleDeadline func() time.Time) error {
+	for {
+		// deadline is set before connection is registered, so it doesn't override the one set by Drain
+		deadline := idleDeadline()
+		r.SetReadDeadline(deadline)
+
+		drainState.mu.Lock()
+		if drainState.draining {
+			drainState.mu.Unlock()
+			return errShuttingDown
+		}
+		drainState.idle[r] = struct{}{}
+		drainState.mu.Unlock()
+
+		_, err := reader.Peek(1)
+
+		drainState.mu.Lock()
+		delete(drainState.idle, r)
+		interrupted := drainState.draining
+		drainState.mu.Unlock()
+		// request started before draining is served, read deadline is reset by caller
+		if err == nil || !interrupted && !isTimeout(err) {
+			return nil
+		}
+		if interrupted {
+			return errShuttingDown
+		}
+		// deadline is moved while connection isn't idle
+		if !deadline.IsZero() && !time.Now().Before(idleDeadline()) {
+			return errIdleTimeout
+		}
+	}
+}
+
+// waitResponses waits for responses to requests already sent upstream until drain deadline
+func (nr *NetHTTPRequest) waitResponses() {
+	drainState.mu.Lock()
+	deadline := drainState.deadline
+	drainState.mu.Unlock()
+	for nr.httpRequests.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// waitHalfClosed waits for responses to requests sent before client half-closed connection,
+// the rest of connection is closed as soon as request loop returns
+func (nr *NetHTTPRequest) waitHalfClosed(readTimeout time.Duration) {
+	nr.waitPendingResponses(readTimeout)
+}
+
+// waitPendingResponses waits for response loops to answer pending requests, it returns false if some of them are left.
+// Waiting stops early if response loops are done without answering them (e.g. upstream connection is closed)
+// or timeout passes, zero timeout means no limit
+func (nr *NetHTTPRequest) waitPendingResponses(timeout time.Duration) bool {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for nr.httpRequests.Len() > 0 && (deadline.IsZero() || time.Now().Before(deadline)) {
+		// response loop may not be started yet
+		if atomic.LoadInt32(&nr.responseLoops) == 0 && atomic.LoadInt32(&nr.responseLoopsStarted) == 1 {
+			return false
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return nr.httpRequests.Len() == 0
+}
@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"github.com/opentracing/opentracing-go"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// SpanEnricher sets custom tags of HTTP request span, e.g. tenant parsed from custom header.
+// Enrich is called after built-in tags are set, resp is nil for request without response
+type SpanEnricher interface {
+	Enrich(span opentracing.Span, req *nhttp.Request, resp *nhttp.Response)
+}
+
+// SpanEnricherFunc is function used as SpanEnricher
+type SpanEnricherFunc func(span opentracing.Span, req *nhttp.Request, resp *nhttp.Response)
+
+// Enrich calls f
+func (f SpanEnricherFunc) Enrich(span opentracing.Span, req *nhttp.Request, resp *nhttp.Response) {
+	f(span, req, resp)
+}
+
+// spanEnrichers are called in order of registration, they're registered on startup and only read later
+var spanEnrichers []SpanEnricher
+
+// RegisterSpanEnricher adds enricher called for every traced HTTP request,
+// it should be called before connections are handled
+func RegisterSpanEnricher(enricher SpanEnricher) {
+	spanEnrichers = append(spanEnrichers, enricher)
+}
+
+// enrichSpan calls registered enrichers, enricher panic is logged and the rest of enrichers are still called
+func (nr *NetHTTPRequest) enrichSpan(span opentracing.Span, req *nhttp.Request, resp *nhttp.Response) {
+	for _, enricher := range spanEnrichers {
+		nr.callEnricher(enricher, span, req, resp)
+	}
+}
+
+func (nr *NetHTTPRequest) callEnricher(
+	enricher SpanEnricher,
+	span opentracing.Span,
+	req *nhttp.Request,
+	resp *nhttp.Response) {
+	defer func() {
+		if r := recover(); r != nil {
+			nr.logger.Errorf("Span enricher panicked: %v", r)
+		}
+	}()
+	enricher.Enrich(span, req, resp)
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestSpanEnrichers(t *testing.T) {
+	defer func() { spanEnrichers = nil }()
+	RegisterSpanEnricher(SpanEnricherFunc(func(span opentracing.Span, req *nhttp.Request, resp *nhttp.Response) {
+		span.SetTag("tenant", req.Header.Get("X-Tenant"))
+	}))
+	RegisterSpanEnricher(SpanEnricherFunc(func(span opentracing.Span, req *nhttp.Request, resp *nhttp.Response) {
+		// response is nil for request without response
+		span.SetTag("cache_hit", resp.Header.Get("X-Cache") == "HIT")
+	}))
+	RegisterSpanEnricher(SpanEnricherFunc(func(span opentracing.Span, req *nhttp.Request, resp *nhttp.Response) {
+		span.SetTag("enriched", true)
+	}))
+
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nr := NewNetHTTPRequest(logger, true, cache.New(time.Minute, time.Minute))
+	req := &nhttp.Request{
+		Method: nhttp.MethodGet,
+		URL:    &url.URL{Path: "/orders"},
+		Header: nhttp.Header{"X-Tenant": {"acme"}},
+	}
+	resp := &nhttp.Response{StatusCode: nhttp.StatusOK, Header: nhttp.Header{"X-Cache": {"HIT"}}, Body: nhttp.NoBody}
+
+	span := mocktracer.New().StartSpan("GET").(*mocktracer.MockSpan)
+	nr.fillSpan(span, req, resp)
+	if span.Tag("tenant") != "acme" || span.Tag("cache_hit") != true || span.Tag("enriched") != true {
+		t.Fatalf("unexpected tags %v", span.Tags())
+	}
+
+	// panicking enricher doesn't stop the following ones
+	span = mocktracer.New().StartSpan("GET").(*mocktracer.MockSpan)
+	nr.fillSpan(span, req, nil)
+	if span.Tag("tenant") != "acme" || span.Tag("cache_hit") != nil || span.Tag("enriched") != true {
+		t.Fatalf("unexpected tags %v", span.Tags())
+	}
+}
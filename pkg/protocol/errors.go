@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// Causes of read errors handlers tell apart, errors returned by classifyReadError match one of them with errors.Is
+var (
+	// ErrConnClosed means connection is closed by peer (EOF) or locally
+	ErrConnClosed = errors.New("connection is closed")
+	// ErrReadTimeout means read deadline is exceeded
+	ErrReadTimeout = errors.New("read timeout")
+	// ErrMalformed means bytes read aren't valid message of protocol
+	ErrMalformed = errors.New("malformed message")
+)
+
+// ReadError is error of reading message from connection with its cause
+type ReadError struct {
+	Cause error
+	Err   error
+}
+
+func (e *ReadError) Error() string {
+	return e.Cause.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns original error, so it's still matched by errors.Is and errors.As
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the cause of error
+func (e *ReadError) Is(target error) bool {
+	return target == e.Cause
+}
+
+// classifyReadError wraps error of reading message with its cause, nil error stays nil
+func classifyReadError(err error) error {
+	if err == nil {
+		return nil
+	}
+	cause := ErrMalformed
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed):
+		cause = ErrConnClosed
+	case isTimeout(err):
+		cause = ErrReadTimeout
+	}
+	return &ReadError{Cause: cause, Err: err}
+}
+
+// readErrorCause returns metric label of classified read error
+func readErrorCause(err error) string {
+	switch {
+	case errors.Is(err, ErrConnClosed):
+		return "closed"
+	case errors.Is(err, ErrReadTimeout):
+		return "timeout"
+	}
+	return "malformed"
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+func TestClassifyReadError(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		err   error
+		cause error
+		label string
+	}{
+		{io.EOF, ErrConnClosed, "closed"},
+		{&net.OpError{Op: "read", Net: "tcp", Err: net.ErrClosed}, ErrConnClosed, "closed"},
+		{fmt.Errorf("reading header: %w", timeout), ErrReadTimeout, "timeout"},
+		{nhttp.ErrRequestHeaderTooLarge, ErrMalformed, "malformed"},
+		{io.ErrUnexpectedEOF, ErrMalformed, "malformed"},
+	}
+	for _, tt := range tests {
+		err := classifyReadError(tt.err)
+		if !errors.Is(err, tt.cause) || !errors.Is(err, tt.err) {
+			t.Fatalf("%v: expected cause %v, got %v", tt.err, tt.cause, err)
+		}
+		if label := readErrorCause(err); label != tt.label {
+			t.Fatalf("%v: expected label %s, got %s", tt.err, tt.label, label)
+		}
+	}
+	if classifyReadError(nil) != nil {
+		t.Fatal("expected nil error to stay nil")
+	}
+}
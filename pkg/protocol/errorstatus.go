@@ -0,0 +1,26 @@
+package protocol
+
+import (
+	"strings"
+
+	"github.com/Lookyan/netramesh/internal/config"
+)
+
+// isErrorStatus reports whether response status marks request span as error,
+// statuses of the longest matching path prefix override default ones
+func isErrorStatus(httpConfig config.HTTPConfig, path string, status int) bool {
+	ranges := httpConfig.ErrorStatuses
+	matched := -1
+	for prefix, prefixRanges := range httpConfig.ErrorStatusesByPath {
+		if len(prefix) > matched && strings.HasPrefix(path, prefix) {
+			ranges = prefixRanges
+			matched = len(prefix)
+		}
+	}
+	for _, r := range ranges {
+		if status >= r.Min && status <= r.Max {
+			return true
+		}
+	}
+	return false
+}
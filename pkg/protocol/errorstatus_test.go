@@ -0,0 +1,34 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/Lookyan/netramesh/internal/config"
+)
+
+func TestIsErrorStatus(t *testing.T) {
+	httpConfig := config.HTTPConfig{
+		ErrorStatuses: []config.StatusRange{{Min: 429, Max: 429}, {Min: 500, Max: 599}},
+		ErrorStatusesByPath: map[string][]config.StatusRange{
+			"/search":        {{Min: 404, Max: 404}},
+			"/search/legacy": {},
+		},
+	}
+	for _, c := range []struct {
+		path   string
+		status int
+		error  bool
+	}{
+		{"/orders", 200, false},
+		{"/orders", 404, false},
+		{"/orders", 429, true},
+		{"/orders", 503, true},
+		{"/search", 404, true},
+		{"/search", 503, false},
+		{"/search/legacy", 404, false},
+	} {
+		if isError := isErrorStatus(httpConfig, c.path, c.status); isError != c.error {
+			t.Errorf("%s %d: expected error %v, got %v", c.path, c.status, c.error, isError)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// expectContinueTimeout is how long request body is held waiting for 100 Continue,
+// body is sent anyway after it like net/http client does
+const expectContinueTimeout = 1 * time.Second
+
+// expectsContinue reports whether request body should be sent after 100 Continue response only
+func expectsContinue(req *nhttp.Request) bool {
+	return req.ProtoAtLeast(1, 1) &&
+		req.Body != nil && req.Body != nhttp.NoBody &&
+		httpguts.HeaderValuesContainsToken(req.Header["Expect"], "100-continue")
+}
+
+// expectContinue registers request waiting for interim response,
+// it should be called before request header is written
+func (nr *NetHTTPRequest) expectContinue(req *nhttp.Request) chan bool {
+	ch := make(chan bool, 1)
+	nr.continueMu.Lock()
+	nr.continueReq = req
+	nr.continueCh = ch
+	nr.continueMu.Unlock()
+	return ch
+}
+
+// waitContinue waits for response side decision whether request body should be sent
+func (nr *NetHTTPRequest) waitContinue(ch chan bool) bool {
+	timer := time.NewTimer(expectContinueTimeout)
+	defer timer.Stop()
+	select {
+	case ok := <-ch:
+		return ok
+	case <-timer.C:
+		nr.resolveContinue(nil, true)
+		return true
+	}
+}
+
+// resolveContinue passes interim or final response decision to request waiting for it,
+// nil req resolves any waiting request
+func (nr *NetHTTPRequest) resolveContinue(req *nhttp.Request, ok bool) {
+	nr.continueMu.Lock()
+	defer nr.continueMu.Unlock()
+	if nr.continueCh == nil || (req != nil && nr.continueReq != req) {
+		return
+	}
+	nr.continueCh <- ok
+	nr.continueCh = nil
+	nr.continueReq = nil
+}
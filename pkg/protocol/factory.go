@@ -3,47 +3,42 @@ package protocol
 import (
 	"github.com/patrickmn/go-cache"
 
+	"github.com/Lookyan/netramesh/internal/config"
 	"github.com/Lookyan/netramesh/pkg/log"
 )
 
-var httpHandler *HTTPHandler
-var tcpHandler *TCPHandler
+// netTCPRequest is shared by all TCP connections, it doesn't keep any state
 var netTCPRequest *NetTCPRequest
 
 func InitHandlerRequest(
 	logger *log.Logger,
 	tracingContextMapping *cache.Cache,
 	routingInfoContextMapping *cache.Cache) {
-	httpHandler = NewHTTPHandler(logger, tracingContextMapping, routingInfoContextMapping)
-	tcpHandler = NewTCPHandler(logger)
+	initBufferSizes(config.GetHTTPConfig())
+	initRequestIDFormat(config.GetHTTPConfig().RequestIdFormat)
 	netTCPRequest = NewNetTCPRequest(logger)
+	initHandlers(logger, tracingContextMapping, routingInfoContextMapping)
 }
 
+// GetNetworkHandler returns handler of registered protocol, TCP one is returned for unknown protocol
 func GetNetworkHandler(
 	proto Proto,
 	logger *log.Logger,
 	tracingContextMapping *cache.Cache) NetHandler {
-	switch proto {
-	case HTTPProto:
-		return httpHandler
-	case TCPProto:
-		return tcpHandler
-	default:
-		return tcpHandler
+	if handler, ok := registry.handlers[proto]; ok {
+		return handler
 	}
+	return registry.handlers[TCPProto]
 }
 
+// GetNetRequest returns new connection state of registered protocol, TCP one is returned for unknown protocol
 func GetNetRequest(
 	proto Proto,
 	isInbound bool,
 	logger *log.Logger,
 	tracingContextMapping *cache.Cache) NetRequest {
-	switch proto {
-	case HTTPProto:
-		return NewNetHTTPRequest(logger, isInbound, tracingContextMapping)
-	case TCPProto:
-		return netTCPRequest
-	default:
-		return netTCPRequest
+	if p, ok := lookupProtocol(proto); ok {
+		return p.factory.NewRequest(logger, isInbound, tracingContextMapping)
 	}
+	return netTCPRequest
 }
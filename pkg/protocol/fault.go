@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// routeFaultRule returns fault rule of the longest configured path prefix matching path
+func routeFaultRule(httpConfig config.HTTPConfig, path string) (config.FaultRule, bool) {
+	var rule config.FaultRule
+	matched := -1
+	for prefix, prefixRule := range httpConfig.FaultRules {
+		if len(prefix) > matched && strings.HasPrefix(path, prefix) {
+			rule = prefixRule
+			matched = len(prefix)
+		}
+	}
+	return rule, matched >= 0
+}
+
+// injectFault applies fault rule of request route before request is forwarded:
+// request is either answered with configured status or delayed. It returns true if request is aborted
+func (h *HTTPHandler) injectFault(w io.Writer, req *nhttp.Request, netHTTPRequest *NetHTTPRequest) bool {
+	startTime := time.Now()
+	httpConfig := config.GetHTTPConfig()
+	rule, ok := routeFaultRule(httpConfig, req.URL.Path)
+	if !ok {
+		return false
+	}
+	if rule.AbortPercent > 0 && rand.Float64()*100 < rule.AbortPercent {
+		h.respondLocally(w, req, netHTTPRequest, rule.AbortStatus, nil,
+			opentracing.Tag{Key: "fault.injected", Value: "abort"}, startTime)
+		return true
+	}
+	if rule.Delay > 0 && rand.Float64()*100 < rule.DelayPercent {
+		delay := rule.Delay
+		// injected delay never outlasts request read timeout
+		if timeouts, _ := routeTimeouts(httpConfig, req.URL.Path); timeouts.Read > 0 && delay > timeouts.Read {
+			delay = timeouts.Read
+		}
+		time.Sleep(delay)
+		netHTTPRequest.setInjectedFault(req, "delay")
+	}
+	return false
+}
+
+func (nr *NetHTTPRequest) setInjectedFault(req *nhttp.Request, fault string) {
+	nr.faultsMu.Lock()
+	nr.injectedFaults[req] = fault
+	nr.faultsMu.Unlock()
+}
+
+// popInjectedFault returns type of fault injected into request and forgets it
+func (nr *NetHTTPRequest) popInjectedFault(req *nhttp.Request) (string, bool) {
+	nr.faultsMu.Lock()
+	defer nr.faultsMu.Unlock()
+	fault, ok := nr.injectedFaults[req]
+	if ok {
+		delete(nr.injectedFaults, req)
+	}
+	return fault, ok
+}
@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+const (
+	xForwardedForHeaderName   = "X-Forwarded-For"
+	xForwardedProtoHeaderName = "X-Forwarded-Proto"
+)
+
+// setForwardedHeaders appends client IP to X-Forwarded-For header and sets X-Forwarded-Proto,
+// values set by untrusted client are replaced
+func setForwardedHeaders(httpConfig config.HTTPConfig, header nhttp.Header, remoteAddr net.Addr) {
+	tcpAddr, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	clientIP := tcpAddr.IP.String()
+	if !isTrustedProxy(httpConfig, tcpAddr.IP) {
+		header.Del(xForwardedForHeaderName)
+		header.Del(xForwardedProtoHeaderName)
+	}
+	// several header lines are combined into single comma separated list
+	if prior, ok := header[xForwardedForHeaderName]; ok && len(prior) > 0 {
+		clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	}
+	header.Set(xForwardedForHeaderName, clientIP)
+	if header.Get(xForwardedProtoHeaderName) == "" {
+		// netra proxies plain HTTP only
+		header.Set(xForwardedProtoHeaderName, "http")
+	}
+}
+
+// isTrustedProxy reports whether forwarded headers set by ip are kept, everyone is trusted without configured CIDRs
+func isTrustedProxy(httpConfig config.HTTPConfig, ip net.IP) bool {
+	if len(httpConfig.XForwardedTrustedCIDRs) == 0 {
+		return true
+	}
+	for _, cidr := range httpConfig.XForwardedTrustedCIDRs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
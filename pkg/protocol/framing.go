@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// ambiguousFraming describes why request body length is ambiguous (RFC 7230, section 3.3.3),
+// such request may be interpreted differently by upstream (request smuggling).
+// It returns empty string if framing is fine, err is request parsing error
+func ambiguousFraming(req *nhttp.Request, err error) string {
+	if mcl, ok := err.(*nhttp.MultipleContentLengthError); ok {
+		return fmt.Sprintf("multiple Content-Length headers %q", mcl.Values)
+	}
+	if req != nil && len(req.TransferEncoding) > 0 && len(req.ReceivedContentLength) > 0 {
+		return fmt.Sprintf("both Transfer-Encoding %q and Content-Length %q headers",
+			req.TransferEncoding, req.ReceivedContentLength)
+	}
+	return ""
+}
+
+// rejectRequest responds with empty response of statusCode, connection should be closed after it
+func rejectRequest(w io.Writer, statusCode int) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n",
+		statusCode, nhttp.StatusText(statusCode))
+	return err
+}
+
+// oversizedRequestStatus returns status oversized request is rejected with, it's false for other errors
+func oversizedRequestStatus(err error) (int, bool) {
+	switch err {
+	case nhttp.ErrRequestLineTooLong:
+		return nhttp.StatusRequestURITooLong, true
+	case nhttp.ErrRequestHeaderTooLarge:
+		return nhttp.StatusRequestHeaderFieldsTooLarge, true
+	}
+	return 0, false
+}
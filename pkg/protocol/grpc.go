@@ -0,0 +1,461 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/patrickmn/go-cache"
+	"github.com/uber/jaeger-client-go"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// GRPCHandler process gRPC calls over cleartext HTTP/2 (prior knowledge h2c)
+type GRPCHandler struct {
+	tracingContextMapping *cache.Cache
+	logger                *log.Logger
+}
+
+// NewGRPCHandler returns gRPC handler
+func NewGRPCHandler(logger *log.Logger, tracingContextMapping *cache.Cache) *GRPCHandler {
+	return &GRPCHandler{
+		tracingContextMapping: tracingContextMapping,
+		logger:                logger,
+	}
+}
+
+// HandleRequest handles client side of HTTP/2 connection
+func (h *GRPCHandler) HandleRequest(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) *net.TCPConn {
+
+	netGRPCRequest := netRequest.(*NetGRPCRequest)
+	if w == nil {
+		// calls are multiplexed over single connection, so it isn't routed per call
+		defer close(addrCh)
+		addrCh <- originalDst
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+	}
+	if isInboundConn {
+		netGRPCRequest.setRemoteAddr(r.RemoteAddr().String())
+	} else {
+		netGRPCRequest.setRemoteAddr(w.RemoteAddr().String())
+	}
+
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(r)
+	defer readerPool.Put(bufioReader)
+	preface, err := bufioReader.Peek(len(http2ClientPreface))
+	if err != nil || !bytes.Equal(preface, http2ClientPreface) {
+		h.logger.Debug("Connection isn't HTTP/2 with prior knowledge, passing it through")
+		h.passThrough(w, bufioReader)
+		return w
+	}
+	bufioReader.Discard(len(http2ClientPreface))
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	if _, err = bufioWriter.Write(http2ClientPreface); err != nil {
+		h.logger.Warning(err.Error())
+		return w
+	}
+	h.copyFrames(bufioReader, bufioWriter, netGRPCRequest, true)
+	return w
+}
+
+// HandleResponse handles server side of HTTP/2 connection
+func (h *GRPCHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	netGRPCRequest := netRequest.(*NetGRPCRequest)
+	// calls without response are finished when connection is closed
+	defer netGRPCRequest.CleanUp()
+
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(r)
+	defer readerPool.Put(bufioReader)
+	// server connection preface is SETTINGS frame
+	header, err := bufioReader.Peek(http2FrameHeaderLen)
+	if err != nil || header[3] != http2FrameSettings {
+		h.logger.Debug("Connection isn't HTTP/2 with prior knowledge, passing it through")
+		h.passThrough(w, bufioReader)
+		return
+	}
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	h.copyFrames(bufioReader, bufioWriter, netGRPCRequest, false)
+}
+
+func (h *GRPCHandler) passThrough(w io.Writer, r io.Reader) {
+	buf := bufferPool.Get().([]byte)
+	_, err := io.CopyBuffer(w, r, buf)
+	bufferPool.Put(buf)
+	if err != nil {
+		h.logger.Debugf("Err CopyBuffer: %s", err.Error())
+	}
+}
+
+// copyFrames forwards frames from r to w till the connection is closed,
+// isRequest is true for client to server direction
+func (h *GRPCHandler) copyFrames(r *bufio.Reader, w *bufio.Writer, netGRPCRequest *NetGRPCRequest, isRequest bool) {
+	codec := netGRPCRequest.responseCodec
+	if isRequest {
+		codec = netGRPCRequest.requestCodec
+	}
+	fr := newHTTP2FrameReader(r)
+	fw := newHTTP2FrameWriter(w)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			h.logFrameError(err)
+			return
+		}
+		// response END_STREAM finishes the call
+		endStream := !isRequest && f.flags&http2FlagEndStream != 0
+		switch f.typ {
+		case http2FrameHeaders, http2FramePushPromise:
+			block, err := fr.ReadHeaderBlock(f)
+			if err != nil {
+				h.logFrameError(err)
+				return
+			}
+			// header block is decoded even if it's not traced to keep compression state in sync
+			fields, err := codec.Decode(block.fragment)
+			if err != nil {
+				h.logger.Warningf("Error while decoding HTTP/2 headers: %s", err.Error())
+				return
+			}
+			if block.typ == http2FrameHeaders {
+				if isRequest {
+					fields = netGRPCRequest.StartStream(block.streamID, fields)
+				} else {
+					netGRPCRequest.SetStreamResponse(block.streamID, fields)
+				}
+			}
+			fragment, err := codec.Encode(fields)
+			if err == nil {
+				err = fw.WriteHeaderBlock(block, fragment)
+			}
+			if err != nil {
+				h.logger.Errorf("Error while writing HTTP/2 headers: %s", err.Error())
+				return
+			}
+			if endStream && block.typ == http2FrameHeaders {
+				netGRPCRequest.StopStream(block.streamID, false)
+			}
+		case http2FrameData:
+			netGRPCRequest.AddStreamData(f.streamID, len(f.payload), isRequest)
+		case http2FrameRSTStream:
+			netGRPCRequest.StopStream(f.streamID, true)
+		case http2FrameSettings:
+			if f.flags&http2FlagAck == 0 {
+				// receiver advertises table size used by the other side encoder
+				peerCodec := netGRPCRequest.requestCodec
+				if isRequest {
+					peerCodec = netGRPCRequest.responseCodec
+				}
+				parseHTTP2Settings(f.payload, func(id uint16, value uint32) {
+					if id == http2SettingHeaderTableSize {
+						peerCodec.SetMaxTableSize(value)
+					}
+				})
+			}
+		}
+		if f.typ != http2FrameHeaders && f.typ != http2FramePushPromise {
+			if err = fw.WriteFrame(f.typ, f.flags, f.streamID, f.payload); err != nil {
+				h.logger.Errorf("Error while writing HTTP/2 frame: %s", err.Error())
+				return
+			}
+			if endStream && f.typ == http2FrameData {
+				netGRPCRequest.StopStream(f.streamID, false)
+			}
+		}
+		if r.Buffered() == 0 {
+			if err = fw.Flush(); err != nil {
+				h.logger.Errorf("Error while writing HTTP/2 frame: %s", err.Error())
+				return
+			}
+		}
+	}
+}
+
+func (h *GRPCHandler) logFrameError(err error) {
+	if errors.Is(classifyReadError(err), ErrConnClosed) {
+		h.logger.Debug(err.Error())
+		return
+	}
+	h.logger.Warningf("Error while reading HTTP/2 frame: %s", err.Error())
+}
+
+// grpcStream keeps state of single gRPC call
+type grpcStream struct {
+	span         opentracing.Span
+	requestSize  int64
+	responseSize int64
+	statusCode   string
+	grpcStatus   string
+	grpcMessage  string
+}
+
+type NetGRPCRequest struct {
+	isInbound             bool
+	tracingContextMapping *cache.Cache
+	logger                *log.Logger
+	// header compression state of each direction
+	requestCodec  *http2HeaderCodec
+	responseCodec *http2HeaderCodec
+
+	mu         sync.Mutex
+	remoteAddr string
+	streams    map[uint32]*grpcStream
+}
+
+func NewNetGRPCRequest(logger *log.Logger, isInbound bool, tracingContextMapping *cache.Cache) *NetGRPCRequest {
+	return &NetGRPCRequest{
+		isInbound:             isInbound,
+		tracingContextMapping: tracingContextMapping,
+		logger:                logger,
+		requestCodec:          newHTTP2HeaderCodec(),
+		responseCodec:         newHTTP2HeaderCodec(),
+		streams:               make(map[uint32]*grpcStream),
+	}
+}
+
+// StartRequest does nothing, calls are started by HEADERS frames with StartStream
+func (nr *NetGRPCRequest) StartRequest() {}
+
+// StopRequest does nothing, calls are stopped by END_STREAM and RST_STREAM frames with StopStream
+func (nr *NetGRPCRequest) StopRequest() {}
+
+// CleanUp finishes calls left without response
+func (nr *NetGRPCRequest) CleanUp() {
+	nr.mu.Lock()
+	streamIDs := make([]uint32, 0, len(nr.streams))
+	for streamID := range nr.streams {
+		streamIDs = append(streamIDs, streamID)
+	}
+	nr.mu.Unlock()
+	for _, streamID := range streamIDs {
+		nr.StopStream(streamID, true)
+	}
+}
+
+func (nr *NetGRPCRequest) setRemoteAddr(remoteAddr string) {
+	nr.mu.Lock()
+	nr.remoteAddr = remoteAddr
+	nr.mu.Unlock()
+}
+
+// StartStream starts span for call headers and returns headers with propagated tracing context,
+// trailers of already started call are returned as is
+func (nr *NetGRPCRequest) StartStream(streamID uint32, fields []hpack.HeaderField) []hpack.HeaderField {
+	nr.mu.Lock()
+	_, ok := nr.streams[streamID]
+	nr.mu.Unlock()
+	if ok {
+		return fields
+	}
+
+	httpConfig := config.GetHTTPConfig()
+	var authority, path string
+	header := make(nhttp.Header, len(fields))
+	for _, f := range fields {
+		switch {
+		case f.Name == ":authority":
+			authority = f.Value
+		case f.Name == ":path":
+			path = f.Value
+		case !f.IsPseudo():
+			header.Add(f.Name, f.Value)
+		}
+	}
+	ensureRequestID(httpConfig, header)
+	if !nr.isInbound {
+		tracingInfoByRequestID, ok := nr.tracingContextMapping.Get(header.Get(httpConfig.RequestIdHeaderName))
+		if ok && !preservesTraceContext(httpConfig, header) {
+			header.Set(jaeger.TraceContextHeaderName, tracingInfoByRequestID.(jaeger.SpanContext).String())
+		}
+		if v := header.Get(httpConfig.XSourceHeaderName); v == "" {
+			header.Set(httpConfig.XSourceHeaderName, httpConfig.XSourceValue)
+		}
+	}
+
+	operation := path
+	if !nr.isInbound {
+		operation = authority + path
+	}
+	span := nr.startSpan(operation, header)
+	setStringTag(span, "grpc.method", path)
+	setStringTag(span, "http.host", authority)
+	if requestID := header.Get(httpConfig.RequestIdHeaderName); requestID != "" {
+		setStringTag(span, "http.request_id", requestID)
+	}
+
+	nr.mu.Lock()
+	nr.streams[streamID] = &grpcStream{span: span}
+	nr.mu.Unlock()
+	return mergeHeaderFields(fields, header)
+}
+
+// startSpan starts span for call and propagates its tracing context to header
+func (nr *NetGRPCRequest) startSpan(operation string, header nhttp.Header) opentracing.Span {
+	wireContext, err := extractContext(header)
+	httpConfig := config.GetHTTPConfig()
+	var span opentracing.Span
+	if err != nil {
+		nr.logger.Infof("Carrier extract error: %s", err.Error())
+		var opts []opentracing.StartSpanOption
+		if priority, ok := extractSamplingPriority(header); ok {
+			opts = append(opts, opentracing.Tag{Key: string(ext.SamplingPriority), Value: priority})
+		}
+		span = opentracing.StartSpan(operation, opts...)
+		if nr.isInbound {
+			for headerName, tagName := range httpConfig.HeadersMap {
+				if val := header.Get(headerName); val != "" {
+					setStringTag(span, tagName, maskSensitive(httpConfig, headerName, val))
+				}
+			}
+		}
+		wireContext = span.Context()
+	} else {
+		span = opentracing.StartSpan(operation, opentracing.ChildOf(wireContext))
+	}
+
+	if nr.isInbound {
+		context := span.Context().(jaeger.SpanContext)
+		nr.tracingContextMapping.SetDefault(header.Get(httpConfig.RequestIdHeaderName), context)
+	} else {
+		injectContext(wireContext, header)
+	}
+	return span
+}
+
+// SetStreamResponse records response headers or trailers of call
+func (nr *NetGRPCRequest) SetStreamResponse(streamID uint32, fields []hpack.HeaderField) {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	stream, ok := nr.streams[streamID]
+	if !ok {
+		return
+	}
+	for _, f := range fields {
+		switch f.Name {
+		case ":status":
+			stream.statusCode = f.Value
+		case "grpc-status":
+			stream.grpcStatus = f.Value
+		case "grpc-message":
+			stream.grpcMessage = f.Value
+		}
+	}
+}
+
+// AddStreamData accounts DATA frame payload of call
+func (nr *NetGRPCRequest) AddStreamData(streamID uint32, size int, isRequest bool) {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	stream, ok := nr.streams[streamID]
+	if !ok {
+		return
+	}
+	if isRequest {
+		stream.requestSize += int64(size)
+	} else {
+		stream.responseSize += int64(size)
+	}
+}
+
+// StopStream finishes span of call, reset is true when call is cancelled or connection is closed
+func (nr *NetGRPCRequest) StopStream(streamID uint32, reset bool) {
+	nr.mu.Lock()
+	stream, ok := nr.streams[streamID]
+	if ok {
+		delete(nr.streams, streamID)
+	}
+	remoteAddr := nr.remoteAddr
+	nr.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	span := stream.span
+	if nr.isInbound {
+		span.SetTag("span.kind", "server")
+	} else {
+		span.SetTag("span.kind", "client")
+	}
+	span.SetTag("remote_addr", remoteAddr)
+	span.SetTag("http.request_size", stream.requestSize)
+	span.SetTag("http.response_size", stream.responseSize)
+	if stream.statusCode != "" {
+		span.SetTag("http.status_code", stream.statusCode)
+	}
+	if stream.grpcStatus != "" {
+		span.SetTag("grpc.status", stream.grpcStatus)
+	}
+	if stream.grpcMessage != "" {
+		span.SetTag("grpc.message", stream.grpcMessage)
+	}
+	if reset {
+		span.SetTag("grpc.reset", true)
+	}
+	// OK status is 0, call without status is failed as well
+	if reset || stream.grpcStatus != "0" {
+		span.SetTag("error", true)
+	}
+	span.Finish()
+}
+
+// mergeHeaderFields applies changes of header to fields keeping original order,
+// HTTP/2 requires lowercase header names
+func mergeHeaderFields(fields []hpack.HeaderField, header nhttp.Header) []hpack.HeaderField {
+	merged := make([]hpack.HeaderField, 0, len(fields)+len(header))
+	seen := make(map[string]struct{}, len(header))
+	for _, f := range fields {
+		if f.IsPseudo() {
+			merged = append(merged, f)
+			continue
+		}
+		key := nhttp.CanonicalHeaderKey(f.Name)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		for _, v := range header[key] {
+			merged = append(merged, hpack.HeaderField{Name: f.Name, Value: v, Sensitive: f.Sensitive})
+		}
+	}
+	var added []string
+	for key := range header {
+		if _, ok := seen[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	for _, key := range added {
+		for _, v := range header[key] {
+			merged = append(merged, hpack.HeaderField{Name: strings.ToLower(key), Value: v})
+		}
+	}
+	return merged
+}
@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+	"github.com/uber/jaeger-client-go"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// grpcExchange returns client frames of unary call, its request headers are split into CONTINUATION frame,
+// and server frames answering it with grpc-status in trailers
+func grpcExchange(t *testing.T) ([]byte, []byte) {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	var client bytes.Buffer
+	fw := newHTTP2FrameWriter(bufio.NewWriter(&client))
+	fw.WriteFrame(http2FrameSettings, 0, 0)
+	fragment := encodeHPACK(t, enc, &buf,
+		hpack.HeaderField{Name: ":method", Value: "POST"},
+		hpack.HeaderField{Name: ":scheme", Value: "http"},
+		hpack.HeaderField{Name: ":path", Value: "/orders.Orders/Get"},
+		hpack.HeaderField{Name: ":authority", Value: "orders:50051"},
+		hpack.HeaderField{Name: "content-type", Value: "application/grpc"},
+		hpack.HeaderField{Name: "x-request-id", Value: "grpc-call"},
+	)
+	fw.WriteFrame(http2FrameHeaders, 0, 1, fragment[:5])
+	fw.WriteFrame(http2FrameContinuation, http2FlagEndHeaders, 1, fragment[5:])
+	fw.WriteFrame(http2FrameData, http2FlagEndStream, 1, []byte{0, 0, 0, 0, 2, 8, 1})
+	fw.Flush()
+
+	enc = hpack.NewEncoder(&buf)
+	var server bytes.Buffer
+	fw = newHTTP2FrameWriter(bufio.NewWriter(&server))
+	fw.WriteFrame(http2FrameSettings, 0, 0)
+	fw.WriteFrame(http2FrameHeaders, http2FlagEndHeaders, 1, encodeHPACK(t, enc, &buf,
+		hpack.HeaderField{Name: ":status", Value: "200"},
+		hpack.HeaderField{Name: "content-type", Value: "application/grpc"},
+	))
+	fw.WriteFrame(http2FrameData, 0, 1, []byte{0, 0, 0, 0, 0})
+	fw.WriteFrame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, encodeHPACK(t, enc, &buf,
+		hpack.HeaderField{Name: "grpc-status", Value: "5"},
+		hpack.HeaderField{Name: "grpc-message", Value: "order not found"},
+	))
+	fw.Flush()
+	return client.Bytes(), server.Bytes()
+}
+
+// copyGRPC forwards data in one direction of connection and returns forwarded frames
+func copyGRPC(h *GRPCHandler, nr *NetGRPCRequest, data []byte, isRequest bool) []byte {
+	var forwarded bytes.Buffer
+	w := bufio.NewWriter(&forwarded)
+	h.copyFrames(bufio.NewReader(bytes.NewReader(data)), w, nr, isRequest)
+	w.Flush()
+	return forwarded.Bytes()
+}
+
+func TestGRPCStreamSpan(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewGRPCHandler(logger, cache.New(time.Minute, time.Minute))
+	nr := NewNetGRPCRequest(logger, false, h.tracingContextMapping)
+	client, server := grpcExchange(t)
+
+	copyGRPC(h, nr, client, true)
+	if spans := tracer.FinishedSpans(); len(spans) != 0 {
+		t.Fatalf("expected call to be in progress, got %d spans", len(spans))
+	}
+	forwarded := copyGRPC(h, nr, server, false)
+	// trailers reach client
+	blocks := readHeaderBlocks(t, forwarded)
+	if len(blocks) != 2 || headerValue(blocks[1], "grpc-status") != "5" {
+		t.Fatalf("unexpected response headers %v", blocks)
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.OperationName != "orders:50051/orders.Orders/Get" || span.Tag("grpc.status") != "5" ||
+		span.Tag("grpc.message") != "order not found" || span.Tag("http.status_code") != "200" ||
+		span.Tag("error") != true || span.Tag("http.request_size") != int64(7) ||
+		span.Tag("http.response_size") != int64(5) || span.Tag("span.kind") != "client" {
+		t.Fatalf("unexpected span %s %v", span.OperationName, span.Tags())
+	}
+}
+
+func TestGRPCResetStream(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewGRPCHandler(logger, cache.New(time.Minute, time.Minute))
+	nr := NewNetGRPCRequest(logger, false, h.tracingContextMapping)
+	client, _ := grpcExchange(t)
+	copyGRPC(h, nr, client, true)
+
+	var server bytes.Buffer
+	fw := newHTTP2FrameWriter(bufio.NewWriter(&server))
+	fw.WriteFrame(http2FrameRSTStream, 0, 1, []byte{0, 0, 0, 8})
+	fw.Flush()
+	copyGRPC(h, nr, server.Bytes(), false)
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 || spans[0].Tag("grpc.reset") != true || spans[0].Tag("error") != true ||
+		spans[0].Tag("grpc.status") != nil {
+		t.Fatalf("expected reset call span, got %v", spans)
+	}
+}
+
+func TestGRPCPropagatesTraceContext(t *testing.T) {
+	tracer := newTestTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	w3cConfig := httpConfig
+	w3cConfig.W3CPropagationEnabled = true
+	config.SetHTTPConfig(w3cConfig)
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewGRPCHandler(logger, cache.New(time.Minute, time.Minute))
+	nr := NewNetGRPCRequest(logger, false, h.tracingContextMapping)
+	client, _ := grpcExchange(t)
+
+	blocks := readHeaderBlocks(t, copyGRPC(h, nr, client, true))
+	if len(blocks) != 1 {
+		t.Fatalf("expected 1 header block, got %d", len(blocks))
+	}
+	fields := blocks[0]
+	if headerValue(fields, ":path") != "/orders.Orders/Get" || headerValue(fields, "x-request-id") != "grpc-call" {
+		t.Fatalf("expected call headers to be kept, got %v", fields)
+	}
+	// HTTP/2 header names are lowercase
+	traceParent := headerValue(fields, strings.ToLower(w3cTraceParentHeaderName))
+	if len(traceParent) != 55 || headerValue(fields, jaeger.TraceContextHeaderName) == "" {
+		t.Fatalf("expected trace context to be injected, got %v", fields)
+	}
+	nr.CleanUp()
+}
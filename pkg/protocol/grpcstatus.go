@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// isGRPCResponse reports whether response carries gRPC call (e.g. tunneled through HTTP/1.1 bridge),
+// content type may have subtype like application/grpc+proto
+func isGRPCResponse(resp *nhttp.Response) bool {
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcStatus returns status of gRPC call read from response trailers. Trailers-only response
+// (call failed before any message was sent) has status in the initial headers.
+// Trailers are filled when body is read to the end, so response should be written already
+func grpcStatus(resp *nhttp.Response) (code int, message string, ok bool) {
+	header := resp.Trailer
+	if header.Get("grpc-status") == "" {
+		header = resp.Header
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(header.Get("grpc-status")))
+	if err != nil {
+		return 0, "", false
+	}
+	// message is percent-encoded by gRPC
+	message = header.Get("grpc-message")
+	if decoded, err := url.PathUnescape(message); err == nil {
+		message = decoded
+	}
+	return code, message, true
+}
+
+// tagGRPCStatus sets gRPC status of response and returns whether call failed,
+// HTTP status of gRPC response is 200 whatever call result is, so call without status is failed as well
+func tagGRPCStatus(span opentracing.Span, resp *nhttp.Response) bool {
+	code, message, ok := grpcStatus(resp)
+	if !ok {
+		return true
+	}
+	span.SetTag("grpc.status_code", code)
+	if message != "" {
+		span.SetTag("grpc.message", message)
+	}
+	return code != 0
+}
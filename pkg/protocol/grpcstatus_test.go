@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+func TestGRPCStatusTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  nhttp.Header
+		trailer nhttp.Header
+		code    interface{}
+		message interface{}
+		failed  bool
+	}{
+		{"ok in trailers", nhttp.Header{}, nhttp.Header{"Grpc-Status": {"0"}}, 0, nil, false},
+		{"error in trailers", nhttp.Header{}, nhttp.Header{"Grpc-Status": {"5"}, "Grpc-Message": {"order%20not%20found"}},
+			5, "order not found", true},
+		{"trailers-only", nhttp.Header{"Grpc-Status": {"14"}, "Grpc-Message": {"unavailable"}}, nil, 14, "unavailable", true},
+		{"no status", nhttp.Header{}, nhttp.Header{}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		tt.header.Set("Content-Type", "application/grpc+proto")
+		resp := &nhttp.Response{StatusCode: nhttp.StatusOK, Header: tt.header, Trailer: tt.trailer}
+		if !isGRPCResponse(resp) {
+			t.Fatalf("%s: expected gRPC response", tt.name)
+		}
+		span := mocktracer.New().StartSpan("call").(*mocktracer.MockSpan)
+		if failed := tagGRPCStatus(span, resp); failed != tt.failed {
+			t.Fatalf("%s: expected failed %t, got %t", tt.name, tt.failed, failed)
+		}
+		if span.Tag("grpc.status_code") != tt.code || span.Tag("grpc.message") != tt.message {
+			t.Fatalf("%s: unexpected tags %v", tt.name, span.Tags())
+		}
+	}
+}
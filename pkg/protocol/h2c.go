@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// hasHTTP2Preface reports whether reader starts with HTTP/2 client connection preface, nothing is consumed.
+// Bytes are peeked while they match the preface, so short HTTP/1.1 request doesn't block it
+func hasHTTP2Preface(reader *bufio.Reader) bool {
+	n := 1
+	for {
+		b, err := reader.Peek(n)
+		if err != nil || !bytes.HasPrefix(http2ClientPreface, b) {
+			return false
+		}
+		if len(b) == len(http2ClientPreface) {
+			return true
+		}
+		n = len(b) + 1
+		if buffered := reader.Buffered(); buffered > n {
+			n = buffered
+		}
+		if n > len(http2ClientPreface) {
+			n = len(http2ClientPreface)
+		}
+	}
+}
+
+// passHTTP2 copies HTTP/2 cleartext connection to original destination as is, HTTP/1.1 parser would corrupt its frames
+func (h *HTTPHandler) passHTTP2(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	netHTTPRequest *NetHTTPRequest,
+	originalDst string,
+	bufioHTTPReader *bufio.Reader) *net.TCPConn {
+	h.logger.Infof("HTTP/2 cleartext connection from %s to %s isn't traced, passing it through. "+
+		"Add port to NETRA_GRPC_PORTS to trace it", r.RemoteAddr().String(), originalDst)
+	if addrCh != nil {
+		addrCh <- originalDst
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+	}
+	if w == nil {
+		return nil
+	}
+
+	// response side switches to copying before upstream gets the preface
+	atomic.StoreInt32(&netHTTPRequest.tunneling, 1)
+	setReadDeadline(r, 0)
+	buf := bufferPool.Get().([]byte)
+	_, err := io.CopyBuffer(w, bufioHTTPReader, buf)
+	bufferPool.Put(buf)
+	if err != nil {
+		h.logger.Debugf("Err CopyBuffer: %s", err.Error())
+	}
+	return w
+}
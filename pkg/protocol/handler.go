@@ -3,6 +3,8 @@ package protocol
 import (
 	"net"
 	"sync"
+
+	"github.com/Lookyan/netramesh/internal/config"
 )
 
 type NetHandler interface {
@@ -19,6 +21,24 @@ type NetHandler interface {
 	HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool)
 }
 
+// PooledResponseHandler is NetHandler whose upstream connections can be shared between requests
+type PooledResponseHandler interface {
+	// HandlePooledResponse handles response to single request and reports whether connection can be reused
+	HandlePooledResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool) bool
+}
+
+// pooled buffer sizes are set once on handlers init, pools never mix buffers of different sizes
+var (
+	bufioSize      = 4 * 1024
+	copyBufferSize = 64 * 1024
+)
+
 var bufferPool = sync.Pool{
-	New: func() interface{} { return make([]byte, 0xffff) },
+	New: func() interface{} { return make([]byte, copyBufferSize) },
+}
+
+// initBufferSizes sets sizes of pooled buffers, it should be called before any buffer is taken
+func initBufferSizes(httpConfig config.HTTPConfig) {
+	bufioSize = httpConfig.BufioSize
+	copyBufferSize = httpConfig.CopyBufferSize
 }
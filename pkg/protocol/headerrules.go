@@ -0,0 +1,31 @@
+package protocol
+
+import (
+	"strings"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// matchHeaderRule returns the most specific rule of path, rules are sorted from the longest prefix
+func matchHeaderRule(rules []config.HeaderRule, path string) (config.HeaderRule, bool) {
+	for _, rule := range rules {
+		if strings.HasPrefix(path, rule.Prefix) {
+			return rule, true
+		}
+	}
+	return config.HeaderRule{}, false
+}
+
+// applyHeaderRules removes headers according to the most specific rule of request path
+func applyHeaderRules(rules []config.HeaderRule, path string, header nhttp.Header) {
+	rule, ok := matchHeaderRule(rules, path)
+	if !ok {
+		return
+	}
+	for name := range header {
+		if _, listed := rule.Headers[name]; listed != rule.Keep {
+			delete(header, name)
+		}
+	}
+}
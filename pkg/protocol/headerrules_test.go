@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+func TestApplyHeaderRules(t *testing.T) {
+	// the most specific prefix goes first
+	rules := []config.HeaderRule{
+		{Prefix: "/api/public", Keep: true, Headers: map[string]struct{}{"Accept": {}, "Content-Length": {}}},
+		{Prefix: "/api", Headers: map[string]struct{}{"X-Internal-Secret": {}}},
+	}
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"/api/public/items", []string{"Accept", "Content-Length"}},
+		{"/api/orders", []string{"Accept", "Content-Length", "X-Debug"}},
+		{"/index.html", []string{"Accept", "Content-Length", "X-Debug", "X-Internal-Secret"}},
+	}
+	for _, tt := range tests {
+		header := nhttp.Header{
+			"Accept":            {"*/*"},
+			"Content-Length":    {"0"},
+			"X-Debug":           {"1"},
+			"X-Internal-Secret": {"secret"},
+		}
+		applyHeaderRules(rules, tt.path, header)
+		var names []string
+		for _, name := range []string{"Accept", "Content-Length", "X-Debug", "X-Internal-Secret"} {
+			if _, ok := header[name]; ok {
+				names = append(names, name)
+			}
+		}
+		if !reflect.DeepEqual(names, tt.expected) {
+			t.Fatalf("%s: expected headers %v, got %v", tt.path, tt.expected, names)
+		}
+	}
+}
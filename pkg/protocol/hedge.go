@@ -0,0 +1,385 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+const (
+	// hedgeWindowSize is number of recent latencies percentile delay is computed from
+	hedgeWindowSize = 128
+	// hedgeMinSamples is number of latencies observed before percentile delay is trusted
+	hedgeMinSamples = 20
+)
+
+var errHedgeLost = errors.New("request is answered by another attempt")
+
+// safe methods only are hedged: every copy of request may reach upstream
+var hedgedMethods = map[string]struct{}{
+	nhttp.MethodGet:     {},
+	nhttp.MethodHead:    {},
+	nhttp.MethodOptions: {},
+}
+
+// routeHedgeRule returns hedge rule of the longest configured path prefix matching path
+func routeHedgeRule(httpConfig config.HTTPConfig, path string) (string, config.HedgeRule, bool) {
+	var rule config.HedgeRule
+	var route string
+	matched := -1
+	for prefix, prefixRule := range httpConfig.HedgeRules {
+		if len(prefix) > matched && strings.HasPrefix(path, prefix) {
+			route, rule = prefix, prefixRule
+			matched = len(prefix)
+		}
+	}
+	return route, rule, matched >= 0
+}
+
+// latencyWindow keeps recent latencies of hedged route
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [hedgeWindowSize]time.Duration
+	size    int
+	next    int
+}
+
+func (lw *latencyWindow) add(latency time.Duration) {
+	lw.mu.Lock()
+	lw.samples[lw.next] = latency
+	lw.next = (lw.next + 1) % hedgeWindowSize
+	if lw.size < hedgeWindowSize {
+		lw.size++
+	}
+	lw.mu.Unlock()
+}
+
+// percentile returns latency below which given percent of samples are, it's false while there are too few samples
+func (lw *latencyWindow) percentile(percent float64) (time.Duration, bool) {
+	lw.mu.Lock()
+	if lw.size < hedgeMinSamples {
+		lw.mu.Unlock()
+		return 0, false
+	}
+	samples := make([]time.Duration, lw.size)
+	copy(samples, lw.samples[:lw.size])
+	lw.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[int(float64(len(samples)-1)*percent/100)], true
+}
+
+var hedgeLatencies = struct {
+	sync.Mutex
+	windows map[string]*latencyWindow
+}{windows: make(map[string]*latencyWindow)}
+
+func hedgeLatencyWindow(route string) *latencyWindow {
+	hedgeLatencies.Lock()
+	defer hedgeLatencies.Unlock()
+	lw, ok := hedgeLatencies.windows[route]
+	if !ok {
+		lw = &latencyWindow{}
+		hedgeLatencies.windows[route] = lw
+	}
+	return lw
+}
+
+type hedgeResult struct {
+	resp    *nhttp.Response
+	conn    *net.TCPConn
+	attempt int
+}
+
+// requestHedge races copies of request sent over separate upstream connections:
+// attempt 1 is request sent over primary connection, hedges are sent after delay while nobody answered.
+// The first attempt which gets response wins and connections of the others are closed,
+// response side of primary connection takes response of the winner
+type requestHedge struct {
+	req       *nhttp.Request
+	body      []byte
+	dstAddr   string
+	delay     time.Duration
+	maxHedges int
+	window    *latencyWindow
+	logger    *log.Logger
+
+	mu            sync.Mutex
+	startTime     time.Time
+	primary       *net.TCPConn
+	conns         []*net.TCPConn
+	timer         *time.Timer
+	launched      int
+	inflight      int
+	winner        int
+	primaryFailed bool
+	result        chan *hedgeResult
+}
+
+// newRequestHedge buffers body of request to hedged route, it returns nil for requests which can't be hedged
+func newRequestHedge(req *nhttp.Request, primary *net.TCPConn, dstAddr string, logger *log.Logger) (*requestHedge, error) {
+	httpConfig := config.GetHTTPConfig()
+	if len(httpConfig.HedgeRules) == 0 {
+		return nil, nil
+	}
+	if _, ok := hedgedMethods[req.Method]; !ok || expectsContinue(req) {
+		return nil, nil
+	}
+	if req.ContentLength < 0 || req.ContentLength > httpConfig.RetryMaxBodyBytes {
+		return nil, nil
+	}
+	route, rule, ok := routeHedgeRule(httpConfig, req.URL.Path)
+	if !ok {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	hg := &requestHedge{
+		req:       req,
+		body:      body,
+		dstAddr:   dstAddr,
+		delay:     rule.Delay,
+		maxHedges: rule.MaxHedges,
+		window:    hedgeLatencyWindow(route),
+		logger:    logger,
+		primary:   primary,
+		result:    make(chan *hedgeResult, 1),
+	}
+	if rule.Percentile > 0 {
+		// latencies are still observed to compute delay of the next requests
+		hg.delay, _ = hg.window.percentile(rule.Percentile)
+	}
+	req.Body = hg.newBody()
+	return hg, nil
+}
+
+func (hg *requestHedge) newBody() io.ReadCloser {
+	if len(hg.body) == 0 {
+		return nhttp.NoBody
+	}
+	return ioutil.NopCloser(bytes.NewReader(hg.body))
+}
+
+// start schedules hedges after request is written to primary connection
+func (hg *requestHedge) start() {
+	hg.mu.Lock()
+	defer hg.mu.Unlock()
+	hg.startTime = time.Now()
+	if hg.delay > 0 {
+		hg.timer = time.AfterFunc(hg.delay, hg.launch)
+	}
+}
+
+// launch sends the next hedge unless request is already answered
+func (hg *requestHedge) launch() {
+	hg.mu.Lock()
+	if hg.winner != 0 || hg.primaryFailed || hg.launched >= hg.maxHedges {
+		hg.mu.Unlock()
+		return
+	}
+	hg.launched++
+	hg.inflight++
+	attempt := hg.launched + 1
+	if hg.launched < hg.maxHedges {
+		hg.timer = time.AfterFunc(hg.delay, hg.launch)
+	}
+	hg.mu.Unlock()
+
+	resp, conn, err := hg.exchange()
+	if err != nil {
+		hg.logger.Debugf("Hedge %d of %s %s%s failed: %s", attempt, hg.req.Method, hg.req.Host, hg.req.URL.Path, err.Error())
+		hg.fail()
+		return
+	}
+
+	hg.mu.Lock()
+	hg.inflight--
+	if hg.winner != 0 {
+		hg.mu.Unlock()
+		return
+	}
+	hg.winner = attempt
+	hg.observeLatency()
+	losers := append([]*net.TCPConn{hg.primary}, hg.conns...)
+	hg.mu.Unlock()
+	for _, loser := range losers {
+		if loser != conn {
+			loser.Close()
+		}
+	}
+	hg.result <- &hedgeResult{resp: resp, conn: conn, attempt: attempt}
+}
+
+// exchange sends request copy over new connection and reads its final response
+func (hg *requestHedge) exchange() (*nhttp.Response, *net.TCPConn, error) {
+	httpConfig := config.GetHTTPConfig()
+	c, err := net.DialTimeout("tcp", hg.dstAddr, httpConfig.ConnectTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := c.(*net.TCPConn)
+	hg.mu.Lock()
+	if hg.winner != 0 {
+		hg.mu.Unlock()
+		conn.Close()
+		return nil, nil, errHedgeLost
+	}
+	hg.conns = append(hg.conns, conn)
+	hg.mu.Unlock()
+
+	req := new(nhttp.Request)
+	*req = *hg.req
+	req.Header = cloneHeader(hg.req.Header)
+	req.Body = hg.newBody()
+	timeouts, _ := routeTimeouts(httpConfig, hg.req.URL.Path)
+	setWriteDeadline(conn, timeouts.Write)
+	bufioWriter := bufio.NewWriter(conn)
+	err = req.Write(bufioWriter)
+	if flushErr := bufioWriter.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	setWriteDeadline(conn, 0)
+	setReadDeadline(conn, timeouts.Read)
+
+	// reader outlives this call, response body is read from it by response side of primary connection
+	bufioReader := bufio.NewReaderSize(conn, bufioSize)
+	for {
+		resp, err := nhttp.ReadResponse(bufioReader, hg.req)
+		if err != nil {
+			return nil, nil, err
+		}
+		// interim responses of hedges aren't forwarded, client gets them from primary only
+		if !isInterimResponse(resp) {
+			return resp, conn, nil
+		}
+	}
+}
+
+// observeLatency records latency of the winner, request which failed to be written isn't started.
+// It's called with mu held
+func (hg *requestHedge) observeLatency() {
+	if !hg.startTime.IsZero() {
+		hg.window.add(time.Since(hg.startTime))
+	}
+}
+
+// fail drops failed hedge, if primary attempt failed too and nobody else is in flight, request fails
+func (hg *requestHedge) fail() {
+	hg.mu.Lock()
+	defer hg.mu.Unlock()
+	hg.inflight--
+	if hg.inflight == 0 && hg.primaryFailed && hg.winner == 0 {
+		hg.result <- nil
+	}
+}
+
+// resolve takes response read from primary connection and returns response of the winner,
+// primary error is returned when all hedges failed too
+func (hg *requestHedge) resolve(resp *nhttp.Response, err error) (*nhttp.Response, error) {
+	hg.mu.Lock()
+	if hg.winner == 0 && err == nil {
+		// interim responses of primary are forwarded while attempts race
+		if isInterimResponse(resp) {
+			hg.mu.Unlock()
+			return resp, nil
+		}
+		hg.winner = 1
+		if hg.timer != nil {
+			hg.timer.Stop()
+		}
+		hg.observeLatency()
+		losers := hg.conns
+		hg.mu.Unlock()
+		for _, loser := range losers {
+			loser.Close()
+		}
+		return resp, nil
+	}
+	if hg.winner == 0 {
+		hg.primaryFailed = true
+		if hg.timer != nil {
+			hg.timer.Stop()
+		}
+		if hg.inflight == 0 {
+			hg.mu.Unlock()
+			return resp, err
+		}
+	}
+	if hg.winner == 1 {
+		hg.mu.Unlock()
+		return resp, err
+	}
+	hg.mu.Unlock()
+
+	result := <-hg.result
+	if result == nil {
+		return resp, err
+	}
+	// the next read of closed primary connection gets nothing
+	hg.result <- result
+	return result.resp, nil
+}
+
+// close closes connections of hedges, it's called when response is written
+func (hg *requestHedge) close() {
+	hg.mu.Lock()
+	if hg.timer != nil {
+		hg.timer.Stop()
+	}
+	conns := hg.conns
+	hg.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// tags reports whether hedges were sent and which attempt won
+func (hg *requestHedge) tags() (bool, int) {
+	hg.mu.Lock()
+	defer hg.mu.Unlock()
+	return hg.launched > 0, hg.winner
+}
+
+func (nr *NetHTTPRequest) setHedge(req *nhttp.Request, hedge *requestHedge) {
+	nr.hedgesMu.Lock()
+	nr.hedges[req] = hedge
+	nr.hedgesMu.Unlock()
+}
+
+// hedgeOf returns hedge of request sent over primary connection conn
+func (nr *NetHTTPRequest) hedgeOf(req *nhttp.Request, conn *net.TCPConn) *requestHedge {
+	nr.hedgesMu.Lock()
+	defer nr.hedgesMu.Unlock()
+	hedge, ok := nr.hedges[req]
+	if !ok || hedge.primary != conn {
+		return nil
+	}
+	return hedge
+}
+
+// popHedge returns hedge of request and forgets it
+func (nr *NetHTTPRequest) popHedge(req *nhttp.Request) *requestHedge {
+	nr.hedgesMu.Lock()
+	defer nr.hedgesMu.Unlock()
+	hedge, ok := nr.hedges[req]
+	if ok {
+		delete(nr.hedges, req)
+	}
+	return hedge
+}
@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// proxyHedged sends single request through outbound HTTP handler in routing mode,
+// upstream answers request on the first connection after slowDelay and immediately on the others
+func proxyHedged(t *testing.T, slowDelay time.Duration) (*nhttp.Response, string, *mocktracer.MockSpan, int32) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n := atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				if _, err := nhttp.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				body := "fast"
+				if n == 1 {
+					time.Sleep(slowDelay)
+					body = "slow"
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+			}()
+		}
+	}()
+
+	client, proxyIn := tcpConnPair(t)
+	defer client.Close()
+	handler := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	netRequest := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+	addrCh := make(chan string)
+	connCh := make(chan *net.TCPConn)
+	go handler.HandleRequest(proxyIn, nil, connCh, addrCh, netRequest, false, ln.Addr().String())
+	// the same as transport does in routing mode
+	go func() {
+		for addr := range addrCh {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				connCh <- nil
+				return
+			}
+			connCh <- conn.(*net.TCPConn)
+			handler.HandleResponse(conn.(*net.TCPConn), proxyIn, netRequest, false, true)
+			conn.Close()
+		}
+	}()
+
+	fmt.Fprint(client, "GET /search?q=1 HTTP/1.1\r\nHost: upstream\r\n\r\n")
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nhttp.ReadResponse(bufio.NewReader(client), &nhttp.Request{Method: nhttp.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tracer.FinishedSpans()) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	return resp, string(body), spans[0], atomic.LoadInt32(&accepted)
+}
+
+func withHedgeRule(rule config.HedgeRule) func() {
+	httpConfig := config.GetHTTPConfig()
+	hedgedConfig := httpConfig
+	hedgedConfig.HedgeRules = map[string]config.HedgeRule{"/search": rule}
+	config.SetHTTPConfig(hedgedConfig)
+	return func() { config.SetHTTPConfig(httpConfig) }
+}
+
+func TestHedgeWinsSlowRequest(t *testing.T) {
+	defer withHedgeRule(config.HedgeRule{Delay: 50 * time.Millisecond, MaxHedges: 1})()
+
+	resp, body, span, accepted := proxyHedged(t, time.Second)
+	if resp.StatusCode != 200 || body != "fast" {
+		t.Fatalf("expected response of hedge, got %d %q", resp.StatusCode, body)
+	}
+	if accepted != 2 {
+		t.Fatalf("expected 2 upstream connections, got %d", accepted)
+	}
+	if hedged := span.Tag("hedged"); hedged != true {
+		t.Fatalf("expected hedged span, got %v", hedged)
+	}
+	if winner := span.Tag("hedge.winner"); winner != 2 {
+		t.Fatalf("expected hedge to win, got attempt %v", winner)
+	}
+}
+
+func TestHedgeNotSentForFastRequest(t *testing.T) {
+	defer withHedgeRule(config.HedgeRule{Delay: time.Second, MaxHedges: 1})()
+
+	resp, body, span, accepted := proxyHedged(t, 10*time.Millisecond)
+	if resp.StatusCode != 200 || body != "slow" {
+		t.Fatalf("expected response of primary request, got %d %q", resp.StatusCode, body)
+	}
+	if accepted != 1 {
+		t.Fatalf("expected 1 upstream connection, got %d", accepted)
+	}
+	if hedged := span.Tag("hedged"); hedged != nil {
+		t.Fatalf("expected span without hedges, got %v", hedged)
+	}
+}
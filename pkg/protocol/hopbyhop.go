@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// hopByHopHeaders are meaningful for single transport level connection only (RFC 7230, section 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// stripHopByHopHeaders removes hop-by-hop headers and headers listed in Connection,
+// persistence of HTTP/1.0 connection is kept as it's requested with Connection header only.
+// Message framing isn't affected: it's written from ContentLength and TransferEncoding fields
+func stripHopByHopHeaders(header nhttp.Header, protoMajor, protoMinor int) {
+	keepAlive := protoMajor == 1 && protoMinor == 0 &&
+		httpguts.HeaderValuesContainsToken(header["Connection"], "keep-alive")
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	if keepAlive {
+		header.Set("Connection", "keep-alive")
+	}
+}
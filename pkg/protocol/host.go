@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// defaultHTTPPort is stripped from hosts, `host:80` and `host` are the same destination
+const defaultHTTPPort = "80"
+
+// normalizeHost validates host against RFC 3986 authority grammar without userinfo
+// and returns it lowercased, without trailing dot of name and without default port
+func normalizeHost(host string) (string, error) {
+	hostname, port := host, ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return "", fmt.Errorf("malformed host: '%s'", host)
+		}
+		hostname = host[:end+1]
+		rest := host[end+1:]
+		if rest != "" {
+			if rest[0] != ':' {
+				return "", fmt.Errorf("malformed host: '%s'", host)
+			}
+			port = rest[1:]
+		}
+		if !isIPLiteral(hostname[1:end]) {
+			return "", fmt.Errorf("malformed host: '%s'", host)
+		}
+	} else {
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			hostname, port = host[:i], host[i+1:]
+		}
+		if !isRegName(hostname) {
+			return "", fmt.Errorf("malformed host: '%s'", host)
+		}
+		hostname = strings.TrimSuffix(hostname, ".")
+	}
+	if !isPort(port) {
+		return "", fmt.Errorf("malformed host port: '%s'", host)
+	}
+	hostname = strings.ToLower(hostname)
+	if port == "" || port == defaultHTTPPort {
+		return hostname, nil
+	}
+	return hostname + ":" + port, nil
+}
+
+// isIPLiteral checks content of brackets: IPv6 address or IPvFuture `v<hex>.<chars>`
+func isIPLiteral(s string) bool {
+	if len(s) > 1 && (s[0] == 'v' || s[0] == 'V') {
+		dot := strings.Index(s, ".")
+		if dot < 2 || dot == len(s)-1 {
+			return false
+		}
+		for i := 1; i < dot; i++ {
+			if !isHexDigit(s[i]) {
+				return false
+			}
+		}
+		for i := dot + 1; i < len(s); i++ {
+			if !isUnreserved(s[i]) && !isSubDelim(s[i]) && s[i] != ':' {
+				return false
+			}
+		}
+		return true
+	}
+	ip := net.ParseIP(s)
+	return ip != nil && strings.Contains(s, ":")
+}
+
+// isRegName checks registered name or IPv4 address: unreserved, percent-encoded and sub-delims characters
+func isRegName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%':
+			if i+2 >= len(s) || !isHexDigit(s[i+1]) || !isHexDigit(s[i+2]) {
+				return false
+			}
+			i += 2
+		case !isUnreserved(c) && !isSubDelim(c):
+			return false
+		}
+	}
+	return true
+}
+
+// isPort checks port is empty or decimal number not greater than 65535
+func isPort(s string) bool {
+	if s == "" {
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	n, err := strconv.Atoi(s)
+	return err == nil && n <= 65535
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isSubDelim(c byte) bool {
+	return strings.IndexByte("!$&'()*+,;=", c) >= 0
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// isAllowedHost reports whether normalized host is in configured allowlist with or without port,
+// every host is allowed if allowlist is empty
+func isAllowedHost(httpConfig config.HTTPConfig, host string) bool {
+	if len(httpConfig.AllowedHosts) == 0 {
+		return true
+	}
+	if _, ok := httpConfig.AllowedHosts[host]; ok {
+		return true
+	}
+	// IPv6 literal keeps its brackets
+	if i := strings.LastIndex(host, ":"); i > strings.LastIndex(host, "]") {
+		if _, ok := httpConfig.AllowedHosts[host[:i]]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost replaces request host with normalized one. Request with malformed host is answered with 400
+// and inbound request to host out of allowlist is answered with 421. It returns true if request is rejected
+func (h *HTTPHandler) checkHost(w io.Writer, req *nhttp.Request, netHTTPRequest *NetHTTPRequest, isInboundConn bool) bool {
+	startTime := time.Now()
+	host, err := normalizeHost(req.Host)
+	if err != nil {
+		h.logger.Debugf("Rejecting request %s %s: %s", req.Method, req.URL.Path, err.Error())
+		h.respondLocally(w, req, netHTTPRequest, nhttp.StatusBadRequest, nil,
+			opentracing.Tag{Key: "host.rejected", Value: "malformed"}, startTime)
+		return true
+	}
+	req.Host = host
+	if isInboundConn && !isAllowedHost(config.GetHTTPConfig(), host) {
+		h.logger.Debugf("Rejecting request %s %s%s: host isn't allowed", req.Method, req.Host, req.URL.Path)
+		h.respondLocally(w, req, netHTTPRequest, nhttp.StatusMisdirectedRequest, nil,
+			opentracing.Tag{Key: "host.rejected", Value: "not_allowed"}, startTime)
+		return true
+	}
+	return false
+}
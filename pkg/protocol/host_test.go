@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/Lookyan/netramesh/internal/config"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	cases := []struct {
+		host     string
+		expected string
+	}{
+		{"", ""},
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"example.com.", "example.com"},
+		{"example.com.:8080", "example.com:8080"},
+		{"example.com:80", "example.com"},
+		{"example.com:", "example.com"},
+		{"example.com:443", "example.com:443"},
+		{"10.0.0.1:80", "10.0.0.1"},
+		{"10.0.0.1:8080", "10.0.0.1:8080"},
+		{"my%2Dhost", "my%2dhost"},
+		// IPv6 literals keep brackets
+		{"[::1]", "[::1]"},
+		{"[::1]:80", "[::1]"},
+		{"[::1]:8080", "[::1]:8080"},
+		{"[2001:DB8::1]", "[2001:db8::1]"},
+		{"[2001:db8::1]:", "[2001:db8::1]"},
+		{"[::ffff:10.0.0.1]:9000", "[::ffff:10.0.0.1]:9000"},
+		{"[v1.fe80::a+en1]", "[v1.fe80::a+en1]"},
+	}
+	for _, c := range cases {
+		actual, err := normalizeHost(c.host)
+		if err != nil {
+			t.Fatalf("host %q: unexpected error %s", c.host, err.Error())
+		}
+		if actual != c.expected {
+			t.Fatalf("host %q: expected %q, got %q", c.host, c.expected, actual)
+		}
+	}
+}
+
+func TestNormalizeHostMalformed(t *testing.T) {
+	hosts := []string{
+		"user@example.com",
+		"example.com/path",
+		"exa mple.com",
+		"example.com:port",
+		"example.com:65536",
+		"example.com:80:80",
+		"my%2host",
+		"::1",
+		"[::1",
+		"[::1]x",
+		"[::1]:x",
+		"[10.0.0.1]",
+		"[example.com]",
+		"[v1.]",
+	}
+	for _, host := range hosts {
+		if normalized, err := normalizeHost(host); err == nil {
+			t.Fatalf("host %q: expected error, got %q", host, normalized)
+		}
+	}
+}
+
+func TestIsAllowedHost(t *testing.T) {
+	httpConfig := config.HTTPConfig{}
+	if !isAllowedHost(httpConfig, "example.com") {
+		t.Fatal("expected every host to be allowed without allowlist")
+	}
+	httpConfig.AllowedHosts = map[string]struct{}{"example.com": {}, "[::1]": {}}
+	for _, host := range []string{"example.com", "example.com:8080", "[::1]", "[::1]:8080"} {
+		if !isAllowedHost(httpConfig, host) {
+			t.Fatalf("host %q: expected to be allowed", host)
+		}
+	}
+	for _, host := range []string{"", "other.com", "sub.example.com", "[::2]"} {
+		if isAllowedHost(httpConfig, host) {
+			t.Fatalf("host %q: expected to be rejected", host)
+		}
+	}
+}
@@ -4,41 +4,58 @@ import (
 	"bufio"
 	"bytes"
 	"container/list"
-	"fmt"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/patrickmn/go-cache"
 	"github.com/uber/jaeger-client-go"
+	"golang.org/x/net/http/httpguts"
 
 	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/accesslog"
+	"github.com/Lookyan/netramesh/pkg/breaker"
 	nhttp "github.com/Lookyan/netramesh/pkg/http"
 	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+	"github.com/Lookyan/netramesh/pkg/outlier"
+	"github.com/Lookyan/netramesh/pkg/ratelimit"
+	"github.com/Lookyan/netramesh/pkg/stats"
 )
 
 var dumbReader = bytes.NewReader([]byte{})
 var readerPool = sync.Pool{
 	New: func() interface{} {
-		return bufio.NewReaderSize(dumbReader, 0xfff)
+		return bufio.NewReaderSize(dumbReader, bufioSize)
 	},
 }
 
 var dumbWriter = bytes.NewBuffer([]byte{})
 var writerPool = sync.Pool{
 	New: func() interface{} {
-		return bufio.NewWriterSize(dumbWriter, 0xfff)
+		return bufio.NewWriterSize(dumbWriter, bufioSize)
 	},
 }
 
 // HTTPHandler process HTTP protocol
 type HTTPHandler struct {
+	// mirrorsInflight is number of mirrored requests being sent, it's accessed atomically
+	mirrorsInflight           int64
 	tracingContextMapping     *cache.Cache
 	routingInfoContextMapping *cache.Cache
 	logger                    *log.Logger
+	rateLimiter               *ratelimit.Limiter
+	breakers                  *breaker.Set
+	outliers                  *outlier.Set
+	coalescer                 *coalescer
 }
 
 // NewHTTPHandler returns HTTP handler
@@ -50,6 +67,10 @@ func NewHTTPHandler(
 		tracingContextMapping:     tracingContextMapping,
 		routingInfoContextMapping: routingInfoContextMapping,
 		logger:                    logger,
+		rateLimiter:               ratelimit.New(),
+		breakers:                  breaker.NewSet(observeBreakerTransition),
+		outliers:                  outlier.NewSet(observeOutlierEjection),
+		coalescer:                 newCoalescer(),
 	}
 }
 
@@ -70,79 +91,234 @@ func (h *HTTPHandler) HandleRequest(
 	bufioHTTPReader := readerPool.Get().(*bufio.Reader)
 	bufioHTTPReader.Reset(readerWithFallback)
 	defer readerPool.Put(bufioHTTPReader)
-	if config.GetHTTPConfig().RoutingEnabled {
-		defer func() {
-			if addrCh != nil {
-				close(addrCh)
-			}
-		}()
+	// routing mode is chosen when connection is accepted, config may be reloaded since then
+	if addrCh != nil {
+		defer close(addrCh)
+	}
+	// upstream address of current request, it's resolved with routing logic only
+	dstAddr := originalDst
+	if w != nil {
+		netHTTPRequest.setConnDestination(w, dstAddr)
 	}
+	startLoop()
+	defer stopLoop()
+	// client address, it differs from connection peer address behind load balancer speaking PROXY protocol
+	clientAddr := r.RemoteAddr()
+	if isInboundConn && config.GetHTTPConfig().ProxyProtocol {
+		setReadDeadline(r, config.GetHTTPConfig().ReadTimeout)
+		addr, err := readProxyHeader(bufioHTTPReader)
+		if err == io.EOF {
+			h.logger.Debug("EOF while reading PROXY protocol header")
+			return w
+		}
+		if err != nil {
+			h.logger.Warningf("Closing connection from %s: %s", r.RemoteAddr().String(), err.Error())
+			return w
+		}
+		if addr != nil {
+			clientAddr = addr
+		}
+		// header is consumed by netra, it isn't forwarded upstream with unparsed request
+		tmpWriter.Stop()
+	}
+	// HTTP/2 with prior knowledge is recognized by connection preface only
+	firstRequest := true
 	for {
 		tmpWriter.Start()
-		req, err := nhttp.ReadRequest(bufioHTTPReader)
+		// keep-alive connection may be idle between requests, so read deadline counts from request first byte
+		idleTimeout := config.GetHTTPConfig().IdleTimeout
+		err := waitRequest(r, bufioHTTPReader, func() time.Time { return netHTTPRequest.idleDeadline(idleTimeout) })
+		if err == errShuttingDown {
+			// connection is closed between requests on shutdown, responses to sent requests are waited for
+			h.logger.Debug("Closing connection on shutdown")
+			netHTTPRequest.waitResponses()
+			return w
+		}
+		if err == errIdleTimeout {
+			h.logger.Debugf("Closing connection from %s idle for %s", r.RemoteAddr().String(), idleTimeout)
+			return w
+		}
+		readConfig := config.GetHTTPConfig()
+		setReadDeadline(r, readConfig.ReadTimeout)
+		if firstRequest && hasHTTP2Preface(bufioHTTPReader) {
+			tmpWriter.Stop()
+			return h.passHTTP2(r, w, connCh, addrCh, netHTTPRequest, originalDst, bufioHTTPReader)
+		}
+		firstRequest = false
+		req, err := nhttp.ReadRequestLimited(bufioHTTPReader, readConfig.MaxRequestLineBytes, readConfig.MaxHeaderBytes)
 		if err == io.EOF {
 			h.logger.Debug("EOF while parsing request HTTP")
+			// client may half-close connection after the last request and still read responses
+			netHTTPRequest.waitHalfClosed(config.GetHTTPConfig().ReadTimeout)
 			return w
 		}
-		if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
-			h.logger.Debug(err.Error())
+		readErr := classifyReadError(err)
+		if errors.Is(readErr, ErrConnClosed) {
+			h.logger.Debug(readErr.Error())
 			return w
 		}
+		// closed connection is the usual end of it, the rest of errors are counted
+		if readErr != nil {
+			metrics.ObserveReadError(isInboundConn, "request", readErrorCause(readErr))
+		}
+		if errors.Is(readErr, ErrReadTimeout) {
+			h.logger.Debugf("Timeout while reading http request: %s", err.Error())
+			return w
+		}
+		// the rest of oversized request is never parsed, so it isn't forwarded either
+		if status, ok := oversizedRequestStatus(err); ok {
+			h.logger.Warningf("Rejecting request from %s: %s", r.RemoteAddr().String(), err.Error())
+			if err := rejectRequest(r, status); err != nil {
+				h.logger.Debug(err.Error())
+			}
+			return w
+		}
+		if config.GetHTTPConfig().StrictFraming {
+			if reason := ambiguousFraming(req, err); reason != "" {
+				h.logger.Warningf("Rejecting request from %s with ambiguous framing: %s", r.RemoteAddr().String(), reason)
+				if err := rejectRequest(r, nhttp.StatusBadRequest); err != nil {
+					h.logger.Debug(err.Error())
+				}
+				return w
+			}
+		}
+
+		// observe only mode forwards request as it came: it's traced, but neither rewritten nor rejected
+		observeOnly := config.GetHTTPConfig().ObserveOnly
 
+		// tunnel authority is dialed as is, so its host isn't normalized
+		if req != nil && req.Method != nhttp.MethodConnect && !observeOnly &&
+			h.checkHost(r, req, netHTTPRequest, isInboundConn) {
+			tmpWriter.Stop()
+			if !isKeepAlive(req) {
+				return w
+			}
+			continue
+		}
+
+		if req != nil && req.Method != nhttp.MethodConnect && !observeOnly && h.checkHops(r, req, netHTTPRequest) {
+			tmpWriter.Stop()
+			if !isKeepAlive(req) {
+				return w
+			}
+			continue
+		}
+
+		if req != nil && isInboundConn && !observeOnly && h.limitRequest(r, req, netHTTPRequest) {
+			tmpWriter.Stop()
+			if !isKeepAlive(req) {
+				return w
+			}
+			continue
+		}
+
+		// explicit proxy clients open tunnel, nothing else is read from connection after it
+		if req != nil && req.Method == nhttp.MethodConnect {
+			tmpWriter.Stop()
+			return h.tunnel(r, w, connCh, addrCh, req, netHTTPRequest, isInboundConn, bufioHTTPReader)
+		}
+
+		// destination request copy is sent to, it's set by routing logic only
+		mirrorAddr := ""
 		if req != nil {
-			if req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName) == "" {
-				req.Header.Set(config.GetHTTPConfig().RequestIdHeaderName, uuid.New().String())
+			// the same config snapshot is used for whole routing decision
+			httpConfig := config.GetHTTPConfig()
+			if !observeOnly {
+				ensureRequestID(httpConfig, req.Header)
+			}
+			if isInboundConn && httpConfig.XForwardedForEnabled && !observeOnly {
+				setForwardedHeaders(httpConfig, req.Header, clientAddr)
 			}
 
-			if config.GetHTTPConfig().RoutingEnabled {
+			if addrCh != nil {
+				dstAddr = originalDst
+			}
+			if addrCh != nil && !observeOnly {
 				// check Cookie if enabled
 				currentRoutingHeaderValue := ""
-				if config.GetHTTPConfig().RoutingCookieEnabled {
-					cookie, err := req.Cookie(config.GetHTTPConfig().RoutingCookieName)
+				routingSource := routingSourceCookie
+				if httpConfig.RoutingCookieEnabled {
+					cookie, err := req.Cookie(httpConfig.RoutingCookieName)
 					if err == nil {
 						currentRoutingHeaderValue = cookie.Value
 					}
 				}
+				hasRoutingCookie := currentRoutingHeaderValue != ""
 				if currentRoutingHeaderValue == "" {
-					currentRoutingHeaderValue = req.Header.Get(config.GetHTTPConfig().RoutingHeaderName)
+					currentRoutingHeaderValue = req.Header.Get(httpConfig.RoutingHeaderName)
+					routingSource = routingSourceHeader
 				}
 				if currentRoutingHeaderValue == "" {
 					routingContext, ok := h.routingInfoContextMapping.Get(
-						req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName),
+						req.Header.Get(httpConfig.RequestIdHeaderName),
 					)
 					if ok {
 						currentRoutingHeaderValue = routingContext.(string)
-						req.Header.Add(config.GetHTTPConfig().RoutingHeaderName, currentRoutingHeaderValue)
+						routingSource = routingSourceContext
+						req.Header.Add(httpConfig.RoutingHeaderName, currentRoutingHeaderValue)
 					}
 				}
 
 				// here we can override destination (DNS allowed)
 				if currentRoutingHeaderValue != "" {
-					addr, err := getRoutingDestination(currentRoutingHeaderValue, req.Host, originalDst)
+					destination, err := getRoutingDestination(currentRoutingHeaderValue, req, originalDst, h.outliers.Ejected)
 					if err != nil {
 						log.Warning(err.Error())
-						addrCh <- originalDst
 					} else {
 						if isInboundConn {
-							if rID := req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName); rID != "" {
+							if rID := req.Header.Get(httpConfig.RequestIdHeaderName); rID != "" {
 								h.routingInfoContextMapping.SetDefault(
 									rID,
 									currentRoutingHeaderValue,
 								)
 							}
-							addrCh <- originalDst
 						} else {
-							addrCh <- addr
+							dstAddr = destination.addr
+							netHTTPRequest.setRoutedDestination(req, routedRequest{
+								addr:        destination.addr,
+								originalDst: originalDst,
+								source:      routingSource,
+							})
+							mirrorAddr = destination.mirror
+							// client keeps the same target of weighted rule for subsequent requests
+							if destination.weighted && !hasRoutingCookie && httpConfig.RoutingCookieEnabled &&
+								httpConfig.RoutingStickyCookieEnabled {
+								netHTTPRequest.setStickyRoute(req, req.Host+destination.pathPrefix+"="+destination.addr)
+							}
 						}
 					}
-				} else {
-					addrCh <- originalDst
 				}
+			}
+
+			if !observeOnly && h.injectFault(r, req, netHTTPRequest) {
+				tmpWriter.Stop()
+				if !isKeepAlive(req) {
+					return w
+				}
+				continue
+			}
+
+			// requests to failing destination are rejected without dialing it
+			if !isInboundConn && !observeOnly && h.breakRequest(r, req, netHTTPRequest, dstAddr) {
+				tmpWriter.Stop()
+				if !isKeepAlive(req) {
+					return w
+				}
+				continue
+			}
 
+			if addrCh != nil {
+				connectStart := time.Now()
+				addrCh <- dstAddr
 				w = <-connCh
 				if w == nil {
+					if !isInboundConn {
+						h.upstreamDone(dstAddr, false)
+					}
 					return w
 				}
+				netHTTPRequest.setConnectTime(req, time.Since(connectStart))
+				netHTTPRequest.setConnDestination(w, dstAddr)
 			}
 		}
 
@@ -151,7 +327,7 @@ func (h *HTTPHandler) HandleRequest(
 		}
 
 		if isInboundConn {
-			netHTTPRequest.remoteAddr = r.RemoteAddr().String()
+			netHTTPRequest.remoteAddr = clientAddr.String()
 		} else {
 			if w != nil {
 				netHTTPRequest.remoteAddr = w.RemoteAddr().String()
@@ -159,6 +335,7 @@ func (h *HTTPHandler) HandleRequest(
 		}
 		if err != nil {
 			h.logger.Warningf("Error while parsing http request '%s'", err.Error())
+			setReadDeadline(r, 0)
 			buf := bufferPool.Get().([]byte)
 			_, err = io.CopyBuffer(w, tmpWriter, buf)
 			bufferPool.Put(buf)
@@ -174,8 +351,12 @@ func (h *HTTPHandler) HandleRequest(
 			}
 			return w
 		}
-		// avoid ws connections and other upgrade protos
+		// ws connections and other upgrade protos are passed through as is,
+		// span for upgraded connection is started on 101 response
 		if strings.ToLower(req.Header.Get("Connection")) == "upgrade" {
+			netHTTPRequest.SetHTTPRequest(req)
+			netHTTPRequest.startFrameObservers(req)
+			setReadDeadline(r, 0)
 			buf := bufferPool.Get().([]byte)
 			_, err = io.CopyBuffer(w, tmpWriter, buf)
 			bufferPool.Put(buf)
@@ -184,25 +365,47 @@ func (h *HTTPHandler) HandleRequest(
 			}
 			tmpWriter.Stop()
 			buf = bufferPool.Get().([]byte)
-			_, err = io.CopyBuffer(w, bufioHTTPReader, buf)
+			_, err = io.CopyBuffer(
+				netHTTPRequest.observeFrames(newCountingWriter(w, &netHTTPRequest.upgradeBytesSent), true),
+				bufioHTTPReader, buf)
 			bufferPool.Put(buf)
 			if err != nil {
 				h.logger.Warning(err.Error())
 			}
+			netHTTPRequest.StopUpgrade()
 			return w
 		}
 
 		tmpWriter.Stop()
 
-		if !isInboundConn {
+		if !observeOnly {
+			netHTTPRequest.rewriteRequestPath(req)
+		}
+		if config.GetHTTPConfig().StripHopByHopHeaders && !observeOnly {
+			stripHopByHopHeaders(req.Header, req.ProtoMajor, req.ProtoMinor)
+		}
+		if !observeOnly {
+			applyHeaderRules(config.GetHTTPConfig().RequestHeaderRules, req.URL.Path, req.Header)
+		}
+		if httpConfig := config.GetHTTPConfig(); httpConfig.ViaEnabled && !observeOnly {
+			addVia(req.Header, req.ProtoMajor, req.ProtoMinor, httpConfig.ViaPseudonym)
+		}
+		if _, ok := req.Header["User-Agent"]; observeOnly && !ok {
+			// blank value keeps request writer from adding its default user agent
+			req.Header["User-Agent"] = []string{""}
+		}
+		keepTrailers(&req.Trailer, req.TransferEncoding)
+
+		if !isInboundConn && !observeOnly {
 			// we need to generate context header and propagate it
 			tracingInfoByRequestID, ok := h.tracingContextMapping.Get(
 				req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName),
 			)
-			if ok {
+			if ok && !preservesTraceContext(config.GetHTTPConfig(), req.Header) {
 				//h.logger.Debugf("Found request-id matching: %#v", tracingInfoByRequestID)
 				tracingContext := tracingInfoByRequestID.(jaeger.SpanContext)
 				req.Header[jaeger.TraceContextHeaderName] = []string{tracingContext.String()}
+				injectBaggage(tracingContext, req.Header)
 				//h.logger.Debugf("Outbound span: %s", tracingContext.String())
 			}
 			if v := req.Header.Get(config.GetHTTPConfig().XSourceHeaderName); v == "" {
@@ -210,25 +413,192 @@ func (h *HTTPHandler) HandleRequest(
 			}
 		}
 
+		// responses lagging behind pipelined requests make queues grow
+		if maxInflight := config.GetHTTPConfig().MaxInflightRequests; maxInflight > 0 &&
+			netHTTPRequest.httpRequests.Len() >= maxInflight {
+			h.logger.Warningf("Too many requests waiting for response (%d) on connection with %s, closing it",
+				netHTTPRequest.httpRequests.Len(), netHTTPRequest.remoteAddr)
+			return w
+		}
+
+		// identical request in flight shares its response, request pipelined after pending ones can't wait for it
+		if key, ok := coalesceKey(config.GetHTTPConfig(), req, dstAddr); ok && !observeOnly {
+			if flight, leader := h.coalescer.join(key); leader {
+				netHTTPRequest.leadCoalescing(req, flight)
+			} else if netHTTPRequest.httpRequests.Len() == 0 && h.respondCoalesced(r, req, netHTTPRequest, flight) {
+				if !isKeepAlive(req) {
+					return w
+				}
+				continue
+			}
+		}
+
+		// body is captured before it's buffered by hedges, retries or mirroring
+		netHTTPRequest.startCapture(req)
+
+		// safe requests to hedged routes race copies sent over new connections (routing logic only)
+		var hedge *requestHedge
+		if addrCh != nil && !isInboundConn && !observeOnly {
+			hedge, err = newRequestHedge(req, w, dstAddr, h.logger)
+			if err != nil {
+				h.logger.Warningf("Error while buffering request body for hedges: %s", err.Error())
+				hedge = nil
+			}
+			if hedge != nil {
+				netHTTPRequest.setHedge(req, hedge)
+			}
+		}
+
+		// idempotent requests can be replayed on new upstream connection (routing logic only)
+		var replay *requestReplay
+		if hedge == nil && addrCh != nil && !observeOnly && isRetryable(req) {
+			replay, err = newRequestReplay(req, w)
+			if err != nil {
+				h.logger.Warningf("Error while buffering request body for retries: %s", err.Error())
+				replay = nil
+			}
+			netHTTPRequest.setReplay(replay)
+		}
+
+		// route timeouts are known once request head is read, request body is read within them
+		if timeouts, ok := routeTimeouts(config.GetHTTPConfig(), req.URL.Path); ok {
+			netHTTPRequest.setTimeouts(req, timeouts)
+			netHTTPRequest.setRequestReadDeadline(r, req)
+		}
 		netHTTPRequest.SetHTTPRequest(req)
 		netHTTPRequest.StartRequest()
+		if mirrorAddr != "" {
+			h.mirrorRequest(req, mirrorAddr)
+		}
 
-		bufioWriter := writerPool.Get().(*bufio.Writer)
-		bufioWriter.Reset(w)
-		// write the same request to writer
-		err = req.Write(bufioWriter)
-		bufioWriter.Flush()
-		writerPool.Put(bufioWriter)
-		if err != nil && err != io.ErrUnexpectedEOF {
-			h.logger.Errorf("Error while writing request to w: %s", err.Error())
+		err = h.writeRequest(w, req, netHTTPRequest)
+		if err == nil {
+			netHTTPRequest.setRequestSent(req)
+			netHTTPRequest.logSpanEvent(req, "request_sent")
+		}
+		if hedge != nil && err == nil {
+			hedge.start()
+		}
+		for replay != nil {
+			// write failure is retried immediately, otherwise response side decides
+			if err == nil && !<-replay.verdict {
+				break
+			}
+			if !replay.nextAttempt() {
+				break
+			}
+			if delay := replay.takeDelay(); delay > 0 {
+				// upstream asked to wait with Retry-After
+				netHTTPRequest.addRetryDelay(req, delay)
+				if !waitDelay(r, bufioHTTPReader, delay) {
+					h.logger.Debugf("Client closed connection while waiting to retry %s %s%s", req.Method, req.Host, req.URL.Path)
+					netHTTPRequest.setReplay(nil)
+					return w
+				}
+			}
+			h.logger.Debugf("Retrying request %s %s%s", req.Method, req.Host, req.URL.Path)
+			netHTTPRequest.addRetry(req)
+			netHTTPRequest.logSpanEvent(req, "request_retried")
+			connectStart := time.Now()
+			addrCh <- dstAddr
+			w = <-connCh
+			if w == nil {
+				if !isInboundConn {
+					h.upstreamDone(dstAddr, false)
+				}
+				netHTTPRequest.setReplay(nil)
+				return w
+			}
+			netHTTPRequest.setConnectTime(req, time.Since(connectStart))
+			netHTTPRequest.setConnDestination(w, dstAddr)
+			replay.attempt(w)
+			err = h.writeRequest(w, req, netHTTPRequest)
+			if err == nil {
+				netHTTPRequest.setRequestSent(req)
+				netHTTPRequest.logSpanEvent(req, "request_sent")
+			}
+		}
+		if replay != nil {
+			netHTTPRequest.setReplay(nil)
+		}
+
+		if !isKeepAlive(req) {
+			break
 		}
 	}
 
+	// HTTP/1.0 connection without keep-alive serves single request:
+	// response side closes client connection, wait for it without parsing anything else
+	setReadDeadline(r, 0)
+	buf := bufferPool.Get().([]byte)
+	_, err := io.CopyBuffer(ioutil.Discard, bufioHTTPReader, buf)
+	bufferPool.Put(buf)
+	if err != nil {
+		h.logger.Debug(err.Error())
+	}
 	return w
 }
 
+// writeRequest writes request to upstream connection w
+func (h *HTTPHandler) writeRequest(w *net.TCPConn, req *nhttp.Request, netHTTPRequest *NetHTTPRequest) error {
+	netHTTPRequest.setRequestWriteDeadline(w, req)
+	written := &forwardWriter{w: w}
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(written)
+	// write the same request to writer
+	var err error
+	if expectsContinue(req) {
+		// body is streamed only when upstream agrees to accept it
+		continueCh := netHTTPRequest.expectContinue(req)
+		err = req.WriteContinue(bufioWriter, func() bool {
+			return netHTTPRequest.waitContinue(continueCh)
+		})
+	} else {
+		err = req.Write(bufioWriter)
+	}
+	if flushErr := bufioWriter.Flush(); err == nil {
+		err = flushErr
+	}
+	writerPool.Put(bufioWriter)
+	setWriteDeadline(w, 0)
+	metrics.ObserveHTTPRequestBytes(netHTTPRequest.isInbound, written.written)
+	if err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	if err != nil {
+		h.logger.Errorf("Error while writing request to w: %s", err.Error())
+		return err
+	}
+	// response is expected within read timeout
+	netHTTPRequest.deadlineMu.Lock()
+	netHTTPRequest.setRequestReadDeadline(w, req)
+	netHTTPRequest.deadlineMu.Unlock()
+	return nil
+}
+
 func (h *HTTPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	h.handleResponses(r, w, netRequest, isInboundConn, forceClose, false)
+}
+
+// HandlePooledResponse handles response to single request sent over connection borrowed from pool
+// and reports whether connection can be reused
+func (h *HTTPHandler) HandlePooledResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool) bool {
+	return h.handleResponses(r, w, netRequest, isInboundConn, false, true)
+}
+
+// handleResponses handles responses read from r until connection is closed,
+// pooled connection is left after the first final response
+func (h *HTTPHandler) handleResponses(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	netRequest NetRequest,
+	isInboundConn bool,
+	forceClose bool,
+	pooled bool) bool {
 	netHTTPRequest := netRequest.(*NetHTTPRequest)
+	atomic.AddInt32(&netHTTPRequest.responseLoops, 1)
+	atomic.StoreInt32(&netHTTPRequest.responseLoopsStarted, 1)
+	defer atomic.AddInt32(&netHTTPRequest.responseLoops, -1)
 	tmpWriter := NewTempWriter()
 	defer tmpWriter.Close()
 	readerWithFallback := io.TeeReader(r, tmpWriter)
@@ -238,19 +608,85 @@ func (h *HTTPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest
 	if !config.GetHTTPConfig().RoutingEnabled {
 		defer netHTTPRequest.CleanUp()
 	}
+	// request waiting for response from this connection is retried if connection fails
+	defer netHTTPRequest.resolveReplay(r, true)
+	defer netHTTPRequest.forgetConnDestination(r)
 	for {
 		tmpWriter.Start()
-		resp, err := nhttp.ReadResponse(bufioHTTPReader, nil)
+		// response is waited for before pending request is looked up, request is queued before it's sent
+		if _, err := bufioHTTPReader.Peek(1); err == nil && netHTTPRequest.isTunneling() {
+			tmpWriter.Stop()
+			setReadDeadline(r, 0)
+			_, err = io.Copy(
+				newCountingWriter(w, &netHTTPRequest.upgradeBytesReceived), bufioHTTPReader)
+			if err != nil {
+				h.logger.Warning(err.Error())
+			}
+			netHTTPRequest.StopUpgrade()
+			return false
+		}
+		// responses come in order of requests (pipelining included), so response answers the oldest pending request,
+		// its method tells whether response has body (e.g. HEAD response doesn't have one despite Content-Length)
+		var pendingReq *nhttp.Request
+		rq := netHTTPRequest.httpRequests.Peek()
+		if rq != nil {
+			pendingReq = rq.(*nhttp.Request)
+		}
+		resp, err := nhttp.ReadResponse(bufioHTTPReader, pendingReq)
+		var hedge *requestHedge
+		if pendingReq != nil {
+			hedge = netHTTPRequest.hedgeOf(pendingReq, r)
+		}
+		if hedge != nil {
+			resp, err = hedge.resolve(resp, err)
+			if err != nil {
+				hedge.close()
+			}
+		}
+		if err == nil && pendingReq != nil {
+			netHTTPRequest.setFirstByte(pendingReq)
+		}
+		// upstream failed request waiting for response, the rest of pending requests are replayed or left as is
+		if pendingReq != nil && isUpstreamReset(err) {
+			h.logger.Warningf("Upstream connection failed before response: %s", err.Error())
+			if dstAddr, ok := netHTTPRequest.connDestination(r); ok && !isInboundConn {
+				h.upstreamDone(dstAddr, false)
+			}
+			if !netHTTPRequest.resolveReplay(r, true) {
+				h.failUpstream(w, pendingReq, netHTTPRequest)
+			}
+			return false
+		}
 		if err == io.EOF {
 			h.logger.Debug("EOF while parsing response HTTP")
-			return
+			return false
+		}
+		readErr := classifyReadError(err)
+		if errors.Is(readErr, ErrConnClosed) {
+			h.logger.Debug(readErr.Error())
+			return false
 		}
-		if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
-			h.logger.Debug(err.Error())
-			return
+		// closed connection is the usual end of it, the rest of errors are counted
+		if readErr != nil {
+			metrics.ObserveReadError(isInboundConn, "response", readErrorCause(readErr))
+		}
+		if errors.Is(readErr, ErrReadTimeout) {
+			h.logger.Debugf("Timeout while waiting for http response: %s", err.Error())
+			if dstAddr, ok := netHTTPRequest.connDestination(r); ok && !isInboundConn {
+				h.upstreamDone(dstAddr, false)
+			}
+			if netHTTPRequest.resolveReplay(r, true) {
+				return false
+			}
+			// requests left without response are finished as timed out
+			for netHTTPRequest.httpRequests.Peek() != nil {
+				netHTTPRequest.StopRequest()
+			}
+			return false
 		}
 		if err != nil {
 			h.logger.Warningf("Error while parsing http response: %s", err.Error())
+			setReadDeadline(r, 0)
 			_, err = io.Copy(w, tmpWriter)
 			if err != nil {
 				h.logger.Warning(err.Error())
@@ -260,40 +696,146 @@ func (h *HTTPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest
 			if err != nil {
 				h.logger.Warning(err.Error())
 			}
-			return
+			return false
 		}
 
-		// avoid ws connections and other upgrade protos
+		// ws connections and other upgrade protos are passed through as is
 		if strings.ToLower(resp.Header.Get("Connection")) == "upgrade" {
+			if resp.StatusCode == nhttp.StatusSwitchingProtocols {
+				netHTTPRequest.StartUpgrade(resp)
+			}
+			setReadDeadline(r, 0)
 			_, err = io.Copy(w, tmpWriter)
 			if err != nil {
 				h.logger.Warning(err.Error())
 			}
 			tmpWriter.Stop()
-			_, err = io.Copy(w, bufioHTTPReader)
+			_, err = io.Copy(
+				netHTTPRequest.observeFrames(newCountingWriter(w, &netHTTPRequest.upgradeBytesReceived), false),
+				bufioHTTPReader)
 			if err != nil {
 				h.logger.Warning(err.Error())
 			}
-			return
+			netHTTPRequest.StopUpgrade()
+			return false
 		}
 
 		tmpWriter.Stop()
 
-		// if method == HEAD and content-length != 0, it will hang on read with LimitReader, handle this:
-		rq := netHTTPRequest.httpRequests.Peek()
-		if rq != nil && rq.(*nhttp.Request).Method == nhttp.MethodHead {
+		observeOnly := config.GetHTTPConfig().ObserveOnly
+		if config.GetHTTPConfig().StripHopByHopHeaders && !observeOnly {
+			stripHopByHopHeaders(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+		}
+		keepTrailers(&resp.Trailer, resp.TransferEncoding)
+
+		if pendingReq != nil {
+			netHTTPRequest.captureResponse(pendingReq, resp)
+		}
+		// body prefix is kept to tag span with its fields
+		if httpConfig := config.GetHTTPConfig(); len(httpConfig.ResponseBodyFieldsMap) > 0 &&
+			httpConfig.MaxBodyInspectBytes > 0 && resp.Body != nil && resp.Body != nhttp.NoBody {
+			resp.Body = newBodyInspector(resp.Body, httpConfig.MaxBodyInspectBytes)
+		}
+		// body length is unknown in advance (e.g. chunked), count it while streaming
+		if resp.ContentLength < 0 && resp.Body != nil {
+			resp.Body = newCountingReadCloser(resp.Body)
+		}
+
+		// response is written within write timeout of its request
+		if pendingReq != nil {
+			netHTTPRequest.setRequestWriteDeadline(w, pendingReq)
+		} else {
+			setWriteDeadline(w, config.GetHTTPConfig().WriteTimeout)
+		}
+		// interim response (e.g. 100 Continue, 103 Early Hints) is forwarded and followed by final one
+		interim := isInterimResponse(resp)
+		// interim responses don't tell anything about destination health
+		if dstAddr, ok := netHTTPRequest.connDestination(r); ok && !isInboundConn && !interim {
+			h.upstreamDone(dstAddr, resp.StatusCode < 500)
+		}
+		if rq != nil && (resp.StatusCode == nhttp.StatusContinue || !interim) {
+			// request body is sent after 100 Continue, final response means upstream doesn't want it
+			netHTTPRequest.resolveContinue(rq.(*nhttp.Request), resp.StatusCode == nhttp.StatusContinue)
+		}
+		// upstream failure of idempotent request isn't sent to client, request is replayed instead
+		if rq != nil && resp.StatusCode >= 500 && netHTTPRequest.isReplayed(rq.(*nhttp.Request)) {
+			if netHTTPRequest.delayReplay(rq.(*nhttp.Request), resp) && netHTTPRequest.resolveReplay(r, true) {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				return false
+			}
+		}
+
+		// shared response is taken before headers of leading request are added to it
+		if pendingReq != nil && !interim {
+			netHTTPRequest.captureSharedResponse(pendingReq, resp, r)
+		}
+		if rq != nil && !interim {
+			netHTTPRequest.assignStickyRoute(rq.(*nhttp.Request), resp)
+		}
+		if rq != nil && !interim && !observeOnly {
+			applyHeaderRules(config.GetHTTPConfig().ResponseHeaderRules, rq.(*nhttp.Request).URL.Path, resp.Header)
+		}
+		if httpConfig := config.GetHTTPConfig(); !interim && httpConfig.ViaEnabled && !observeOnly {
+			addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, httpConfig.ViaPseudonym)
+		}
+		if httpConfig := config.GetHTTPConfig(); rq != nil && !interim && !observeOnly &&
+			len(httpConfig.ResponseHeaders) > 0 {
+			upstream, ok := netHTTPRequest.connDestination(r)
+			if !ok {
+				upstream = r.RemoteAddr().String()
+			}
+			setResponseHeaders(httpConfig, resp.Header,
+				rq.(*nhttp.Request).Header.Get(httpConfig.RequestIdHeaderName), upstream)
+		}
+
+		upstreamFailed := false
+		streamed := false
+		// bytes written to client are counted for every kind of response
+		forwarded := &forwardWriter{w: w}
+		if interim {
+			err = writeInterimResponse(forwarded, resp)
+		} else if rq != nil && rq.(*nhttp.Request).Method == nhttp.MethodHead {
+			// HEAD response is written without body whatever its Content-Length is,
 			// server side can hold connection which leads to stuck Close() method in Write(w)
-			if forceClose && resp.StatusCode != 100 {
+			if forceClose {
 				r.CloseRead()
 				r.CloseWrite()
 				r.Close()
 			}
-			err = resp.Write(w)
+			err = resp.Write(forwarded)
+		} else if isEventStream(resp) {
+			// request is finished when stream starts, stream which isn't closed cleanly is truncated
+			err = h.streamEvents(r, w, resp, netHTTPRequest)
+			streamed, upstreamFailed = true, err != nil
 		} else {
 			bufioWriter := writerPool.Get().(*bufio.Writer)
-			bufioWriter.Reset(w)
+			bufioWriter.Reset(forwarded)
 			// write the same response to w
 			err = resp.Write(bufioWriter)
+			if err != nil && forwarded.writeErr == nil && pendingReq != nil &&
+				isShortRead(resp, err) && !config.GetHTTPConfig().StrictResponseLength {
+				// backend is known to declare longer body than it sends, truncation is passed to client as is
+				h.logger.Debugf("Upstream closed connection before Content-Length %d is read", resp.ContentLength)
+				netHTTPRequest.logSpanEvent(pendingReq, "response_truncated")
+				upstreamFailed, err = true, nil
+			} else if err != nil && forwarded.writeErr == nil && pendingReq != nil {
+				// body isn't read to the end, upstream connection failed in the middle of response
+				h.logger.Warningf("Upstream connection failed in the middle of response: %s", err.Error())
+				if isShortRead(resp, err) {
+					netHTTPRequest.setErrorType(pendingReq, shortReadErrorType)
+				} else {
+					netHTTPRequest.setErrorType(pendingReq, upstreamResetErrorType)
+				}
+				upstreamFailed = true
+				if answersBadGateway(forwarded.written > 0) {
+					// response head is still buffered, so it's dropped
+					bufioWriter.Reset(w)
+					resp.Body.Close()
+					resp, err = writeBadGateway(forwarded, pendingReq)
+					upstreamFailed = false
+				}
+			}
 			bufioWriter.Flush()
 			writerPool.Put(bufioWriter)
 		}
@@ -301,11 +843,54 @@ func (h *HTTPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest
 		if err != nil {
 			h.logger.Errorf("Error while writing response to w: %s", err.Error())
 		}
+		metrics.ObserveHTTPResponseBytes(netHTTPRequest.isInbound, forwarded.written)
+		setWriteDeadline(w, 0)
+		if hedge != nil && !interim {
+			hedge.close()
+		}
+
+		// interim response doesn't finish request, final one follows it
+		if interim {
+			if rq != nil {
+				netHTTPRequest.logSpanEvent(rq.(*nhttp.Request), "interim_response_received",
+					otlog.Int("http.status_code", resp.StatusCode))
+			}
+			continue
+		}
 
-		netHTTPRequest.SetHTTPResponse(resp)
-		netHTTPRequest.StopRequest()
-		// in case of 100 response we can't close connection (server can keep on sending responses)
-		if forceClose && resp.StatusCode != 100 {
+		if pendingReq != nil {
+			netHTTPRequest.finishCoalescing(pendingReq, err == nil && !upstreamFailed && !streamed)
+		}
+		if !streamed {
+			netHTTPRequest.SetHTTPResponse(resp)
+			netHTTPRequest.StopRequest()
+		}
+		if upstreamFailed {
+			// client sees truncated response as closed connection, the rest of upstream one can't be read
+			w.Close()
+			return false
+		}
+		if rq != nil && netHTTPRequest.isReplayed(rq.(*nhttp.Request)) {
+			netHTTPRequest.resolveReplay(r, false)
+		}
+		if httpConfig := config.GetHTTPConfig(); httpConfig.ReadTimeout > 0 || len(httpConfig.RouteTimeouts) > 0 {
+			// idle backend connection without pending requests shouldn't time out
+			netHTTPRequest.deadlineMu.Lock()
+			if netHTTPRequest.httpRequests.Peek() == nil {
+				setReadDeadline(r, 0)
+			}
+			netHTTPRequest.deadlineMu.Unlock()
+		}
+		// HTTP/1.0 client without keep-alive waits for connection close after response
+		if rq != nil && !isKeepAlive(rq.(*nhttp.Request)) {
+			w.CloseWrite()
+		}
+		if pooled {
+			// the rest of connection data would be lost, so connection with it isn't reused
+			return err == nil && rq != nil && !rq.(*nhttp.Request).Close && !resp.Close &&
+				bufioHTTPReader.Buffered() == 0
+		}
+		if forceClose {
 			r.CloseRead()
 			r.CloseWrite()
 			r.Close()
@@ -317,10 +902,92 @@ type NetHTTPRequest struct {
 	httpRequests          *Queue
 	httpResponses         *Queue
 	spans                 *Queue
+	startTimes            *Queue
 	isInbound             bool
 	tracingContextMapping *cache.Cache
 	logger                *log.Logger
 	remoteAddr            string
+	// deadlineMu serializes response read deadline updates between request and response sides
+	deadlineMu sync.Mutex
+
+	// request waiting for 100 Continue before sending its body
+	continueMu  sync.Mutex
+	continueReq *nhttp.Request
+	continueCh  chan bool
+
+	// replayed request state shared between request and response sides
+	replayMu    sync.Mutex
+	replay      *requestReplay
+	retryCounts map[*nhttp.Request]int
+	retryDelays map[*nhttp.Request]time.Duration
+
+	// hedged requests raced over several upstream connections
+	hedgesMu sync.Mutex
+	hedges   map[*nhttp.Request]*requestHedge
+
+	// span logs of request events waiting for span to be finished
+	spanEventsMu sync.Mutex
+	spanEvents   map[*nhttp.Request][]opentracing.LogRecord
+
+	// destinations of outbound requests rewritten by routing logic
+	routedMu           sync.Mutex
+	routedDestinations map[*nhttp.Request]routedRequest
+
+	// destinations of upstream connections, circuit breaker results are keyed by them
+	connDestinationsMu sync.Mutex
+	connDestinations   map[*net.TCPConn]string
+
+	// paths of requests before they were rewritten
+	rewritesMu    sync.Mutex
+	originalPaths map[*nhttp.Request]string
+
+	// flights of identical requests led by requests of connection
+	coalesceMu     sync.Mutex
+	coalescing     map[*nhttp.Request]*coalescingRequest
+	coalesceClosed bool
+
+	// faults injected into requests to be traced
+	faultsMu       sync.Mutex
+	injectedFaults map[*nhttp.Request]string
+
+	// types of errors requests failed with, e.g. upstream reset
+	errorTypesMu sync.Mutex
+	errorTypes   map[*nhttp.Request]string
+
+	// routes assigned to clients with sticky routing cookie
+	stickyMu     sync.Mutex
+	stickyRoutes map[*nhttp.Request]string
+
+	// upstream connection and response timings of requests
+	timingsMu sync.Mutex
+	timings   map[*nhttp.Request]*requestTiming
+
+	// bodies of requests sampled for capture
+	capturesMu sync.Mutex
+	captures   map[*nhttp.Request]*requestCapture
+
+	// number of queued requests reported to metrics
+	inflightMu sync.Mutex
+	inflight   int
+	cleanedUp  bool
+
+	// upgraded connection (e.g. websocket) state
+	upgradeMu            sync.Mutex
+	upgradeSpan          opentracing.Span
+	upgradeClosed        bool
+	upgradeBytesSent     int64
+	upgradeBytesReceived int64
+	// frame observers of websocket connection, they are set if frame tracing is enabled
+	framesSent     *wsFrameObserver
+	framesReceived *wsFrameObserver
+	// set when connection is tunneled with CONNECT request or passed through as HTTP/2 one
+	tunneling int32
+	// unix time in nanoseconds the last request was finished at, idle timeout counts from it
+	lastActive int64
+	// number of running response loops and whether any of them has started,
+	// client half-closed connection waits for them
+	responseLoops        int32
+	responseLoopsStarted int32
 }
 
 func NewNetHTTPRequest(logger *log.Logger, isInbound bool, tracingContextMapping *cache.Cache) *NetHTTPRequest {
@@ -328,34 +995,89 @@ func NewNetHTTPRequest(logger *log.Logger, isInbound bool, tracingContextMapping
 		httpRequests:          NewQueue(),
 		httpResponses:         NewQueue(),
 		spans:                 NewQueue(),
+		startTimes:            NewQueue(),
+		retryCounts:           make(map[*nhttp.Request]int),
+		retryDelays:           make(map[*nhttp.Request]time.Duration),
+		hedges:                make(map[*nhttp.Request]*requestHedge),
+		spanEvents:            make(map[*nhttp.Request][]opentracing.LogRecord),
+		routedDestinations:    make(map[*nhttp.Request]routedRequest),
+		connDestinations:      make(map[*net.TCPConn]string),
+		originalPaths:         make(map[*nhttp.Request]string),
+		coalescing:            make(map[*nhttp.Request]*coalescingRequest),
+		injectedFaults:        make(map[*nhttp.Request]string),
+		errorTypes:            make(map[*nhttp.Request]string),
+		stickyRoutes:          make(map[*nhttp.Request]string),
+		timings:               make(map[*nhttp.Request]*requestTiming),
+		captures:              make(map[*nhttp.Request]*requestCapture),
 		logger:                logger,
 		isInbound:             isInbound,
 		tracingContextMapping: tracingContextMapping,
+		lastActive:            time.Now().UnixNano(),
 	}
 }
 
+// StartRequest starts span of request queued last, older pipelined requests already have their spans
 func (nr *NetHTTPRequest) StartRequest() {
-	request := nr.httpRequests.Peek()
+	request := nr.httpRequests.Last()
 	if request == nil {
 		return
 	}
-	httpRequest := request.(*nhttp.Request)
-	carrier := opentracing.HTTPHeadersCarrier(httpRequest.Header)
-	wireContext, err := opentracing.GlobalTracer().Extract(opentracing.HTTPHeaders, carrier)
+	start := requestStart{time: time.Now()}
+	if stats.Enabled() {
+		start.operation = nr.operationName(request.(*nhttp.Request))
+	}
+	nr.startTimes.Push(start)
+	if isUntraced(config.GetHTTPConfig(), request.(*nhttp.Request)) {
+		// nil span keeps spans aligned with requests
+		nr.spans.Push(nil)
+		return
+	}
+	nr.spans.Push(nr.startSpan(request.(*nhttp.Request)))
+	nr.logSpanEvent(request.(*nhttp.Request), "request_received")
+}
 
-	operation := httpRequest.URL.Path
-	if !nr.isInbound {
-		operation = httpRequest.Host + httpRequest.URL.Path
+// requestStart is start time of request, operation is set only if its latency stats are recorded
+type requestStart struct {
+	time      time.Time
+	operation string
+}
+
+// operationName returns operation name of request, it's called before routing of request is forgotten
+func (nr *NetHTTPRequest) operationName(req *nhttp.Request) string {
+	destination := req.Host
+	if addr, ok := nr.routedDestination(req); ok {
+		destination = addr
 	}
+	return operationName(config.GetHTTPConfig(), req, nr.isInbound, destination)
+}
+
+// startSpan starts span for request and propagates its tracing context
+func (nr *NetHTTPRequest) startSpan(httpRequest *nhttp.Request) opentracing.Span {
+	wireContext, err := extractContext(httpRequest.Header)
+
 	httpConfig := config.GetHTTPConfig()
+	operation := nr.operationName(httpRequest)
 	var span opentracing.Span
 	if err != nil {
 		nr.logger.Infof("Carrier extract error: %s", err.Error())
+		var opts []opentracing.StartSpanOption
+		if priority, ok := forcedSamplingPriority(httpConfig, httpRequest.Header); ok {
+			opts = append(opts, opentracing.Tag{Key: string(ext.SamplingPriority), Value: priority})
+		} else if priority, ok := extractSamplingPriority(httpRequest.Header); ok {
+			opts = append(opts, opentracing.Tag{Key: string(ext.SamplingPriority), Value: priority})
+		} else if rate, ok := routeSamplingRate(httpConfig, httpRequest.URL.Path); nr.isInbound && ok {
+			// noisy routes (e.g. health checks) are sampled less than the rest
+			if dropSampling(rate) {
+				opts = append(opts, opentracing.Tag{Key: string(ext.SamplingPriority), Value: uint16(0)})
+			}
+		}
 		span = opentracing.StartSpan(
 			operation,
+			opts...,
 		)
 
 		if nr.isInbound {
+			seedBaggage(httpConfig, span, httpRequest.Header)
 			context := span.Context().(jaeger.SpanContext)
 			nr.tracingContextMapping.SetDefault(
 				httpRequest.Header.Get(httpConfig.RequestIdHeaderName),
@@ -366,7 +1088,7 @@ func (nr *NetHTTPRequest) StartRequest() {
 				// prefer httpConfig iteration, headers are already parsed into a map
 				for headerName, tagName := range httpConfig.HeadersMap {
 					if val := httpRequest.Header.Get(headerName); val != "" {
-						span.SetTag(tagName, val)
+						setStringTag(span, tagName, maskSensitive(httpConfig, headerName, val))
 					}
 				}
 			}
@@ -374,21 +1096,21 @@ func (nr *NetHTTPRequest) StartRequest() {
 				// prefer cookies list iteration (there is no pre-parsed cookies list)
 				for _, cookie := range httpRequest.Cookies() {
 					if tagName, ok := httpConfig.CookiesMap[cookie.Name]; ok {
-						span.SetTag(tagName, cookie.Value)
+						setStringTag(span, tagName, maskSensitive(httpConfig, cookie.Name, cookie.Value))
 					}
 				}
 			}
-		} else {
-			span.Tracer().Inject(
-				span.Context(),
-				opentracing.HTTPHeaders,
-				opentracing.HTTPHeadersCarrier(httpRequest.Header),
-			)
+		} else if !httpConfig.ObserveOnly {
+			injectContext(span.Context(), httpRequest.Header)
 		}
 	} else {
+		opts := []opentracing.StartSpanOption{opentracing.ChildOf(wireContext)}
+		if priority, ok := forcedSamplingPriority(httpConfig, httpRequest.Header); ok {
+			opts = append(opts, opentracing.Tag{Key: string(ext.SamplingPriority), Value: priority})
+		}
 		span = opentracing.StartSpan(
 			operation,
-			opentracing.ChildOf(wireContext),
+			opts...,
 		)
 
 		if nr.isInbound {
@@ -397,15 +1119,23 @@ func (nr *NetHTTPRequest) StartRequest() {
 				httpRequest.Header.Get(httpConfig.RequestIdHeaderName),
 				context,
 			)
+		} else if !httpConfig.ObserveOnly {
+			injectContext(wireContext, httpRequest.Header)
 		}
 	}
+	tagBaggage(httpConfig, span)
 
-	nr.spans.Push(span)
+	return span
 }
 
 func (nr *NetHTTPRequest) StopRequest() {
-	request := nr.httpRequests.Pop()
+	request := nr.popHTTPRequest()
 	response := nr.httpResponses.Pop()
+	atomic.StoreInt64(&nr.lastActive, time.Now().UnixNano())
+	if request != nil {
+		// request finished without shared response leaves its flight to identical requests waiting for it
+		nr.finishCoalescing(request.(*nhttp.Request), false)
+	}
 	if request != nil && response != nil {
 		httpRequest := request.(*nhttp.Request)
 		httpResponse := response.(*nhttp.Response)
@@ -413,8 +1143,12 @@ func (nr *NetHTTPRequest) StopRequest() {
 		if span != nil {
 			requestSpan := span.(opentracing.Span)
 			nr.fillSpan(requestSpan, httpRequest, httpResponse)
-			requestSpan.Finish()
+			nr.finishSpan(requestSpan, httpRequest, httpResponse)
+		} else {
+			nr.forgetSpanState(httpRequest)
 		}
+		nr.observe(httpRequest, httpResponse)
+		nr.writeCapture(httpRequest, httpResponse)
 	}
 
 	if request != nil && response == nil {
@@ -422,16 +1156,125 @@ func (nr *NetHTTPRequest) StopRequest() {
 		span := nr.spans.Pop()
 		if span != nil {
 			requestSpan := span.(opentracing.Span)
+			// request without response either failed with known error or timed out
+			errorType, failed := nr.popErrorType(httpRequest)
 			nr.fillSpan(requestSpan, httpRequest, nil)
 			requestSpan.SetTag("error", true)
-			requestSpan.SetTag("timeout", true)
-			requestSpan.Finish()
+			if failed {
+				requestSpan.SetTag("error.type", errorType)
+			} else {
+				requestSpan.SetTag("timeout", true)
+			}
+			nr.finishSpan(requestSpan, httpRequest, nil)
+		} else {
+			nr.forgetSpanState(httpRequest)
 		}
+		nr.observe(httpRequest, nil)
+		nr.writeCapture(httpRequest, nil)
+	}
+}
+
+// forgetSpanState drops request state kept to be set as span tags, it's used for requests without span
+func (nr *NetHTTPRequest) forgetSpanState(req *nhttp.Request) {
+	nr.popRetries(req)
+	nr.popRetryDelay(req)
+	nr.popHedge(req)
+	nr.popInjectedFault(req)
+	nr.popErrorType(req)
+	nr.popOriginalPath(req)
+	nr.popRoutedDestination(req)
+	nr.popSpanEvents(req)
+	nr.popTiming(req)
+}
+
+// observe records request metrics and access log entry, resp is nil for request without response
+func (nr *NetHTTPRequest) observe(req *nhttp.Request, resp *nhttp.Response) {
+	start := nr.startTimes.Pop()
+	if start == nil {
+		return
+	}
+	duration := time.Since(start.(requestStart).time)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	metrics.ObserveHTTPRequest(nr.isInbound, req.Method, statusCode, duration)
+	if operation := start.(requestStart).operation; operation != "" {
+		stats.Observe(operation, duration)
+	}
+
+	if !accesslog.Enabled() {
+		return
+	}
+	entry := accesslog.Entry{
+		Direction:   "outbound",
+		Method:      req.Method,
+		Host:        req.Host,
+		Path:        req.URL.Path,
+		StatusCode:  statusCode,
+		RequestSize: req.ContentLength,
+		Duration:    duration.Seconds(),
+		RemoteAddr:  nr.remoteAddr,
+		RequestID:   req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName),
+	}
+	if nr.isInbound {
+		entry.Direction = "inbound"
+	}
+	if resp != nil {
+		entry.ResponseSize = responseSize(resp)
+	}
+	if err := accesslog.Write(entry); err != nil {
+		nr.logger.Warningf("Error while writing access log: %s", err.Error())
+	}
+}
+
+// responseSize returns size of response body, body of unknown length is counted while streamed
+func responseSize(resp *nhttp.Response) int64 {
+	if countingBody, ok := resp.Body.(*countingReadCloser); ok {
+		return countingBody.Count()
 	}
+	return resp.ContentLength
+}
+
+// StartUpgrade starts span for upgraded connection (e.g. websocket) when 101 response is received
+func (nr *NetHTTPRequest) StartUpgrade(resp *nhttp.Response) {
+	request := nr.popHTTPRequest()
+	if request == nil {
+		return
+	}
+	httpRequest := request.(*nhttp.Request)
+	nr.upgradeMu.Lock()
+	defer nr.upgradeMu.Unlock()
+	if nr.upgradeClosed || nr.upgradeSpan != nil {
+		return
+	}
+	span := nr.startSpan(httpRequest)
+	nr.fillSpan(span, httpRequest, resp)
+	span.SetTag("http.upgrade", strings.ToLower(resp.Header.Get("Upgrade")))
+	if subprotocol := resp.Header.Get("Sec-WebSocket-Protocol"); subprotocol != "" {
+		span.SetTag("websocket.protocol", subprotocol)
+	}
+	nr.upgradeSpan = span
+}
+
+// StopUpgrade finishes span for upgraded connection, it's called when either side is closed
+func (nr *NetHTTPRequest) StopUpgrade() {
+	nr.upgradeMu.Lock()
+	defer nr.upgradeMu.Unlock()
+	nr.upgradeClosed = true
+	if nr.upgradeSpan == nil {
+		return
+	}
+	// sent is client to server direction, received is server to client one
+	nr.upgradeSpan.SetTag("bytes_sent", atomic.LoadInt64(&nr.upgradeBytesSent))
+	nr.upgradeSpan.SetTag("bytes_received", atomic.LoadInt64(&nr.upgradeBytesReceived))
+	nr.upgradeSpan.FinishWithOptions(opentracing.FinishOptions{LogRecords: nr.tagFrames(nr.upgradeSpan)})
+	nr.upgradeSpan = nil
 }
 
 func (nr *NetHTTPRequest) CleanUp() {
-	// here we can do some cleanup staff
+	nr.dropInflight()
+	nr.abandonCoalescing()
 }
 
 func (nr *NetHTTPRequest) fillSpan(
@@ -445,28 +1288,88 @@ func (nr *NetHTTPRequest) fillSpan(
 	}
 	span.SetTag("remote_addr", nr.remoteAddr)
 	if req != nil {
-		span.SetTag("http.host", req.Host)
-		span.SetTag("http.path", req.URL.String())
+		setStringTag(span, "http.host", req.Host)
+		setStringTag(span, "http.path", req.URL.String())
+		if originalPath, ok := nr.popOriginalPath(req); ok {
+			setStringTag(span, "http.original_path", originalPath)
+		}
 		span.SetTag("http.request_size", req.ContentLength)
 		span.SetTag("http.method", req.Method)
+		tagQueryParams(config.GetHTTPConfig(), span, req)
+		if nr.isInbound {
+			tagConnectionMetadata(config.GetHTTPConfig(), span, req.Header)
+		}
 		if userAgent := req.Header.Get("User-Agent"); userAgent != "" {
-			span.SetTag("http.user_agent", userAgent)
+			setStringTag(span, "http.user_agent", userAgent)
 		}
 		if requestID := req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName); requestID != "" {
-			span.SetTag("http.request_id", requestID)
+			setStringTag(span, "http.request_id", requestID)
+		}
+		if retries := nr.popRetries(req); retries > 0 {
+			span.SetTag("retry.count", retries)
+		}
+		if delay, ok := nr.popRetryDelay(req); ok {
+			span.SetTag("retry.after_honored", true)
+			span.SetTag("retry.after_delay_ms", durationMilliseconds(delay))
+		}
+		if hedge := nr.popHedge(req); hedge != nil {
+			if hedged, winner := hedge.tags(); hedged {
+				span.SetTag("hedged", true)
+				span.SetTag("hedge.winner", winner)
+			}
+		}
+		if fault, ok := nr.popInjectedFault(req); ok {
+			span.SetTag("fault.injected", fault)
+		}
+		if errorType, ok := nr.popErrorType(req); ok {
+			span.SetTag("error", true)
+			span.SetTag("error.type", errorType)
+		}
+		nr.tagTiming(span, req)
+		if !nr.isInbound {
+			nr.tagRouting(span, req)
 		}
 	}
 	if resp != nil {
-		span.SetTag("http.response_size", resp.ContentLength)
+		body := resp.Body
+		if countingBody, ok := body.(*countingReadCloser); ok {
+			body = countingBody.ReadCloser
+		}
+		if inspector, ok := body.(*bodyInspector); ok {
+			nr.tagResponseBody(span, inspector, resp)
+		}
+		span.SetTag("http.response_size", responseSize(resp))
 		span.SetTag("http.status_code", resp.StatusCode)
-		if resp.StatusCode >= 500 {
-			span.SetTag("error", "true")
+		if isEventStream(resp) {
+			// span of event stream is finished on its first byte
+			span.SetTag("streaming", true)
+		}
+		path := ""
+		if req != nil {
+			path = req.URL.Path
+		}
+		if resp.StatusCode == nhttp.StatusOK && isGRPCResponse(resp) {
+			if tagGRPCStatus(span, resp) {
+				span.SetTag("error", true)
+			}
+		} else if isErrorStatus(config.GetHTTPConfig(), path, resp.StatusCode) {
+			span.SetTag("error", true)
 		}
 	}
+	nr.enrichSpan(span, req, resp)
 }
 
-func (nr *NetHTTPRequest) SetHTTPRequest(r *nhttp.Request) {
-	nr.httpRequests.Push(r)
+// tagResponseBody sets tags from inspected response body fields,
+// body which can't be decoded is ignored
+func (nr *NetHTTPRequest) tagResponseBody(span opentracing.Span, inspector *bodyInspector, resp *nhttp.Response) {
+	body, err := inspector.Prefix(resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		nr.logger.Debugf("Error while inspecting response body: %s", err.Error())
+		return
+	}
+	for tagName, value := range extractJSONTags(body, config.GetHTTPConfig().ResponseBodyFieldsMap) {
+		span.SetTag(tagName, value)
+	}
 }
 
 func (nr *NetHTTPRequest) SetHTTPResponse(r *nhttp.Response) {
@@ -515,29 +1418,46 @@ func (q *Queue) Peek() interface{} {
 	}
 }
 
+// Last returns last element in the queue without removing it
+func (q *Queue) Last() interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if el := q.elements.Back(); el != nil {
+		return el.Value
+	}
+	return nil
+}
+
+// Contains reports whether value is in the queue
+func (q *Queue) Contains(value interface{}) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for el := q.elements.Front(); el != nil; el = el.Next() {
+		if el.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
 // Clear clears queue
 func (q *Queue) Clear() {
-	for el := q.Pop(); el != nil; {
+	for el := q.Pop(); el != nil; el = q.Pop() {
 	}
 }
 
-func getRoutingDestination(routingValue string, host string, originalDst string) (string, error) {
-	pairs := strings.Split(routingValue, ",")
-	for _, p := range pairs {
-		keyval := strings.Split(p, "=")
-		if len(keyval) < 2 {
-			return "", fmt.Errorf("malformed routing header: '%s'", routingValue)
-		}
-		// avoid infinite route loops
-		if keyval[0] == keyval[1] {
-			continue
-		}
-		if host == keyval[0] {
-			if !strings.Contains(keyval[1], ":") {
-				keyval[1] += ":80"
-			}
-			return keyval[1], nil
-		}
+// Len returns number of elements in the queue
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.elements.Len()
+}
+
+// isKeepAlive reports whether connection can be reused after request,
+// HTTP/1.0 requests are persistent only with explicit Connection: keep-alive
+func isKeepAlive(req *nhttp.Request) bool {
+	if req.ProtoMajor == 1 && req.ProtoMinor == 0 {
+		return httpguts.HeaderValuesContainsToken(req.Header["Connection"], "keep-alive")
 	}
-	return originalDst, nil
+	return true
 }
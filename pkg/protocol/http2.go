@@ -0,0 +1,290 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// minimal HTTP/2 framing support: frames are forwarded as is except header blocks,
+// which are decoded to be traced and encoded again
+
+const (
+	http2FrameHeaderLen = 9
+	// every peer accepts frames of this size regardless of its settings
+	http2MinMaxFrameSize        = 1 << 14
+	http2InitialHeaderTableSize = 4096
+
+	http2FrameData         byte = 0x0
+	http2FrameHeaders      byte = 0x1
+	http2FrameRSTStream    byte = 0x3
+	http2FrameSettings     byte = 0x4
+	http2FramePushPromise  byte = 0x5
+	http2FrameContinuation byte = 0x9
+
+	http2FlagEndStream  byte = 0x1
+	http2FlagAck        byte = 0x1
+	http2FlagEndHeaders byte = 0x4
+	http2FlagPadded     byte = 0x8
+	http2FlagPriority   byte = 0x20
+
+	http2SettingHeaderTableSize uint16 = 0x1
+)
+
+var http2ClientPreface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+var (
+	errHTTP2Framing      = errors.New("malformed HTTP/2 frame")
+	errHTTP2TableSize    = errors.New("HPACK dynamic table size update too large")
+	errHTTP2HeaderVarInt = errors.New("malformed HPACK integer")
+)
+
+type http2Frame struct {
+	typ      byte
+	flags    byte
+	streamID uint32
+	// payload is valid till the next frame is read
+	payload []byte
+}
+
+type http2FrameReader struct {
+	r      *bufio.Reader
+	header [http2FrameHeaderLen]byte
+	buf    []byte
+}
+
+func newHTTP2FrameReader(r *bufio.Reader) *http2FrameReader {
+	return &http2FrameReader{r: r}
+}
+
+// ReadFrame reads next frame
+func (fr *http2FrameReader) ReadFrame() (*http2Frame, error) {
+	if _, err := io.ReadFull(fr.r, fr.header[:]); err != nil {
+		return nil, err
+	}
+	length := int(fr.header[0])<<16 | int(fr.header[1])<<8 | int(fr.header[2])
+	if cap(fr.buf) < length {
+		fr.buf = make([]byte, length)
+	}
+	payload := fr.buf[:length]
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return &http2Frame{
+		typ:      fr.header[3],
+		flags:    fr.header[4],
+		streamID: binary.BigEndian.Uint32(fr.header[5:]) & (1<<31 - 1),
+		payload:  payload,
+	}, nil
+}
+
+// http2HeaderBlock is a complete header block of HEADERS or PUSH_PROMISE frame
+// with its CONTINUATION frames
+type http2HeaderBlock struct {
+	typ      byte
+	flags    byte
+	streamID uint32
+	// prefix keeps priority fields or promised stream id, padding is dropped
+	prefix   []byte
+	fragment []byte
+}
+
+// ReadHeaderBlock reads header block started with frame f
+func (fr *http2FrameReader) ReadHeaderBlock(f *http2Frame) (*http2HeaderBlock, error) {
+	payload := f.payload
+	if f.flags&http2FlagPadded != 0 {
+		if len(payload) < 1 {
+			return nil, errHTTP2Framing
+		}
+		padLen := int(payload[0])
+		payload = payload[1:]
+		if padLen > len(payload) {
+			return nil, errHTTP2Framing
+		}
+		payload = payload[:len(payload)-padLen]
+	}
+	prefixLen := 0
+	if f.typ == http2FrameHeaders && f.flags&http2FlagPriority != 0 {
+		prefixLen = 5
+	}
+	if f.typ == http2FramePushPromise {
+		prefixLen = 4
+	}
+	if len(payload) < prefixLen {
+		return nil, errHTTP2Framing
+	}
+	block := &http2HeaderBlock{
+		typ:      f.typ,
+		flags:    f.flags &^ (http2FlagPadded | http2FlagEndHeaders),
+		streamID: f.streamID,
+		prefix:   append([]byte(nil), payload[:prefixLen]...),
+		fragment: append([]byte(nil), payload[prefixLen:]...),
+	}
+	for endHeaders := f.flags&http2FlagEndHeaders != 0; !endHeaders; {
+		cf, err := fr.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		if cf.typ != http2FrameContinuation || cf.streamID != block.streamID {
+			return nil, errHTTP2Framing
+		}
+		block.fragment = append(block.fragment, cf.payload...)
+		endHeaders = cf.flags&http2FlagEndHeaders != 0
+	}
+	return block, nil
+}
+
+type http2FrameWriter struct {
+	w      *bufio.Writer
+	header [http2FrameHeaderLen]byte
+}
+
+func newHTTP2FrameWriter(w *bufio.Writer) *http2FrameWriter {
+	return &http2FrameWriter{w: w}
+}
+
+// WriteFrame writes frame with payload concatenated from parts
+func (fw *http2FrameWriter) WriteFrame(typ byte, flags byte, streamID uint32, parts ...[]byte) error {
+	length := 0
+	for _, part := range parts {
+		length += len(part)
+	}
+	fw.header[0] = byte(length >> 16)
+	fw.header[1] = byte(length >> 8)
+	fw.header[2] = byte(length)
+	fw.header[3] = typ
+	fw.header[4] = flags
+	binary.BigEndian.PutUint32(fw.header[5:], streamID)
+	if _, err := fw.w.Write(fw.header[:]); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if _, err := fw.w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteHeaderBlock writes block with new fragment, it's split into CONTINUATION frames if needed
+func (fw *http2FrameWriter) WriteHeaderBlock(block *http2HeaderBlock, fragment []byte) error {
+	typ, flags, prefix := block.typ, block.flags, block.prefix
+	for {
+		n := http2MinMaxFrameSize - len(prefix)
+		if n >= len(fragment) {
+			n = len(fragment)
+			flags |= http2FlagEndHeaders
+		}
+		if err := fw.WriteFrame(typ, flags, block.streamID, prefix, fragment[:n]); err != nil {
+			return err
+		}
+		fragment = fragment[n:]
+		if flags&http2FlagEndHeaders != 0 {
+			return nil
+		}
+		typ, flags, prefix = http2FrameContinuation, 0, nil
+	}
+}
+
+// Flush writes buffered frames
+func (fw *http2FrameWriter) Flush() error {
+	return fw.w.Flush()
+}
+
+// parseHTTP2Settings calls fn for each setting of SETTINGS frame payload
+func parseHTTP2Settings(payload []byte, fn func(id uint16, value uint32)) error {
+	if len(payload)%6 != 0 {
+		return errHTTP2Framing
+	}
+	for ; len(payload) > 0; payload = payload[6:] {
+		fn(binary.BigEndian.Uint16(payload), binary.BigEndian.Uint32(payload[2:]))
+	}
+	return nil
+}
+
+// http2HeaderCodec re-encodes header blocks flowing in one direction.
+// Blocks are decoded with the sender compression state and encoded without dynamic table,
+// so modified blocks never break receiver compression state.
+type http2HeaderCodec struct {
+	mu           sync.Mutex
+	decoder      *hpack.Decoder
+	maxTableSize uint32
+	encoder      *hpack.Encoder
+	buf          bytes.Buffer
+}
+
+func newHTTP2HeaderCodec() *http2HeaderCodec {
+	c := &http2HeaderCodec{
+		decoder:      hpack.NewDecoder(http2InitialHeaderTableSize, nil),
+		maxTableSize: http2InitialHeaderTableSize,
+	}
+	c.encoder = hpack.NewEncoder(&c.buf)
+	c.encoder.SetMaxDynamicTableSizeLimit(0)
+	return c
+}
+
+// Decode decodes complete header block fragment
+func (c *http2HeaderCodec) Decode(fragment []byte) ([]hpack.HeaderField, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// hpack decoder rejects table size updates when its dynamic table isn't empty,
+	// so updates at the beginning of the block are applied here
+	for len(fragment) > 0 && fragment[0]&0xe0 == 0x20 {
+		size, n, err := readHPACKVarInt(5, fragment)
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(c.maxTableSize) {
+			return nil, errHTTP2TableSize
+		}
+		c.decoder.SetMaxDynamicTableSize(uint32(size))
+		fragment = fragment[n:]
+	}
+	return c.decoder.DecodeFull(fragment)
+}
+
+// Encode encodes fields into header block fragment
+func (c *http2HeaderCodec) Encode(fields []hpack.HeaderField) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf.Reset()
+	for _, f := range fields {
+		if err := c.encoder.WriteField(f); err != nil {
+			return nil, err
+		}
+	}
+	return append([]byte(nil), c.buf.Bytes()...), nil
+}
+
+// SetMaxTableSize applies header table size advertised by receiver, sender may use it up to this size
+func (c *http2HeaderCodec) SetMaxTableSize(v uint32) {
+	c.mu.Lock()
+	c.maxTableSize = v
+	c.mu.Unlock()
+}
+
+// readHPACKVarInt reads integer with n-bit prefix, it returns value and number of bytes read
+func readHPACKVarInt(n uint, p []byte) (uint64, int, error) {
+	mask := uint64(1)<<n - 1
+	v := uint64(p[0]) & mask
+	if v < mask {
+		return v, 1, nil
+	}
+	var shift uint
+	for i := 1; i < len(p) && shift < 63; i++ {
+		v += uint64(p[i]&0x7f) << shift
+		if p[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+		shift += 7
+	}
+	return 0, 0, errHTTP2HeaderVarInt
+}
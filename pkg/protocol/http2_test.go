@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// encodeHPACK encodes fields with dynamic table like regular HTTP/2 peer
+func encodeHPACK(t *testing.T, enc *hpack.Encoder, buf *bytes.Buffer, fields ...hpack.HeaderField) []byte {
+	buf.Reset()
+	for _, f := range fields {
+		if err := enc.WriteField(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+// readHeaderBlocks reads all frames of data and returns decoded fields of header blocks
+func readHeaderBlocks(t *testing.T, data []byte) [][]hpack.HeaderField {
+	fr := newHTTP2FrameReader(bufio.NewReader(bytes.NewReader(data)))
+	dec := hpack.NewDecoder(http2InitialHeaderTableSize, nil)
+	var blocks [][]hpack.HeaderField
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return blocks
+		}
+		if f.typ != http2FrameHeaders {
+			continue
+		}
+		block, err := fr.ReadHeaderBlock(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields, err := dec.DecodeFull(block.fragment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, fields)
+	}
+}
+
+func headerValue(fields []hpack.HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+func TestHTTP2HeaderBlockContinuation(t *testing.T) {
+	codec := newHTTP2HeaderCodec()
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":path", Value: "/orders.Orders/Get"},
+		{Name: "x-large", Value: strings.Repeat("a", 40000)},
+	}
+	fragment, err := codec.Encode(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	fw := newHTTP2FrameWriter(bufio.NewWriter(&out))
+	priority := []byte{0, 0, 0, 1, 16}
+	block := &http2HeaderBlock{typ: http2FrameHeaders, flags: http2FlagEndStream | http2FlagPriority, streamID: 3, prefix: priority}
+	if err := fw.WriteHeaderBlock(block, fragment); err != nil {
+		t.Fatal(err)
+	}
+	fw.Flush()
+
+	fr := newHTTP2FrameReader(bufio.NewReader(bytes.NewReader(out.Bytes())))
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.typ != http2FrameHeaders || f.flags&http2FlagEndHeaders != 0 || len(f.payload) != http2MinMaxFrameSize {
+		t.Fatalf("expected HEADERS frame of max size without END_HEADERS, got type %d flags %d length %d",
+			f.typ, f.flags, len(f.payload))
+	}
+	read, err := fr.ReadHeaderBlock(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.streamID != 3 || read.flags != http2FlagEndStream|http2FlagPriority ||
+		!bytes.Equal(read.prefix, priority) || !bytes.Equal(read.fragment, fragment) {
+		t.Fatalf("unexpected header block %d %d %v", read.streamID, read.flags, read.prefix)
+	}
+	decoded, err := newHTTP2HeaderCodec().Decode(read.fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(fields) || headerValue(decoded, "x-large") != fields[2].Value {
+		t.Fatalf("unexpected decoded fields %d", len(decoded))
+	}
+}
+
+func TestHTTP2ReadHeaderBlock(t *testing.T) {
+	fragment := []byte{0x82, 0x84}
+	var data bytes.Buffer
+	fw := newHTTP2FrameWriter(bufio.NewWriter(&data))
+	// padding is dropped
+	fw.WriteFrame(http2FrameHeaders, http2FlagPadded|http2FlagEndHeaders, 1, []byte{2}, fragment, []byte{0, 0})
+	// CONTINUATION of other stream breaks header block
+	fw.WriteFrame(http2FrameHeaders, 0, 3, fragment)
+	fw.WriteFrame(http2FrameContinuation, http2FlagEndHeaders, 5, fragment)
+	fw.Flush()
+
+	fr := newHTTP2FrameReader(bufio.NewReader(bytes.NewReader(data.Bytes())))
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := fr.ReadHeaderBlock(f)
+	if err != nil || !bytes.Equal(block.fragment, fragment) || len(block.prefix) != 0 || block.flags != 0 {
+		t.Fatalf("unexpected padded header block %+v (%v)", block, err)
+	}
+	if f, err = fr.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fr.ReadHeaderBlock(f); err != errHTTP2Framing {
+		t.Fatalf("expected framing error, got %v", err)
+	}
+}
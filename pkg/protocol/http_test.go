@@ -0,0 +1,685 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+func TestQueueClear(t *testing.T) {
+	q := NewQueue()
+	for i := 0; i < 5; i++ {
+		q.Push(i)
+	}
+	if q.Len() != 5 {
+		t.Fatalf("expected 5 elements, got %d", q.Len())
+	}
+	q.Clear()
+	if el := q.Peek(); el != nil {
+		t.Fatalf("expected empty queue after Clear, got %v", el)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("expected 0 elements, got %d", q.Len())
+	}
+}
+
+func TestQueueClearEmpty(t *testing.T) {
+	q := NewQueue()
+	q.Clear()
+	if el := q.Peek(); el != nil {
+		t.Fatalf("expected nil, got %v", el)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q := NewQueue()
+	q.Push(1)
+	q.Push(2)
+	if el := q.Last(); el != 2 {
+		t.Fatalf("expected last 2, got %v", el)
+	}
+	if el := q.Pop(); el != 1 {
+		t.Fatalf("expected 1, got %v", el)
+	}
+	if el := q.Peek(); el != 2 {
+		t.Fatalf("expected 2, got %v", el)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("expected 1 element, got %d", q.Len())
+	}
+}
+
+// tcpConnPair returns both ends of local TCP connection
+func tcpConnPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*net.TCPConn), (<-accepted).(*net.TCPConn)
+}
+
+// pipelinedRequest is request sent on pipelined connection and status upstream answers it with,
+// local request is answered by proxy itself with empty response
+type pipelinedRequest struct {
+	method string
+	path   string
+	status int
+	local  bool
+}
+
+// proxyPipelined sends all requests through outbound HTTP handler on single connection at once,
+// checks responses and returns spans finished for them
+func proxyPipelined(t *testing.T, requests []pipelinedRequest, expectedSpans int) []*mocktracer.MockSpan {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, proxyIn := tcpConnPair(t)
+	proxyOut, upstream := tcpConnPair(t)
+	defer client.Close()
+	defer upstream.Close()
+	handler := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	netRequest := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+	go func() {
+		handler.HandleRequest(proxyIn, proxyOut, nil, nil, netRequest, false, "127.0.0.1:80")
+		proxyOut.Close()
+	}()
+	go func() {
+		handler.HandleResponse(proxyOut, proxyIn, netRequest, false, false)
+		proxyIn.Close()
+	}()
+
+	// upstream reads all pipelined requests before answering, so all of them are in flight
+	go func() {
+		reader := bufio.NewReader(upstream)
+		var responses bytes.Buffer
+		for _, r := range requests {
+			if r.local {
+				continue
+			}
+			req, err := nhttp.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			body := req.URL.Path
+			fmt.Fprintf(&responses, "HTTP/1.1 %d Status\r\nContent-Length: %d\r\n\r\n", r.status, len(body))
+			if req.Method != nhttp.MethodHead {
+				responses.WriteString(body)
+			}
+		}
+		upstream.Write(responses.Bytes())
+	}()
+
+	var pipeline bytes.Buffer
+	for _, r := range requests {
+		fmt.Fprintf(&pipeline, "%s %s HTTP/1.1\r\nHost: upstream\r\n\r\n", r.method, r.path)
+	}
+	if _, err := client.Write(pipeline.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	for i, r := range requests {
+		resp, err := nhttp.ReadResponse(reader, &nhttp.Request{Method: r.method})
+		if err != nil {
+			t.Fatalf("response %d: %s", i, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != r.status {
+			t.Fatalf("response %d: expected status %d, got %d", i, r.status, resp.StatusCode)
+		}
+		if r.method == nhttp.MethodGet && !r.local && string(body) != r.path {
+			t.Fatalf("response %d: unexpected body %q", i, body)
+		}
+	}
+
+	// span of the last request is finished after its response is sent
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tracer.FinishedSpans()) < expectedSpans && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != expectedSpans {
+		t.Fatalf("expected %d spans, got %d", expectedSpans, len(spans))
+	}
+	return spans
+}
+
+// checkSpan checks that span is finished for request
+func checkSpan(t *testing.T, span *mocktracer.MockSpan, r pipelinedRequest) {
+	if path := span.Tag("http.path"); path != r.path {
+		t.Fatalf("span of %s: unexpected path %v", r.path, path)
+	}
+	if method := span.Tag("http.method"); method != r.method {
+		t.Fatalf("span of %s: expected method %s, got %v", r.path, r.method, method)
+	}
+	if status := span.Tag("http.status_code"); status != r.status {
+		t.Fatalf("span of %s: expected status %d, got %v", r.path, r.status, status)
+	}
+}
+
+// statuses which don't forbid response body
+var pipelinedStatuses = []int{200, 201, 202, 203, 206, 207, 404, 409, 418, 429}
+
+func TestPipelinedResponsesMatchRequests(t *testing.T) {
+	var requests []pipelinedRequest
+	for i := 0; i < 100; i++ {
+		// HEAD response has Content-Length without body
+		method := nhttp.MethodGet
+		if i%3 == 0 {
+			method = nhttp.MethodHead
+		}
+		requests = append(requests, pipelinedRequest{
+			method: method,
+			path:   fmt.Sprintf("/%d", i),
+			status: pipelinedStatuses[i%len(pipelinedStatuses)],
+		})
+	}
+
+	spans := proxyPipelined(t, requests, len(requests))
+	for i, span := range spans {
+		checkSpan(t, span, requests[i])
+	}
+}
+
+func TestPipelinedUntracedRequests(t *testing.T) {
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	untracedConfig := httpConfig
+	untracedConfig.UntracedPathPrefixes = []string{"/health"}
+	config.SetHTTPConfig(untracedConfig)
+
+	var requests, traced []pipelinedRequest
+	for i := 0; i < 100; i++ {
+		r := pipelinedRequest{
+			method: nhttp.MethodGet,
+			path:   fmt.Sprintf("/%d", i),
+			status: pipelinedStatuses[i%len(pipelinedStatuses)],
+		}
+		// untraced requests come both one by one and in a row
+		if i%4 == 0 || i%7 == 1 {
+			r.path = fmt.Sprintf("/health/%d", i)
+		} else {
+			traced = append(traced, r)
+		}
+		requests = append(requests, r)
+	}
+
+	spans := proxyPipelined(t, requests, len(traced))
+	for i, span := range spans {
+		checkSpan(t, span, traced[i])
+	}
+}
+
+func TestPipelinedLocalResponseKeepsOrder(t *testing.T) {
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	faultConfig := httpConfig
+	faultConfig.FaultRules = map[string]config.FaultRule{"/fault": {AbortStatus: 503, AbortPercent: 100}}
+	config.SetHTTPConfig(faultConfig)
+
+	var requests []pipelinedRequest
+	for i := 0; i < 10; i++ {
+		requests = append(requests, pipelinedRequest{
+			method: nhttp.MethodGet,
+			path:   fmt.Sprintf("/%d", i),
+			status: pipelinedStatuses[i%len(pipelinedStatuses)],
+		})
+	}
+	// upstream answers forwarded requests after all of them are read, so aborted one is answered first
+	requests = append(requests, pipelinedRequest{method: nhttp.MethodGet, path: "/fault", status: 503, local: true})
+
+	spans := proxyPipelined(t, requests, len(requests))
+	for i, span := range spans {
+		checkSpan(t, span, requests[i])
+	}
+}
+
+func TestPipelinedSpanLogs(t *testing.T) {
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	spanLogsConfig := httpConfig
+	spanLogsConfig.SpanLogsEnabled = true
+	config.SetHTTPConfig(spanLogsConfig)
+
+	var requests []pipelinedRequest
+	for i := 0; i < 10; i++ {
+		requests = append(requests, pipelinedRequest{
+			method: nhttp.MethodGet,
+			path:   fmt.Sprintf("/%d", i),
+			status: pipelinedStatuses[i%len(pipelinedStatuses)],
+		})
+	}
+
+	spans := proxyPipelined(t, requests, len(requests))
+	for i, span := range spans {
+		checkSpan(t, span, requests[i])
+		logs := span.Logs()
+		var events []string
+		for j, record := range logs {
+			if j > 0 && record.Timestamp.Before(logs[j-1].Timestamp) {
+				t.Fatalf("span of %s: events aren't ordered by time", requests[i].path)
+			}
+			for _, field := range record.Fields {
+				if field.Key == "event" {
+					events = append(events, field.ValueString)
+				}
+			}
+		}
+		if strings.Join(events, ",") != "request_received,request_sent,response_received" {
+			t.Fatalf("span of %s: unexpected events %v", requests[i].path, events)
+		}
+		if status := logs[len(logs)-1].Fields[1].ValueString; status != fmt.Sprint(requests[i].status) {
+			t.Fatalf("span of %s: expected status %d in response event, got %s", requests[i].path, requests[i].status, status)
+		}
+	}
+}
+
+// proxyRequest sends raw request through outbound HTTP handler and answers it with raw response,
+// it returns response got by client and whether upstream got the request
+func proxyRequest(t *testing.T, request string, response string) (*nhttp.Response, bool) {
+	resp, upstreamReq := proxyRequestUpstream(t, request, response)
+	return resp, upstreamReq != nil
+}
+
+// proxyRequestUpstream proxies request like proxyRequest, request received by upstream is nil if it isn't forwarded
+func proxyRequestUpstream(t *testing.T, request string, response string) (*nhttp.Response, *nhttp.Request) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, proxyIn := tcpConnPair(t)
+	proxyOut, upstream := tcpConnPair(t)
+	defer client.Close()
+	defer upstream.Close()
+	handler := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	netRequest := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+	go func() {
+		handler.HandleRequest(proxyIn, proxyOut, nil, nil, netRequest, false, "127.0.0.1:80")
+		proxyOut.Close()
+	}()
+	go func() {
+		handler.HandleResponse(proxyOut, proxyIn, netRequest, false, false)
+		proxyIn.Close()
+	}()
+
+	received := make(chan *nhttp.Request, 1)
+	go func() {
+		upstreamReq, err := nhttp.ReadRequest(bufio.NewReader(upstream))
+		if err != nil {
+			received <- nil
+			return
+		}
+		received <- upstreamReq
+		fmt.Fprint(upstream, response)
+	}()
+
+	if _, err := fmt.Fprint(client, request); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nhttp.ReadResponse(bufio.NewReader(client), &nhttp.Request{Method: nhttp.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, <-received
+}
+
+const emptyResponse = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+
+func withRequestLimits(maxRequestLineBytes, maxHeaderBytes int) func() {
+	httpConfig := config.GetHTTPConfig()
+	limitedConfig := httpConfig
+	limitedConfig.MaxRequestLineBytes = maxRequestLineBytes
+	limitedConfig.MaxHeaderBytes = maxHeaderBytes
+	config.SetHTTPConfig(limitedConfig)
+	return func() { config.SetHTTPConfig(httpConfig) }
+}
+
+func TestRequestHeaderLimit(t *testing.T) {
+	defer withRequestLimits(1024, 100)()
+	// header lines are counted without line endings
+	host := "Host: upstream"
+	pad := "X-Pad: "
+
+	for _, c := range []struct {
+		size     int
+		status   int
+		received bool
+	}{
+		{100, nhttp.StatusOK, true},
+		{101, nhttp.StatusRequestHeaderFieldsTooLarge, false},
+	} {
+		header := host + "\r\n" + pad + strings.Repeat("a", c.size-len(host)-len(pad)) + "\r\n"
+		resp, received := proxyRequest(t, "GET / HTTP/1.1\r\n"+header+"\r\n", emptyResponse)
+		if resp.StatusCode != c.status {
+			t.Fatalf("header of %d bytes: expected status %d, got %d", c.size, c.status, resp.StatusCode)
+		}
+		if received != c.received {
+			t.Fatalf("header of %d bytes: expected upstream to get request %v", c.size, c.received)
+		}
+	}
+}
+
+func TestRequestLineLimit(t *testing.T) {
+	defer withRequestLimits(100, 1024)()
+
+	for _, c := range []struct {
+		size     int
+		status   int
+		received bool
+	}{
+		{100, nhttp.StatusOK, true},
+		{101, nhttp.StatusRequestURITooLong, false},
+	} {
+		line := "GET /" + strings.Repeat("a", c.size-len("GET / HTTP/1.1")) + " HTTP/1.1"
+		resp, received := proxyRequest(t, line+"\r\nHost: upstream\r\n\r\n", emptyResponse)
+		if resp.StatusCode != c.status {
+			t.Fatalf("request line of %d bytes: expected status %d, got %d", c.size, c.status, resp.StatusCode)
+		}
+		if received != c.received {
+			t.Fatalf("request line of %d bytes: expected upstream to get request %v", c.size, c.received)
+		}
+	}
+}
+
+func TestChunkedResponseTrailers(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		declared string
+	}{
+		{"declared", "Trailer: X-Checksum, Grpc-Status\r\n"},
+		{"undeclared", ""},
+	} {
+		resp, _ := proxyRequest(t, "GET / HTTP/1.1\r\nHost: upstream\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n"+c.declared+"\r\n"+
+				"5\r\nhello\r\n0\r\nX-Checksum: abc123\r\nGrpc-Status: 0\r\n\r\n")
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s trailers: %s", c.name, err.Error())
+		}
+		if string(body) != "hello" {
+			t.Fatalf("%s trailers: unexpected body %q", c.name, body)
+		}
+		if checksum := resp.Trailer.Get("X-Checksum"); checksum != "abc123" {
+			t.Fatalf("%s trailers: expected X-Checksum trailer, got %q", c.name, checksum)
+		}
+		if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+			t.Fatalf("%s trailers: expected Grpc-Status trailer, got %q", c.name, status)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	httpConfig := config.GetHTTPConfig()
+	idleConfig := httpConfig
+	idleConfig.IdleTimeout = 200 * time.Millisecond
+	config.SetHTTPConfig(idleConfig)
+	defer config.SetHTTPConfig(httpConfig)
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, proxyIn := tcpConnPair(t)
+	proxyOut, upstream := tcpConnPair(t)
+	defer client.Close()
+	defer upstream.Close()
+	handler := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	netRequest := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+	go func() {
+		handler.HandleRequest(proxyIn, proxyOut, nil, nil, netRequest, false, "127.0.0.1:80")
+		proxyOut.Close()
+		proxyIn.Close()
+	}()
+	go handler.HandleResponse(proxyOut, proxyIn, netRequest, false, false)
+
+	// connection waiting for slow response isn't idle
+	go func() {
+		if _, err := nhttp.ReadRequest(bufio.NewReader(upstream)); err != nil {
+			return
+		}
+		time.Sleep(400 * time.Millisecond)
+		fmt.Fprint(upstream, emptyResponse)
+	}()
+	if _, err := fmt.Fprint(client, "GET / HTTP/1.1\r\nHost: upstream\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	resp, err := nhttp.ReadResponse(reader, &nhttp.Request{Method: nhttp.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != nhttp.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	responded := time.Now()
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+	if idle := time.Since(responded); idle < 150*time.Millisecond || idle > 2*time.Second {
+		t.Fatalf("expected connection to be closed after idle timeout, closed in %s", idle)
+	}
+}
+
+func TestHalfClosedClientGetsResponse(t *testing.T) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, proxyIn := tcpConnPair(t)
+	proxyOut, upstream := tcpConnPair(t)
+	defer client.Close()
+	defer upstream.Close()
+	handler := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	netRequest := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+	go func() {
+		handler.HandleRequest(proxyIn, proxyOut, nil, nil, netRequest, false, "127.0.0.1:80")
+		proxyOut.Close()
+		proxyIn.Close()
+	}()
+	go handler.HandleResponse(proxyOut, proxyIn, netRequest, false, false)
+
+	go func() {
+		if _, err := nhttp.ReadRequest(bufio.NewReader(upstream)); err != nil {
+			return
+		}
+		// response comes after client is done with sending
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(upstream, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+	}()
+	if _, err := fmt.Fprint(client, "GET / HTTP/1.1\r\nHost: upstream\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nhttp.ReadResponse(bufio.NewReader(client), &nhttp.Request{Method: nhttp.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("expected whole response body, got %q, %v", body, err)
+	}
+}
+
+func TestHTTP2PrefacePassedThrough(t *testing.T) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, proxyIn := tcpConnPair(t)
+	proxyOut, upstream := tcpConnPair(t)
+	defer client.Close()
+	defer upstream.Close()
+	handler := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	netRequest := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+	go func() {
+		handler.HandleRequest(proxyIn, proxyOut, nil, nil, netRequest, false, "127.0.0.1:80")
+		proxyOut.Close()
+	}()
+	go func() {
+		handler.HandleResponse(proxyOut, proxyIn, netRequest, false, false)
+		proxyIn.Close()
+	}()
+
+	// empty SETTINGS frames of both sides
+	settings := []byte{0, 0, 0, http2FrameSettings, 0, 0, 0, 0, 0}
+	sent := append(append([]byte{}, http2ClientPreface...), settings...)
+	if _, err := client.Write(sent); err != nil {
+		t.Fatal(err)
+	}
+	upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(upstream, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Fatalf("expected preface to be forwarded as is, got %q", received)
+	}
+
+	if _, err := upstream.Write(settings); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received = make([]byte, len(settings))
+	if _, err := io.ReadFull(client, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, settings) {
+		t.Fatalf("expected server frame to be forwarded as is, got %q", received)
+	}
+}
+
+func TestShortRequestIsNotHTTP2Preface(t *testing.T) {
+	// request is shorter than the preface, it's parsed without waiting for more bytes
+	resp, received := proxyRequest(t, "GET / HTTP/1.0\r\n\r\n", emptyResponse)
+	if !received || resp.StatusCode != nhttp.StatusOK {
+		t.Fatalf("expected request to be proxied, got status %d", resp.StatusCode)
+	}
+}
+
+func TestObserveOnlyForwardsRequestAsIs(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	observeConfig := httpConfig
+	observeConfig.ObserveOnly = true
+	config.SetHTTPConfig(observeConfig)
+
+	resp, upstreamReq := proxyRequestUpstream(t,
+		"GET /orders HTTP/1.1\r\nHost: Upstream.\r\nConnection: keep-alive, X-Hop\r\nX-Hop: 1\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nKeep-Alive: timeout=5\r\nContent-Length: 0\r\n\r\n")
+	if upstreamReq == nil {
+		t.Fatal("request isn't proxied")
+	}
+	if upstreamReq.Host != "Upstream." {
+		t.Fatalf("expected host to be kept, got %s", upstreamReq.Host)
+	}
+	if upstreamReq.Header.Get("X-Hop") != "1" {
+		t.Fatal("expected hop-by-hop request header to be kept")
+	}
+	for name := range upstreamReq.Header {
+		if name != "Connection" && name != "X-Hop" {
+			t.Fatalf("unexpected header added to request: %s", name)
+		}
+	}
+	if resp.Header.Get("Keep-Alive") != "timeout=5" {
+		t.Fatal("expected hop-by-hop response header to be kept")
+	}
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if len(tracer.FinishedSpans()) > 0 {
+			return
+		}
+	}
+	t.Fatal("expected span of observed request")
+}
+
+// httpBytes returns reported number of outbound HTTP bytes of metric
+func httpBytes(t *testing.T, name string) float64 {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "direction" && label.GetValue() == "outbound" {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestHTTPBytesCounted(t *testing.T) {
+	requestBytes := httpBytes(t, "netra_http_request_bytes_total")
+	responseBytes := httpBytes(t, "netra_http_response_bytes_total")
+	body := strings.Repeat("a", 1000)
+
+	resp, received := proxyRequest(t,
+		"POST / HTTP/1.1\r\nHost: upstream\r\nContent-Length: 1000\r\n\r\n"+body,
+		"HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n"+body,
+	)
+	if resp.StatusCode != nhttp.StatusOK || !received {
+		t.Fatalf("expected request to be proxied, got status %d", resp.StatusCode)
+	}
+	// bytes are counted once writes are flushed, that may happen after the client got response
+	deadline := time.Now().Add(time.Second)
+	for {
+		requested := httpBytes(t, "netra_http_request_bytes_total") - requestBytes
+		responded := httpBytes(t, "netra_http_response_bytes_total") - responseBytes
+		if requested > 1000 && responded > 1000 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected more than 1000 bytes each way, got %g requested and %g responded", requested, responded)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,19 @@
+package protocol
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleDeadline returns time connection becomes idle for idleTimeout since its last finished request,
+// zero timeout means no deadline. Connection with requests waiting for response isn't idle,
+// its deadline is moved forward and checked again when it's reached
+func (nr *NetHTTPRequest) idleDeadline(idleTimeout time.Duration) time.Time {
+	if idleTimeout <= 0 {
+		return time.Time{}
+	}
+	if nr.httpRequests.Len() > 0 {
+		return time.Now().Add(idleTimeout)
+	}
+	return time.Unix(0, atomic.LoadInt64(&nr.lastActive)).Add(idleTimeout)
+}
@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+// SetHTTPRequest queues request waiting for response
+func (nr *NetHTTPRequest) SetHTTPRequest(r *nhttp.Request) {
+	nr.httpRequests.Push(r)
+	nr.addInflight(1)
+}
+
+// popHTTPRequest takes the oldest request waiting for response
+func (nr *NetHTTPRequest) popHTTPRequest() interface{} {
+	request := nr.httpRequests.Pop()
+	if request != nil {
+		nr.addInflight(-1)
+	}
+	return request
+}
+
+// addInflight reports change of in-flight requests count, connection requests aren't reported after clean up
+func (nr *NetHTTPRequest) addInflight(delta int) {
+	nr.inflightMu.Lock()
+	defer nr.inflightMu.Unlock()
+	if nr.cleanedUp {
+		return
+	}
+	nr.inflight += delta
+	metrics.AddInflightHTTPRequests(nr.isInbound, delta)
+}
+
+// dropInflight reports requests left without response as finished
+func (nr *NetHTTPRequest) dropInflight() {
+	nr.inflightMu.Lock()
+	defer nr.inflightMu.Unlock()
+	if nr.cleanedUp {
+		return
+	}
+	nr.cleanedUp = true
+	metrics.AddInflightHTTPRequests(nr.isInbound, -nr.inflight)
+	nr.inflight = 0
+}
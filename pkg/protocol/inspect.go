@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// bodyInspector keeps bounded prefix of body streamed through it, body itself is passed as is
+type bodyInspector struct {
+	io.ReadCloser
+	limit  int
+	prefix bytes.Buffer
+}
+
+func newBodyInspector(rc io.ReadCloser, limit int) *bodyInspector {
+	return &bodyInspector{ReadCloser: rc, limit: limit}
+}
+
+// Read reads bytes from underlying body
+func (bi *bodyInspector) Read(p []byte) (int, error) {
+	n, err := bi.ReadCloser.Read(p)
+	if rest := bi.limit - bi.prefix.Len(); rest > 0 && n > 0 {
+		if n < rest {
+			rest = n
+		}
+		bi.prefix.Write(p[:rest])
+	}
+	return n, err
+}
+
+// contentDecoders decode supported content encodings, brotli one is built with `brotli` tag only
+var contentDecoders = map[string]func(r io.Reader) (io.Reader, error){
+	"gzip":    newGzipReader,
+	"x-gzip":  newGzipReader,
+	"deflate": newDeflateReader,
+}
+
+func newGzipReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// newDeflateReader reads zlib stream, raw deflate stream is accepted too since some servers send it
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// zlib header: deflate compression method and check bits making header multiple of 31
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// Prefix returns inspected body prefix, encoded content is decoded up to the same limit
+func (bi *bodyInspector) Prefix(contentEncoding string) ([]byte, error) {
+	return decodeBody(bi.prefix.Bytes(), contentEncoding, bi.limit)
+}
+
+// decodeBody decodes up to limit bytes of possibly truncated encoded body,
+// encodings are undone in reverse order of their application
+func decodeBody(body []byte, contentEncoding string, limit int) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(body)
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+		newDecoder, ok := contentDecoders[encoding]
+		if !ok {
+			return nil, fmt.Errorf("unsupported content encoding '%s'", contentEncoding)
+		}
+		decoder, err := newDecoder(r)
+		if err != nil {
+			return nil, err
+		}
+		r = decoder
+	}
+	// limited reader protects from decompression bombs
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)))
+	if err == io.ErrUnexpectedEOF {
+		// compressed prefix is cut in the middle of stream
+		err = nil
+	}
+	return data, err
+}
+
+// extractJSONTags returns values of top level JSON object fields mapped to tag names,
+// body may be truncated, so fields found before the cut are returned
+func extractJSONTags(body []byte, fieldsMap map[string]string) map[string]string {
+	tags := make(map[string]string)
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return tags
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return tags
+		}
+		key, ok := t.(string)
+		if !ok {
+			return tags
+		}
+		var value interface{}
+		if err := dec.Decode(&value); err != nil {
+			return tags
+		}
+		tagName, ok := fieldsMap[key]
+		if !ok {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			tags[tagName] = v
+		case json.Number, bool:
+			tags[tagName] = fmt.Sprint(v)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,17 @@
+//go:build brotli
+// +build brotli
+
+package protocol
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+// brotli decoder is an external dependency, so it's built with `brotli` tag only
+func init() {
+	contentDecoders["br"] = func(r io.Reader) (io.Reader, error) {
+		return brotli.NewReader(r), nil
+	}
+}
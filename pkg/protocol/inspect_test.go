@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+const inspectedBody = `{"status":"ok","code":42}`
+
+func compress(t *testing.T, newWriter func(w io.Writer) io.WriteCloser, data []byte) []byte {
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipWriter(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+
+func zlibWriter(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }
+
+func flateWriter(w io.Writer) io.WriteCloser {
+	fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return fw
+}
+
+// inspect streams body through inspector and returns its decoded prefix
+func inspect(t *testing.T, body []byte, contentEncoding string, limit int) ([]byte, error) {
+	inspector := newBodyInspector(ioutil.NopCloser(bytes.NewReader(body)), limit)
+	forwarded, err := ioutil.ReadAll(inspector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forwarded, body) {
+		t.Fatalf("encoding %q: expected original body to be forwarded", contentEncoding)
+	}
+	return inspector.Prefix(contentEncoding)
+}
+
+func TestBodyInspectorEncodings(t *testing.T) {
+	body := []byte(inspectedBody)
+	cases := []struct {
+		contentEncoding string
+		encoded         []byte
+	}{
+		{"", body},
+		{"identity", body},
+		{"gzip", compress(t, gzipWriter, body)},
+		{"X-Gzip", compress(t, gzipWriter, body)},
+		{"deflate", compress(t, zlibWriter, body)},
+		// raw deflate stream without zlib wrapper
+		{"deflate", compress(t, flateWriter, body)},
+		{"deflate, gzip", compress(t, gzipWriter, compress(t, zlibWriter, body))},
+	}
+	for _, c := range cases {
+		prefix, err := inspect(t, c.encoded, c.contentEncoding, 4096)
+		if err != nil {
+			t.Fatalf("encoding %q: unexpected error %s", c.contentEncoding, err.Error())
+		}
+		if string(prefix) != inspectedBody {
+			t.Fatalf("encoding %q: unexpected prefix %q", c.contentEncoding, prefix)
+		}
+	}
+}
+
+func TestBodyInspectorTruncatedEncodedBody(t *testing.T) {
+	body := bytes.Repeat([]byte(inspectedBody), 1000)
+	cases := []struct {
+		contentEncoding string
+		newWriter       func(w io.Writer) io.WriteCloser
+	}{
+		{"gzip", gzipWriter},
+		{"deflate", zlibWriter},
+		{"deflate", flateWriter},
+	}
+	for _, c := range cases {
+		// compressed body is cut by inspection limit
+		prefix, err := inspect(t, compress(t, c.newWriter, body), c.contentEncoding, 64)
+		if err != nil {
+			t.Fatalf("encoding %q: unexpected error %s", c.contentEncoding, err.Error())
+		}
+		if len(prefix) == 0 || len(prefix) > 64 || !bytes.HasPrefix(body, prefix) {
+			t.Fatalf("encoding %q: unexpected prefix %q", c.contentEncoding, prefix)
+		}
+	}
+}
+
+func TestBodyInspectorUnsupportedEncoding(t *testing.T) {
+	if _, err := inspect(t, []byte(inspectedBody), "compress", 4096); err == nil {
+		t.Fatal("expected unsupported encoding error")
+	}
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// isInterimResponse reports whether response is informational one followed by final response,
+// 101 Switching Protocols is final since connection doesn't speak HTTP after it
+func isInterimResponse(resp *nhttp.Response) bool {
+	return resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != nhttp.StatusSwitchingProtocols
+}
+
+// writeInterimResponse writes status line and headers of interim response,
+// it's never framed with Content-Length unlike responses written by Response.Write
+func writeInterimResponse(w io.Writer, resp *nhttp.Response) error {
+	status := resp.Status
+	if status == "" {
+		status = strconv.Itoa(resp.StatusCode) + " " + nhttp.StatusText(resp.StatusCode)
+	}
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	if _, err := fmt.Fprintf(bufioWriter, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(bufioWriter); err != nil {
+		return err
+	}
+	if _, err := bufioWriter.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return bufioWriter.Flush()
+}
@@ -0,0 +1,554 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// Kafka API keys of traced requests
+const (
+	kafkaProduce int16 = 0
+	kafkaFetch   int16 = 1
+)
+
+// kafkaInspectLen limits length of strings kept for span, e.g. client id and topic names
+const kafkaInspectLen = 256
+
+// kafkaMaxTopics limits number of topics tagged for single request
+const kafkaMaxTopics = 32
+
+var errKafkaMalformed = errors.New("malformed Kafka message")
+
+// KafkaHandler copies Kafka connection as is and reports span for every Produce and Fetch request,
+// responses are matched to requests by correlation id
+type KafkaHandler struct {
+	logger *log.Logger
+}
+
+// NewKafkaHandler returns Kafka handler
+func NewKafkaHandler(logger *log.Logger) *KafkaHandler {
+	return &KafkaHandler{
+		logger: logger,
+	}
+}
+
+// HandleRequest copies client requests to broker
+func (h *KafkaHandler) HandleRequest(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) *net.TCPConn {
+
+	netKafkaRequest := netRequest.(*NetKafkaRequest)
+	if w == nil {
+		defer close(addrCh)
+		addrCh <- originalDst
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+	}
+	if isInboundConn {
+		netKafkaRequest.setRemoteAddr(r.RemoteAddr().String())
+	} else {
+		netKafkaRequest.setRemoteAddr(w.RemoteAddr().String())
+	}
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(bufioReader)
+
+	err := h.copyRequests(bufioReader, bufioWriter, netKafkaRequest)
+	if err == nil || err == io.EOF {
+		err = bufioWriter.Flush()
+	}
+	if err != nil && err != io.EOF {
+		h.logger.Debugf("Err copying Kafka requests: %s", err.Error())
+	}
+	return w
+}
+
+// HandleResponse copies broker responses to client
+func (h *KafkaHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	netKafkaRequest := netRequest.(*NetKafkaRequest)
+	// requests without response are finished when connection is closed
+	defer netKafkaRequest.StopRequest()
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(bufioReader)
+
+	err := h.copyResponses(bufioReader, bufioWriter, netKafkaRequest)
+	if err == nil || err == io.EOF {
+		err = bufioWriter.Flush()
+	}
+	if err != nil && err != io.EOF {
+		h.logger.Debugf("Err copying Kafka responses: %s", err.Error())
+	}
+}
+
+// copyRequests forwards size delimited requests from r to w, request is parsed while it's copied.
+// The last byte of request is written after request is queued, so response can't outrun it
+func (h *KafkaHandler) copyRequests(r *bufio.Reader, w *bufio.Writer, nr *NetKafkaRequest) error {
+	var sizeBuf [4]byte
+	for {
+		if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(sizeBuf[:]); err != nil {
+			return err
+		}
+		size := int32(binary.BigEndian.Uint32(sizeBuf[:]))
+		if size <= 0 {
+			// it isn't Kafka framing, e.g. TLS handshake
+			return h.passThrough(r, w)
+		}
+
+		kr := &kafkaReader{r: io.TeeReader(io.LimitReader(r, int64(size)-1), w)}
+		if request := readKafkaRequest(kr); request != nil {
+			nr.push(request)
+		}
+		if _, err := io.CopyN(w, r, int64(size)-kr.n); err != nil {
+			return err
+		}
+	}
+}
+
+// copyResponses forwards size delimited responses from r to w and finishes request of every response
+func (h *KafkaHandler) copyResponses(r *bufio.Reader, w *bufio.Writer, nr *NetKafkaRequest) error {
+	var sizeBuf [4]byte
+	for {
+		if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(sizeBuf[:]); err != nil {
+			return err
+		}
+		size := int32(binary.BigEndian.Uint32(sizeBuf[:]))
+		if size < 4 {
+			return h.passThrough(r, w)
+		}
+
+		kr := &kafkaReader{r: io.TeeReader(io.LimitReader(r, int64(size)), w)}
+		request := nr.pop(kr.int32())
+		var errorCode int16
+		if request != nil {
+			if request.flexible {
+				kr.taggedFields()
+			}
+			// Fetch response starts with throttle time, top level error code follows it since v7
+			if request.apiKey == kafkaFetch && request.apiVersion >= 7 {
+				kr.int32()
+				errorCode = kr.int16()
+			}
+		}
+		if _, err := io.CopyN(w, r, int64(size)-kr.n); err != nil {
+			return err
+		}
+		if request != nil {
+			nr.finish(request, false, errorCode)
+		}
+	}
+}
+
+func (h *KafkaHandler) passThrough(r *bufio.Reader, w *bufio.Writer) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	buf := bufferPool.Get().([]byte)
+	_, err := io.CopyBuffer(w, r, buf)
+	bufferPool.Put(buf)
+	return err
+}
+
+// kafkaRequest is traced Produce or Fetch request waiting for response
+type kafkaRequest struct {
+	apiKey        int16
+	apiVersion    int16
+	correlationID int32
+	clientID      string
+	flexible      bool
+	// acks is set for Produce request, it's nil if request is too short to read it
+	acks      *int16
+	topics    []string
+	topicIDs  []string
+	startTime time.Time
+}
+
+// readKafkaRequest parses request header and topics of Produce and Fetch requests,
+// it returns nil for other requests. Malformed request is reported with topics read so far
+func readKafkaRequest(kr *kafkaReader) *kafkaRequest {
+	request := &kafkaRequest{
+		apiKey:        kr.int16(),
+		apiVersion:    kr.int16(),
+		correlationID: kr.int32(),
+		startTime:     time.Now(),
+	}
+	if kr.err != nil || request.apiVersion < 0 {
+		return nil
+	}
+	switch request.apiKey {
+	case kafkaProduce:
+		request.flexible = request.apiVersion >= 9
+	case kafkaFetch:
+		request.flexible = request.apiVersion >= 12
+	default:
+		return nil
+	}
+	// client id isn't compact even in flexible request header
+	request.clientID, _ = kr.string(false)
+	if request.flexible {
+		kr.taggedFields()
+	}
+	if request.apiKey == kafkaProduce {
+		readKafkaProduce(kr, request)
+	} else {
+		readKafkaFetch(kr, request)
+	}
+	return request
+}
+
+func readKafkaProduce(kr *kafkaReader, request *kafkaRequest) {
+	v := request.apiVersion
+	if v >= 3 {
+		// transactional id
+		kr.string(request.flexible)
+	}
+	if acks := kr.int16(); kr.err == nil {
+		request.acks = &acks
+	}
+	// timeout
+	kr.int32()
+	topics := kr.array(request.flexible)
+	for i := 0; i < topics && kr.err == nil; i++ {
+		request.readTopic(kr, v >= 13)
+		partitions := kr.array(request.flexible)
+		for j := 0; j < partitions && kr.err == nil; j++ {
+			// index and records
+			kr.int32()
+			kr.skip(kr.bytesLength(request.flexible))
+			if request.flexible {
+				kr.taggedFields()
+			}
+		}
+		if request.flexible {
+			kr.taggedFields()
+		}
+	}
+}
+
+func readKafkaFetch(kr *kafkaReader, request *kafkaRequest) {
+	v := request.apiVersion
+	if v < 15 {
+		// replica id
+		kr.int32()
+	}
+	// max wait and min bytes
+	kr.skip(8)
+	if v >= 3 {
+		// max bytes
+		kr.skip(4)
+	}
+	if v >= 4 {
+		// isolation level
+		kr.skip(1)
+	}
+	if v >= 7 {
+		// session id and epoch
+		kr.skip(8)
+	}
+	// fetch offset and partition max bytes
+	partitionLen := 12
+	if v >= 9 {
+		// current leader epoch
+		partitionLen += 4
+	}
+	if v >= 12 {
+		// last fetched epoch
+		partitionLen += 4
+	}
+	if v >= 5 {
+		// log start offset
+		partitionLen += 8
+	}
+	topics := kr.array(request.flexible)
+	for i := 0; i < topics && kr.err == nil; i++ {
+		request.readTopic(kr, v >= 13)
+		partitions := kr.array(request.flexible)
+		for j := 0; j < partitions && kr.err == nil; j++ {
+			// partition index and the rest of fields
+			kr.skip(4 + partitionLen)
+			if request.flexible {
+				kr.taggedFields()
+			}
+		}
+		if request.flexible {
+			kr.taggedFields()
+		}
+	}
+}
+
+// readTopic reads topic name or topic id of newer request versions
+func (request *kafkaRequest) readTopic(kr *kafkaReader, byID bool) {
+	if byID {
+		var id [16]byte
+		kr.read(id[:])
+		if kr.err == nil && len(request.topicIDs) < kafkaMaxTopics {
+			request.topicIDs = append(request.topicIDs, hex.EncodeToString(id[:]))
+		}
+		return
+	}
+	topic, ok := kr.string(request.flexible)
+	if ok && len(request.topics) < kafkaMaxTopics {
+		request.topics = append(request.topics, topic)
+	}
+}
+
+// kafkaReader reads fields of Kafka message, the first error is kept
+// and all following reads return zero values
+type kafkaReader struct {
+	r   io.Reader
+	n   int64
+	err error
+	buf [8]byte
+}
+
+func (kr *kafkaReader) read(p []byte) {
+	if kr.err != nil {
+		return
+	}
+	n, err := io.ReadFull(kr.r, p)
+	kr.n += int64(n)
+	kr.err = err
+}
+
+func (kr *kafkaReader) skip(n int) {
+	if kr.err != nil {
+		return
+	}
+	if n < 0 {
+		kr.err = errKafkaMalformed
+		return
+	}
+	copied, err := io.CopyN(ioutil.Discard, kr.r, int64(n))
+	kr.n += copied
+	kr.err = err
+}
+
+func (kr *kafkaReader) int16() int16 {
+	kr.read(kr.buf[:2])
+	if kr.err != nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(kr.buf[:2]))
+}
+
+func (kr *kafkaReader) int32() int32 {
+	kr.read(kr.buf[:4])
+	if kr.err != nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(kr.buf[:4]))
+}
+
+func (kr *kafkaReader) uvarint() uint64 {
+	var x uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		kr.read(kr.buf[:1])
+		if kr.err != nil {
+			return 0
+		}
+		b := kr.buf[0]
+		x |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return x
+		}
+	}
+	kr.err = errKafkaMalformed
+	return 0
+}
+
+// length reads length of string, bytes or array, compact length is stored as uvarint plus one.
+// Null is returned as -1
+func (kr *kafkaReader) length(compact bool, wide bool) int {
+	if compact {
+		return int(kr.uvarint()) - 1
+	}
+	if wide {
+		return int(kr.int32())
+	}
+	return int(kr.int16())
+}
+
+// string reads nullable string, it's false for null or malformed string
+func (kr *kafkaReader) string(compact bool) (string, bool) {
+	n := kr.length(compact, false)
+	if kr.err != nil || n < 0 {
+		return "", false
+	}
+	if n > kafkaInspectLen {
+		kr.skip(n)
+		return "", false
+	}
+	b := make([]byte, n)
+	kr.read(b)
+	return string(b), kr.err == nil
+}
+
+// bytesLength reads length of nullable bytes, null is read as empty bytes
+func (kr *kafkaReader) bytesLength(compact bool) int {
+	if n := kr.length(compact, true); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// array reads number of array elements, null array is read as empty one
+func (kr *kafkaReader) array(compact bool) int {
+	if n := kr.length(compact, true); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// taggedFields skips tagged fields of flexible message
+func (kr *kafkaReader) taggedFields() {
+	fields := kr.uvarint()
+	for i := uint64(0); i < fields && kr.err == nil; i++ {
+		// tag and size
+		kr.uvarint()
+		kr.skip(int(kr.uvarint()))
+	}
+}
+
+// NetKafkaRequest keeps state of single Kafka connection, requests are matched to responses by correlation id
+type NetKafkaRequest struct {
+	isInbound bool
+	logger    *log.Logger
+
+	mu         sync.Mutex
+	remoteAddr string
+	pending    map[int32]*kafkaRequest
+}
+
+// NewNetKafkaRequest returns state of Kafka connection accepted now
+func NewNetKafkaRequest(logger *log.Logger, isInbound bool) *NetKafkaRequest {
+	return &NetKafkaRequest{
+		isInbound: isInbound,
+		logger:    logger,
+		pending:   make(map[int32]*kafkaRequest),
+	}
+}
+
+// StartRequest does nothing, requests are started when they are sent
+func (nr *NetKafkaRequest) StartRequest() {}
+
+// StopRequest finishes requests which didn't get response
+func (nr *NetKafkaRequest) StopRequest() {
+	nr.mu.Lock()
+	pending := nr.pending
+	nr.pending = make(map[int32]*kafkaRequest)
+	nr.mu.Unlock()
+	for _, request := range pending {
+		nr.finish(request, true, 0)
+	}
+}
+
+// CleanUp does nothing, requests are finished when connection is closed
+func (nr *NetKafkaRequest) CleanUp() {}
+
+func (nr *NetKafkaRequest) setRemoteAddr(remoteAddr string) {
+	nr.mu.Lock()
+	nr.remoteAddr = remoteAddr
+	nr.mu.Unlock()
+}
+
+func (nr *NetKafkaRequest) getRemoteAddr() string {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	return nr.remoteAddr
+}
+
+// push queues request waiting for response, Produce request without acks doesn't get one
+// and it's finished right away
+func (nr *NetKafkaRequest) push(request *kafkaRequest) {
+	if request.acks != nil && *request.acks == 0 {
+		nr.finish(request, false, 0)
+		return
+	}
+	nr.mu.Lock()
+	nr.pending[request.correlationID] = request
+	nr.mu.Unlock()
+}
+
+// pop returns request answered by response with correlation id and forgets it
+func (nr *NetKafkaRequest) pop(correlationID int32) *kafkaRequest {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	request, ok := nr.pending[correlationID]
+	if ok {
+		delete(nr.pending, correlationID)
+	}
+	return request
+}
+
+// finish reports request span, timeout is set for request without response
+func (nr *NetKafkaRequest) finish(request *kafkaRequest, timeout bool, errorCode int16) {
+	operation := "kafka.fetch"
+	kind := "consumer"
+	if request.apiKey == kafkaProduce {
+		operation = "kafka.produce"
+		kind = "producer"
+	}
+	span := opentracing.StartSpan(operation, opentracing.StartTime(request.startTime))
+	if nr.isInbound {
+		kind = "server"
+	}
+	span.SetTag("span.kind", kind)
+	span.SetTag("remote_addr", nr.getRemoteAddr())
+	span.SetTag("messaging.system", "kafka")
+	if len(request.topics) > 0 {
+		span.SetTag("messaging.destination", strings.Join(request.topics, ","))
+	}
+	if len(request.topicIDs) > 0 {
+		span.SetTag("messaging.kafka.topic_ids", strings.Join(request.topicIDs, ","))
+	}
+	if request.clientID != "" {
+		span.SetTag("messaging.kafka.client_id", request.clientID)
+	}
+	span.SetTag("messaging.kafka.correlation_id", request.correlationID)
+	span.SetTag("messaging.kafka.api_version", request.apiVersion)
+	if request.acks != nil {
+		span.SetTag("messaging.kafka.acks", *request.acks)
+	}
+	if timeout {
+		span.SetTag("error", true)
+		span.SetTag("timeout", true)
+	}
+	if errorCode != 0 {
+		span.SetTag("error", true)
+		span.SetTag("messaging.kafka.error_code", errorCode)
+	}
+	span.Finish()
+}
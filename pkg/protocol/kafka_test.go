@@ -0,0 +1,273 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// kafkaMessage encodes fields of Kafka message
+type kafkaMessage struct {
+	bytes.Buffer
+}
+
+func (m *kafkaMessage) int16(v int16) *kafkaMessage {
+	binary.Write(m, binary.BigEndian, v)
+	return m
+}
+
+func (m *kafkaMessage) int32(v int32) *kafkaMessage {
+	binary.Write(m, binary.BigEndian, v)
+	return m
+}
+
+func (m *kafkaMessage) uvarint(v uint64) *kafkaMessage {
+	var buf [binary.MaxVarintLen64]byte
+	m.Write(buf[:binary.PutUvarint(buf[:], v)])
+	return m
+}
+
+// string writes string with int16 length or compact one with uvarint length plus one
+func (m *kafkaMessage) string(s string, compact bool) *kafkaMessage {
+	if compact {
+		m.uvarint(uint64(len(s)) + 1)
+	} else {
+		m.int16(int16(len(s)))
+	}
+	m.WriteString(s)
+	return m
+}
+
+// array writes number of elements, compact one is stored as uvarint plus one
+func (m *kafkaMessage) array(n int, compact bool) *kafkaMessage {
+	if compact {
+		return m.uvarint(uint64(n) + 1)
+	}
+	return m.int32(int32(n))
+}
+
+func (m *kafkaMessage) skip(n int) *kafkaMessage {
+	m.Write(make([]byte, n))
+	return m
+}
+
+// tagged writes tagged fields section with single field of given size, empty one if size is 0
+func (m *kafkaMessage) tagged(size int) *kafkaMessage {
+	if size == 0 {
+		return m.uvarint(0)
+	}
+	return m.uvarint(1).uvarint(0).uvarint(uint64(size)).skip(size)
+}
+
+// framed returns message prefixed with its size
+func (m *kafkaMessage) framed() []byte {
+	frame := make([]byte, 4, 4+m.Len())
+	binary.BigEndian.PutUint32(frame, uint32(m.Len()))
+	return append(frame, m.Bytes()...)
+}
+
+func kafkaRequestHeader(apiKey int16, apiVersion int16, correlationID int32, flexible bool) *kafkaMessage {
+	m := &kafkaMessage{}
+	// client id is never compact
+	m.int16(apiKey).int16(apiVersion).int32(correlationID).string("billing", false)
+	if flexible {
+		m.tagged(0)
+	}
+	return m
+}
+
+func kafkaProduceRequest(apiVersion int16, correlationID int32, acks int16, topic string) []byte {
+	flexible := apiVersion >= 9
+	m := kafkaRequestHeader(kafkaProduce, apiVersion, correlationID, flexible)
+	// null transactional id
+	if flexible {
+		m.uvarint(0)
+	} else {
+		m.int16(-1)
+	}
+	m.int16(acks).int32(30000)
+	m.array(1, flexible).string(topic, flexible)
+	m.array(1, flexible).int32(0)
+	// records
+	if flexible {
+		m.uvarint(4).skip(3).tagged(2).tagged(0).tagged(0)
+	} else {
+		m.int32(5).skip(5)
+	}
+	return m.framed()
+}
+
+func kafkaFetchRequest(apiVersion int16, correlationID int32, topic string, topicID []byte) []byte {
+	flexible := apiVersion >= 12
+	m := kafkaRequestHeader(kafkaFetch, apiVersion, correlationID, flexible)
+	// replica id, max wait, min bytes, max bytes and isolation level
+	m.int32(-1).skip(8 + 4 + 1)
+	partitionLen := 12
+	if apiVersion >= 7 {
+		// session id and epoch
+		m.skip(8)
+		// current leader epoch and log start offset
+		partitionLen += 4 + 8
+	}
+	if flexible {
+		// last fetched epoch
+		partitionLen += 4
+	}
+	m.array(1, flexible)
+	if topicID != nil {
+		m.Write(topicID)
+	} else {
+		m.string(topic, flexible)
+	}
+	m.array(1, flexible).int32(0).skip(partitionLen)
+	if flexible {
+		m.tagged(0).tagged(0).tagged(1)
+	} else {
+		// forgotten topics and rack id of newer versions are skipped as the rest of request
+		m.skip(3)
+	}
+	return m.framed()
+}
+
+func TestKafkaSpans(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewKafkaHandler(logger)
+	nr := NewNetKafkaRequest(logger, false)
+
+	topicID := bytes.Repeat([]byte{0xab}, 16)
+	var client bytes.Buffer
+	client.Write(kafkaProduceRequest(3, 1, -1, "orders"))
+	client.Write(kafkaProduceRequest(9, 2, 1, "payments"))
+	// produce without acks gets no response
+	client.Write(kafkaProduceRequest(3, 3, 0, "logs"))
+	client.Write(kafkaFetchRequest(7, 4, "orders", nil))
+	client.Write(kafkaFetchRequest(12, 5, "payments", nil))
+	client.Write(kafkaFetchRequest(13, 6, "", topicID))
+	// ApiVersions request isn't traced
+	client.Write(kafkaRequestHeader(18, 3, 7, true).framed())
+	var forwarded bytes.Buffer
+	w := bufio.NewWriter(&forwarded)
+	if err := h.copyRequests(bufio.NewReader(bytes.NewReader(client.Bytes())), w, nr); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	w.Flush()
+	if !bytes.Equal(forwarded.Bytes(), client.Bytes()) {
+		t.Fatal("requests aren't copied as is")
+	}
+
+	var server bytes.Buffer
+	// responses come out of order, they're matched by correlation id
+	server.Write((&kafkaMessage{}).int32(2).tagged(0).skip(10).framed())
+	server.Write((&kafkaMessage{}).int32(1).skip(10).framed())
+	// flexible Fetch response with UNKNOWN_TOPIC_OR_PARTITION top level error
+	server.Write((&kafkaMessage{}).int32(5).tagged(3).int32(0).int16(3).skip(6).framed())
+	server.Write((&kafkaMessage{}).int32(4).int32(0).int16(0).skip(6).framed())
+	server.Write((&kafkaMessage{}).int32(7).skip(4).framed())
+	forwarded.Reset()
+	w.Reset(&forwarded)
+	if err := h.copyResponses(bufio.NewReader(bytes.NewReader(server.Bytes())), w, nr); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	w.Flush()
+	if !bytes.Equal(forwarded.Bytes(), server.Bytes()) {
+		t.Fatal("responses aren't copied as is")
+	}
+	// Fetch by topic id is left without response
+	nr.StopRequest()
+
+	spans := tracer.FinishedSpans()
+	expected := []struct {
+		operation     string
+		correlationID int32
+		topic         interface{}
+		errorCode     interface{}
+		timeout       bool
+	}{
+		{"kafka.produce", 3, "logs", nil, false},
+		{"kafka.produce", 2, "payments", nil, false},
+		{"kafka.produce", 1, "orders", nil, false},
+		{"kafka.fetch", 5, "payments", int16(3), false},
+		{"kafka.fetch", 4, "orders", nil, false},
+		{"kafka.fetch", 6, nil, nil, true},
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %d", len(expected), len(spans))
+	}
+	for i, e := range expected {
+		span := spans[i]
+		tags := span.Tags()
+		if span.OperationName != e.operation || tags["messaging.kafka.correlation_id"] != e.correlationID ||
+			tags["messaging.destination"] != e.topic || tags["messaging.kafka.error_code"] != e.errorCode ||
+			tags["messaging.kafka.client_id"] != "billing" || (tags["timeout"] == true) != e.timeout ||
+			(tags["error"] == true) != (e.timeout || e.errorCode != nil) {
+			t.Fatalf("span %d: unexpected span %s %v", i, span.OperationName, tags)
+		}
+	}
+	if acks := spans[0].Tag("messaging.kafka.acks"); acks != int16(0) {
+		t.Fatalf("expected acks to be tagged, got %v", acks)
+	}
+	if ids := spans[5].Tag("messaging.kafka.topic_ids"); ids != "abababababababababababababababab" {
+		t.Fatalf("expected topic id to be tagged, got %v", ids)
+	}
+}
+
+func TestKafkaRequestParsing(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		request []byte
+		topics  []string
+	}{
+		{"produce v3", kafkaProduceRequest(3, 1, 1, "orders"), []string{"orders"}},
+		{"flexible produce", kafkaProduceRequest(9, 1, 1, "orders"), []string{"orders"}},
+		{"fetch v4", kafkaFetchRequest(4, 1, "orders", nil), []string{"orders"}},
+		{"fetch v7", kafkaFetchRequest(7, 1, "orders", nil), []string{"orders"}},
+		{"flexible fetch", kafkaFetchRequest(12, 1, "orders", nil), []string{"orders"}},
+		// topics read before request is cut are kept
+		{"truncated produce", kafkaProduceRequest(3, 1, 1, "orders")[:43], []string{"orders"}},
+	} {
+		kr := &kafkaReader{r: bytes.NewReader(c.request[4:])}
+		request := readKafkaRequest(kr)
+		if request == nil || request.clientID != "billing" || len(request.topics) != len(c.topics) ||
+			request.topics[0] != c.topics[0] {
+			t.Fatalf("%s: unexpected request %+v", c.name, request)
+		}
+		// fields after topics are copied unparsed
+		if c.name != "truncated produce" && kr.err != nil {
+			t.Fatalf("%s: unexpected error %v", c.name, kr.err)
+		}
+	}
+}
+
+func TestKafkaOtherProtocolPassedThrough(t *testing.T) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewKafkaHandler(logger)
+	nr := NewNetKafkaRequest(logger, false)
+	// negative size isn't Kafka framing
+	data := []byte("\xff\xff\xff\xf0\x00\x01\x00\x01\xfc\x03\x03\x00\x00\x00\x00")
+	var forwarded bytes.Buffer
+	w := bufio.NewWriter(&forwarded)
+	if err := h.copyRequests(bufio.NewReader(bytes.NewReader(data)), w, nr); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if !bytes.Equal(forwarded.Bytes(), data) {
+		t.Fatalf("expected %q, got %q", data, forwarded.Bytes())
+	}
+}
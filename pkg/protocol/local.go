@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+// respondLocally answers request with empty response instead of forwarding it,
+// request is traced with span tagged with tag
+func (h *HTTPHandler) respondLocally(
+	w io.Writer,
+	req *nhttp.Request,
+	netHTTPRequest *NetHTTPRequest,
+	statusCode int,
+	header nhttp.Header,
+	tag opentracing.Tag,
+	startTime time.Time) {
+	// body is dropped to read the next request from connection
+	io.Copy(ioutil.Discard, req.Body)
+	req.Body.Close()
+
+	if header == nil {
+		header = nhttp.Header{}
+	}
+	resp := &nhttp.Response{
+		StatusCode:    statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: 0,
+		Body:          nhttp.NoBody,
+		Close:         !isKeepAlive(req),
+		Request:       req,
+	}
+	h.writeLocalResponse(w, req, netHTTPRequest, resp, tag, startTime)
+}
+
+// writeLocalResponse writes response made by proxy itself and traces request with span tagged with tag
+func (h *HTTPHandler) writeLocalResponse(
+	w io.Writer,
+	req *nhttp.Request,
+	netHTTPRequest *NetHTTPRequest,
+	resp *nhttp.Response,
+	tag opentracing.Tag,
+	startTime time.Time) {
+	// responses of requests pipelined before this one are written by response side first,
+	// otherwise client would take local response for the answer to an earlier request
+	if !netHTTPRequest.waitPendingResponses(0) {
+		h.logger.Debugf("Requests pipelined before %s %s%s are left without response, local one isn't written",
+			req.Method, req.Host, req.URL.Path)
+		return
+	}
+	forwarded := &forwardWriter{w: w}
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(forwarded)
+	err := resp.Write(bufioWriter)
+	if flushErr := bufioWriter.Flush(); err == nil {
+		err = flushErr
+	}
+	writerPool.Put(bufioWriter)
+	metrics.ObserveHTTPResponseBytes(netHTTPRequest.isInbound, forwarded.written)
+	if err != nil {
+		h.logger.Errorf("Error while writing response to w: %s", err.Error())
+	}
+
+	if !isUntraced(config.GetHTTPConfig(), req) {
+		span := netHTTPRequest.startSpan(req)
+		netHTTPRequest.fillSpan(span, req, resp)
+		tag.Set(span)
+		span.Finish()
+	}
+	metrics.ObserveHTTPRequest(netHTTPRequest.isInbound, req.Method, resp.StatusCode, time.Since(startTime))
+}
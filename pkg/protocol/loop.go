@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// checkHops counts forward of request in hops header, request forwarded more than max hops times
+// (e.g. by routing tables pointing at each other) is answered with 508. It returns true if request is rejected
+func (h *HTTPHandler) checkHops(w io.Writer, req *nhttp.Request, netHTTPRequest *NetHTTPRequest) bool {
+	httpConfig := config.GetHTTPConfig()
+	if httpConfig.MaxHops <= 0 {
+		return false
+	}
+	// malformed counter is started over
+	hops, err := strconv.Atoi(strings.TrimSpace(req.Header.Get(httpConfig.HopsHeaderName)))
+	if err != nil || hops < 0 {
+		hops = 0
+	}
+	// Via entries of netra are kept by proxies which drop unknown headers like hops one
+	if httpConfig.ViaEnabled {
+		if viaHops := countVia(req.Header, httpConfig.ViaPseudonym); viaHops > hops {
+			hops = viaHops
+		}
+	}
+	hops++
+	if hops <= httpConfig.MaxHops {
+		req.Header.Set(httpConfig.HopsHeaderName, strconv.Itoa(hops))
+		return false
+	}
+
+	h.logger.Warningf("Loop detected for request %s %s%s after %d hops", req.Method, req.Host, req.URL.Path, hops-1)
+	h.respondLocally(w, req, netHTTPRequest, nhttp.StatusLoopDetected, nil,
+		opentracing.Tag{Key: "loop.detected", Value: true}, time.Now())
+	return true
+}
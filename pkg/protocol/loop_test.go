@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+func TestHopsCounted(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	hopsConfig := httpConfig
+	hopsConfig.MaxHops = 2
+	hopsConfig.ViaEnabled = true
+	config.SetHTTPConfig(hopsConfig)
+
+	resp, upstreamReq := proxyRequestUpstream(t,
+		"GET /orders HTTP/1.1\r\nHost: upstream\r\nX-Mesh-Hops: 1\r\nConnection: close\r\n\r\n", emptyResponse)
+	if upstreamReq == nil || resp.StatusCode != nhttp.StatusOK {
+		t.Fatal("request isn't proxied")
+	}
+	if hops := upstreamReq.Header.Get("X-Mesh-Hops"); hops != "2" {
+		t.Fatalf("expected hops to be incremented to 2, got %q", hops)
+	}
+	if via := upstreamReq.Header.Get("Via"); via != "1.1 netramesh" {
+		t.Fatalf("expected via to be added, got %q", via)
+	}
+
+	// hops header is dropped by proxy in between, Via entries are counted instead
+	resp, upstreamReq = proxyRequestUpstream(t,
+		"GET /orders HTTP/1.0\r\nHost: upstream\r\nVia: 1.1 netramesh, 1.1 gateway\r\nVia: 1.0 NetraMesh (sidecar)\r\n\r\n", emptyResponse)
+	if upstreamReq != nil || resp.StatusCode != nhttp.StatusLoopDetected {
+		t.Fatal("expected request looping through proxy not to be proxied")
+	}
+
+	resp, upstreamReq = proxyRequestUpstream(t,
+		"GET /orders HTTP/1.0\r\nHost: upstream\r\nX-Mesh-Hops: 2\r\n\r\n", emptyResponse)
+	if upstreamReq != nil {
+		t.Fatal("expected looping request not to be proxied")
+	}
+	if resp.StatusCode != nhttp.StatusLoopDetected {
+		t.Fatalf("expected 508, got %d", resp.StatusCode)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, span := range tracer.FinishedSpans() {
+			if span.Tag("loop.detected") == true {
+				return
+			}
+		}
+	}
+	t.Fatal("expected span tagged with loop.detected")
+}
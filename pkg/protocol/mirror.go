@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+// mirrorTimeout limits whole mirrored request exchange, mirror never waits longer
+const mirrorTimeout = 10 * time.Second
+
+// mirrorRequest sends copy of outbound request to mirror destination in background, its response is discarded.
+// Request body is buffered to be sent twice, requests with bigger or unknown size body aren't mirrored.
+// Request mirrored while MirrorMaxInflight ones are being sent is dropped, so slow mirror can't pile them up
+func (h *HTTPHandler) mirrorRequest(req *nhttp.Request, mirrorAddr string) {
+	httpConfig := config.GetHTTPConfig()
+	if expectsContinue(req) || req.ContentLength < 0 || req.ContentLength > httpConfig.MirrorMaxBodyBytes {
+		h.logger.Debugf("Request %s %s%s isn't mirrored: body is too big", req.Method, req.Host, req.URL.Path)
+		return
+	}
+	inflight := atomic.AddInt64(&h.mirrorsInflight, 1)
+	if httpConfig.MirrorMaxInflight > 0 && inflight > int64(httpConfig.MirrorMaxInflight) {
+		atomic.AddInt64(&h.mirrorsInflight, -1)
+		metrics.ObserveMirrorDropped()
+		h.logger.Debugf("Request %s %s%s isn't mirrored: too many mirrored requests", req.Method, req.Host, req.URL.Path)
+		return
+	}
+	var body []byte
+	if req.ContentLength > 0 {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		// request is sent with body read so far anyway
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			atomic.AddInt64(&h.mirrorsInflight, -1)
+			h.logger.Warningf("Error while buffering request body for mirror: %s", err.Error())
+			return
+		}
+	}
+
+	mirrorReq := new(nhttp.Request)
+	*mirrorReq = *req
+	mirrorReq.Header = cloneHeader(req.Header)
+	mirrorReq.Body = nhttp.NoBody
+	if len(body) > 0 {
+		mirrorReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	mirrorReq.Close = true
+	go func() {
+		defer atomic.AddInt64(&h.mirrorsInflight, -1)
+		h.sendMirror(mirrorReq, mirrorAddr)
+	}()
+}
+
+// sendMirror writes request to mirror destination and discards response
+func (h *HTTPHandler) sendMirror(req *nhttp.Request, mirrorAddr string) {
+	span := startMirrorSpan(req, mirrorAddr)
+	defer span.Finish()
+
+	conn, err := net.DialTimeout("tcp", mirrorAddr, mirrorTimeout)
+	if err != nil {
+		h.logger.Debugf("Error while connecting to mirror %s: %s", mirrorAddr, err.Error())
+		span.SetTag("error", true)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(mirrorTimeout))
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(conn)
+	err = req.Write(bufioWriter)
+	if flushErr := bufioWriter.Flush(); err == nil {
+		err = flushErr
+	}
+	writerPool.Put(bufioWriter)
+	if err != nil {
+		h.logger.Debugf("Error while writing request to mirror %s: %s", mirrorAddr, err.Error())
+		span.SetTag("error", true)
+		return
+	}
+
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(conn)
+	defer readerPool.Put(bufioReader)
+	resp, err := nhttp.ReadResponse(bufioReader, req)
+	if err != nil {
+		h.logger.Debugf("Error while reading response of mirror %s: %s", mirrorAddr, err.Error())
+		span.SetTag("error", true)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	span.SetTag("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetTag("error", true)
+	}
+}
+
+// startMirrorSpan starts client span of mirrored request as a child of the original request span
+func startMirrorSpan(req *nhttp.Request, mirrorAddr string) opentracing.Span {
+	var opts []opentracing.StartSpanOption
+	if wireContext, err := extractContext(req.Header); err == nil {
+		opts = append(opts, opentracing.ChildOf(wireContext))
+	}
+	span := opentracing.StartSpan(operationName(config.GetHTTPConfig(), req, false, mirrorAddr), opts...)
+	injectContext(span.Context(), req.Header)
+	span.SetTag("span.kind", "client")
+	span.SetTag("mirrored", true)
+	span.SetTag("remote_addr", mirrorAddr)
+	setStringTag(span, "http.host", req.Host)
+	setStringTag(span, "http.path", req.URL.String())
+	span.SetTag("http.method", req.Method)
+	return span
+}
+
+func cloneHeader(header nhttp.Header) nhttp.Header {
+	clone := make(nhttp.Header, len(header))
+	for k, v := range header {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestMirrorRule(t *testing.T) {
+	for _, c := range []struct {
+		routingValue string
+		mirror       string
+		percent      int
+		wantErr      bool
+	}{
+		{"example.com=backend|mirror=shadow", "shadow", 100, false},
+		{"example.com=backend|mirror=shadow:8080;30", "shadow:8080", 30, false},
+		{"example.com=a:80;50,b:80;50|mirror=shadow;0", "shadow", 0, false},
+		{"example.com=backend", "", 0, false},
+		{"example.com=backend|mirror=shadow;101", "", 0, true},
+		{"example.com=backend|mirror=shadow;x", "", 0, true},
+	} {
+		rules, err := parseRoutingRules(c.routingValue)
+		if c.wantErr {
+			if err == nil {
+				t.Fatalf("%s: expected error", c.routingValue)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.routingValue, err)
+		}
+		if rules[0].mirror != c.mirror || rules[0].mirrorPercent != c.percent {
+			t.Fatalf("%s: unexpected mirror %s;%d", c.routingValue, rules[0].mirror, rules[0].mirrorPercent)
+		}
+	}
+
+	always := &routingRule{mirror: "shadow", mirrorPercent: 100}
+	never := &routingRule{mirror: "shadow", mirrorPercent: 0}
+	for i := 0; i < 100; i++ {
+		if mirror := always.pickMirror(); mirror != "shadow:80" {
+			t.Fatalf("expected mirror with default port, got %q", mirror)
+		}
+		if mirror := never.pickMirror(); mirror != "" {
+			t.Fatalf("expected no mirror, got %q", mirror)
+		}
+	}
+}
+
+// mirrorListener accepts mirrored requests and sends them to channel, respond answers them
+func mirrorListener(t *testing.T, respond bool) (string, chan *nhttp.Request) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	requests := make(chan *nhttp.Request, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go func() {
+				req, err := nhttp.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				body, _ := ioutil.ReadAll(req.Body)
+				req.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+				requests <- req
+				if respond {
+					conn.Write([]byte("HTTP/1.1 202 Accepted\r\nContent-Length: 0\r\n\r\n"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), requests
+}
+
+func newMirroredRequest(t *testing.T) *nhttp.Request {
+	req, err := nhttp.ReadRequest(bufio.NewReader(strings.NewReader(
+		"POST /orders HTTP/1.1\r\nHost: upstream\r\nContent-Length: 5\r\n\r\nhello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestMirrorRequestSent(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	mirrorAddr, requests := mirrorListener(t, true)
+
+	req := newMirroredRequest(t)
+	h.mirrorRequest(req, mirrorAddr)
+	// original request is still sent with its body
+	if body, err := ioutil.ReadAll(req.Body); err != nil || string(body) != "hello" {
+		t.Fatalf("expected original body to be kept, got %q (%v)", body, err)
+	}
+	select {
+	case mirrored := <-requests:
+		body, _ := ioutil.ReadAll(mirrored.Body)
+		if mirrored.Method != "POST" || mirrored.URL.Path != "/orders" || mirrored.Host != "upstream" || string(body) != "hello" {
+			t.Fatalf("unexpected mirrored request %s %s%s %q", mirrored.Method, mirrored.Host, mirrored.URL.Path, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected request to be mirrored")
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if spans := tracer.FinishedSpans(); len(spans) == 1 {
+			if spans[0].Tag("mirrored") != true || spans[0].Tag("http.status_code") != 202 {
+				t.Fatalf("unexpected mirror span %v", spans[0].Tags())
+			}
+			return
+		}
+	}
+	t.Fatal("expected mirror span to be finished")
+}
+
+func TestMirrorDroppedOverLimit(t *testing.T) {
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	mirrorConfig := httpConfig
+	mirrorConfig.MirrorMaxInflight = 1
+	config.SetHTTPConfig(mirrorConfig)
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	// mirror never answers, so the first mirrored request keeps its slot
+	mirrorAddr, requests := mirrorListener(t, false)
+
+	h.mirrorRequest(newMirroredRequest(t), mirrorAddr)
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected request to be mirrored")
+	}
+	h.mirrorRequest(newMirroredRequest(t), mirrorAddr)
+	select {
+	case <-requests:
+		t.Fatal("expected request over limit to be dropped")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if inflight := atomic.LoadInt64(&h.mirrorsInflight); inflight != 1 {
+		t.Fatalf("expected 1 mirrored request in flight, got %d", inflight)
+	}
+}
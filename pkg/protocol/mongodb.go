@@ -0,0 +1,658 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// MongoDB opcodes, legacy opcodes other than OP_QUERY and compressed messages are copied without spans
+const (
+	mongoOpReply int32 = 1
+	mongoOpQuery int32 = 2004
+	mongoOpMsg   int32 = 2013
+)
+
+// mongoHeaderLen is length of message header: length, request id, response to and opcode
+const mongoHeaderLen = 16
+
+// mongoMaxMessageLen is max message length server accepts, longer length means it isn't MongoDB framing
+const mongoMaxMessageLen = 48000000
+
+// mongoInspectLen limits bytes of message kept to parse its command, document content isn't kept beyond it
+const mongoInspectLen = 4096
+
+// OP_MSG flags
+const (
+	mongoMsgMoreToCome uint32 = 1 << 1
+)
+
+// OP_REPLY flags
+const (
+	mongoReplyCursorNotFound int32 = 1 << 0
+	mongoReplyQueryFailure   int32 = 1 << 1
+)
+
+// mongoHandshakeCommands negotiate wire protocol version, they're copied without spans
+var mongoHandshakeCommands = map[string]struct{}{
+	"hello":    {},
+	"isMaster": {},
+	"ismaster": {},
+}
+
+// MongoDBHandler copies MongoDB connection as is and reports span for every command sent with OP_MSG or OP_QUERY,
+// replies are matched to commands by request id they respond to
+type MongoDBHandler struct {
+	logger *log.Logger
+}
+
+// NewMongoDBHandler returns MongoDB handler
+func NewMongoDBHandler(logger *log.Logger) *MongoDBHandler {
+	return &MongoDBHandler{
+		logger: logger,
+	}
+}
+
+// HandleRequest copies client messages to server
+func (h *MongoDBHandler) HandleRequest(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) *net.TCPConn {
+
+	netMongoDBRequest := netRequest.(*NetMongoDBRequest)
+	if w == nil {
+		defer close(addrCh)
+		addrCh <- originalDst
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+	}
+	if isInboundConn {
+		netMongoDBRequest.setRemoteAddr(r.RemoteAddr().String())
+	} else {
+		netMongoDBRequest.setRemoteAddr(w.RemoteAddr().String())
+	}
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(bufioReader)
+
+	err := h.copyRequests(bufioReader, bufioWriter, netMongoDBRequest)
+	if err == nil || err == io.EOF {
+		err = bufioWriter.Flush()
+	}
+	if err != nil && err != io.EOF {
+		h.logger.Debugf("Err copying MongoDB requests: %s", err.Error())
+	}
+	return w
+}
+
+// HandleResponse copies server replies to client
+func (h *MongoDBHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	netMongoDBRequest := netRequest.(*NetMongoDBRequest)
+	// commands without reply are finished when connection is closed
+	defer netMongoDBRequest.StopRequest()
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(bufioReader)
+
+	err := h.copyReplies(bufioReader, bufioWriter, netMongoDBRequest)
+	if err == nil || err == io.EOF {
+		err = bufioWriter.Flush()
+	}
+	if err != nil && err != io.EOF {
+		h.logger.Debugf("Err copying MongoDB replies: %s", err.Error())
+	}
+}
+
+// copyRequests forwards messages from r to w, command is parsed from inspected message prefix.
+// The last byte of message is written after command is queued, so reply can't outrun it
+func (h *MongoDBHandler) copyRequests(r *bufio.Reader, w *bufio.Writer, nr *NetMongoDBRequest) error {
+	header := make([]byte, mongoHeaderLen)
+	prefix := make([]byte, mongoInspectLen)
+	for {
+		length, err := readMongoHeader(r, w, header)
+		if err != nil {
+			return err
+		}
+		if length < 0 {
+			// it isn't MongoDB framing, e.g. TLS handshake
+			return h.passThrough(r, w)
+		}
+		n := length - mongoHeaderLen - 1
+		if n > mongoInspectLen {
+			n = mongoInspectLen
+		}
+		if _, err := io.ReadFull(r, prefix[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(prefix[:n]); err != nil {
+			return err
+		}
+		if command := parseMongoCommand(header, prefix[:n]); command != nil {
+			nr.push(command)
+		}
+		if _, err := io.CopyN(w, r, int64(length-mongoHeaderLen-n)); err != nil {
+			return err
+		}
+	}
+}
+
+// copyReplies forwards messages from r to w and finishes command of every reply
+func (h *MongoDBHandler) copyReplies(r *bufio.Reader, w *bufio.Writer, nr *NetMongoDBRequest) error {
+	header := make([]byte, mongoHeaderLen)
+	prefix := make([]byte, mongoInspectLen)
+	for {
+		length, err := readMongoHeader(r, w, header)
+		if err != nil {
+			return err
+		}
+		if length < 0 {
+			return h.passThrough(r, w)
+		}
+		n := length - mongoHeaderLen
+		if n > mongoInspectLen {
+			n = mongoInspectLen
+		}
+		if _, err := io.ReadFull(r, prefix[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(prefix[:n]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, int64(length-mongoHeaderLen-n)); err != nil {
+			return err
+		}
+		responseTo := int32(binary.LittleEndian.Uint32(header[8:12]))
+		if command := nr.pop(responseTo); command != nil {
+			nr.finish(command, false, parseMongoReply(header, prefix[:n], command.legacyFind))
+		}
+	}
+}
+
+func (h *MongoDBHandler) passThrough(r *bufio.Reader, w *bufio.Writer) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	buf := bufferPool.Get().([]byte)
+	_, err := io.CopyBuffer(w, r, buf)
+	bufferPool.Put(buf)
+	return err
+}
+
+// readMongoHeader copies message header from r to w, length is -1 if header can't start MongoDB message
+// because of its length or opcode
+func readMongoHeader(r *bufio.Reader, w *bufio.Writer, header []byte) (int, error) {
+	n, err := io.ReadFull(r, header)
+	if _, err := w.Write(header[:n]); err != nil {
+		return 0, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	length := int32(binary.LittleEndian.Uint32(header))
+	// message has at least one byte after header
+	if length <= mongoHeaderLen || length > mongoMaxMessageLen || !isMongoOpCode(header) {
+		return -1, nil
+	}
+	return int(length), nil
+}
+
+// isMongoOpCode reports whether header has opcode of current or legacy message
+func isMongoOpCode(header []byte) bool {
+	opCode := int32(binary.LittleEndian.Uint32(header[12:16]))
+	// OP_REPLY, legacy opcodes from OP_UPDATE to OP_KILL_CURSORS, OP_COMPRESSED and OP_MSG
+	return opCode == mongoOpReply || opCode >= 2001 && opCode <= 2007 || opCode == 2012 || opCode == mongoOpMsg
+}
+
+// isMongoDBPrefix reports whether prefix starts OP_MSG or OP_QUERY client message
+func isMongoDBPrefix(prefix []byte) bool {
+	if len(prefix) < mongoHeaderLen {
+		return false
+	}
+	length := int32(binary.LittleEndian.Uint32(prefix))
+	responseTo := int32(binary.LittleEndian.Uint32(prefix[8:12]))
+	opCode := int32(binary.LittleEndian.Uint32(prefix[12:16]))
+	return length > mongoHeaderLen && length <= mongoMaxMessageLen && responseTo == 0 &&
+		(opCode == mongoOpMsg || opCode == mongoOpQuery)
+}
+
+// mongoCommand is traced command waiting for reply, only its shape is kept, not document content
+type mongoCommand struct {
+	requestID  int32
+	name       string
+	database   string
+	collection string
+	// legacyFind is set for OP_QUERY of collection documents, its reply carries documents instead of command status
+	legacyFind bool
+	// noReply is set for OP_MSG with moreToCome flag, server doesn't answer it
+	noReply   bool
+	startTime time.Time
+}
+
+// parseMongoCommand parses command of OP_MSG or OP_QUERY message from its prefix following header,
+// it returns nil for other messages and handshake commands
+func parseMongoCommand(header []byte, prefix []byte) *mongoCommand {
+	command := &mongoCommand{
+		requestID: int32(binary.LittleEndian.Uint32(header[4:8])),
+		startTime: time.Now(),
+	}
+	switch int32(binary.LittleEndian.Uint32(header[12:16])) {
+	case mongoOpMsg:
+		if len(prefix) < 4 {
+			return nil
+		}
+		flags := binary.LittleEndian.Uint32(prefix)
+		command.noReply = flags&mongoMsgMoreToCome != 0
+		body := mongoMsgBody(prefix[4:])
+		if body == nil {
+			return nil
+		}
+		command.readCommandDocument(body)
+		if database, ok := bsonLookup(body, "$db"); ok {
+			command.database, _ = database.string()
+		}
+	case mongoOpQuery:
+		if len(prefix) < 4 {
+			return nil
+		}
+		namespace, rest, ok := cstring(prefix[4:])
+		// number to skip and number to return precede query
+		if !ok || len(rest) < 8 {
+			return nil
+		}
+		query := rest[8:]
+		command.database = namespace
+		collection := ""
+		if i := strings.IndexByte(namespace, '.'); i >= 0 {
+			command.database, collection = namespace[:i], namespace[i+1:]
+		}
+		if collection != "$cmd" {
+			command.name, command.collection, command.legacyFind = "find", collection, true
+			break
+		}
+		// command may be wrapped with read preference, e.g. {$query: {count: "orders"}, $readPreference: ...}
+		if wrapped, ok := bsonLookup(query, "$query"); ok && wrapped.kind == bsonDocument {
+			query = wrapped.value
+		} else if wrapped, ok := bsonLookup(query, "query"); ok && wrapped.kind == bsonDocument {
+			query = wrapped.value
+		}
+		command.readCommandDocument(query)
+	default:
+		return nil
+	}
+	if command.name == "" {
+		return nil
+	}
+	if _, ok := mongoHandshakeCommands[command.name]; ok {
+		return nil
+	}
+	return command
+}
+
+// readCommandDocument reads command name and collection, command name is the first field of document
+// and collection is its value, getMore refers to collection with separate field
+func (command *mongoCommand) readCommandDocument(doc []byte) {
+	first, ok := bsonFirst(doc)
+	if !ok {
+		return
+	}
+	command.name = first.name
+	command.collection, _ = first.string()
+	if command.name == "getMore" {
+		if collection, ok := bsonLookup(doc, "collection"); ok {
+			command.collection, _ = collection.string()
+		}
+	}
+}
+
+// mongoMsgBody returns body document of OP_MSG sections, document sequences (e.g. inserted documents) are skipped
+func mongoMsgBody(sections []byte) []byte {
+	for len(sections) > 0 {
+		kind := sections[0]
+		sections = sections[1:]
+		if len(sections) < 4 {
+			return nil
+		}
+		size := int(int32(binary.LittleEndian.Uint32(sections)))
+		if kind == 0 {
+			return sections
+		}
+		if kind != 1 || size < 4 || size > len(sections) {
+			return nil
+		}
+		sections = sections[size:]
+	}
+	return nil
+}
+
+// mongoReply is outcome of command read from reply
+type mongoReply struct {
+	failed       bool
+	errorCode    int
+	errorMessage string
+}
+
+// parseMongoReply parses reply to command from its prefix following header,
+// OP_REPLY to legacy query of documents isn't checked for command status since it carries documents
+func parseMongoReply(header []byte, prefix []byte, legacyFind bool) mongoReply {
+	var reply mongoReply
+	var doc []byte
+	switch int32(binary.LittleEndian.Uint32(header[12:16])) {
+	case mongoOpMsg:
+		if len(prefix) < 4 {
+			return reply
+		}
+		doc = mongoMsgBody(prefix[4:])
+	case mongoOpReply:
+		// flags, cursor id, starting from and number returned precede documents
+		if len(prefix) < 20 {
+			return reply
+		}
+		flags := int32(binary.LittleEndian.Uint32(prefix))
+		reply.failed = flags&(mongoReplyCursorNotFound|mongoReplyQueryFailure) != 0
+		if reply.failed || !legacyFind {
+			doc = prefix[20:]
+		}
+		if message, ok := bsonLookup(doc, "$err"); ok {
+			reply.errorMessage, _ = message.string()
+		}
+	}
+	if doc == nil {
+		return reply
+	}
+	if ok, found := bsonLookup(doc, "ok"); found {
+		if value, isNumber := ok.number(); isNumber && value == 0 {
+			reply.failed = true
+		}
+	}
+	if !reply.failed {
+		return reply
+	}
+	if code, ok := bsonLookup(doc, "code"); ok {
+		value, _ := code.number()
+		reply.errorCode = int(value)
+	}
+	if message, ok := bsonLookup(doc, "errmsg"); ok {
+		reply.errorMessage, _ = message.string()
+	}
+	return reply
+}
+
+// BSON element types read by handler
+const (
+	bsonDouble   byte = 0x01
+	bsonString   byte = 0x02
+	bsonDocument byte = 0x03
+	bsonBoolean  byte = 0x08
+	bsonInt32    byte = 0x10
+	bsonInt64    byte = 0x12
+)
+
+// bsonElement is element of BSON document
+type bsonElement struct {
+	kind  byte
+	name  string
+	value []byte
+}
+
+func (e bsonElement) string() (string, bool) {
+	if e.kind != bsonString || len(e.value) < 5 {
+		return "", false
+	}
+	return string(e.value[4 : len(e.value)-1]), true
+}
+
+func (e bsonElement) number() (float64, bool) {
+	switch e.kind {
+	case bsonDouble:
+		return math.Float64frombits(binary.LittleEndian.Uint64(e.value)), true
+	case bsonInt32:
+		return float64(int32(binary.LittleEndian.Uint32(e.value))), true
+	case bsonInt64:
+		return float64(int64(binary.LittleEndian.Uint64(e.value))), true
+	case bsonBoolean:
+		return float64(e.value[0]), true
+	}
+	return 0, false
+}
+
+// bsonElements calls fn for elements of document until it returns false,
+// document may be cut off by inspected prefix, so elements which don't fit are skipped
+func bsonElements(doc []byte, fn func(e bsonElement) bool) {
+	if len(doc) < 5 {
+		return
+	}
+	if size := int(int32(binary.LittleEndian.Uint32(doc))); size >= 5 && size < len(doc) {
+		doc = doc[:size]
+	}
+	for rest := doc[4:]; len(rest) > 0 && rest[0] != 0; {
+		kind := rest[0]
+		name, value, ok := cstring(rest[1:])
+		if !ok {
+			return
+		}
+		size, ok := bsonValueSize(kind, value)
+		if !ok || size > len(value) {
+			return
+		}
+		if !fn(bsonElement{kind: kind, name: name, value: value[:size]}) {
+			return
+		}
+		rest = value[size:]
+	}
+}
+
+// bsonFirst returns the first element of document
+func bsonFirst(doc []byte) (bsonElement, bool) {
+	var first bsonElement
+	found := false
+	bsonElements(doc, func(e bsonElement) bool {
+		first, found = e, true
+		return false
+	})
+	return first, found
+}
+
+// bsonLookup returns top level element of document by name
+func bsonLookup(doc []byte, name string) (bsonElement, bool) {
+	var element bsonElement
+	found := false
+	bsonElements(doc, func(e bsonElement) bool {
+		if e.name == name {
+			element, found = e, true
+		}
+		return !found
+	})
+	return element, found
+}
+
+// bsonValueSize returns size of value of element type, it's false for unknown type or value cut off before its size
+func bsonValueSize(kind byte, value []byte) (int, bool) {
+	lengthPrefixed := func(extra int) (int, bool) {
+		if len(value) < 4 {
+			return 0, false
+		}
+		n := int(int32(binary.LittleEndian.Uint32(value)))
+		if n < 0 {
+			return 0, false
+		}
+		return 4 + n + extra, true
+	}
+	switch kind {
+	case 0x06, 0x0A, 0x7F, 0xFF:
+		// undefined, null, max key and min key
+		return 0, true
+	case bsonBoolean:
+		return 1, true
+	case bsonInt32:
+		return 4, true
+	case bsonDouble, 0x09, 0x11, bsonInt64:
+		// double, datetime, timestamp and int64
+		return 8, true
+	case 0x07:
+		// object id
+		return 12, true
+	case 0x13:
+		// decimal128
+		return 16, true
+	case bsonString, 0x0D, 0x0E:
+		// string, JavaScript code and symbol
+		return lengthPrefixed(0)
+	case bsonDocument, 0x04, 0x0F:
+		// document, array and code with scope include their size
+		n, ok := lengthPrefixed(0)
+		return n - 4, ok
+	case 0x05:
+		// binary subtype follows length
+		return lengthPrefixed(1)
+	case 0x0C:
+		// DB pointer is string and object id
+		return lengthPrefixed(12)
+	case 0x0B:
+		// regular expression is pattern and options
+		_, rest, ok := cstring(value)
+		if !ok {
+			return 0, false
+		}
+		_, tail, ok := cstring(rest)
+		return len(value) - len(tail), ok
+	}
+	return 0, false
+}
+
+// cstring reads null terminated string
+func cstring(b []byte) (string, []byte, bool) {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i]), b[i+1:], true
+		}
+	}
+	return "", nil, false
+}
+
+// NetMongoDBRequest keeps state of single MongoDB connection, commands are matched to replies by request id
+type NetMongoDBRequest struct {
+	isInbound bool
+	logger    *log.Logger
+
+	mu         sync.Mutex
+	remoteAddr string
+	pending    map[int32]*mongoCommand
+}
+
+// NewNetMongoDBRequest returns state of MongoDB connection accepted now
+func NewNetMongoDBRequest(logger *log.Logger, isInbound bool) *NetMongoDBRequest {
+	return &NetMongoDBRequest{
+		isInbound: isInbound,
+		logger:    logger,
+		pending:   make(map[int32]*mongoCommand),
+	}
+}
+
+// StartRequest does nothing, commands are started when they are sent
+func (nr *NetMongoDBRequest) StartRequest() {}
+
+// StopRequest finishes commands which didn't get reply
+func (nr *NetMongoDBRequest) StopRequest() {
+	nr.mu.Lock()
+	pending := nr.pending
+	nr.pending = make(map[int32]*mongoCommand)
+	nr.mu.Unlock()
+	for _, command := range pending {
+		nr.finish(command, true, mongoReply{})
+	}
+}
+
+// CleanUp does nothing, commands are finished when connection is closed
+func (nr *NetMongoDBRequest) CleanUp() {}
+
+func (nr *NetMongoDBRequest) setRemoteAddr(remoteAddr string) {
+	nr.mu.Lock()
+	nr.remoteAddr = remoteAddr
+	nr.mu.Unlock()
+}
+
+func (nr *NetMongoDBRequest) getRemoteAddr() string {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	return nr.remoteAddr
+}
+
+// push queues command waiting for reply, command server doesn't answer is finished right away
+func (nr *NetMongoDBRequest) push(command *mongoCommand) {
+	if command.noReply {
+		nr.finish(command, false, mongoReply{})
+		return
+	}
+	nr.mu.Lock()
+	nr.pending[command.requestID] = command
+	nr.mu.Unlock()
+}
+
+// pop returns command answered by reply and forgets it, so the rest of exhaust replies are ignored
+func (nr *NetMongoDBRequest) pop(responseTo int32) *mongoCommand {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	command, ok := nr.pending[responseTo]
+	if ok {
+		delete(nr.pending, responseTo)
+	}
+	return command
+}
+
+// finish reports command span, timeout is set for command without reply
+func (nr *NetMongoDBRequest) finish(command *mongoCommand, timeout bool, reply mongoReply) {
+	span := opentracing.StartSpan("mongodb."+command.name, opentracing.StartTime(command.startTime))
+	if nr.isInbound {
+		span.SetTag("span.kind", "server")
+	} else {
+		span.SetTag("span.kind", "client")
+	}
+	span.SetTag("remote_addr", nr.getRemoteAddr())
+	span.SetTag("db.type", "mongodb")
+	statement := command.name
+	if command.collection != "" {
+		statement += " " + command.collection
+		setStringTag(span, "db.mongodb.collection", command.collection)
+	}
+	setStringTag(span, "db.statement", statement)
+	if command.database != "" {
+		setStringTag(span, "db.instance", command.database)
+	}
+	if timeout {
+		span.SetTag("error", true)
+		span.SetTag("timeout", true)
+	}
+	if reply.failed {
+		span.SetTag("error", true)
+	}
+	if reply.errorCode != 0 {
+		span.SetTag("db.error_code", reply.errorCode)
+	}
+	if reply.errorMessage != "" {
+		setStringTag(span, "db.error_message", reply.errorMessage)
+	}
+	span.Finish()
+}
@@ -0,0 +1,194 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// bsonDoc builds document of name and value pairs, value is string, int32, float64 or nested document
+func bsonDoc(pairs ...interface{}) []byte {
+	var b bytes.Buffer
+	for i := 0; i < len(pairs); i += 2 {
+		name := pairs[i].(string)
+		switch value := pairs[i+1].(type) {
+		case string:
+			b.WriteByte(bsonString)
+			b.WriteString(name + "\x00")
+			binary.Write(&b, binary.LittleEndian, int32(len(value)+1))
+			b.WriteString(value + "\x00")
+		case int32:
+			b.WriteByte(bsonInt32)
+			b.WriteString(name + "\x00")
+			binary.Write(&b, binary.LittleEndian, value)
+		case float64:
+			b.WriteByte(bsonDouble)
+			b.WriteString(name + "\x00")
+			binary.Write(&b, binary.LittleEndian, math.Float64bits(value))
+		case []byte:
+			b.WriteByte(bsonDocument)
+			b.WriteString(name + "\x00")
+			b.Write(value)
+		}
+	}
+	b.WriteByte(0)
+	doc := make([]byte, 4, 4+b.Len())
+	binary.LittleEndian.PutUint32(doc, uint32(4+b.Len()))
+	return append(doc, b.Bytes()...)
+}
+
+func mongoMessage(requestID int32, responseTo int32, opCode int32, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	header := make([]byte, mongoHeaderLen)
+	binary.LittleEndian.PutUint32(header, uint32(mongoHeaderLen+len(body)))
+	binary.LittleEndian.PutUint32(header[4:], uint32(requestID))
+	binary.LittleEndian.PutUint32(header[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(header[12:], uint32(opCode))
+	return append(header, body...)
+}
+
+func mongoMsg(requestID int32, responseTo int32, flags uint32, body []byte, sequences ...[]byte) []byte {
+	flagBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flagBytes, flags)
+	payload := append([][]byte{flagBytes}, sequences...)
+	payload = append(payload, []byte{0}, body)
+	return mongoMessage(requestID, responseTo, mongoOpMsg, payload...)
+}
+
+// mongoSequence builds OP_MSG document sequence section
+func mongoSequence(identifier string, docs ...[]byte) []byte {
+	content := append([]byte(identifier+"\x00"), bytes.Join(docs, nil)...)
+	section := []byte{1, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(section[1:], uint32(4+len(content)))
+	return append(section, content...)
+}
+
+func mongoQuery(requestID int32, namespace string, query []byte) []byte {
+	return mongoMessage(requestID, 0, mongoOpQuery, []byte{0, 0, 0, 0}, []byte(namespace+"\x00"), make([]byte, 8), query)
+}
+
+func mongoOpReplyMessage(responseTo int32, flags int32, docs ...[]byte) []byte {
+	fields := make([]byte, 20)
+	binary.LittleEndian.PutUint32(fields, uint32(flags))
+	binary.LittleEndian.PutUint32(fields[16:], uint32(len(docs)))
+	return mongoMessage(100+responseTo, responseTo, mongoOpReply, append([][]byte{fields}, docs...)...)
+}
+
+func TestMongoDBSpans(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewMongoDBHandler(logger)
+	nr := NewNetMongoDBRequest(logger, false)
+
+	var client bytes.Buffer
+	client.Write(mongoQuery(1, "admin.$cmd", bsonDoc("isMaster", int32(1))))
+	client.Write(mongoMsg(2, 0, 0, bsonDoc("find", "orders", "filter", bsonDoc("user", "alice"), "$db", "shop")))
+	client.Write(mongoMsg(3, 0, 0, bsonDoc("insert", "orders", "$db", "shop"),
+		mongoSequence("documents", bsonDoc("_id", int32(1)), bsonDoc("_id", int32(2)))))
+	client.Write(mongoMsg(4, 0, mongoMsgMoreToCome, bsonDoc("update", "orders", "$db", "shop")))
+	client.Write(mongoQuery(5, "shop.users", bsonDoc("name", "alice")))
+	client.Write(mongoQuery(6, "shop.$cmd", bsonDoc("$query", bsonDoc("count", "users"), "$readPreference", bsonDoc())))
+	client.Write(mongoMsg(7, 0, 0, bsonDoc("aggregate", "orders", "$db", "shop")))
+	var forwarded bytes.Buffer
+	w := bufio.NewWriter(&forwarded)
+	if err := h.copyRequests(bufio.NewReader(bytes.NewReader(client.Bytes())), w, nr); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	w.Flush()
+	if !bytes.Equal(forwarded.Bytes(), client.Bytes()) {
+		t.Fatal("client messages aren't copied as is")
+	}
+
+	var server bytes.Buffer
+	server.Write(mongoOpReplyMessage(1, 0, bsonDoc("ismaster", int32(1), "ok", 1.0)))
+	server.Write(mongoMsg(103, 3, 0, bsonDoc("ok", 0.0, "errmsg", "duplicate key", "code", int32(11000))))
+	server.Write(mongoMsg(102, 2, 0, bsonDoc("cursor", bsonDoc(), "ok", 1.0)))
+	// returned document of legacy query isn't command status
+	server.Write(mongoOpReplyMessage(5, 0, bsonDoc("name", "alice", "ok", int32(0))))
+	server.Write(mongoOpReplyMessage(6, 0, bsonDoc("n", int32(1), "ok", 1.0)))
+	forwarded.Reset()
+	w.Reset(&forwarded)
+	if err := h.copyReplies(bufio.NewReader(bytes.NewReader(server.Bytes())), w, nr); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	w.Flush()
+	if !bytes.Equal(forwarded.Bytes(), server.Bytes()) {
+		t.Fatal("server messages aren't copied as is")
+	}
+	// aggregate is left without reply
+	nr.StopRequest()
+
+	spans := tracer.FinishedSpans()
+	expected := []struct {
+		operation  string
+		statement  string
+		database   string
+		collection interface{}
+		failed     bool
+	}{
+		{"mongodb.update", "update orders", "shop", "orders", false},
+		{"mongodb.insert", "insert orders", "shop", "orders", true},
+		{"mongodb.find", "find orders", "shop", "orders", false},
+		{"mongodb.find", "find users", "shop", "users", false},
+		{"mongodb.count", "count users", "shop", "users", false},
+		{"mongodb.aggregate", "aggregate orders", "shop", "orders", true},
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %d", len(expected), len(spans))
+	}
+	for i, e := range expected {
+		span := spans[i]
+		if span.OperationName != e.operation {
+			t.Fatalf("span %d: expected operation %s, got %s", i, e.operation, span.OperationName)
+		}
+		tags := span.Tags()
+		if tags["db.type"] != "mongodb" || tags["db.statement"] != e.statement || tags["db.instance"] != e.database ||
+			tags["db.mongodb.collection"] != e.collection || (tags["error"] == true) != e.failed {
+			t.Fatalf("span %d: unexpected tags %v", i, tags)
+		}
+	}
+	if spans[1].Tag("db.error_code") != 11000 || spans[1].Tag("db.error_message") != "duplicate key" {
+		t.Fatalf("unexpected insert error tags %v", spans[1].Tags())
+	}
+	if spans[5].Tag("timeout") != true {
+		t.Fatalf("unexpected aggregate tags %v", spans[5].Tags())
+	}
+}
+
+func TestMongoDBOtherProtocolPassedThrough(t *testing.T) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewMongoDBHandler(logger)
+	data := []byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00\x00\x00\x00\x00\x00\x00\x00")
+	var forwarded bytes.Buffer
+	w := bufio.NewWriter(&forwarded)
+	if err := h.copyRequests(bufio.NewReader(bytes.NewReader(data)), w, NewNetMongoDBRequest(logger, false)); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if !bytes.Equal(forwarded.Bytes(), data) {
+		t.Fatalf("expected %q, got %q", data, forwarded.Bytes())
+	}
+	if isMongoDBPrefix(data) {
+		t.Fatal("TLS handshake is recognized as MongoDB")
+	}
+	if !isMongoDBPrefix(mongoMsg(1, 0, 0, bsonDoc("ping", int32(1), "$db", "admin"))) {
+		t.Fatal("OP_MSG isn't recognized as MongoDB")
+	}
+}
@@ -0,0 +1,507 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+const (
+	mysqlHeaderLen     = 4
+	mysqlMaxPacketLen  = 0xffffff
+	mysqlResponseBytes = 256
+
+	mysqlComQuit             = 0x01
+	mysqlComQuery            = 0x03
+	mysqlComStmtPrepare      = 0x16
+	mysqlComStmtSendLongData = 0x18
+	mysqlComStmtClose        = 0x19
+
+	mysqlPacketOK          = 0x00
+	mysqlPacketLocalInfile = 0xfb
+	mysqlPacketEOF         = 0xfe
+	mysqlPacketERR         = 0xff
+
+	mysqlClientProtocol41   = 0x00000200
+	mysqlClientCompress     = 0x00000020
+	mysqlClientSSL          = 0x00000800
+	mysqlClientDeprecateEOF = 0x01000000
+	mysqlServerMoreResults  = 0x0008
+)
+
+// MySQLHandler copies MySQL connection as is and reports span for every query and prepared statement,
+// connection phase isn't parsed, TLS and compressed connections are passed through without spans
+type MySQLHandler struct {
+	logger *log.Logger
+}
+
+// NewMySQLHandler returns MySQL handler
+func NewMySQLHandler(logger *log.Logger) *MySQLHandler {
+	return &MySQLHandler{
+		logger: logger,
+	}
+}
+
+// HandleRequest copies client commands to upstream
+func (h *MySQLHandler) HandleRequest(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) *net.TCPConn {
+
+	netMySQLRequest := netRequest.(*NetMySQLRequest)
+	if w == nil {
+		defer close(addrCh)
+		addrCh <- originalDst
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+	}
+	if isInboundConn {
+		netMySQLRequest.setRemoteAddr(r.RemoteAddr().String())
+	} else {
+		netMySQLRequest.setRemoteAddr(w.RemoteAddr().String())
+	}
+
+	inspectLen := config.GetNetraConfig().MySQLStatementMaxLength + 1
+	if err := h.copyPackets(w, r, inspectLen, netMySQLRequest, netMySQLRequest.inspectCommand); err != nil {
+		h.logger.Debugf("Err copying MySQL packets: %s", err.Error())
+	}
+	return w
+}
+
+// HandleResponse copies server responses to client
+func (h *MySQLHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	netMySQLRequest := netRequest.(*NetMySQLRequest)
+	// commands without complete response are finished when connection is closed
+	defer netMySQLRequest.StopRequest()
+	if err := h.copyPackets(w, r, mysqlResponseBytes, netMySQLRequest, netMySQLRequest.inspectResponse); err != nil {
+		h.logger.Debugf("Err copying MySQL packets: %s", err.Error())
+	}
+}
+
+// copyPackets forwards packets from r to w, first inspectLen bytes of every packet payload
+// are inspected before the packet is written, continuation of packets longer than 16MB isn't inspected
+func (h *MySQLHandler) copyPackets(
+	w io.Writer,
+	r io.Reader,
+	inspectLen int,
+	netMySQLRequest *NetMySQLRequest,
+	inspect func(seq byte, length int, payload []byte)) error {
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(reader)
+
+	header := make([]byte, mysqlHeaderLen)
+	payload := make([]byte, inspectLen)
+	continuation := false
+	for {
+		if netMySQLRequest.isRaw() {
+			if err := bufioWriter.Flush(); err != nil {
+				return err
+			}
+			buf := bufferPool.Get().([]byte)
+			_, err := io.CopyBuffer(w, reader, buf)
+			bufferPool.Put(buf)
+			return err
+		}
+		// bytes of incomplete packet are still forwarded as is
+		if n, err := io.ReadFull(reader, header); err != nil {
+			bufioWriter.Write(header[:n])
+			bufioWriter.Flush()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		n := length
+		if n > inspectLen {
+			n = inspectLen
+		}
+		if read, err := io.ReadFull(reader, payload[:n]); err != nil {
+			bufioWriter.Write(header)
+			bufioWriter.Write(payload[:read])
+			bufioWriter.Flush()
+			return err
+		}
+		if !continuation && !netMySQLRequest.isRaw() {
+			inspect(header[3], length, payload[:n])
+		}
+		continuation = length == mysqlMaxPacketLen
+
+		if _, err := bufioWriter.Write(header); err != nil {
+			return err
+		}
+		if _, err := bufioWriter.Write(payload[:n]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(bufioWriter, reader, int64(length-n)); err != nil {
+			bufioWriter.Flush()
+			return err
+		}
+	}
+}
+
+// flushingReader flushes pending writes before it reads from connection, so when proxy blocks
+// waiting for more bytes, peer on the other side never waits for bytes stuck in the buffer
+type flushingReader struct {
+	r io.Reader
+	w *bufio.Writer
+}
+
+func (fr *flushingReader) Read(p []byte) (int, error) {
+	if err := fr.w.Flush(); err != nil {
+		return 0, err
+	}
+	return fr.r.Read(p)
+}
+
+// mysqlCommand is a command sent by client, only queries and prepared statements are traced
+type mysqlCommand struct {
+	code      byte
+	statement string
+	startTime time.Time
+}
+
+// mysqlResponse states
+const (
+	mysqlExpectFirst = iota
+	mysqlColumns
+	mysqlColumnsEOF
+	mysqlRows
+	mysqlPrepareDefinitions
+)
+
+// mysqlResponse follows response to traced command till it's complete
+type mysqlResponse struct {
+	command      *mysqlCommand
+	state        int
+	remaining    int
+	resultSet    bool
+	rows         int64
+	affectedRows int64
+	errorCode    uint16
+	errorMessage string
+	failed       bool
+}
+
+// NetMySQLRequest keeps state of single MySQL connection, commands are queued by client side
+// and every response starts with sequence id 1, so the oldest queued command is matched to it
+type NetMySQLRequest struct {
+	isInbound bool
+	logger    *log.Logger
+	commands  *Queue
+
+	raw          int32
+	deprecateEOF int32
+
+	mu         sync.Mutex
+	remoteAddr string
+
+	// client side state
+	handshaken bool
+
+	// server side state
+	response *mysqlResponse
+}
+
+// NewNetMySQLRequest returns state of MySQL connection accepted now
+func NewNetMySQLRequest(logger *log.Logger, isInbound bool) *NetMySQLRequest {
+	return &NetMySQLRequest{
+		isInbound: isInbound,
+		logger:    logger,
+		commands:  NewQueue(),
+	}
+}
+
+// StartRequest does nothing, commands are started when they are sent
+func (nr *NetMySQLRequest) StartRequest() {}
+
+// StopRequest finishes commands which didn't get complete response
+func (nr *NetMySQLRequest) StopRequest() {
+	if nr.response != nil {
+		nr.response.failed = true
+		nr.finish(nr.response)
+		nr.response = nil
+	}
+	for el := nr.commands.Pop(); el != nil; el = nr.commands.Pop() {
+		if command := el.(*mysqlCommand); isTracedMySQLCommand(command.code) {
+			nr.finish(&mysqlResponse{command: command, failed: true})
+		}
+	}
+}
+
+// CleanUp does nothing, commands are finished when connection is closed
+func (nr *NetMySQLRequest) CleanUp() {}
+
+func (nr *NetMySQLRequest) setRemoteAddr(remoteAddr string) {
+	nr.mu.Lock()
+	nr.remoteAddr = remoteAddr
+	nr.mu.Unlock()
+}
+
+func (nr *NetMySQLRequest) getRemoteAddr() string {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	return nr.remoteAddr
+}
+
+// isRaw reports whether connection is encrypted or compressed, so its packets can't be parsed anymore
+func (nr *NetMySQLRequest) isRaw() bool {
+	return atomic.LoadInt32(&nr.raw) == 1
+}
+
+// inspectCommand handles client packet, handshake response is the only packet with sequence id 1
+// and commands always start with sequence id 0
+func (nr *NetMySQLRequest) inspectCommand(seq byte, length int, payload []byte) {
+	switch {
+	case seq == 1 && !nr.handshaken:
+		nr.handshaken = true
+		var capabilities uint32
+		if len(payload) >= 4 {
+			capabilities = uint32(binary.LittleEndian.Uint16(payload))
+			if capabilities&mysqlClientProtocol41 != 0 {
+				capabilities = binary.LittleEndian.Uint32(payload)
+			}
+		}
+		if capabilities&(mysqlClientSSL|mysqlClientCompress) != 0 {
+			atomic.StoreInt32(&nr.raw, 1)
+		}
+		if capabilities&mysqlClientDeprecateEOF != 0 {
+			atomic.StoreInt32(&nr.deprecateEOF, 1)
+		}
+	case seq == 0 && len(payload) > 0:
+		code := payload[0]
+		switch code {
+		case mysqlComQuit, mysqlComStmtSendLongData, mysqlComStmtClose:
+			// there is no response to these commands
+			return
+		}
+		command := &mysqlCommand{code: code, startTime: time.Now()}
+		if isTracedMySQLCommand(code) {
+			command.statement = mysqlStatement(payload[1:])
+		}
+		nr.commands.Push(command)
+	}
+}
+
+// mysqlStatement truncates and sanitizes statement according to the config
+func mysqlStatement(payload []byte) string {
+	netraConfig := config.GetNetraConfig()
+	if len(payload) > netraConfig.MySQLStatementMaxLength {
+		payload = payload[:netraConfig.MySQLStatementMaxLength]
+	}
+	if netraConfig.MySQLSanitizeStatements {
+		return SanitizeSQL(string(payload))
+	}
+	return string(payload)
+}
+
+func isTracedMySQLCommand(code byte) bool {
+	return code == mysqlComQuery || code == mysqlComStmtPrepare
+}
+
+// inspectResponse handles server packet and finishes command when its response is complete
+func (nr *NetMySQLRequest) inspectResponse(seq byte, length int, payload []byte) {
+	if seq == 1 && nr.commands.Len() > 0 {
+		if nr.response != nil {
+			nr.finish(nr.response)
+		}
+		nr.response = nil
+		command := nr.commands.Pop().(*mysqlCommand)
+		if isTracedMySQLCommand(command.code) {
+			nr.response = &mysqlResponse{command: command}
+		}
+	}
+	if nr.response == nil || len(payload) == 0 {
+		return
+	}
+	if nr.response.parse(length, payload, atomic.LoadInt32(&nr.deprecateEOF) == 1) {
+		nr.finish(nr.response)
+		nr.response = nil
+	}
+}
+
+// parse handles next packet of response and reports whether response is complete
+func (resp *mysqlResponse) parse(length int, payload []byte, deprecateEOF bool) bool {
+	switch resp.state {
+	case mysqlExpectFirst:
+		switch payload[0] {
+		case mysqlPacketOK:
+			if resp.command.code == mysqlComStmtPrepare {
+				return resp.parsePrepareOK(payload, deprecateEOF)
+			}
+			affectedRows, status := parseMySQLOK(payload)
+			resp.affectedRows += affectedRows
+			return status&mysqlServerMoreResults == 0
+		case mysqlPacketERR:
+			resp.parseERR(payload)
+			return true
+		case mysqlPacketLocalInfile:
+			// client sends file and server replies with OK packet
+			return false
+		default:
+			columns, _ := parseMySQLLengthEncodedInt(payload)
+			resp.resultSet = true
+			resp.remaining = int(columns)
+			resp.state = mysqlColumns
+		}
+	case mysqlColumns:
+		resp.remaining--
+		if resp.remaining <= 0 {
+			if deprecateEOF {
+				resp.state = mysqlRows
+			} else {
+				resp.state = mysqlColumnsEOF
+			}
+		}
+	case mysqlColumnsEOF:
+		resp.state = mysqlRows
+	case mysqlRows:
+		switch {
+		case payload[0] == mysqlPacketEOF && !deprecateEOF && length < 9:
+			if len(payload) >= 5 && binary.LittleEndian.Uint16(payload[3:])&mysqlServerMoreResults != 0 {
+				resp.state = mysqlExpectFirst
+				return false
+			}
+			return true
+		case payload[0] == mysqlPacketEOF && deprecateEOF && length < mysqlMaxPacketLen:
+			if _, status := parseMySQLOK(payload); status&mysqlServerMoreResults != 0 {
+				resp.state = mysqlExpectFirst
+				return false
+			}
+			return true
+		case payload[0] == mysqlPacketERR:
+			resp.parseERR(payload)
+			return true
+		default:
+			resp.rows++
+		}
+	case mysqlPrepareDefinitions:
+		resp.remaining--
+		return resp.remaining <= 0
+	}
+	return false
+}
+
+// parsePrepareOK handles COM_STMT_PREPARE response header followed by
+// parameter and column definitions, each block is terminated by EOF packet unless it's deprecated
+func (resp *mysqlResponse) parsePrepareOK(payload []byte, deprecateEOF bool) bool {
+	if len(payload) < 9 {
+		return true
+	}
+	columns := int(binary.LittleEndian.Uint16(payload[5:]))
+	params := int(binary.LittleEndian.Uint16(payload[7:]))
+	resp.remaining = columns + params
+	if !deprecateEOF {
+		if columns > 0 {
+			resp.remaining++
+		}
+		if params > 0 {
+			resp.remaining++
+		}
+	}
+	resp.state = mysqlPrepareDefinitions
+	return resp.remaining == 0
+}
+
+// parseERR reads error code and message, message follows SQL state marker '#' and 5 bytes of state
+func (resp *mysqlResponse) parseERR(payload []byte) {
+	resp.failed = true
+	if len(payload) < 3 {
+		return
+	}
+	resp.errorCode = binary.LittleEndian.Uint16(payload[1:])
+	message := payload[3:]
+	if len(message) >= 6 && message[0] == '#' {
+		message = message[6:]
+	}
+	resp.errorMessage = string(message)
+}
+
+// parseMySQLOK returns affected rows and status flags of OK packet
+func parseMySQLOK(payload []byte) (affectedRows int64, status uint16) {
+	pos := 1
+	rows, n := parseMySQLLengthEncodedInt(payload[pos:])
+	pos += n
+	_, n = parseMySQLLengthEncodedInt(payload[pos:])
+	pos += n
+	if len(payload) >= pos+2 {
+		status = binary.LittleEndian.Uint16(payload[pos:])
+	}
+	return int64(rows), status
+}
+
+// parseMySQLLengthEncodedInt returns length-encoded integer and number of bytes it takes
+func parseMySQLLengthEncodedInt(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	var size int
+	switch b[0] {
+	case 0xfc:
+		size = 3
+	case 0xfd:
+		size = 4
+	case 0xfe:
+		size = 9
+	default:
+		return uint64(b[0]), 1
+	}
+	if len(b) < size {
+		return 0, len(b)
+	}
+	var value uint64
+	for i := size - 1; i > 0; i-- {
+		value = value<<8 | uint64(b[i])
+	}
+	return value, size
+}
+
+// finish reports command span
+func (nr *NetMySQLRequest) finish(resp *mysqlResponse) {
+	operation := "mysql.query"
+	if resp.command.code == mysqlComStmtPrepare {
+		operation = "mysql.prepare"
+	}
+	span := opentracing.StartSpan(operation, opentracing.StartTime(resp.command.startTime))
+	if nr.isInbound {
+		span.SetTag("span.kind", "server")
+	} else {
+		span.SetTag("span.kind", "client")
+	}
+	span.SetTag("remote_addr", nr.getRemoteAddr())
+	span.SetTag("db.type", "mysql")
+	setStringTag(span, "db.statement", resp.command.statement)
+	if resp.resultSet {
+		span.SetTag("db.rows", resp.rows)
+	} else if resp.command.code == mysqlComQuery && !resp.failed {
+		span.SetTag("db.rows_affected", resp.affectedRows)
+	}
+	if resp.failed {
+		span.SetTag("error", true)
+	}
+	if resp.errorCode != 0 {
+		span.SetTag("db.error_code", resp.errorCode)
+		span.SetTag("db.error_message", resp.errorMessage)
+	}
+	span.Finish()
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"strings"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// pathIDPlaceholder replaces id segments of normalized path
+const pathIDPlaceholder = "{id}"
+
+// NormalizePath replaces numeric and UUID path segments with {id},
+// so paths of the same route make single span operation
+func NormalizePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isNumeric(segment) || isUUID(segment) {
+			segments[i] = pathIDPlaceholder
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isUUID reports whether s is UUID in canonical 8-4-4-4-12 hex form
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			c := s[i]
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// operationName returns span operation of request: path for inbound and configured format for outbound one,
+// destination is address outbound request is sent to
+func operationName(httpConfig config.HTTPConfig, req *nhttp.Request, isInbound bool, destination string) string {
+	path := req.URL.Path
+	if httpConfig.OperationNormalizePath {
+		path = NormalizePath(path)
+	}
+	operation := path
+	if !isInbound {
+		switch httpConfig.OutboundOperationFormat {
+		case config.OperationFormatPath:
+			// path is shared by all hosts
+		case config.OperationFormatPeerService:
+			operation = peerService(httpConfig, destination)
+		default:
+			operation = req.Host + path
+		}
+	}
+	if httpConfig.OperationMethodPrefix {
+		operation = req.Method + " " + operation
+	}
+	return operation
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+func TestNormalizePath(t *testing.T) {
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/", "/"},
+		{"", ""},
+		{"/users", "/users"},
+		{"/users/123", "/users/{id}"},
+		{"/users/123/orders/456", "/users/{id}/orders/{id}"},
+		{"/users/123/", "/users/{id}/"},
+		{"/orders/3f2504e0-4f89-11d3-9a0c-0305e82c3301", "/orders/{id}"},
+		{"/orders/3F2504E0-4F89-11D3-9A0C-0305E82C3301/items", "/orders/{id}/items"},
+		{"/users/42/orders/3f2504e0-4f89-11d3-9a0c-0305e82c3301", "/users/{id}/orders/{id}"},
+		// mixed segments aren't ids
+		{"/api/v2/users", "/api/v2/users"},
+		{"/users/abc123", "/users/abc123"},
+		{"/users/123abc", "/users/123abc"},
+		{"/orders/3f2504e0-4f89-11d3-9a0c-0305e82c330", "/orders/3f2504e0-4f89-11d3-9a0c-0305e82c330"},
+		{"/orders/3f2504e0x4f89-11d3-9a0c-0305e82c3301", "/orders/3f2504e0x4f89-11d3-9a0c-0305e82c3301"},
+		{"/orders/zf2504e0-4f89-11d3-9a0c-0305e82c3301", "/orders/zf2504e0-4f89-11d3-9a0c-0305e82c3301"},
+	}
+	for _, c := range cases {
+		if actual := NormalizePath(c.path); actual != c.expected {
+			t.Fatalf("path %q: expected %q, got %q", c.path, c.expected, actual)
+		}
+	}
+}
+
+func TestOutboundOperationName(t *testing.T) {
+	req := &nhttp.Request{Method: nhttp.MethodGet, Host: "orders.svc:8080", URL: &url.URL{Path: "/orders/123"}}
+	cases := []struct {
+		format   string
+		expected string
+	}{
+		{config.OperationFormatHostPath, "GET orders.svc:8080/orders/{id}"},
+		{config.OperationFormatPath, "GET /orders/{id}"},
+		{config.OperationFormatPeerService, "GET orders-v2"},
+	}
+	for _, c := range cases {
+		httpConfig := config.HTTPConfig{
+			OperationNormalizePath:  true,
+			OperationMethodPrefix:   true,
+			OutboundOperationFormat: c.format,
+		}
+		if actual := operationName(httpConfig, req, false, "orders-v2:80"); actual != c.expected {
+			t.Fatalf("format %s: expected %q, got %q", c.format, c.expected, actual)
+		}
+		// inbound operation doesn't depend on format
+		if actual := operationName(httpConfig, req, true, ""); actual != "GET /orders/{id}" {
+			t.Fatalf("format %s: unexpected inbound operation %q", c.format, actual)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// PassthroughHandler copies raw bytes in both directions without any parsing,
+// connection is traced as a whole
+type PassthroughHandler struct {
+	logger *log.Logger
+}
+
+// NewPassthroughHandler returns passthrough handler
+func NewPassthroughHandler(logger *log.Logger) *PassthroughHandler {
+	return &PassthroughHandler{
+		logger: logger,
+	}
+}
+
+// HandleRequest copies client side of connection to upstream
+func (h *PassthroughHandler) HandleRequest(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) *net.TCPConn {
+
+	netPassthroughRequest := netRequest.(*NetPassthroughRequest)
+	if w == nil {
+		defer close(addrCh)
+		addrCh <- originalDst
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+	}
+	if isInboundConn {
+		netPassthroughRequest.setConnection(originalDst, r.RemoteAddr().String())
+	} else {
+		netPassthroughRequest.setConnection(originalDst, w.RemoteAddr().String())
+	}
+
+	netPassthroughRequest.stopDirection(true, h.copy(w, r))
+	return w
+}
+
+// HandleResponse copies upstream side of connection to client
+func (h *PassthroughHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	netRequest.(*NetPassthroughRequest).stopDirection(false, h.copy(w, r))
+}
+
+func (h *PassthroughHandler) copy(w *net.TCPConn, r *net.TCPConn) int64 {
+	written, err := copyTCP(w, r)
+	if err != nil {
+		h.logger.Debugf("Err ReadFrom: %s", err.Error())
+	}
+	return written
+}
+
+// NetPassthroughRequest keeps state of single passed through connection
+type NetPassthroughRequest struct {
+	isInbound bool
+	startTime time.Time
+
+	mu            sync.Mutex
+	started       bool
+	operation     string
+	remoteAddr    string
+	bytesSent     int64
+	bytesReceived int64
+	stopped       int
+	// TLS connection state, routed is set for connections passed through by TLS handler only
+	sni    string
+	routed *routedRequest
+}
+
+// NewNetPassthroughRequest returns state of connection accepted now
+func NewNetPassthroughRequest(logger *log.Logger, isInbound bool) *NetPassthroughRequest {
+	return &NetPassthroughRequest{
+		isInbound: isInbound,
+		startTime: time.Now(),
+	}
+}
+
+// StartRequest does nothing, connection is started when it's accepted
+func (nr *NetPassthroughRequest) StartRequest() {}
+
+// setConnection marks connection to originalDst as established, span is reported only for such connections
+func (nr *NetPassthroughRequest) setConnection(originalDst string, remoteAddr string) {
+	nr.mu.Lock()
+	nr.started = true
+	nr.operation = originalDst
+	nr.remoteAddr = remoteAddr
+	nr.mu.Unlock()
+}
+
+// setTLS sets server name of TLS connection and its routing
+func (nr *NetPassthroughRequest) setTLS(sni string, routed routedRequest) {
+	nr.mu.Lock()
+	nr.sni = sni
+	nr.routed = &routed
+	nr.mu.Unlock()
+}
+
+// StopDirection records bytes copied in one direction, span is reported when both directions are closed
+func (nr *NetPassthroughRequest) stopDirection(isRequest bool, written int64) {
+	nr.mu.Lock()
+	if isRequest {
+		nr.bytesSent = written
+	} else {
+		nr.bytesReceived = written
+	}
+	nr.stopped++
+	done := nr.stopped == 2
+	nr.mu.Unlock()
+	if done {
+		nr.StopRequest()
+	}
+}
+
+// StopRequest reports connection span
+func (nr *NetPassthroughRequest) StopRequest() {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	if !nr.started {
+		return
+	}
+	nr.started = false
+
+	finishTime := time.Now()
+	span := opentracing.StartSpan(nr.operation, opentracing.StartTime(nr.startTime))
+	if nr.isInbound {
+		span.SetTag("span.kind", "server")
+	} else {
+		span.SetTag("span.kind", "client")
+	}
+	span.SetTag("remote_addr", nr.remoteAddr)
+	span.SetTag("bytes_sent", nr.bytesSent)
+	span.SetTag("bytes_received", nr.bytesReceived)
+	span.SetTag("duration", finishTime.Sub(nr.startTime).String())
+	if nr.routed != nil {
+		if nr.sni != "" {
+			setStringTag(span, "tls.sni", nr.sni)
+		}
+		if nr.routed.overridden() {
+			span.SetTag("routing.applied", true)
+			setStringTag(span, "routing.original_dst", nr.routed.originalDst)
+			setStringTag(span, "routing.resolved_dst", nr.routed.addr)
+			span.SetTag("routing.source", nr.routed.source)
+		}
+	}
+	span.FinishWithOptions(opentracing.FinishOptions{FinishTime: finishTime})
+}
+
+// CleanUp does nothing, span is reported when both directions are closed
+func (nr *NetPassthroughRequest) CleanUp() {}
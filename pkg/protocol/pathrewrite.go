@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// rewrite returns path rewritten by rule and whether rule matches it
+func rewrite(rule config.PathRewriteRule, path string) (string, bool) {
+	if rule.Pattern != nil {
+		if !rule.Pattern.MatchString(path) {
+			return path, false
+		}
+		path = rule.Pattern.ReplaceAllString(path, rule.Replacement)
+	} else {
+		if !strings.HasPrefix(path, rule.Prefix) {
+			return path, false
+		}
+		path = rule.Replacement + path[len(rule.Prefix):]
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path, true
+}
+
+// rewritePath applies the most specific rule of decoded path to url, rules are sorted by specificity.
+// Escaped path is rewritten with the same rule to keep its escaping, request line falls back
+// to default escaping if it's no longer encoding of the rewritten path
+func rewritePath(rules []config.PathRewriteRule, u *url.URL) bool {
+	for _, rule := range rules {
+		path, ok := rewrite(rule, u.Path)
+		if !ok {
+			continue
+		}
+		rawPath := ""
+		if u.RawPath != "" {
+			rawPath, _ = rewrite(rule, u.RawPath)
+		}
+		u.Path, u.RawPath = path, rawPath
+		return true
+	}
+	return false
+}
+
+// rewriteRequestPath rewrites path of request before it's forwarded and keeps original one for its span
+func (nr *NetHTTPRequest) rewriteRequestPath(req *nhttp.Request) {
+	originalPath := req.URL.EscapedPath()
+	if rewritePath(config.GetHTTPConfig().PathRewriteRules, req.URL) {
+		nr.rewritesMu.Lock()
+		nr.originalPaths[req] = originalPath
+		nr.rewritesMu.Unlock()
+	}
+}
+
+// popOriginalPath returns path request had before it was rewritten and forgets it
+func (nr *NetHTTPRequest) popOriginalPath(req *nhttp.Request) (string, bool) {
+	nr.rewritesMu.Lock()
+	defer nr.rewritesMu.Unlock()
+	path, ok := nr.originalPaths[req]
+	if ok {
+		delete(nr.originalPaths, req)
+	}
+	return path, ok
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestRewritePath(t *testing.T) {
+	// the most specific prefix goes first, patterns follow prefixes
+	rules := []config.PathRewriteRule{
+		{Prefix: "/old/admin", Replacement: "/admin"},
+		{Prefix: "/api/v1", Replacement: ""},
+		{Prefix: "/old", Replacement: "/new"},
+		{Pattern: regexp.MustCompile(`^/users/([0-9]+)/info$`), Replacement: "/v2/users/$1"},
+	}
+	tests := []struct {
+		uri       string
+		rewritten bool
+		expected  string
+	}{
+		{"/old/x?id=1", true, "/new/x?id=1"},
+		{"/old/admin/users", true, "/admin/users"},
+		{"/api/v1", true, "/"},
+		{"/api/v1/orders", true, "/orders"},
+		{"/users/42/info", true, "/v2/users/42"},
+		{"/users/me/info", false, "/users/me/info"},
+		// escaping of the rest of path is kept
+		{"/old/a%2Fb/c%20d", true, "/new/a%2Fb/c%20d"},
+		// decoded path matches, escaped one falls back to default escaping
+		{"/%6Fld/a%2Fb", true, "/new/a/b"},
+	}
+	for _, tt := range tests {
+		u, err := url.ParseRequestURI(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rewritten := rewritePath(rules, u); rewritten != tt.rewritten {
+			t.Fatalf("%s: expected rewritten %v, got %v", tt.uri, tt.rewritten, rewritten)
+		}
+		if actual := u.RequestURI(); actual != tt.expected {
+			t.Fatalf("%s: expected %s, got %s", tt.uri, tt.expected, actual)
+		}
+	}
+}
+
+func TestRewrittenPathIsTagged(t *testing.T) {
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	rewriteConfig := httpConfig
+	rewriteConfig.PathRewriteRules = []config.PathRewriteRule{{Prefix: "/old", Replacement: "/new"}}
+	config.SetHTTPConfig(rewriteConfig)
+
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nr := NewNetHTTPRequest(logger, true, cache.New(time.Minute, time.Minute))
+	for _, path := range []string{"/old/a%20b", "/index.html"} {
+		u, err := url.ParseRequestURI(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &nhttp.Request{Method: nhttp.MethodGet, URL: u, Header: nhttp.Header{}}
+		nr.rewriteRequestPath(req)
+		span := mocktracer.New().StartSpan("GET").(*mocktracer.MockSpan)
+		nr.fillSpan(span, req, nil)
+		if path == "/index.html" {
+			if tag := span.Tag("http.original_path"); tag != nil {
+				t.Fatalf("unexpected original path of request which isn't rewritten: %v", tag)
+			}
+			continue
+		}
+		if tag := span.Tag("http.original_path"); tag != "/old/a%20b" || span.Tag("http.path") != "/new/a%20b" {
+			t.Fatalf("unexpected tags %v", span.Tags())
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"net"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// routing sources tell where routing value of request came from
+const (
+	routingSourceCookie  = "cookie"
+	routingSourceHeader  = "header"
+	routingSourceContext = "context"
+	routingSourceSNI     = "sni"
+)
+
+// routedRequest is destination outbound request is routed to and how routing was decided
+type routedRequest struct {
+	addr        string
+	originalDst string
+	source      string
+}
+
+// overridden reports whether routing changed request destination
+func (rr routedRequest) overridden() bool {
+	return rr.addr != rr.originalDst
+}
+
+// setRoutedDestination remembers destination outbound request is routed to instead of its host
+func (nr *NetHTTPRequest) setRoutedDestination(req *nhttp.Request, routed routedRequest) {
+	nr.routedMu.Lock()
+	nr.routedDestinations[req] = routed
+	nr.routedMu.Unlock()
+}
+
+// routedDestination returns destination request is routed to
+func (nr *NetHTTPRequest) routedDestination(req *nhttp.Request) (string, bool) {
+	nr.routedMu.Lock()
+	defer nr.routedMu.Unlock()
+	routed, ok := nr.routedDestinations[req]
+	return routed.addr, ok
+}
+
+// popRoutedDestination returns routing of request and forgets it
+func (nr *NetHTTPRequest) popRoutedDestination(req *nhttp.Request) (routedRequest, bool) {
+	nr.routedMu.Lock()
+	defer nr.routedMu.Unlock()
+	routed, ok := nr.routedDestinations[req]
+	if ok {
+		delete(nr.routedDestinations, req)
+	}
+	return routed, ok
+}
+
+// tagRouting sets peer.service tag of outbound request span and routing tags if routing overrode its destination
+func (nr *NetHTTPRequest) tagRouting(span opentracing.Span, req *nhttp.Request) {
+	destination := req.Host
+	routed, ok := nr.popRoutedDestination(req)
+	if ok {
+		destination = routed.addr
+	}
+	span.SetTag("peer.service", peerService(config.GetHTTPConfig(), destination))
+	if !ok || !routed.overridden() {
+		return
+	}
+	span.SetTag("routing.applied", true)
+	setStringTag(span, "routing.original_dst", routed.originalDst)
+	setStringTag(span, "routing.resolved_dst", routed.addr)
+	span.SetTag("routing.source", routed.source)
+}
+
+// peerService returns service name of destination, it's host without port
+// or the first group of configured pattern matched against the host
+func peerService(httpConfig config.HTTPConfig, destination string) string {
+	host := destination
+	if h, _, err := net.SplitHostPort(destination); err == nil {
+		host = h
+	}
+	if httpConfig.PeerServicePattern == nil {
+		return host
+	}
+	if m := httpConfig.PeerServicePattern.FindStringSubmatch(host); len(m) > 1 && m[1] != "" {
+		return m[1]
+	}
+	return host
+}
@@ -0,0 +1,317 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+const (
+	w3cTraceParentHeaderName = "Traceparent"
+	w3cSampledFlag           = 0x01
+
+	b3TraceIDHeaderName      = "X-B3-Traceid"
+	b3SpanIDHeaderName       = "X-B3-Spanid"
+	b3ParentSpanIDHeaderName = "X-B3-Parentspanid"
+	b3SampledHeaderName      = "X-B3-Sampled"
+	b3FlagsHeaderName        = "X-B3-Flags"
+
+	datadogTraceIDHeaderName          = "X-Datadog-Trace-Id"
+	datadogParentIDHeaderName         = "X-Datadog-Parent-Id"
+	datadogSamplingPriorityHeaderName = "X-Datadog-Sampling-Priority"
+	datadogTagsHeaderName             = "X-Datadog-Tags"
+	// datadogTraceIDHighTag carries upper 64 bits of 128-bit trace id as hex, trace id header has lower ones
+	datadogTraceIDHighTag = "_dd.p.tid"
+)
+
+var (
+	errMalformedTraceParent = errors.New("malformed traceparent header")
+	errMalformedB3          = errors.New("malformed B3 headers")
+	errMalformedDatadog     = errors.New("malformed datadog headers")
+)
+
+// extractContext extracts parent span context from request headers,
+// jaeger format has priority over the other enabled formats
+func extractContext(header nhttp.Header) (opentracing.SpanContext, error) {
+	carrier := opentracing.HTTPHeadersCarrier(header)
+	wireContext, err := opentracing.GlobalTracer().Extract(opentracing.HTTPHeaders, carrier)
+	if err == nil {
+		return wireContext, nil
+	}
+	if config.GetHTTPConfig().W3CPropagationEnabled && header.Get(w3cTraceParentHeaderName) != "" {
+		if w3cContext, w3cErr := extractW3CContext(header); w3cErr == nil {
+			return w3cContext, nil
+		}
+	}
+	if config.GetHTTPConfig().B3PropagationEnabled && header.Get(b3TraceIDHeaderName) != "" {
+		if b3Context, b3Err := extractB3Context(header); b3Err == nil {
+			return b3Context, nil
+		}
+	}
+	if config.GetHTTPConfig().DatadogPropagationEnabled && header.Get(datadogTraceIDHeaderName) != "" {
+		if datadogContext, datadogErr := extractDatadogContext(header); datadogErr == nil {
+			return datadogContext, nil
+		}
+	}
+	return nil, err
+}
+
+// extractSamplingPriority returns sampling decision which is propagated without span context,
+// it's used for spans started without parent
+func extractSamplingPriority(header nhttp.Header) (uint16, bool) {
+	if config.GetHTTPConfig().B3PropagationEnabled {
+		if sampled, ok := b3Sampled(header); ok {
+			if sampled {
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if config.GetHTTPConfig().DatadogPropagationEnabled {
+		if sampled, ok := datadogSampled(header); ok {
+			if sampled {
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// injectContext propagates span context to outbound request headers in every enabled format
+func injectContext(spanContext opentracing.SpanContext, header nhttp.Header) {
+	httpConfig := config.GetHTTPConfig()
+	if !hasJaegerContext(header) {
+		opentracing.GlobalTracer().Inject(
+			spanContext,
+			opentracing.HTTPHeaders,
+			opentracing.HTTPHeadersCarrier(header),
+		)
+	}
+	jaegerContext, ok := spanContext.(jaeger.SpanContext)
+	if !ok {
+		return
+	}
+	preserve := httpConfig.TraceContextInjection == config.TraceContextInjectionPreserve
+	if httpConfig.W3CPropagationEnabled && !(preserve && header.Get(w3cTraceParentHeaderName) != "") {
+		injectW3CContext(jaegerContext, header)
+	}
+	if httpConfig.B3PropagationEnabled && !(preserve && header.Get(b3TraceIDHeaderName) != "") {
+		injectB3Context(jaegerContext, header)
+	}
+	if httpConfig.DatadogPropagationEnabled && !(preserve && header.Get(datadogTraceIDHeaderName) != "") {
+		injectDatadogContext(jaegerContext, header)
+	}
+}
+
+// hasJaegerContext reports whether header carries jaeger trace context,
+// request id matching may have already set it with non-canonical name
+func hasJaegerContext(header nhttp.Header) bool {
+	return len(header[jaeger.TraceContextHeaderName]) != 0 || header.Get(jaeger.TraceContextHeaderName) != ""
+}
+
+// preservesTraceContext reports whether trace context application has set in outbound request header
+// should be kept instead of the one matched by request id
+func preservesTraceContext(httpConfig config.HTTPConfig, header nhttp.Header) bool {
+	if httpConfig.TraceContextInjection != config.TraceContextInjectionPreserve {
+		return false
+	}
+	return hasJaegerContext(header) ||
+		httpConfig.W3CPropagationEnabled && header.Get(w3cTraceParentHeaderName) != "" ||
+		httpConfig.B3PropagationEnabled && header.Get(b3TraceIDHeaderName) != "" ||
+		httpConfig.DatadogPropagationEnabled && header.Get(datadogTraceIDHeaderName) != ""
+}
+
+// extractW3CContext builds span context from W3C traceparent header:
+// version-trace_id-parent_id-trace_flags
+func extractW3CContext(header nhttp.Header) (jaeger.SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(header.Get(w3cTraceParentHeaderName)), "-")
+	if len(parts) < 4 {
+		return jaeger.SpanContext{}, errMalformedTraceParent
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	// version 00 has exactly 4 fields, future versions may append more
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return jaeger.SpanContext{}, errMalformedTraceParent
+	}
+	if len(traceID) != 32 || len(parentID) != 16 || len(flags) != 2 {
+		return jaeger.SpanContext{}, errMalformedTraceParent
+	}
+	high, err := strconv.ParseUint(traceID[:16], 16, 64)
+	if err != nil {
+		return jaeger.SpanContext{}, errMalformedTraceParent
+	}
+	low, err := strconv.ParseUint(traceID[16:], 16, 64)
+	if err != nil {
+		return jaeger.SpanContext{}, errMalformedTraceParent
+	}
+	spanID, err := strconv.ParseUint(parentID, 16, 64)
+	if err != nil {
+		return jaeger.SpanContext{}, errMalformedTraceParent
+	}
+	traceFlags, err := strconv.ParseUint(flags, 16, 8)
+	if err != nil {
+		return jaeger.SpanContext{}, errMalformedTraceParent
+	}
+	if high == 0 && low == 0 || spanID == 0 {
+		return jaeger.SpanContext{}, errMalformedTraceParent
+	}
+	return jaeger.NewSpanContext(
+		jaeger.TraceID{High: high, Low: low},
+		jaeger.SpanID(spanID),
+		0,
+		traceFlags&w3cSampledFlag != 0,
+		nil,
+	), nil
+}
+
+// injectW3CContext sets W3C traceparent header from span context
+func injectW3CContext(spanContext jaeger.SpanContext, header nhttp.Header) {
+	var flags byte
+	if spanContext.IsSampled() {
+		flags |= w3cSampledFlag
+	}
+	traceID := spanContext.TraceID()
+	header.Set(
+		w3cTraceParentHeaderName,
+		fmt.Sprintf("00-%016x%016x-%016x-%02x", traceID.High, traceID.Low, uint64(spanContext.SpanID()), flags),
+	)
+}
+
+// extractB3Context builds span context from B3 multi headers
+func extractB3Context(header nhttp.Header) (jaeger.SpanContext, error) {
+	traceID, err := jaeger.TraceIDFromString(header.Get(b3TraceIDHeaderName))
+	if err != nil || !traceID.IsValid() {
+		return jaeger.SpanContext{}, errMalformedB3
+	}
+	spanID, err := strconv.ParseUint(header.Get(b3SpanIDHeaderName), 16, 64)
+	if err != nil || spanID == 0 {
+		return jaeger.SpanContext{}, errMalformedB3
+	}
+	var parentID uint64
+	if v := header.Get(b3ParentSpanIDHeaderName); v != "" {
+		parentID, err = strconv.ParseUint(v, 16, 64)
+		if err != nil {
+			return jaeger.SpanContext{}, errMalformedB3
+		}
+	}
+	// absent sampling decision is deferred to receiver, such traces are sampled
+	sampled, ok := b3Sampled(header)
+	if !ok {
+		sampled = true
+	}
+	return jaeger.NewSpanContext(traceID, jaeger.SpanID(spanID), jaeger.SpanID(parentID), sampled, nil), nil
+}
+
+// b3Sampled returns B3 sampling decision if it's present, debug flag implies sampling
+func b3Sampled(header nhttp.Header) (sampled bool, ok bool) {
+	if header.Get(b3FlagsHeaderName) == "1" {
+		return true, true
+	}
+	switch strings.ToLower(header.Get(b3SampledHeaderName)) {
+	case "1", "true", "d":
+		return true, true
+	case "0", "false":
+		return false, true
+	}
+	return false, false
+}
+
+// injectB3Context sets B3 multi headers from span context
+func injectB3Context(spanContext jaeger.SpanContext, header nhttp.Header) {
+	traceID := spanContext.TraceID()
+	if traceID.High != 0 {
+		header.Set(b3TraceIDHeaderName, fmt.Sprintf("%016x%016x", traceID.High, traceID.Low))
+	} else {
+		header.Set(b3TraceIDHeaderName, fmt.Sprintf("%016x", traceID.Low))
+	}
+	header.Set(b3SpanIDHeaderName, fmt.Sprintf("%016x", uint64(spanContext.SpanID())))
+	if parentID := spanContext.ParentID(); parentID != 0 {
+		header.Set(b3ParentSpanIDHeaderName, fmt.Sprintf("%016x", uint64(parentID)))
+	} else {
+		header.Del(b3ParentSpanIDHeaderName)
+	}
+	if spanContext.IsSampled() {
+		header.Set(b3SampledHeaderName, "1")
+	} else {
+		header.Set(b3SampledHeaderName, "0")
+	}
+}
+
+// extractDatadogContext builds span context from datadog headers, ids are decimal and
+// upper bits of 128-bit trace id come in x-datadog-tags
+func extractDatadogContext(header nhttp.Header) (jaeger.SpanContext, error) {
+	low, err := strconv.ParseUint(header.Get(datadogTraceIDHeaderName), 10, 64)
+	if err != nil || low == 0 {
+		return jaeger.SpanContext{}, errMalformedDatadog
+	}
+	traceID := jaeger.TraceID{Low: low}
+	if v, ok := datadogTag(header, datadogTraceIDHighTag); ok {
+		if traceID.High, err = strconv.ParseUint(v, 16, 64); err != nil {
+			return jaeger.SpanContext{}, errMalformedDatadog
+		}
+	}
+	spanID, err := strconv.ParseUint(header.Get(datadogParentIDHeaderName), 10, 64)
+	if err != nil || spanID == 0 {
+		return jaeger.SpanContext{}, errMalformedDatadog
+	}
+	// absent sampling decision is deferred to receiver, such traces are sampled
+	sampled, ok := datadogSampled(header)
+	if !ok {
+		sampled = true
+	}
+	return jaeger.NewSpanContext(traceID, jaeger.SpanID(spanID), 0, sampled, nil), nil
+}
+
+// datadogSampled returns datadog sampling decision if it's present: user and auto keep priorities are positive,
+// reject ones are zero or negative
+func datadogSampled(header nhttp.Header) (sampled bool, ok bool) {
+	priority, err := strconv.Atoi(strings.TrimSpace(header.Get(datadogSamplingPriorityHeaderName)))
+	if err != nil {
+		return false, false
+	}
+	return priority > 0, true
+}
+
+// datadogTag returns value of x-datadog-tags header tag, tags are comma separated `key=value` pairs
+func datadogTag(header nhttp.Header, key string) (string, bool) {
+	for _, tag := range strings.Split(header.Get(datadogTagsHeaderName), ",") {
+		if i := strings.IndexByte(tag, '='); i >= 0 && strings.TrimSpace(tag[:i]) == key {
+			return strings.TrimSpace(tag[i+1:]), true
+		}
+	}
+	return "", false
+}
+
+// injectDatadogContext sets datadog headers from span context, the other propagated datadog tags are kept
+func injectDatadogContext(spanContext jaeger.SpanContext, header nhttp.Header) {
+	traceID := spanContext.TraceID()
+	header.Set(datadogTraceIDHeaderName, strconv.FormatUint(traceID.Low, 10))
+	header.Set(datadogParentIDHeaderName, strconv.FormatUint(uint64(spanContext.SpanID()), 10))
+	if spanContext.IsSampled() {
+		header.Set(datadogSamplingPriorityHeaderName, "1")
+	} else {
+		header.Set(datadogSamplingPriorityHeaderName, "0")
+	}
+	var tags []string
+	for _, tag := range strings.Split(header.Get(datadogTagsHeaderName), ",") {
+		if tag != "" && !strings.HasPrefix(strings.TrimSpace(tag), datadogTraceIDHighTag+"=") {
+			tags = append(tags, tag)
+		}
+	}
+	if traceID.High != 0 {
+		tags = append(tags, fmt.Sprintf("%s=%016x", datadogTraceIDHighTag, traceID.High))
+	}
+	if len(tags) == 0 {
+		header.Del(datadogTagsHeaderName)
+		return
+	}
+	header.Set(datadogTagsHeaderName, strings.Join(tags, ","))
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+func TestPreservesTraceContext(t *testing.T) {
+	jaegerHeader := nhttp.Header{}
+	jaegerHeader[jaeger.TraceContextHeaderName] = []string{"1:1:0:1"}
+	w3cHeader := nhttp.Header{}
+	w3cHeader.Set(w3cTraceParentHeaderName, "00-00000000000000000000000000000001-0000000000000001-01")
+	for _, c := range []struct {
+		name      string
+		injection string
+		w3c       bool
+		header    nhttp.Header
+		expected  bool
+	}{
+		{"override", config.TraceContextInjectionOverride, true, jaegerHeader, false},
+		{"preserve jaeger", config.TraceContextInjectionPreserve, false, jaegerHeader, true},
+		{"preserve w3c", config.TraceContextInjectionPreserve, true, w3cHeader, true},
+		{"w3c propagation disabled", config.TraceContextInjectionPreserve, false, w3cHeader, false},
+		{"no context", config.TraceContextInjectionPreserve, true, nhttp.Header{}, false},
+	} {
+		httpConfig := config.HTTPConfig{TraceContextInjection: c.injection, W3CPropagationEnabled: c.w3c}
+		if actual := preservesTraceContext(httpConfig, c.header); actual != c.expected {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestInjectContextPreservesApplicationHeaders(t *testing.T) {
+	tracer := newTestTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	preserveConfig := httpConfig
+	preserveConfig.TraceContextInjection = config.TraceContextInjectionPreserve
+	preserveConfig.W3CPropagationEnabled = true
+	preserveConfig.B3PropagationEnabled = true
+	config.SetHTTPConfig(preserveConfig)
+
+	const traceParent = "00-00000000000000000000000000000001-0000000000000001-01"
+	header := nhttp.Header{}
+	header.Set(w3cTraceParentHeaderName, traceParent)
+	injectContext(tracer.StartSpan("outbound").Context(), header)
+	if v := header.Get(w3cTraceParentHeaderName); v != traceParent {
+		t.Fatalf("expected traceparent to be kept, got %s", v)
+	}
+	// formats application hasn't set are still injected
+	if header.Get(jaeger.TraceContextHeaderName) == "" || header.Get(b3TraceIDHeaderName) == "" {
+		t.Fatalf("expected jaeger and B3 headers to be injected, got %v", header)
+	}
+}
+
+func TestDatadogContextRoundTrip(t *testing.T) {
+	header := nhttp.Header{}
+	header.Set(datadogTraceIDHeaderName, "1234567890123456789")
+	header.Set(datadogParentIDHeaderName, "987654321")
+	header.Set(datadogSamplingPriorityHeaderName, "-1")
+	header.Set(datadogTagsHeaderName, "_dd.p.dm=-4,_dd.p.tid=640cfd8d00000000")
+	spanContext, err := extractDatadogContext(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := jaeger.TraceID{High: 0x640cfd8d00000000, Low: 1234567890123456789}
+	if spanContext.TraceID() != expected || spanContext.SpanID() != 987654321 || spanContext.IsSampled() {
+		t.Fatalf("unexpected span context %v", spanContext)
+	}
+
+	injected := nhttp.Header{}
+	injected.Set(datadogTagsHeaderName, "_dd.p.dm=-4,_dd.p.tid=0000000000000001")
+	injectDatadogContext(spanContext, injected)
+	for name, value := range map[string]string{
+		datadogTraceIDHeaderName:          "1234567890123456789",
+		datadogParentIDHeaderName:         "987654321",
+		datadogSamplingPriorityHeaderName: "0",
+		datadogTagsHeaderName:             "_dd.p.dm=-4,_dd.p.tid=640cfd8d00000000",
+	} {
+		if v := injected.Get(name); v != value {
+			t.Fatalf("expected %s to be %s, got %s", name, value, v)
+		}
+	}
+}
+
+func TestDatadogSamplingPriority(t *testing.T) {
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	datadogConfig := httpConfig
+	datadogConfig.DatadogPropagationEnabled = true
+	config.SetHTTPConfig(datadogConfig)
+
+	for _, c := range []struct {
+		priority string
+		expected uint16
+		ok       bool
+	}{
+		{"2", 1, true},
+		{"1", 1, true},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"", 0, false},
+		{"keep", 0, false},
+	} {
+		header := nhttp.Header{}
+		if c.priority != "" {
+			header.Set(datadogSamplingPriorityHeaderName, c.priority)
+		}
+		if priority, ok := extractSamplingPriority(header); priority != c.expected || ok != c.ok {
+			t.Fatalf("%q: expected %d %v, got %d %v", c.priority, c.expected, c.ok, priority, ok)
+		}
+	}
+
+	// trace id without parent id is malformed, so no parent context is extracted
+	header := nhttp.Header{}
+	header.Set(datadogTraceIDHeaderName, "1")
+	if _, err := extractContext(header); err == nil {
+		t.Fatal("expected error for datadog headers without parent id")
+	}
+	header.Set(datadogParentIDHeaderName, "2")
+	if spanContext, err := extractContext(header); err != nil || !spanContext.(jaeger.SpanContext).IsSampled() {
+		t.Fatalf("expected sampled datadog context, got %v %v", spanContext, err)
+	}
+}
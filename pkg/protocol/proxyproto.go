@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// proxyV1Prefix starts human-readable PROXY protocol header
+	proxyV1Prefix = "PROXY "
+	// proxyV1MaxLength is max length of v1 header line including CRLF
+	proxyV1MaxLength = 107
+	// proxyV2HeaderLength is length of fixed part of binary header: signature, version and command,
+	// address family and protocol, length of addresses
+	proxyV2HeaderLength = 16
+)
+
+// proxyV2Signature starts binary PROXY protocol header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNoProxyHeader = errors.New("connection doesn't start with PROXY protocol header")
+
+// readProxyHeader reads PROXY protocol v1 or v2 header at the start of connection and returns source address of
+// proxied client. Nil address is returned for connection which isn't proxied (e.g. health check of load balancer)
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(signature, proxyV2Signature) {
+		return readProxyHeaderV2(reader)
+	}
+	prefix, err := reader.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) != proxyV1Prefix {
+		return nil, errNoProxyHeader
+	}
+	return readProxyHeaderV1(reader)
+}
+
+// readProxyHeaderV1 reads `PROXY TCP4|TCP6|UNKNOWN <src> <dst> <src port> <dst port>\r\n` line
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header is too long")
+		}
+		c, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header: '%s'", line[:len(line)-2])
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 source address: '%s'", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 source port: '%s'", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads binary header, TLVs following addresses are skipped
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	version, command := header[12]>>4, header[12]&0x0f
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	family, transport := header[13]>>4, header[13]&0x0f
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL command is sent by proxy itself, connection endpoints are the real ones
+	if command == 0x0 {
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", command)
+	}
+	// only TCP over IPv4 and IPv6 is proxied, addresses of other families are ignored
+	if transport != 0x1 {
+		return nil, nil
+	}
+	switch family {
+	case 0x1:
+		if len(payload) < 12 {
+			return nil, errors.New("PROXY protocol v2 IPv4 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2:
+		if len(payload) < 36 {
+			return nil, errors.New("PROXY protocol v2 IPv6 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
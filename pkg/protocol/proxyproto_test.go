@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command byte, family byte, addresses []byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family, 0, byte(len(addresses)))
+		return string(append(header, addresses...))
+	}
+	ipv4Addresses := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0x30, 0x39, 0, 80}
+	ipv6Addresses := append(append(make([]byte, 15), 1), make([]byte, 16)...)
+	ipv6Addresses = append(ipv6Addresses, 0x1f, 0x90, 0, 80)
+	cases := []struct {
+		header   string
+		expected string
+	}{
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 56324 80\r\n", "192.168.0.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 80\r\n", "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", ""},
+		{v2(0x1, 0x11, ipv4Addresses), "192.168.0.1:12345"},
+		{v2(0x1, 0x21, ipv6Addresses), "[::1]:8080"},
+		// TLVs after addresses are skipped
+		{v2(0x1, 0x11, append(ipv4Addresses, 0x04, 0, 1, 0)), "192.168.0.1:12345"},
+		{v2(0x0, 0x00, nil), ""},
+	}
+	for _, c := range cases {
+		reader := bufio.NewReader(strings.NewReader(c.header + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyHeader(reader)
+		if err != nil {
+			t.Fatalf("header %q: unexpected error %s", c.header, err.Error())
+		}
+		actual := ""
+		if addr != nil {
+			actual = addr.String()
+		}
+		if actual != c.expected {
+			t.Fatalf("header %q: expected address %q, got %q", c.header, c.expected, actual)
+		}
+		// request following header is left to be read
+		rest, _ := ioutil.ReadAll(reader)
+		if !bytes.Equal(rest, []byte("GET / HTTP/1.1\r\n")) {
+			t.Fatalf("header %q: unexpected rest %q", c.header, rest)
+		}
+	}
+}
+
+func TestReadProxyHeaderMalformed(t *testing.T) {
+	cases := []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 56324 80\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 65536 80\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324 80\n",
+		"PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n",
+		string(proxyV2Signature) + "\x31\x11\x00\x0c",
+		string(proxyV2Signature) + "\x21\x11\x00\x04\xc0\xa8\x00\x01",
+	}
+	for _, header := range cases {
+		if _, err := readProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Fatalf("header %q: expected error", header)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package protocol
+
+import (
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// tagQueryParams sets tags from configured request query params, values of repeated param are joined
+func tagQueryParams(httpConfig config.HTTPConfig, span opentracing.Span, req *nhttp.Request) {
+	if len(httpConfig.QueryParamsMap) == 0 || req.URL == nil || req.URL.RawQuery == "" {
+		return
+	}
+	query := req.URL.Query()
+	for name, tagName := range httpConfig.QueryParamsMap {
+		if values, ok := query[name]; ok {
+			setStringTag(span, tagName, maskSensitive(httpConfig, name, strings.Join(values, ",")))
+		}
+	}
+}
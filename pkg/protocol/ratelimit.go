@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// routeRateLimit returns rate limit of the longest configured path prefix matching path
+func routeRateLimit(httpConfig config.HTTPConfig, path string) (string, config.RateLimit, bool) {
+	var limit config.RateLimit
+	matched := ""
+	ok := false
+	for prefix, prefixLimit := range httpConfig.RateLimits {
+		if (!ok || len(prefix) > len(matched)) && strings.HasPrefix(path, prefix) {
+			matched, limit, ok = prefix, prefixLimit, true
+		}
+	}
+	return matched, limit, ok
+}
+
+// limitRequest checks inbound request against rate limit of its route, limited request isn't forwarded:
+// it's answered with 429. It returns true if request is limited
+func (h *HTTPHandler) limitRequest(w io.Writer, req *nhttp.Request, netHTTPRequest *NetHTTPRequest) bool {
+	startTime := time.Now()
+	prefix, limit, ok := routeRateLimit(config.GetHTTPConfig(), req.URL.Path)
+	if !ok {
+		return false
+	}
+	allowed, retryAfter := h.rateLimiter.Allow(prefix, limit.Rate, limit.Burst)
+	if allowed {
+		return false
+	}
+
+	h.respondLocally(w, req, netHTTPRequest, nhttp.StatusTooManyRequests, nhttp.Header{
+		"Retry-After": {strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))},
+	}, opentracing.Tag{Key: "ratelimited", Value: true}, startTime)
+	return true
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/uber/jaeger-client-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestRouteRateLimit(t *testing.T) {
+	httpConfig := config.HTTPConfig{RateLimits: map[string]config.RateLimit{
+		"/":           {Rate: 100, Burst: 100},
+		"/api":        {Rate: 10, Burst: 20},
+		"/api/orders": {Rate: 1, Burst: 2},
+	}}
+	for _, c := range []struct {
+		path   string
+		prefix string
+		ok     bool
+	}{
+		{"/api/orders/1", "/api/orders", true},
+		{"/api/users", "/api", true},
+		{"/index.html", "/", true},
+	} {
+		prefix, limit, ok := routeRateLimit(httpConfig, c.path)
+		if ok != c.ok || prefix != c.prefix || limit != httpConfig.RateLimits[c.prefix] {
+			t.Fatalf("%s: unexpected limit %s %v", c.path, prefix, limit)
+		}
+	}
+	if _, _, ok := routeRateLimit(config.HTTPConfig{}, "/api"); ok {
+		t.Fatal("expected no limit without configured routes")
+	}
+}
+
+func TestLimitRequest(t *testing.T) {
+	reporter := jaeger.NewInMemoryReporter()
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), reporter)
+	defer closer.Close()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	limitConfig := httpConfig
+	limitConfig.RateLimits = map[string]config.RateLimit{"/api": {Rate: 0.5, Burst: 1}}
+	config.SetHTTPConfig(limitConfig)
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	netRequest := NewNetHTTPRequest(logger, true, cache.New(time.Minute, time.Minute))
+	newRequest := func(path string) *nhttp.Request {
+		req, err := nhttp.ReadRequest(bufio.NewReader(strings.NewReader(
+			"POST " + path + " HTTP/1.1\r\nHost: service\r\nContent-Length: 4\r\n\r\nbody")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	var out bytes.Buffer
+	if h.limitRequest(&out, newRequest("/api/orders"), netRequest) {
+		t.Fatal("expected request within burst to be forwarded")
+	}
+	if h.limitRequest(&out, newRequest("/health"), netRequest) {
+		t.Fatal("expected request without limit to be forwarded")
+	}
+	if !h.limitRequest(&out, newRequest("/api/users"), netRequest) {
+		t.Fatal("expected request over burst to be limited")
+	}
+	resp, err := nhttp.ReadResponse(bufio.NewReader(&out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != nhttp.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+		t.Fatalf("expected 429 with Retry-After 2, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if spans := reporter.GetSpans(); len(spans) != 1 {
+		t.Fatalf("expected limited request to be traced, got %d spans", len(spans))
+	}
+}
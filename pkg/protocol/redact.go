@@ -0,0 +1,18 @@
+package protocol
+
+import (
+	"strings"
+
+	"github.com/Lookyan/netramesh/internal/config"
+)
+
+// sensitiveValueMask replaces sensitive values, tag is kept to show value presence
+const sensitiveValueMask = "***"
+
+// maskSensitive returns value to be set as tag, values of sensitive headers, cookies and query params are masked
+func maskSensitive(httpConfig config.HTTPConfig, name string, value string) string {
+	if _, ok := httpConfig.SensitiveHeaders[strings.ToLower(name)]; ok {
+		return sensitiveValueMask
+	}
+	return value
+}
@@ -0,0 +1,405 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// redisInspectLen limits bytes of command name, key and error reply kept for span
+const redisInspectLen = 256
+
+// RedisHandler copies Redis connection as is and reports span for every command,
+// replies are matched to pipelined commands in order, MULTI ... EXEC is reported as single span
+type RedisHandler struct {
+	logger *log.Logger
+}
+
+// NewRedisHandler returns Redis handler
+func NewRedisHandler(logger *log.Logger) *RedisHandler {
+	return &RedisHandler{
+		logger: logger,
+	}
+}
+
+// HandleRequest copies client commands to upstream
+func (h *RedisHandler) HandleRequest(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) *net.TCPConn {
+
+	netRedisRequest := netRequest.(*NetRedisRequest)
+	if w == nil {
+		defer close(addrCh)
+		addrCh <- originalDst
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+	}
+	if isInboundConn {
+		netRedisRequest.setRemoteAddr(r.RemoteAddr().String())
+	} else {
+		netRedisRequest.setRemoteAddr(w.RemoteAddr().String())
+	}
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(bufioReader)
+
+	err := h.copyCommands(bufioReader, bufioWriter, netRedisRequest)
+	if err == nil || err == io.EOF {
+		err = bufioWriter.Flush()
+	}
+	if err != nil && err != io.EOF {
+		h.logger.Debugf("Err copying Redis commands: %s", err.Error())
+	}
+	return w
+}
+
+// HandleResponse copies server replies to client
+func (h *RedisHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	netRedisRequest := netRequest.(*NetRedisRequest)
+	// commands without reply are finished when connection is closed
+	defer netRedisRequest.StopRequest()
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(bufioReader)
+
+	err := h.copyReplies(bufioReader, bufioWriter, netRedisRequest)
+	if err == nil || err == io.EOF {
+		err = bufioWriter.Flush()
+	}
+	if err != nil && err != io.EOF {
+		h.logger.Debugf("Err copying Redis replies: %s", err.Error())
+	}
+}
+
+// copyCommands forwards commands from r to w, every command is queued before
+// its last inspected part is written, so reply can't outrun the command
+func (h *RedisHandler) copyCommands(r *bufio.Reader, w *bufio.Writer, nr *NetRedisRequest) error {
+	keysEnabled := config.GetNetraConfig().RedisKeysEnabled
+	content := make([]byte, redisInspectLen)
+	for !nr.isRaw() {
+		line, err := r.ReadSlice('\n')
+		if len(line) == 0 {
+			return err
+		}
+		if line[0] != '*' {
+			// inline command, e.g. telnet session
+			fields := strings.Fields(string(inspectedPrefix(line)))
+			if len(fields) > 0 {
+				key := ""
+				if keysEnabled && len(fields) > 1 {
+					key = fields[1]
+				}
+				nr.pushCommand(fields[0], key)
+			}
+			if err = copyRESPLine(r, w, line, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		args, _ := parseRESPLength(line)
+		if err = copyRESPLine(r, w, line, err); err != nil {
+			return err
+		}
+		var name string
+		pushed := false
+		for i := 0; i < args; i++ {
+			line, err = r.ReadSlice('\n')
+			if len(line) == 0 {
+				return err
+			}
+			size, ok := parseRESPLength(line)
+			if line[0] != '$' || !ok || size < 0 || i > 1 {
+				if i > 0 && !pushed {
+					// key isn't bulk string, command is queued without it
+					nr.pushCommand(name, "")
+					pushed = true
+				}
+				if err = copyRESPValue(r, w, line, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = copyRESPLine(r, w, line, err); err != nil {
+				return err
+			}
+			n := size
+			if n > redisInspectLen {
+				n = redisInspectLen
+			}
+			if _, err = io.ReadFull(r, content[:n]); err != nil {
+				return err
+			}
+			switch {
+			case i == 0:
+				name = string(content[:n])
+				if args == 1 || !keysEnabled {
+					nr.pushCommand(name, "")
+					pushed = true
+				}
+			case i == 1 && !pushed:
+				nr.pushCommand(name, string(content[:n]))
+				pushed = true
+			}
+			if _, err = w.Write(content[:n]); err != nil {
+				return err
+			}
+			// rest of argument and trailing CRLF
+			if _, err = io.CopyN(w, r, int64(size-n+2)); err != nil {
+				return err
+			}
+		}
+	}
+	return h.passThrough(r, w)
+}
+
+// copyReplies forwards replies from r to w and finishes command of every reply
+func (h *RedisHandler) copyReplies(r *bufio.Reader, w *bufio.Writer, nr *NetRedisRequest) error {
+	for !nr.isRaw() {
+		line, err := r.ReadSlice('\n')
+		if len(line) == 0 {
+			return err
+		}
+		kind := line[0]
+		var message string
+		if kind == '-' {
+			message = strings.TrimRight(string(inspectedPrefix(line[1:])), "\r\n")
+		}
+		size, _ := parseRESPLength(line)
+		if err = copyRESPValue(r, w, line, err); err != nil {
+			return err
+		}
+		// RESP3 push isn't reply to any command
+		if kind != '>' {
+			nr.reply(kind == '-' || kind == '!', message, kind == '*' && size < 0 || kind == '_')
+		}
+	}
+	return h.passThrough(r, w)
+}
+
+func (h *RedisHandler) passThrough(r *bufio.Reader, w *bufio.Writer) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	buf := bufferPool.Get().([]byte)
+	_, err := io.CopyBuffer(w, r, buf)
+	bufferPool.Put(buf)
+	return err
+}
+
+func inspectedPrefix(b []byte) []byte {
+	if len(b) > redisInspectLen {
+		return b[:redisInspectLen]
+	}
+	return b
+}
+
+// parseRESPLength parses length of bulk string or number of aggregate elements, e.g. "$5\r\n"
+func parseRESPLength(line []byte) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimRight(string(line[1:]), "\r\n"))
+	return n, err == nil
+}
+
+// copyRESPLine writes line read by ReadSlice and the rest of it if it didn't fit into the buffer
+func copyRESPLine(r *bufio.Reader, w *bufio.Writer, line []byte, err error) error {
+	for {
+		if _, werr := w.Write(line); werr != nil {
+			return werr
+		}
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+		line, err = r.ReadSlice('\n')
+	}
+}
+
+// copyRESPValue writes value started with line including all nested elements
+func copyRESPValue(r *bufio.Reader, w *bufio.Writer, line []byte, err error) error {
+	for pending := 1; ; {
+		kind := line[0]
+		size, ok := parseRESPLength(line)
+		if err = copyRESPLine(r, w, line, err); err != nil {
+			return err
+		}
+		pending--
+		if ok && size >= 0 {
+			switch kind {
+			case '$', '!', '=':
+				if _, err = io.CopyN(w, r, int64(size+2)); err != nil {
+					return err
+				}
+			case '*', '~', '>':
+				pending += size
+			case '%':
+				pending += 2 * size
+			case '|':
+				// attributes are followed by the value itself
+				pending += 2*size + 1
+			}
+		}
+		if pending <= 0 {
+			return nil
+		}
+		line, err = r.ReadSlice('\n')
+		if len(line) == 0 {
+			return err
+		}
+	}
+}
+
+// redisCommand is a command sent by client, commands inside transaction are reported by transaction
+type redisCommand struct {
+	name      string
+	key       string
+	startTime time.Time
+	traced    bool
+	commands  []string
+}
+
+// NetRedisRequest keeps state of single Redis connection, commands are queued by client side
+// and replies come in the same order
+type NetRedisRequest struct {
+	isInbound bool
+	logger    *log.Logger
+	commands  *Queue
+
+	raw int32
+
+	mu         sync.Mutex
+	remoteAddr string
+
+	// client side state
+	transaction *redisCommand
+}
+
+// NewNetRedisRequest returns state of Redis connection accepted now
+func NewNetRedisRequest(logger *log.Logger, isInbound bool) *NetRedisRequest {
+	return &NetRedisRequest{
+		isInbound: isInbound,
+		logger:    logger,
+		commands:  NewQueue(),
+	}
+}
+
+// StartRequest does nothing, commands are started when they are sent
+func (nr *NetRedisRequest) StartRequest() {}
+
+// StopRequest finishes commands which didn't get reply
+func (nr *NetRedisRequest) StopRequest() {
+	for el := nr.commands.Pop(); el != nil; el = nr.commands.Pop() {
+		if command := el.(*redisCommand); command.traced {
+			nr.finish(command, true, "", false)
+		}
+	}
+}
+
+// CleanUp does nothing, commands are finished when connection is closed
+func (nr *NetRedisRequest) CleanUp() {}
+
+func (nr *NetRedisRequest) setRemoteAddr(remoteAddr string) {
+	nr.mu.Lock()
+	nr.remoteAddr = remoteAddr
+	nr.mu.Unlock()
+}
+
+func (nr *NetRedisRequest) getRemoteAddr() string {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	return nr.remoteAddr
+}
+
+// isRaw reports whether connection is switched to pub/sub or monitor mode,
+// messages aren't replies to commands there, so connection isn't parsed anymore
+func (nr *NetRedisRequest) isRaw() bool {
+	return atomic.LoadInt32(&nr.raw) == 1
+}
+
+// pushCommand queues command sent by client, commands between MULTI and EXEC or DISCARD
+// are collected by transaction which is queued in place of EXEC
+func (nr *NetRedisRequest) pushCommand(name string, key string) {
+	name = strings.ToUpper(name)
+	command := &redisCommand{name: name, key: key, startTime: time.Now(), traced: true}
+	switch {
+	case name == "MULTI" && nr.transaction == nil:
+		nr.transaction = &redisCommand{name: name, startTime: command.startTime, traced: true, commands: []string{name}}
+		command.traced = false
+	case nr.transaction != nil && (name == "EXEC" || name == "DISCARD"):
+		nr.transaction.commands = append(nr.transaction.commands, name)
+		command = nr.transaction
+		nr.transaction = nil
+	case nr.transaction != nil:
+		nr.transaction.commands = append(nr.transaction.commands, name)
+		command.traced = false
+	case name == "SUBSCRIBE" || name == "PSUBSCRIBE" || name == "SSUBSCRIBE" || name == "MONITOR":
+		command.traced = false
+		atomic.StoreInt32(&nr.raw, 1)
+	}
+	nr.commands.Push(command)
+}
+
+// reply finishes the oldest command, replies without commands are ignored
+func (nr *NetRedisRequest) reply(failed bool, message string, null bool) {
+	el := nr.commands.Pop()
+	if el == nil {
+		return
+	}
+	if command := el.(*redisCommand); command.traced {
+		nr.finish(command, failed, message, null)
+	}
+}
+
+// finish reports command span
+func (nr *NetRedisRequest) finish(command *redisCommand, failed bool, message string, null bool) {
+	span := opentracing.StartSpan(command.name, opentracing.StartTime(command.startTime))
+	if nr.isInbound {
+		span.SetTag("span.kind", "server")
+	} else {
+		span.SetTag("span.kind", "client")
+	}
+	span.SetTag("remote_addr", nr.getRemoteAddr())
+	span.SetTag("db.type", "redis")
+	if command.commands != nil {
+		setStringTag(span, "db.statement", strings.Join(command.commands, " "))
+		// EXEC replies with null when watched key is changed
+		if null {
+			span.SetTag("db.redis.aborted", true)
+		}
+	} else {
+		setStringTag(span, "db.statement", command.name)
+	}
+	if command.key != "" {
+		setStringTag(span, "db.redis.key", command.key)
+	}
+	if failed {
+		span.SetTag("error", true)
+	}
+	if message != "" {
+		span.SetTag("db.error_message", message)
+	}
+	span.Finish()
+}
@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// copyRedis copies data with copy function and checks it's forwarded as is
+func copyRedis(t *testing.T, data string, copy func(r *bufio.Reader, w *bufio.Writer) error) {
+	var forwarded bytes.Buffer
+	w := bufio.NewWriter(&forwarded)
+	if err := copy(bufio.NewReader(bytes.NewReader([]byte(data))), w); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if forwarded.String() != data {
+		t.Fatalf("expected %q to be copied as is, got %q", data, forwarded.String())
+	}
+}
+
+func TestRedisSpans(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewRedisHandler(logger)
+	nr := NewNetRedisRequest(logger, false)
+
+	// inline command, pipelined commands, transaction and unknown command
+	commands := "PING\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n" +
+		"*2\r\n$3\r\nget\r\n$7\r\nmissing\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n" +
+		"*2\r\n$5\r\nLPUSH\r\n$4\r\nlist\r\n" +
+		"*1\r\n$4\r\nEXEC\r\n" +
+		"*1\r\n$3\r\nBAD\r\n" +
+		"*1\r\n$4\r\nEXEC\r\n"
+	copyRedis(t, commands, func(r *bufio.Reader, w *bufio.Writer) error {
+		return h.copyCommands(r, w, nr)
+	})
+	// EXEC replies with nested array, transaction aborted by watched key is replied with null array
+	replies := "+PONG\r\n" +
+		"+OK\r\n" +
+		"$-1\r\n" +
+		"+OK\r\n" +
+		"+QUEUED\r\n" +
+		"+QUEUED\r\n" +
+		"*2\r\n:1\r\n*2\r\n$1\r\na\r\n$1\r\nb\r\n" +
+		"-ERR unknown command 'BAD'\r\n" +
+		"*-1\r\n"
+	copyRedis(t, replies, func(r *bufio.Reader, w *bufio.Writer) error {
+		return h.copyReplies(r, w, nr)
+	})
+	nr.StopRequest()
+
+	spans := tracer.FinishedSpans()
+	expected := []struct {
+		operation string
+		statement string
+		failed    bool
+	}{
+		{"PING", "PING", false},
+		{"SET", "SET", false},
+		{"GET", "GET", false},
+		{"MULTI", "MULTI INCR LPUSH EXEC", false},
+		{"BAD", "BAD", true},
+		// EXEC without MULTI isn't transaction
+		{"EXEC", "EXEC", false},
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %d", len(expected), len(spans))
+	}
+	for i, e := range expected {
+		span := spans[i]
+		if span.OperationName != e.operation || span.Tag("db.type") != "redis" || span.Tag("db.statement") != e.statement ||
+			(span.Tag("error") == true) != e.failed {
+			t.Fatalf("span %d: unexpected span %s %v", i, span.OperationName, span.Tags())
+		}
+	}
+	if message := spans[4].Tag("db.error_message"); message != "ERR unknown command 'BAD'" {
+		t.Fatalf("unexpected error message %v", message)
+	}
+	if spans[3].Tag("db.redis.aborted") != nil {
+		t.Fatalf("expected transaction not to be aborted, got %v", spans[3].Tags())
+	}
+}
+
+func TestRedisTransactionAborted(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewRedisHandler(logger)
+	nr := NewNetRedisRequest(logger, true)
+	copyRedis(t, "*1\r\n$5\r\nMULTI\r\n*2\r\n$4\r\nINCR\r\n$1\r\nk\r\n*1\r\n$4\r\nEXEC\r\n", func(r *bufio.Reader, w *bufio.Writer) error {
+		return h.copyCommands(r, w, nr)
+	})
+	copyRedis(t, "+OK\r\n+QUEUED\r\n*-1\r\n", func(r *bufio.Reader, w *bufio.Writer) error {
+		return h.copyReplies(r, w, nr)
+	})
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 || spans[0].Tag("db.redis.aborted") != true || spans[0].Tag("span.kind") != "server" {
+		t.Fatalf("expected single aborted transaction span, got %v", spans)
+	}
+}
+
+func TestRedisPubSubPassedThrough(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewRedisHandler(logger)
+	nr := NewNetRedisRequest(logger, false)
+
+	// commands after SUBSCRIBE aren't parsed, even malformed ones
+	copyRedis(t, "*1\r\n$4\r\nPING\r\n*2\r\n$9\r\nSUBSCRIBE\r\n$2\r\nch\r\n*9\r\n\x00\xff", func(r *bufio.Reader, w *bufio.Writer) error {
+		return h.copyCommands(r, w, nr)
+	})
+	if !nr.isRaw() {
+		t.Fatal("expected connection to be switched to raw mode")
+	}
+	copyRedis(t, "+PONG\r\n*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n",
+		func(r *bufio.Reader, w *bufio.Writer) error {
+			return h.copyReplies(r, w, nr)
+		})
+	nr.StopRequest()
+	// PING reply comes after switch, so it's finished as unreplied on close
+	if spans := tracer.FinishedSpans(); len(spans) != 1 || spans[0].OperationName != "PING" {
+		t.Fatalf("expected only PING span, got %v", spans)
+	}
+}
+
+func TestCopyRESPValue(t *testing.T) {
+	for _, value := range []string{
+		"+OK\r\n",
+		":42\r\n",
+		"$-1\r\n",
+		"$0\r\n\r\n",
+		"$12\r\nhello\r\nworld\r\n",
+		"*-1\r\n",
+		"*0\r\n",
+		"*2\r\n*2\r\n:1\r\n:2\r\n*1\r\n$3\r\nabc\r\n",
+		// RESP3 map, set, verbatim string, attribute and push
+		"%2\r\n+a\r\n:1\r\n+b\r\n*1\r\n_\r\n",
+		"~2\r\n:1\r\n:2\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"|1\r\n+ttl\r\n:3600\r\n$2\r\nok\r\n",
+		">2\r\n+message\r\n+hi\r\n",
+	} {
+		data := value + "+NEXT\r\n"
+		r := bufio.NewReader(bytes.NewReader([]byte(data)))
+		var forwarded bytes.Buffer
+		w := bufio.NewWriter(&forwarded)
+		line, err := r.ReadSlice('\n')
+		if err = copyRESPValue(r, w, line, err); err != nil {
+			t.Fatalf("%q: %v", value, err)
+		}
+		w.Flush()
+		if forwarded.String() != value {
+			t.Fatalf("expected %q to be copied, got %q", value, forwarded.String())
+		}
+	}
+}
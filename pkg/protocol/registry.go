@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"github.com/patrickmn/go-cache"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// Factory builds handler of protocol and state of its connections
+type Factory struct {
+	// NewHandler builds handler shared by all connections of protocol, it's called once on init
+	NewHandler func(logger *log.Logger, tracingContextMapping *cache.Cache, routingInfoContextMapping *cache.Cache) NetHandler
+	// NewRequest builds state of connection
+	NewRequest func(logger *log.Logger, isInbound bool, tracingContextMapping *cache.Cache) NetRequest
+	// Ports returns configured ports of protocol, it may be nil for protocol recognized by first bytes only
+	Ports func(netraConfig config.NetraConfig) map[string]struct{}
+	// Sniff reports whether connection starting with prefix is of protocol, it may be nil.
+	// Prefix is first bytes client has sent, it may be shorter than sniffPrefixLength
+	Sniff func(prefix []byte) bool
+}
+
+type registeredProtocol struct {
+	proto   Proto
+	factory Factory
+}
+
+// registry keeps protocols in order of registration, the first matching protocol is chosen.
+// TCP handler is used for connections no protocol matches
+var registry = struct {
+	protocols []registeredProtocol
+	handlers  map[Proto]NetHandler
+}{
+	handlers: make(map[Proto]NetHandler),
+}
+
+// Register adds protocol or replaces factory of registered one, it should be called before InitHandlerRequest
+func Register(proto Proto, factory Factory) {
+	for i, p := range registry.protocols {
+		if p.proto == proto {
+			registry.protocols[i].factory = factory
+			return
+		}
+	}
+	registry.protocols = append(registry.protocols, registeredProtocol{proto: proto, factory: factory})
+}
+
+func lookupProtocol(proto Proto) (registeredProtocol, bool) {
+	for _, p := range registry.protocols {
+		if p.proto == proto {
+			return p, true
+		}
+	}
+	return registeredProtocol{}, false
+}
+
+// initHandlers builds handlers of registered protocols
+func initHandlers(logger *log.Logger, tracingContextMapping *cache.Cache, routingInfoContextMapping *cache.Cache) {
+	for _, p := range registry.protocols {
+		registry.handlers[p.proto] = p.factory.NewHandler(logger, tracingContextMapping, routingInfoContextMapping)
+	}
+}
+
+// built-in protocols, HTTP is checked first
+func init() {
+	Register(HTTPProto, Factory{
+		NewHandler: func(logger *log.Logger, tracingContextMapping *cache.Cache, routingInfoContextMapping *cache.Cache) NetHandler {
+			return NewHTTPHandler(logger, tracingContextMapping, routingInfoContextMapping)
+		},
+		NewRequest: func(logger *log.Logger, isInbound bool, tracingContextMapping *cache.Cache) NetRequest {
+			return NewNetHTTPRequest(logger, isInbound, tracingContextMapping)
+		},
+		Ports: func(netraConfig config.NetraConfig) map[string]struct{} { return netraConfig.HTTPProtoPorts },
+		Sniff: isHTTPPrefix,
+	})
+	Register(GRPCProto, Factory{
+		NewHandler: func(logger *log.Logger, tracingContextMapping *cache.Cache, _ *cache.Cache) NetHandler {
+			return NewGRPCHandler(logger, tracingContextMapping)
+		},
+		NewRequest: func(logger *log.Logger, isInbound bool, tracingContextMapping *cache.Cache) NetRequest {
+			return NewNetGRPCRequest(logger, isInbound, tracingContextMapping)
+		},
+		Ports: func(netraConfig config.NetraConfig) map[string]struct{} { return netraConfig.GRPCProtoPorts },
+		Sniff: isHTTP2Prefix,
+	})
+	Register(PassthroughProto, Factory{
+		NewHandler: func(logger *log.Logger, _ *cache.Cache, _ *cache.Cache) NetHandler {
+			return NewPassthroughHandler(logger)
+		},
+		NewRequest: func(logger *log.Logger, isInbound bool, _ *cache.Cache) NetRequest {
+			return NewNetPassthroughRequest(logger, isInbound)
+		},
+		Ports: func(netraConfig config.NetraConfig) map[string]struct{} { return netraConfig.PassthroughProtoPorts },
+	})
+	// server speaks first in MySQL protocol, so it can't be recognized by client bytes
+	Register(MySQLProto, Factory{
+		NewHandler: func(logger *log.Logger, _ *cache.Cache, _ *cache.Cache) NetHandler {
+			return NewMySQLHandler(logger)
+		},
+		NewRequest: func(logger *log.Logger, isInbound bool, _ *cache.Cache) NetRequest {
+			return NewNetMySQLRequest(logger, isInbound)
+		},
+		Ports: func(netraConfig config.NetraConfig) map[string]struct{} { return netraConfig.MySQLProtoPorts },
+	})
+	Register(RedisProto, Factory{
+		NewHandler: func(logger *log.Logger, _ *cache.Cache, _ *cache.Cache) NetHandler {
+			return NewRedisHandler(logger)
+		},
+		NewRequest: func(logger *log.Logger, isInbound bool, _ *cache.Cache) NetRequest {
+			return NewNetRedisRequest(logger, isInbound)
+		},
+		Ports: func(netraConfig config.NetraConfig) map[string]struct{} { return netraConfig.RedisProtoPorts },
+	})
+	Register(KafkaProto, Factory{
+		NewHandler: func(logger *log.Logger, _ *cache.Cache, _ *cache.Cache) NetHandler {
+			return NewKafkaHandler(logger)
+		},
+		NewRequest: func(logger *log.Logger, isInbound bool, _ *cache.Cache) NetRequest {
+			return NewNetKafkaRequest(logger, isInbound)
+		},
+		Ports: func(netraConfig config.NetraConfig) map[string]struct{} { return netraConfig.KafkaProtoPorts },
+	})
+	Register(AMQPProto, Factory{
+		NewHandler: func(logger *log.Logger, _ *cache.Cache, _ *cache.Cache) NetHandler {
+			return NewAMQPHandler(logger)
+		},
+		NewRequest: func(logger *log.Logger, isInbound bool, _ *cache.Cache) NetRequest {
+			return NewNetAMQPRequest(logger, isInbound)
+		},
+		Ports: func(netraConfig config.NetraConfig) map[string]struct{} { return netraConfig.AMQPProtoPorts },
+		Sniff: isAMQPPrefix,
+	})
+	Register(MongoDBProto, Factory{
+		NewHandler: func(logger *log.Logger, _ *cache.Cache, _ *cache.Cache) NetHandler {
+			return NewMongoDBHandler(logger)
+		},
+		NewRequest: func(logger *log.Logger, isInbound bool, _ *cache.Cache) NetRequest {
+			return NewNetMongoDBRequest(logger, isInbound)
+		},
+		Ports: func(netraConfig config.NetraConfig) map[string]struct{} { return netraConfig.MongoDBProtoPorts },
+		Sniff: isMongoDBPrefix,
+	})
+	Register(ThriftProto, Factory{
+		NewHandler: func(logger *log.Logger, _ *cache.Cache, _ *cache.Cache) NetHandler {
+			return NewThriftHandler(logger)
+		},
+		NewRequest: func(logger *log.Logger, isInbound bool, _ *cache.Cache) NetRequest {
+			return NewNetThriftRequest(logger, isInbound)
+		},
+		Ports: func(netraConfig config.NetraConfig) map[string]struct{} { return netraConfig.ThriftProtoPorts },
+		Sniff: isThriftPrefix,
+	})
+	Register(TLSProto, Factory{
+		NewHandler: func(logger *log.Logger, _ *cache.Cache, _ *cache.Cache) NetHandler {
+			return NewTLSHandler(logger)
+		},
+		NewRequest: func(logger *log.Logger, isInbound bool, _ *cache.Cache) NetRequest {
+			return NewNetPassthroughRequest(logger, isInbound)
+		},
+		Ports: func(netraConfig config.NetraConfig) map[string]struct{} { return netraConfig.TLSProtoPorts },
+		Sniff: isTLSPrefix,
+	})
+	Register(TCPProto, Factory{
+		NewHandler: func(logger *log.Logger, _ *cache.Cache, _ *cache.Cache) NetHandler {
+			return NewTCPHandler(logger)
+		},
+		NewRequest: func(logger *log.Logger, _ bool, _ *cache.Cache) NetRequest {
+			return netTCPRequest
+		},
+	})
+}
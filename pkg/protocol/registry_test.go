@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	cases := []struct {
+		prefix   string
+		expected Proto
+	}{
+		{"GET / HTTP/1.1\r\n", HTTPProto},
+		{"OPTIONS * HTTP/1", HTTPProto},
+		{"PRI * HTTP/2.0\r\n", GRPCProto},
+		{"PRI * HTTP/2.0", GRPCProto},
+		// partial request line isn't recognized
+		{"GE", TCPProto},
+		{"PRI * HTTP", TCPProto},
+		{"*1\r\n$4\r\nPING\r\n", TCPProto},
+		{"\x16\x03\x01\x02\x00\x01\x00\x01", TLSProto},
+		// TLS alert isn't ClientHello
+		{"\x15\x03\x01\x00\x02\x02\x28", TCPProto},
+	}
+	for _, c := range cases {
+		actual := TCPProto
+		for _, p := range registry.protocols {
+			if p.factory.Sniff != nil && p.factory.Sniff([]byte(c.prefix)) {
+				actual = p.proto
+				break
+			}
+		}
+		if actual != c.expected {
+			t.Fatalf("prefix %q: expected %s, got %s", c.prefix, c.expected, actual)
+		}
+	}
+}
+
+func TestPeekConn(t *testing.T) {
+	client, server := tcpConnPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// nothing is sent within timeout
+	start := time.Now()
+	if _, err := peekConn(server, sniffPrefixLength, 50*time.Millisecond, sniffIncomplete); !isTimeout(err) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected peek to be limited with timeout, it took %s", elapsed)
+	}
+
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\nHost: upstream\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	prefix, err := peekConn(server, sniffPrefixLength, time.Second, sniffIncomplete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(prefix) != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("unexpected prefix %q", prefix)
+	}
+	// peeked bytes are left in connection
+	buf := make([]byte, 3)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := server.Read(buf); err != nil || string(buf) != "GET" {
+		t.Fatalf("expected peeked bytes to be read, got %q (%v)", buf, err)
+	}
+}
+
+func TestPeekConnWaitsForAmbiguousPrefix(t *testing.T) {
+	client, server := tcpConnPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// request line split between segments is waited for
+	if _, err := client.Write([]byte("GE")); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Write([]byte("T / HTTP/1.1\r\nHost: upstream\r\n\r\n"))
+	}()
+	prefix, err := peekConn(server, sniffPrefixLength, time.Second, sniffIncomplete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(prefix) != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("unexpected prefix %q", prefix)
+	}
+
+	// prefix still ambiguous by timeout is returned as is
+	client2, server2 := tcpConnPair(t)
+	defer client2.Close()
+	defer server2.Close()
+	if _, err := client2.Write([]byte("PRI * HT")); err != nil {
+		t.Fatal(err)
+	}
+	prefix, err = peekConn(server2, sniffPrefixLength, 50*time.Millisecond, sniffIncomplete)
+	if err != nil || string(prefix) != "PRI * HT" {
+		t.Fatalf("expected ambiguous prefix, got %q (%v)", prefix, err)
+	}
+
+	// unknown prefix isn't waited for
+	client3, server3 := tcpConnPair(t)
+	defer client3.Close()
+	defer server3.Close()
+	if _, err := client3.Write([]byte("*1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	prefix, err = peekConn(server3, sniffPrefixLength, time.Second, sniffIncomplete)
+	if err != nil || string(prefix) != "*1\r\n" {
+		t.Fatalf("unexpected prefix %q (%v)", prefix, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected unknown prefix to be returned at once, it took %s", elapsed)
+	}
+}
+
+func TestSniffIncomplete(t *testing.T) {
+	for prefix, expected := range map[string]bool{
+		"":                         true,
+		"G":                        true,
+		"DELE":                     true,
+		"PRI * HTTP/2":             true,
+		"\x16\x03\x01\x02":         true,
+		"GET ":                     false,
+		"GET/":                     false,
+		"PRI * HTTP/2.0":           false,
+		"\x16\x02":                 false,
+		"\x16\x03\x01\x02\x00\x01": false,
+		"*1\r\n":                   false,
+	} {
+		if actual := sniffIncomplete([]byte(prefix)); actual != expected {
+			t.Fatalf("prefix %q: expected %v, got %v", prefix, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// newRequestID generates id for requests without one, it's selected by format on handlers init
+var newRequestID = newUUIDRequestID
+
+// initRequestIDFormat selects generator of request ids
+func initRequestIDFormat(format string) {
+	switch format {
+	case config.RequestIdFormatHex:
+		newRequestID = newHexRequestID
+	case config.RequestIdFormatULID:
+		newRequestID = newULIDRequestID
+	default:
+		newRequestID = newUUIDRequestID
+	}
+}
+
+// newUUIDRequestID returns canonical UUIDv4, e.g. 9b2f0c3e-6c1a-4f5e-8d7b-2a1c3e4f5a6b
+func newUUIDRequestID() string {
+	return uuid.New().String()
+}
+
+// newHexRequestID returns UUIDv4 without dashes
+func newHexRequestID() string {
+	id := uuid.New()
+	return hex.EncodeToString(id[:])
+}
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULIDRequestID returns ULID: 48 bits of milliseconds since epoch and 80 random bits
+// encoded with Crockford's base32, so ids are lexicographically sorted by time
+func newULIDRequestID() string {
+	var id [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		id[i] = byte(ms)
+		ms >>= 8
+	}
+	rand.Read(id[6:])
+
+	// 128 bits are encoded as 26 characters, the first one holds the highest 3 bits
+	var encoded [26]byte
+	var acc uint32
+	bits := uint(2)
+	pos := 0
+	for _, b := range id {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			encoded[pos] = crockfordAlphabet[(acc>>bits)&0x1f]
+			pos++
+		}
+	}
+	return string(encoded[:])
+}
+
+// ensureRequestID makes all request id headers carry the same value: the first non-empty one
+// by configured priority or a new one, the value is returned
+func ensureRequestID(httpConfig config.HTTPConfig, header nhttp.Header) string {
+	var requestID string
+	for _, name := range httpConfig.RequestIdHeaderNames {
+		if requestID = header.Get(name); requestID != "" {
+			break
+		}
+	}
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	for _, name := range httpConfig.RequestIdHeaderNames {
+		header.Set(name, requestID)
+	}
+	return requestID
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestULIDRequestID(t *testing.T) {
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	id := newULIDRequestID()
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+
+	if len(id) != 26 {
+		t.Fatalf("expected 26 characters, got %d in %s", len(id), id)
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(crockfordAlphabet, c) {
+			t.Fatalf("unexpected character %q in %s", c, id)
+		}
+	}
+	// the first character holds the highest 3 bits only
+	if id[0] > '7' {
+		t.Fatalf("unexpected first character in %s", id)
+	}
+	// the first 10 characters are milliseconds since epoch
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockfordAlphabet, c))
+	}
+	if ms < before || ms > after {
+		t.Fatalf("expected timestamp within [%d, %d], got %d", before, after, ms)
+	}
+	if newULIDRequestID() == newULIDRequestID() {
+		t.Fatal("expected random part to differ")
+	}
+}
+
+func TestULIDRequestIDSortedByTime(t *testing.T) {
+	prev := newULIDRequestID()
+	for i := 0; i < 5; i++ {
+		time.Sleep(2 * time.Millisecond)
+		id := newULIDRequestID()
+		if id <= prev {
+			t.Fatalf("expected %s to be sorted after %s", id, prev)
+		}
+		prev = id
+	}
+}
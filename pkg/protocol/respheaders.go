@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"os"
+	"strings"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// hostname is name of host proxy runs on, it's substituted into {hostname} of response header templates
+var hostname, _ = os.Hostname()
+
+// setResponseHeaders adds configured headers to response overwriting upstream ones, values are templates
+// where {request_id}, {upstream} and {hostname} are replaced with request id, address of upstream and proxy host name
+func setResponseHeaders(httpConfig config.HTTPConfig, header nhttp.Header, requestID string, upstream string) {
+	if len(httpConfig.ResponseHeaders) == 0 {
+		return
+	}
+	replacer := strings.NewReplacer(
+		"{request_id}", requestID,
+		"{upstream}", upstream,
+		"{hostname}", hostname,
+	)
+	for name, value := range httpConfig.ResponseHeaders {
+		header.Set(name, replacer.Replace(value))
+	}
+}
@@ -0,0 +1,266 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+var idempotentMethods = map[string]struct{}{
+	nhttp.MethodGet:     {},
+	nhttp.MethodHead:    {},
+	nhttp.MethodPut:     {},
+	nhttp.MethodDelete:  {},
+	nhttp.MethodOptions: {},
+}
+
+// isRetryable reports whether request can be replayed: it should be idempotent
+// and its body should be small enough to be buffered
+func isRetryable(req *nhttp.Request) bool {
+	httpConfig := config.GetHTTPConfig()
+	if httpConfig.MaxRetries <= 0 {
+		return false
+	}
+	if _, ok := idempotentMethods[req.Method]; !ok {
+		return false
+	}
+	return req.ContentLength >= 0 && req.ContentLength <= httpConfig.RetryMaxBodyBytes
+}
+
+// requestReplay keeps buffered request to write it again to another upstream connection
+type requestReplay struct {
+	req  *nhttp.Request
+	body []byte
+	// verdict receives response side decision whether request should be retried
+	verdict chan bool
+
+	mu       sync.Mutex
+	conn     *net.TCPConn // upstream connection of current unresolved attempt
+	attempts int
+	// delay is wait requested by upstream before the next attempt
+	delay time.Duration
+}
+
+func newRequestReplay(req *nhttp.Request, conn *net.TCPConn) (*requestReplay, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	rp := &requestReplay{
+		req:     req,
+		body:    body,
+		verdict: make(chan bool, 1),
+		conn:    conn,
+	}
+	rp.rewind()
+	return rp, nil
+}
+
+// rewind resets request body to be written from the beginning
+func (rp *requestReplay) rewind() {
+	if len(rp.body) == 0 {
+		rp.req.Body = nhttp.NoBody
+		return
+	}
+	rp.req.Body = ioutil.NopCloser(bytes.NewReader(rp.body))
+}
+
+// nextAttempt reserves one more retry, it returns false when retries are exhausted
+func (rp *requestReplay) nextAttempt() bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.attempts >= config.GetHTTPConfig().MaxRetries {
+		return false
+	}
+	rp.attempts++
+	return true
+}
+
+// attempt starts writing request to conn, verdicts from previous connections are dropped
+func (rp *requestReplay) attempt(conn *net.TCPConn) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	select {
+	case <-rp.verdict:
+	default:
+	}
+	rp.conn = conn
+	rp.rewind()
+}
+
+// resolve delivers verdict for attempt made over conn once, retry is granted while attempts are left
+func (rp *requestReplay) resolve(conn *net.TCPConn, retry bool) bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.conn == nil || rp.conn != conn {
+		return false
+	}
+	retry = retry && rp.attempts < config.GetHTTPConfig().MaxRetries
+	rp.conn = nil
+	rp.verdict <- retry
+	return retry
+}
+
+// setDelay sets wait before the next attempt
+func (rp *requestReplay) setDelay(delay time.Duration) {
+	rp.mu.Lock()
+	rp.delay = delay
+	rp.mu.Unlock()
+}
+
+// takeDelay returns wait before the next attempt and resets it
+func (rp *requestReplay) takeDelay() time.Duration {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	delay := rp.delay
+	rp.delay = 0
+	return delay
+}
+
+// waitDelay waits before the next attempt while watching client connection r read by reader,
+// it returns false if client connection is closed meanwhile, so request shouldn't be retried.
+// Data client sends while waiting (e.g. pipelined request) stays buffered by reader
+func waitDelay(r *net.TCPConn, reader *bufio.Reader, delay time.Duration) bool {
+	closed := make(chan error, 1)
+	go func() {
+		_, err := reader.Peek(1)
+		closed <- err
+	}()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		// pending read is interrupted, read deadline of the next request is set by request loop
+		r.SetReadDeadline(time.Now())
+		err := <-closed
+		r.SetReadDeadline(time.Time{})
+		return err == nil || isTimeout(err)
+	case err := <-closed:
+		if err != nil && !isTimeout(err) {
+			return false
+		}
+		<-timer.C
+		return true
+	}
+}
+
+// retryAfterDelay returns wait requested by Retry-After header of 503 response,
+// header value is either number of seconds or HTTP-date
+func retryAfterDelay(resp *nhttp.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != nhttp.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > int64(math.MaxInt64/time.Second) {
+			return time.Duration(math.MaxInt64), true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := nhttp.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
+func (nr *NetHTTPRequest) setReplay(replay *requestReplay) {
+	nr.replayMu.Lock()
+	nr.replay = replay
+	nr.replayMu.Unlock()
+}
+
+// isReplayed reports whether request is waiting for response side verdict
+func (nr *NetHTTPRequest) isReplayed(req *nhttp.Request) bool {
+	nr.replayMu.Lock()
+	defer nr.replayMu.Unlock()
+	return nr.replay != nil && nr.replay.req == req
+}
+
+// resolveReplay delivers verdict for replayed request sent over conn,
+// it returns true if request is going to be retried
+func (nr *NetHTTPRequest) resolveReplay(conn *net.TCPConn, retry bool) bool {
+	nr.replayMu.Lock()
+	replay := nr.replay
+	nr.replayMu.Unlock()
+	if replay == nil {
+		return false
+	}
+	return replay.resolve(conn, retry)
+}
+
+// delayReplay sets wait requested by Retry-After header of response to req before replayed request is retried,
+// it returns false if wait doesn't end before read timeout or total deadline of request,
+// so response should be passed to client instead
+func (nr *NetHTTPRequest) delayReplay(req *nhttp.Request, resp *nhttp.Response) bool {
+	now := time.Now()
+	delay, ok := retryAfterDelay(resp, now)
+	if !ok {
+		return true
+	}
+	timeouts, total := nr.requestTimeouts(req)
+	if deadline := timeoutDeadline(timeouts.Read, total); !deadline.IsZero() && now.Add(delay).After(deadline) {
+		return false
+	}
+	nr.replayMu.Lock()
+	replay := nr.replay
+	nr.replayMu.Unlock()
+	if replay == nil {
+		return false
+	}
+	replay.setDelay(delay)
+	return true
+}
+
+func (nr *NetHTTPRequest) addRetryDelay(req *nhttp.Request, delay time.Duration) {
+	nr.replayMu.Lock()
+	nr.retryDelays[req] += delay
+	nr.replayMu.Unlock()
+}
+
+// popRetryDelay returns total wait requested by upstream before retries of request and forgets it
+func (nr *NetHTTPRequest) popRetryDelay(req *nhttp.Request) (time.Duration, bool) {
+	nr.replayMu.Lock()
+	defer nr.replayMu.Unlock()
+	delay, ok := nr.retryDelays[req]
+	if ok {
+		delete(nr.retryDelays, req)
+	}
+	return delay, ok
+}
+
+func (nr *NetHTTPRequest) addRetry(req *nhttp.Request) {
+	nr.replayMu.Lock()
+	nr.retryCounts[req]++
+	nr.replayMu.Unlock()
+}
+
+// popRetries returns number of retries made for request and forgets it
+func (nr *NetHTTPRequest) popRetries(req *nhttp.Request) int {
+	nr.replayMu.Lock()
+	defer nr.replayMu.Unlock()
+	retries, ok := nr.retryCounts[req]
+	if ok {
+		delete(nr.retryCounts, req)
+	}
+	return retries
+}
@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestRetryAfterDelay(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		status     int
+		retryAfter string
+		delay      time.Duration
+		ok         bool
+	}{
+		{nhttp.StatusServiceUnavailable, "", 0, false},
+		{nhttp.StatusServiceUnavailable, "2", 2 * time.Second, true},
+		{nhttp.StatusServiceUnavailable, " 0 ", 0, true},
+		{nhttp.StatusServiceUnavailable, "-1", 0, false},
+		{nhttp.StatusServiceUnavailable, "soon", 0, false},
+		{nhttp.StatusServiceUnavailable, "Wed, 01 Jan 2020 12:00:03 GMT", 3 * time.Second, true},
+		{nhttp.StatusServiceUnavailable, "Wed, 01 Jan 2020 11:59:00 GMT", 0, true},
+		{nhttp.StatusInternalServerError, "2", 0, false},
+	}
+	for _, tt := range tests {
+		resp := &nhttp.Response{StatusCode: tt.status, Header: nhttp.Header{}}
+		if tt.retryAfter != "" {
+			resp.Header.Set("Retry-After", tt.retryAfter)
+		}
+		delay, ok := retryAfterDelay(resp, now)
+		if delay != tt.delay || ok != tt.ok {
+			t.Fatalf("%d %q: expected %s %t, got %s %t", tt.status, tt.retryAfter, tt.delay, tt.ok, delay, ok)
+		}
+	}
+}
+
+func TestDelayReplayLimitedByDeadline(t *testing.T) {
+	httpConfig := config.GetHTTPConfig()
+	defer config.SetHTTPConfig(httpConfig)
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		readTimeout time.Duration
+		total       time.Duration
+		retryAfter  string
+		delayed     bool
+		delay       time.Duration
+	}{
+		{name: "no Retry-After", readTimeout: time.Second, delayed: true},
+		{name: "no deadline", retryAfter: "3600", delayed: true, delay: time.Hour},
+		{name: "within read timeout", readTimeout: 2 * time.Second, retryAfter: "1", delayed: true, delay: time.Second},
+		{name: "over read timeout", readTimeout: 2 * time.Second, retryAfter: "3"},
+		{name: "over total timeout", total: 500 * time.Millisecond, retryAfter: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeoutConfig := httpConfig
+			timeoutConfig.ReadTimeout = tt.readTimeout
+			config.SetHTTPConfig(timeoutConfig)
+			nr := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+			req := &nhttp.Request{Method: nhttp.MethodGet, URL: &url.URL{Path: "/"}}
+			if tt.total > 0 {
+				nr.setTimeouts(req, config.RouteTimeouts{Read: tt.readTimeout, Total: tt.total})
+			}
+			replay := &requestReplay{req: req, verdict: make(chan bool, 1)}
+			nr.setReplay(replay)
+			resp := &nhttp.Response{StatusCode: nhttp.StatusServiceUnavailable, Header: nhttp.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			if delayed := nr.delayReplay(req, resp); delayed != tt.delayed {
+				t.Fatalf("expected retry to be %v", tt.delayed)
+			}
+			if delay := replay.takeDelay(); delay != tt.delay {
+				t.Fatalf("expected %s delay, got %s", tt.delay, delay)
+			}
+		})
+	}
+}
+
+func TestWaitDelay(t *testing.T) {
+	client, proxyIn := tcpConnPair(t)
+	defer client.Close()
+	defer proxyIn.Close()
+	reader := bufio.NewReader(proxyIn)
+
+	if !waitDelay(proxyIn, reader, 50*time.Millisecond) {
+		t.Fatal("expected wait to end with timer")
+	}
+	// pipelined request doesn't interrupt wait and stays buffered
+	client.Write([]byte("G"))
+	if !waitDelay(proxyIn, reader, 50*time.Millisecond) {
+		t.Fatal("expected wait to end with timer")
+	}
+	if b, err := reader.ReadByte(); err != nil || b != 'G' {
+		t.Fatalf("expected pipelined data to be buffered, got %q (%v)", b, err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Close()
+	}()
+	start := time.Now()
+	if waitDelay(proxyIn, reader, time.Minute) {
+		t.Fatal("expected wait to be interrupted by closed client connection")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected wait to be interrupted early, waited %s", elapsed)
+	}
+}
@@ -0,0 +1,331 @@
+package protocol
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// routingHostPatternPrefix marks rule host as regular expression matching whole host
+const routingHostPatternPrefix = "~"
+
+// routingMirrorSeparator starts rule mirror target in format `|mirror=host:port;percent`
+const routingMirrorSeparator = "|mirror="
+
+// routingPatterns keeps compiled rule host patterns, patterns come with every request in routing header
+var routingPatterns = cache.New(10*time.Minute, time.Minute)
+
+// routingRule routes host to one of its targets, targets are chosen by weight if there are several ones
+type routingRule struct {
+	host    string
+	pattern *regexp.Regexp
+	targets []string
+	weights []int
+	// mirror receives copy of mirrorPercent percents of requests
+	mirror        string
+	mirrorPercent int
+	// match is conditions of JSON directive rule, legacy rules match any request
+	match *routingMatch
+}
+
+// compileRoutingPattern compiles rule host pattern or takes it from cache
+func compileRoutingPattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := routingPatterns.Get(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+	routingPatterns.SetDefault(pattern, re)
+	return re, nil
+}
+
+// parseRoutingRules parses routing value in format
+// `host1=host2,host3=host4:80;60,host5:80;40,~host.*=host6,host7=host8:80|mirror=host9:80;10,host1/v2=host10`
+func parseRoutingRules(routingValue string) ([]*routingRule, error) {
+	var rules []*routingRule
+	var weighted bool
+	for _, p := range strings.Split(routingValue, ",") {
+		mirror := ""
+		if i := strings.Index(p, routingMirrorSeparator); i >= 0 {
+			mirror = p[i+len(routingMirrorSeparator):]
+			p = p[:i]
+		}
+		keyval := strings.Split(p, "=")
+		if len(keyval) < 2 {
+			// weighted rule continues with the next target
+			if !weighted {
+				return nil, fmt.Errorf("malformed routing header: '%s'", routingValue)
+			}
+			target, weight, err := parseWeightedTarget(p)
+			if err != nil {
+				return nil, fmt.Errorf("malformed routing weights: '%s'", routingValue)
+			}
+			rule := rules[len(rules)-1]
+			rule.targets = append(rule.targets, target)
+			rule.weights = append(rule.weights, weight)
+			if err := rule.setMirror(mirror); err != nil {
+				return nil, fmt.Errorf("malformed routing mirror: '%s'", routingValue)
+			}
+			continue
+		}
+		rule := &routingRule{host: keyval[0]}
+		// exact host may be followed by path prefix, e.g. `host/v2`
+		if i := strings.IndexByte(rule.host, '/'); i >= 0 && !strings.HasPrefix(rule.host, routingHostPatternPrefix) {
+			if i == 0 {
+				return nil, fmt.Errorf("malformed routing header: '%s'", routingValue)
+			}
+			rule.host, rule.match = rule.host[:i], &routingMatch{PathPrefix: rule.host[i:]}
+		}
+		if strings.HasPrefix(rule.host, routingHostPatternPrefix) {
+			re, err := compileRoutingPattern(strings.TrimPrefix(rule.host, routingHostPatternPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("malformed routing host pattern '%s': %s", rule.host, err.Error())
+			}
+			rule.pattern = re
+		}
+		weighted = strings.Contains(keyval[1], ";")
+		if weighted {
+			target, weight, err := parseWeightedTarget(keyval[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed routing weights: '%s'", routingValue)
+			}
+			rule.targets = []string{target}
+			rule.weights = []int{weight}
+		} else {
+			rule.targets = []string{keyval[1]}
+		}
+		if err := rule.setMirror(mirror); err != nil {
+			return nil, fmt.Errorf("malformed routing mirror: '%s'", routingValue)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseWeightedTarget parses target in format `host:port;weight`
+func parseWeightedTarget(value string) (string, int, error) {
+	parts := strings.Split(value, ";")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, fmt.Errorf("malformed weighted target: '%s'", value)
+	}
+	weight, err := strconv.Atoi(parts[1])
+	if err != nil || weight < 0 {
+		return "", 0, fmt.Errorf("malformed weighted target: '%s'", value)
+	}
+	return parts[0], weight, nil
+}
+
+// setMirror sets rule mirror from value in format `host:port;percent`, percent defaults to 100
+func (rule *routingRule) setMirror(value string) error {
+	if value == "" {
+		return nil
+	}
+	if !strings.Contains(value, ";") {
+		rule.mirror, rule.mirrorPercent = value, 100
+		return nil
+	}
+	target, percent, err := parseWeightedTarget(value)
+	if err != nil {
+		return err
+	}
+	if percent > 100 {
+		return fmt.Errorf("mirror percent should be in [0, 100]: '%s'", value)
+	}
+	rule.mirror, rule.mirrorPercent = target, percent
+	return nil
+}
+
+// pickMirror returns rule mirror for mirrorPercent percents of calls
+func (rule *routingRule) pickMirror() string {
+	if rule.mirror == "" || rand.Intn(100) >= rule.mirrorPercent {
+		return ""
+	}
+	return withDefaultPort(rule.mirror)
+}
+
+// pick chooses rule target for host, targets pointing to the host itself are skipped to avoid infinite route loops.
+// Ejected targets of weighted rule are skipped as well unless all of them are ejected
+func (rule *routingRule) pick(host string, ejected func(addr string) bool) (string, bool) {
+	if rule.weights == nil {
+		if rule.targets[0] == host {
+			return "", false
+		}
+		return rule.targets[0], true
+	}
+	if target, ok := rule.pickWeighted(host, ejected); ok {
+		return target, true
+	}
+	return rule.pickWeighted(host, nil)
+}
+
+// pickWeighted chooses target by weight among ones not pointing to host and not skipped
+func (rule *routingRule) pickWeighted(host string, skip func(addr string) bool) (string, bool) {
+	eligible := func(target string) bool {
+		return target != host && (skip == nil || !skip(withDefaultPort(target)))
+	}
+	total := 0
+	for i, target := range rule.targets {
+		if eligible(target) {
+			total += rule.weights[i]
+		}
+	}
+	if total == 0 {
+		return "", false
+	}
+	n := rand.Intn(total)
+	for i, target := range rule.targets {
+		if !eligible(target) {
+			continue
+		}
+		if n < rule.weights[i] {
+			return target, true
+		}
+		n -= rule.weights[i]
+	}
+	return "", false
+}
+
+// routingDestination is routing decision for request
+type routingDestination struct {
+	addr string
+	// mirror is destination request copy should be sent to, it's empty if request isn't mirrored
+	mirror string
+	// weighted is set if addr is chosen among several weighted targets
+	weighted bool
+	// pathPrefix is path condition of rule addr is chosen by
+	pathPrefix string
+}
+
+// getRoutingDestination returns destination of request, ejected reports destinations weighted rules avoid.
+// Routing value is either JSON directive or legacy `host=target` rules
+func getRoutingDestination(
+	routingValue string,
+	req *nhttp.Request,
+	originalDst string,
+	ejected func(addr string) bool) (routingDestination, error) {
+	parse := parseRoutingRules
+	if isJSONRoutingValue(routingValue) {
+		parse = parseJSONRoutingRules
+	}
+	rules, err := parse(routingValue)
+	if err != nil {
+		return routingDestination{}, err
+	}
+	for _, rule := range rules {
+		if err := rule.validateTargets(); err != nil {
+			return routingDestination{}, err
+		}
+	}
+	// rule of the longest path prefix is the most specific one, rules without path are the fallback
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].pathPrefix()) > len(rules[j].pathPrefix())
+	})
+	rule, target, ok := pickRoutingRule(rules, req.Host, func(rule *routingRule) bool {
+		return rule.match.matches(req)
+	}, ejected)
+	if !ok {
+		return routingDestination{addr: originalDst}, nil
+	}
+	return rule.destination(target), nil
+}
+
+// pickRoutingRule returns the first rule of host which matches and its picked target,
+// exact host match has priority over pattern one
+func pickRoutingRule(
+	rules []*routingRule,
+	host string,
+	matches func(rule *routingRule) bool,
+	ejected func(addr string) bool) (*routingRule, string, bool) {
+	for _, rule := range rules {
+		if rule.pattern != nil || host != rule.host || !matches(rule) {
+			continue
+		}
+		if target, ok := rule.pick(host, ejected); ok {
+			return rule, target, true
+		}
+	}
+	for _, rule := range rules {
+		if rule.pattern == nil || !rule.pattern.MatchString(host) || !matches(rule) {
+			continue
+		}
+		if target, ok := rule.pick(host, ejected); ok {
+			return rule, target, true
+		}
+	}
+	return nil, "", false
+}
+
+// destination returns routing decision for picked rule target
+func (rule *routingRule) destination(target string) routingDestination {
+	return routingDestination{
+		addr:       withDefaultPort(target),
+		mirror:     rule.pickMirror(),
+		weighted:   len(rule.targets) > 1,
+		pathPrefix: rule.pathPrefix(),
+	}
+}
+
+// pathPrefix returns path condition of rule, it's empty if rule matches any path
+func (rule *routingRule) pathPrefix() string {
+	if rule.match == nil {
+		return ""
+	}
+	return rule.match.PathPrefix
+}
+
+// withDefaultPort adds port 80 to valid target without port, IPv6 literal target is bracketed e.g. `[::1]`
+func withDefaultPort(target string) string {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(target, "["), "]"), "80")
+}
+
+// validateTarget checks that target is host or `host:port` authority, IPv6 literal should be bracketed
+// since bare one (e.g. `::1`) can't be told from host with port
+func validateTarget(target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		// target without port
+		host, port = target, "80"
+		if strings.HasPrefix(target, "[") && strings.HasSuffix(target, "]") {
+			host = target[1 : len(target)-1]
+			if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+				return fmt.Errorf("malformed IPv6 routing target: '%s'", target)
+			}
+		} else if strings.Contains(target, ":") {
+			return fmt.Errorf("malformed routing target: '%s'", target)
+		}
+	}
+	if host == "" || strings.ContainsAny(host, "[]/@") {
+		return fmt.Errorf("malformed routing target host: '%s'", target)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("malformed routing target port: '%s'", target)
+	}
+	return nil
+}
+
+// validateTargets checks rule targets and mirror
+func (rule *routingRule) validateTargets() error {
+	for _, target := range rule.targets {
+		if err := validateTarget(target); err != nil {
+			return err
+		}
+	}
+	if rule.mirror != "" {
+		return validateTarget(rule.mirror)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// jsonRoutingRule is rule of JSON routing directive, rules with the same host and match conditions
+// following each other are targets of single weighted rule
+type jsonRoutingRule struct {
+	Host          string        `json:"host"`
+	Target        string        `json:"target"`
+	Weight        *int          `json:"weight"`
+	Match         *routingMatch `json:"match"`
+	Mirror        string        `json:"mirror"`
+	MirrorPercent *int          `json:"mirror_percent"`
+}
+
+// routingMatch is conditions request should meet to be routed by rule, empty condition matches any request
+type routingMatch struct {
+	Method     string            `json:"method"`
+	PathPrefix string            `json:"path_prefix"`
+	Headers    map[string]string `json:"headers"`
+}
+
+// matches reports whether request meets all conditions
+func (m *routingMatch) matches(req *nhttp.Request) bool {
+	if m == nil {
+		return true
+	}
+	if m.Method != "" && !strings.EqualFold(m.Method, req.Method) {
+		return false
+	}
+	if m.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, m.PathPrefix) {
+		return false
+	}
+	for name, value := range m.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// parseJSONRoutingRules parses routing value in format
+// `{"rules":[{"host":"host1","target":"host2:80","weight":60,"match":{"path_prefix":"/api"}},...]}`
+func parseJSONRoutingRules(routingValue string) ([]*routingRule, error) {
+	var directive struct {
+		Rules []jsonRoutingRule `json:"rules"`
+	}
+	dec := json.NewDecoder(strings.NewReader(routingValue))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&directive); err != nil {
+		return nil, fmt.Errorf("malformed routing directive: %s", err.Error())
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("malformed routing directive: '%s'", routingValue)
+	}
+	var rules []*routingRule
+	var last *jsonRoutingRule
+	for i := range directive.Rules {
+		r := &directive.Rules[i]
+		if r.Host == "" || r.Target == "" {
+			return nil, fmt.Errorf("routing rule should have host and target: '%s'", routingValue)
+		}
+		if r.Weight != nil && *r.Weight < 0 {
+			return nil, fmt.Errorf("routing weight should not be negative: '%s'", routingValue)
+		}
+		if last != nil && last.Host == r.Host && reflect.DeepEqual(last.Match, r.Match) {
+			// weighted rule continues with the next target
+			if last.Weight == nil || r.Weight == nil {
+				return nil, fmt.Errorf("targets of the same host should have weights: '%s'", routingValue)
+			}
+			rule := rules[len(rules)-1]
+			rule.targets = append(rule.targets, r.Target)
+			rule.weights = append(rule.weights, *r.Weight)
+			if err := rule.setJSONMirror(r); err != nil {
+				return nil, err
+			}
+			last = r
+			continue
+		}
+		rule := &routingRule{host: r.Host, targets: []string{r.Target}, match: r.Match}
+		if strings.HasPrefix(rule.host, routingHostPatternPrefix) {
+			re, err := compileRoutingPattern(strings.TrimPrefix(rule.host, routingHostPatternPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("malformed routing host pattern '%s': %s", rule.host, err.Error())
+			}
+			rule.pattern = re
+		}
+		if r.Weight != nil {
+			rule.weights = []int{*r.Weight}
+		}
+		if err := rule.setJSONMirror(r); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+		last = r
+	}
+	return rules, nil
+}
+
+// setJSONMirror sets rule mirror, percent defaults to 100
+func (rule *routingRule) setJSONMirror(r *jsonRoutingRule) error {
+	if r.Mirror == "" {
+		if r.MirrorPercent != nil {
+			return fmt.Errorf("routing mirror percent is set without mirror for host '%s'", r.Host)
+		}
+		return nil
+	}
+	percent := 100
+	if r.MirrorPercent != nil {
+		percent = *r.MirrorPercent
+	}
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("mirror percent should be in [0, 100]: %d", percent)
+	}
+	rule.mirror, rule.mirrorPercent = r.Mirror, percent
+	return nil
+}
+
+// isJSONRoutingValue reports whether routing value is JSON directive, legacy values never start with `{`
+func isJSONRoutingValue(routingValue string) bool {
+	return strings.HasPrefix(strings.TrimLeft(routingValue, " \t"), "{")
+}
@@ -0,0 +1,312 @@
+package protocol
+
+import (
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestRoutingDestination(t *testing.T) {
+	tests := []struct {
+		name         string
+		routingValue string
+		method       string
+		path         string
+		header       nhttp.Header
+		addr         string
+		wantErr      bool
+	}{
+		{
+			name:         "legacy",
+			routingValue: "other=foo,example.com=bar:8080",
+			addr:         "bar:8080",
+		},
+		{
+			name:         "legacy without matching rule",
+			routingValue: "other=foo",
+			addr:         "original:80",
+		},
+		{
+			name:         "json",
+			routingValue: ` {"rules":[{"host":"example.com","target":"bar"}]}`,
+			addr:         "bar:80",
+		},
+		{
+			name: "json path match",
+			routingValue: `{"rules":[
+				{"host":"example.com","target":"api:80","match":{"path_prefix":"/api"}},
+				{"host":"example.com","target":"web:80"}]}`,
+			path: "/api/orders",
+			addr: "api:80",
+		},
+		{
+			name: "json path mismatch",
+			routingValue: `{"rules":[
+				{"host":"example.com","target":"api:80","match":{"path_prefix":"/api"}},
+				{"host":"example.com","target":"web:80"}]}`,
+			path: "/index.html",
+			addr: "web:80",
+		},
+		{
+			name: "json method and header match",
+			routingValue: `{"rules":[
+				{"host":"example.com","target":"v2:80","match":{"method":"post","headers":{"X-Version":"2"}}}]}`,
+			method: nhttp.MethodPost,
+			header: nhttp.Header{"X-Version": {"2"}},
+			addr:   "v2:80",
+		},
+		{
+			name: "json header mismatch",
+			routingValue: `{"rules":[
+				{"host":"example.com","target":"v2:80","match":{"headers":{"X-Version":"2"}}}]}`,
+			header: nhttp.Header{"X-Version": {"1"}},
+			addr:   "original:80",
+		},
+		{
+			name: "json weighted",
+			routingValue: `{"rules":[
+				{"host":"example.com","target":"a:80","weight":0},
+				{"host":"example.com","target":"b:80","weight":100}]}`,
+			addr: "b:80",
+		},
+		{
+			name:         "json pattern",
+			routingValue: `{"rules":[{"host":"~.*\\.com","target":"proxy:8080"}]}`,
+			addr:         "proxy:8080",
+		},
+		{
+			name:         "json without target",
+			routingValue: `{"rules":[{"host":"example.com"}]}`,
+			wantErr:      true,
+		},
+		{
+			name:         "json unknown field",
+			routingValue: `{"rules":[{"host":"example.com","target":"a","wieght":10}]}`,
+			wantErr:      true,
+		},
+		{
+			name: "json weights of several targets",
+			routingValue: `{"rules":[
+				{"host":"example.com","target":"a:80","weight":50},
+				{"host":"example.com","target":"b:80"}]}`,
+			wantErr: true,
+		},
+		{
+			name:         "json mirror percent",
+			routingValue: `{"rules":[{"host":"example.com","target":"a","mirror":"m","mirror_percent":101}]}`,
+			wantErr:      true,
+		},
+		{
+			name:         "legacy path prefix",
+			routingValue: "example.com=web:80,example.com/v2=v2:80,example.com/v2/orders=orders:80",
+			path:         "/v2/items",
+			addr:         "v2:80",
+		},
+		{
+			name:         "legacy longest path prefix",
+			routingValue: "example.com=web:80,example.com/v2=v2:80,example.com/v2/orders=orders:80",
+			path:         "/v2/orders/1",
+			addr:         "orders:80",
+		},
+		{
+			name:         "legacy host fallback",
+			routingValue: "example.com/v2=v2:80,example.com=web:80",
+			path:         "/v1/items",
+			addr:         "web:80",
+		},
+		{
+			name:         "legacy path rule pointing to host itself",
+			routingValue: "example.com/v2=example.com,example.com=web:80",
+			path:         "/v2/items",
+			addr:         "web:80",
+		},
+		{
+			name:         "legacy weighted path prefix",
+			routingValue: "example.com/v2=a:80;0,b:80;100",
+			path:         "/v2",
+			addr:         "b:80",
+		},
+		{
+			name:         "legacy path without host",
+			routingValue: "/v2=v2:80",
+			wantErr:      true,
+		},
+		{
+			name:         "ipv4 without port",
+			routingValue: "example.com=10.0.0.1",
+			addr:         "10.0.0.1:80",
+		},
+		{
+			name:         "ipv4 with port",
+			routingValue: "example.com=10.0.0.1:8080",
+			addr:         "10.0.0.1:8080",
+		},
+		{
+			name:         "ipv6 without port",
+			routingValue: "example.com=[::1]",
+			addr:         "[::1]:80",
+		},
+		{
+			name:         "ipv6 with port",
+			routingValue: "example.com=[fe80::1]:8080;100",
+			addr:         "[fe80::1]:8080",
+		},
+		{
+			name:         "json ipv6 without port",
+			routingValue: `{"rules":[{"host":"example.com","target":"[2001:db8::1]"}]}`,
+			addr:         "[2001:db8::1]:80",
+		},
+		{
+			name:         "hostname without port",
+			routingValue: "example.com=backend.local",
+			addr:         "backend.local:80",
+		},
+		{
+			name:         "hostname with port",
+			routingValue: "example.com=backend.local:9090",
+			addr:         "backend.local:9090",
+		},
+		{
+			name:         "bare ipv6",
+			routingValue: "example.com=::1",
+			wantErr:      true,
+		},
+		{
+			name:         "unclosed ipv6 bracket",
+			routingValue: "example.com=[::1:80",
+			wantErr:      true,
+		},
+		{
+			name:         "bracketed ipv4",
+			routingValue: "example.com=[10.0.0.1]",
+			wantErr:      true,
+		},
+		{
+			name:         "empty port",
+			routingValue: "example.com=backend:",
+			wantErr:      true,
+		},
+		{
+			name:         "invalid port",
+			routingValue: "example.com=backend:http",
+			wantErr:      true,
+		},
+		{
+			name:         "malformed mirror",
+			routingValue: "example.com=backend|mirror=::1",
+			wantErr:      true,
+		},
+		{
+			name:         "malformed json",
+			routingValue: `{"rules":[`,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &nhttp.Request{
+				Method: tt.method,
+				Host:   "example.com",
+				URL:    &url.URL{Path: tt.path},
+				Header: tt.header,
+			}
+			destination, err := getRoutingDestination(tt.routingValue, req, "original:80", nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got destination %#v", destination)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if destination.addr != tt.addr {
+				t.Fatalf("expected destination %s, got %s", tt.addr, destination.addr)
+			}
+		})
+	}
+}
+
+func TestRoutingTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		routed *routedRequest
+		tags   map[string]interface{}
+	}{
+		{
+			name: "not routed",
+			tags: map[string]interface{}{"peer.service": "example.com"},
+		},
+		{
+			name:   "routed to original destination",
+			routed: &routedRequest{addr: "10.0.0.1:80", originalDst: "10.0.0.1:80", source: routingSourceHeader},
+			tags:   map[string]interface{}{"peer.service": "10.0.0.1"},
+		},
+		{
+			name:   "overridden",
+			routed: &routedRequest{addr: "canary:80", originalDst: "10.0.0.1:80", source: routingSourceCookie},
+			tags: map[string]interface{}{
+				"peer.service":         "canary",
+				"routing.applied":      true,
+				"routing.original_dst": "10.0.0.1:80",
+				"routing.resolved_dst": "canary:80",
+				"routing.source":       "cookie",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, err := log.Init("test", "error", os.Stderr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nr := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+			req := &nhttp.Request{Host: "example.com", URL: &url.URL{Path: "/"}}
+			if tt.routed != nil {
+				nr.setRoutedDestination(req, *tt.routed)
+			}
+			span := mocktracer.New().StartSpan("outbound").(*mocktracer.MockSpan)
+
+			nr.tagRouting(span, req)
+
+			if tags := span.Tags(); !reflect.DeepEqual(tags, tt.tags) {
+				t.Fatalf("expected tags %v, got %v", tt.tags, tags)
+			}
+		})
+	}
+}
+
+func TestWeightedRoutingSkipsEjected(t *testing.T) {
+	rules, err := parseRoutingRules("example.com=a:80;50,b:80;50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := rules[0]
+	ejectedA := func(addr string) bool { return addr == "a:80" }
+	for i := 0; i < 20; i++ {
+		if target, ok := rule.pick("example.com", ejectedA); !ok || target != "b:80" {
+			t.Fatalf("expected healthy target to be chosen, got %q", target)
+		}
+	}
+	// the last destination isn't ejected, all targets are chosen by weight then
+	allEjected := func(string) bool { return true }
+	picked := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		target, ok := rule.pick("example.com", allEjected)
+		if !ok {
+			t.Fatal("expected target to be chosen when all targets are ejected")
+		}
+		picked[target] = true
+	}
+	if !picked["a:80"] || !picked["b:80"] {
+		t.Fatalf("expected both targets to be chosen, got %v", picked)
+	}
+}
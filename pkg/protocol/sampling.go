@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// routeSamplingRate returns sampling rate of the longest configured path prefix matching path
+func routeSamplingRate(httpConfig config.HTTPConfig, path string) (float64, bool) {
+	var rate float64
+	matched := -1
+	for prefix, prefixRate := range httpConfig.SamplingRates {
+		if len(prefix) > matched && strings.HasPrefix(path, prefix) {
+			rate = prefixRate
+			matched = len(prefix)
+		}
+	}
+	return rate, matched >= 0
+}
+
+// forcedSamplingPriority returns sampling priority set by force sample header,
+// it overrides both route sampling rate and sampling decision of propagated context
+func forcedSamplingPriority(httpConfig config.HTTPConfig, header nhttp.Header) (uint16, bool) {
+	if httpConfig.ForceSampleHeaderName == "" {
+		return 0, false
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get(httpConfig.ForceSampleHeaderName))) {
+	case "1", "true":
+		return 1, true
+	case "0", "false":
+		return 0, true
+	}
+	return 0, false
+}
+
+// dropSampling reports whether span should be started as not sampled,
+// it's dropped with probability 1 - rate, otherwise tracer sampling is used
+func dropSampling(rate float64) bool {
+	return rand.Float64() >= rate
+}
+
+// isUntraced reports whether request matches configured untraced host or path prefix,
+// spans aren't started for such requests
+func isUntraced(httpConfig config.HTTPConfig, req *nhttp.Request) bool {
+	if len(httpConfig.UntracedHosts) > 0 {
+		host := strings.ToLower(req.Host)
+		if _, ok := httpConfig.UntracedHosts[host]; ok {
+			return true
+		}
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			if _, ok := httpConfig.UntracedHosts[hostname]; ok {
+				return true
+			}
+		}
+	}
+	for _, prefix := range httpConfig.UntracedPathPrefixes {
+		if strings.HasPrefix(req.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
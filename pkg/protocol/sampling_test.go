@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+func TestForcedSamplingPriority(t *testing.T) {
+	httpConfig := config.HTTPConfig{ForceSampleHeaderName: "X-Force-Trace"}
+	tests := []struct {
+		value    string
+		priority uint16
+		ok       bool
+	}{
+		{"", 0, false},
+		{"1", 1, true},
+		{" TRUE ", 1, true},
+		{"0", 0, true},
+		{"false", 0, true},
+		{"maybe", 0, false},
+	}
+	for _, tt := range tests {
+		header := nhttp.Header{}
+		if tt.value != "" {
+			header.Set("X-Force-Trace", tt.value)
+		}
+		priority, ok := forcedSamplingPriority(httpConfig, header)
+		if priority != tt.priority || ok != tt.ok {
+			t.Fatalf("%q: expected %d %t, got %d %t", tt.value, tt.priority, tt.ok, priority, ok)
+		}
+	}
+
+	header := nhttp.Header{"X-Force-Trace": {"1"}}
+	if _, ok := forcedSamplingPriority(config.HTTPConfig{}, header); ok {
+		t.Fatal("expected header to be ignored without configured name")
+	}
+}
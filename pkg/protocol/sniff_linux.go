@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// peekConn returns up to n first bytes of connection without consuming them.
+// It waits up to timeout for the first bytes and for more ones while incomplete reports prefix
+// is too short to be recognized, what has come by then is returned
+func peekConn(conn *net.TCPConn, n int, timeout time.Duration, incomplete func(prefix []byte) bool) ([]byte, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, n)
+	var prefix []byte
+	var peekErr error
+	err = rawConn.Read(func(fd uintptr) bool {
+		read, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK)
+		if err == syscall.EAGAIN {
+			// connection is waited to be readable while nothing has come yet
+			return false
+		}
+		if err != nil {
+			peekErr = err
+			return true
+		}
+		prefix = buf[:read]
+		// peeked bytes are left in socket, so returning false waits for the next ones to come
+		return read == 0 || read == n || !incomplete(prefix)
+	})
+	if peekErr != nil {
+		return nil, peekErr
+	}
+	if err != nil && (len(prefix) == 0 || !isTimeout(err)) {
+		return nil, err
+	}
+	return prefix, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package protocol
+
+import (
+	"net"
+	"time"
+)
+
+// peekConn isn't supported, connections are never sniffed
+func peekConn(conn *net.TCPConn, n int, timeout time.Duration, incomplete func(prefix []byte) bool) ([]byte, error) {
+	return nil, nil
+}
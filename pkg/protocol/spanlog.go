@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// logSpanEvent remembers event of request with current time, events are logged to span when it's finished.
+// Event of request which is already answered (e.g. sent after response came) is dropped, nobody would pop it
+func (nr *NetHTTPRequest) logSpanEvent(req *nhttp.Request, event string, fields ...otlog.Field) {
+	if !config.GetHTTPConfig().SpanLogsEnabled {
+		return
+	}
+	record := newSpanEvent(event, fields...)
+	nr.spanEventsMu.Lock()
+	defer nr.spanEventsMu.Unlock()
+	// events are popped after request is dequeued, so the check and the append aren't interleaved with it
+	if !nr.httpRequests.Contains(req) {
+		return
+	}
+	nr.spanEvents[req] = append(nr.spanEvents[req], record)
+}
+
+func newSpanEvent(event string, fields ...otlog.Field) opentracing.LogRecord {
+	return opentracing.LogRecord{
+		Timestamp: time.Now(),
+		Fields:    append([]otlog.Field{otlog.String("event", event)}, fields...),
+	}
+}
+
+// popSpanEvents returns events of request and forgets them
+func (nr *NetHTTPRequest) popSpanEvents(req *nhttp.Request) []opentracing.LogRecord {
+	nr.spanEventsMu.Lock()
+	defer nr.spanEventsMu.Unlock()
+	records, ok := nr.spanEvents[req]
+	if ok {
+		delete(nr.spanEvents, req)
+	}
+	return records
+}
+
+// finishSpan finishes span of request with logs of its events, resp is nil for request without response
+func (nr *NetHTTPRequest) finishSpan(span opentracing.Span, req *nhttp.Request, resp *nhttp.Response) {
+	records := nr.popSpanEvents(req)
+	if resp != nil && config.GetHTTPConfig().SpanLogsEnabled {
+		records = append(records, newSpanEvent("response_received", otlog.Int("http.status_code", resp.StatusCode)))
+	}
+	span.FinishWithOptions(opentracing.FinishOptions{LogRecords: records})
+}
@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"strings"
+)
+
+// SanitizeSQL replaces string, numeric, hex and bit literals of statement with "?",
+// identifiers, keywords and comments are kept as is, unterminated literal is replaced up to the end
+func SanitizeSQL(statement string) string {
+	var b strings.Builder
+	b.Grow(len(statement))
+	for i := 0; i < len(statement); {
+		c := statement[i]
+		switch {
+		case c == '\'' || c == '"':
+			i = skipSQLString(statement, i)
+			b.WriteByte('?')
+		case c == '`':
+			end := strings.IndexByte(statement[i+1:], '`')
+			if end < 0 {
+				b.WriteString(statement[i:])
+				return b.String()
+			}
+			b.WriteString(statement[i : i+end+2])
+			i += end + 2
+		case c == '-' && strings.HasPrefix(statement[i:], "-- "), c == '#':
+			end := strings.IndexByte(statement[i:], '\n')
+			if end < 0 {
+				b.WriteString(statement[i:])
+				return b.String()
+			}
+			b.WriteString(statement[i : i+end])
+			i += end
+		case c == '/' && strings.HasPrefix(statement[i:], "/*"):
+			end := strings.Index(statement[i+2:], "*/")
+			if end < 0 {
+				b.WriteString(statement[i:])
+				return b.String()
+			}
+			b.WriteString(statement[i : i+end+4])
+			i += end + 4
+		case isSQLIdentifierByte(c) && !isSQLDigit(c):
+			// X'1F', B'01' and N'text' are literals too
+			if i+1 < len(statement) && statement[i+1] == '\'' && strings.IndexByte("xXbBnN", c) >= 0 {
+				i = skipSQLString(statement, i+1)
+				b.WriteByte('?')
+				continue
+			}
+			start := i
+			for i < len(statement) && isSQLIdentifierByte(statement[i]) {
+				i++
+			}
+			b.WriteString(statement[start:i])
+		case isSQLDigit(c) || c == '.' && i+1 < len(statement) && isSQLDigit(statement[i+1]):
+			i = skipSQLNumber(statement, i)
+			b.WriteByte('?')
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// skipSQLString returns position after quoted string started at i,
+// both backslash escapes and doubled quotes are supported
+func skipSQLString(statement string, i int) int {
+	quote := statement[i]
+	for i++; i < len(statement); i++ {
+		switch statement[i] {
+		case '\\':
+			i++
+		case quote:
+			if i+1 < len(statement) && statement[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(statement)
+}
+
+// skipSQLNumber returns position after number started at i, e.g. 42, 4.2e-1 or 0x2A
+func skipSQLNumber(statement string, i int) int {
+	if strings.HasPrefix(statement[i:], "0x") || strings.HasPrefix(statement[i:], "0b") {
+		i += 2
+		for i < len(statement) && isSQLIdentifierByte(statement[i]) {
+			i++
+		}
+		return i
+	}
+	for i < len(statement) {
+		c := statement[i]
+		switch {
+		case isSQLDigit(c) || c == '.':
+			i++
+		case (c == 'e' || c == 'E') && i+1 < len(statement):
+			i++
+			if statement[i] == '+' || statement[i] == '-' {
+				i++
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+func isSQLDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSQLIdentifierByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isSQLDigit(c) || c == '_' || c == '$' || c >= 0x80
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import "testing"
+
+func TestSanitizeSQL(t *testing.T) {
+	cases := []struct {
+		statement string
+		expected  string
+	}{
+		{"", ""},
+		{"SELECT 1", "SELECT ?"},
+		{"SELECT * FROM users WHERE id = 42", "SELECT * FROM users WHERE id = ?"},
+		{"SELECT * FROM users WHERE name = 'john' AND age > 18", "SELECT * FROM users WHERE name = ? AND age > ?"},
+		{`SELECT * FROM users WHERE name = "john"`, "SELECT * FROM users WHERE name = ?"},
+		{`SELECT 'it\'s', 'it''s'`, "SELECT ?, ?"},
+		{"SELECT 3.14, -1.5e-3, .5, 0x1F, X'1F', b'01', N'text'", "SELECT ?, -?, ?, ?, ?, ?, ?"},
+		{"INSERT INTO t1 (a, b2) VALUES (1, 'x'), (2, 'y')", "INSERT INTO t1 (a, b2) VALUES (?, ?), (?, ?)"},
+		{"SELECT `col 1`, `x'y` FROM t", "SELECT `col 1`, `x'y` FROM t"},
+		{"SELECT a FROM t -- id 42\nWHERE b = 1", "SELECT a FROM t -- id 42\nWHERE b = ?"},
+		{"SELECT /*+ MAX_EXECUTION_TIME(1000) */ a FROM t2 WHERE c IS NULL", "SELECT /*+ MAX_EXECUTION_TIME(1000) */ a FROM t2 WHERE c IS NULL"},
+		{"UPDATE t SET a = $1 WHERE b = ?", "UPDATE t SET a = $1 WHERE b = ?"},
+		// statement can be truncated in the middle of literal
+		{"SELECT * FROM t WHERE name = 'jo", "SELECT * FROM t WHERE name = ?"},
+	}
+	for _, c := range cases {
+		if actual := SanitizeSQL(c.statement); actual != c.expected {
+			t.Fatalf("statement %q: expected %q, got %q", c.statement, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+// isEventStream reports whether response is Server-Sent Events stream, it lasts until upstream closes it
+func isEventStream(resp *nhttp.Response) bool {
+	mediaType := strings.Split(resp.Header.Get("Content-Type"), ";")[0]
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream")
+}
+
+// flushingBody is response body flushing events written so far before it waits for the next ones
+type flushingBody struct {
+	flushingReader
+	io.Closer
+}
+
+// streamEvents finishes request span as soon as event stream starts and forwards events as they come
+// until stream is closed, timeouts of single response don't apply since stream is idle between events
+func (h *HTTPHandler) streamEvents(r *net.TCPConn, w *net.TCPConn, resp *nhttp.Response, nr *NetHTTPRequest) error {
+	nr.SetHTTPResponse(resp)
+	nr.StopRequest()
+	setReadDeadline(r, 0)
+	setWriteDeadline(w, 0)
+
+	forwarded := &forwardWriter{w: w}
+	defer func() { metrics.ObserveHTTPResponseBytes(nr.isInbound, forwarded.written) }()
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(forwarded)
+	defer writerPool.Put(bufioWriter)
+	resp.Body = &flushingBody{flushingReader: flushingReader{r: resp.Body, w: bufioWriter}, Closer: resp.Body}
+	err := resp.Write(bufioWriter)
+	if flushErr := bufioWriter.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestEventStream(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, proxyIn := tcpConnPair(t)
+	proxyOut, upstream := tcpConnPair(t)
+	defer client.Close()
+	defer upstream.Close()
+	handler := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	netRequest := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+	go func() {
+		handler.HandleRequest(proxyIn, proxyOut, nil, nil, netRequest, false, "127.0.0.1:80")
+		proxyOut.Close()
+	}()
+	go func() {
+		handler.HandleResponse(proxyOut, proxyIn, netRequest, false, false)
+		proxyIn.Close()
+	}()
+
+	next := make(chan struct{})
+	go func() {
+		if _, err := nhttp.ReadRequest(bufio.NewReader(upstream)); err != nil {
+			return
+		}
+		fmt.Fprint(upstream, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream; charset=utf-8\r\n"+
+			"Transfer-Encoding: chunked\r\n\r\n9\r\ndata: 1\n\n\r\n")
+		<-next
+		fmt.Fprint(upstream, "9\r\ndata: 2\n\n\r\n0\r\n\r\n")
+	}()
+
+	if _, err := fmt.Fprint(client, "GET /events HTTP/1.1\r\nHost: upstream\r\nAccept: text/event-stream\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := nhttp.ReadResponse(bufio.NewReader(client), &nhttp.Request{Method: nhttp.MethodGet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := bufio.NewReader(resp.Body)
+	// the first event comes while stream is still open
+	if line, err := events.ReadString('\n'); err != nil || line != "data: 1\n" {
+		t.Fatalf("unexpected event %q, %v", line, err)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 || spans[0].Tag("streaming") != true || spans[0].Tag("http.status_code") != nhttp.StatusOK {
+		t.Fatalf("expected streaming span to be finished, got %v", spans)
+	}
+
+	close(next)
+	events.ReadString('\n')
+	if line, err := events.ReadString('\n'); err != nil || line != "data: 2\n" {
+		t.Fatalf("unexpected event %q, %v", line, err)
+	}
+	if len(tracer.FinishedSpans()) != 1 {
+		t.Fatal("stream end is reported as another span")
+	}
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// setStickyRoute remembers routing directive in format `host=target` to be assigned to client with response
+func (nr *NetHTTPRequest) setStickyRoute(req *nhttp.Request, route string) {
+	nr.stickyMu.Lock()
+	nr.stickyRoutes[req] = route
+	nr.stickyMu.Unlock()
+}
+
+// assignStickyRoute sets routing cookie with route remembered for request,
+// cookie is read by routing logic on subsequent requests as is
+func (nr *NetHTTPRequest) assignStickyRoute(req *nhttp.Request, resp *nhttp.Response) {
+	nr.stickyMu.Lock()
+	route, ok := nr.stickyRoutes[req]
+	if ok {
+		delete(nr.stickyRoutes, req)
+	}
+	nr.stickyMu.Unlock()
+	if !ok {
+		return
+	}
+
+	httpConfig := config.GetHTTPConfig()
+	cookie := &nhttp.Cookie{
+		Name:  httpConfig.RoutingCookieName,
+		Value: route,
+		Path:  httpConfig.RoutingStickyCookiePath,
+	}
+	if ttl := httpConfig.RoutingStickyCookieTTL; ttl > 0 {
+		cookie.MaxAge = int(ttl.Seconds())
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"unicode/utf8"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+)
+
+// truncatedTagSuffix ends tag value cut to max length
+const truncatedTagSuffix = "..."
+
+// setStringTag sets tag with value limited to configured max length,
+// truncated value is marked with `<tag>.truncated` tag
+func setStringTag(span opentracing.Span, key string, value string) {
+	value, truncated := truncateTagValue(value, config.GetNetraConfig().MaxTagValueLength)
+	span.SetTag(key, value)
+	if truncated {
+		span.SetTag(key+".truncated", true)
+	}
+}
+
+// truncateTagValue cuts value longer than maxLength bytes at UTF-8 character boundary,
+// so value with the suffix fits maxLength. Zero maxLength means no limit
+func truncateTagValue(value string, maxLength int) (string, bool) {
+	if maxLength <= 0 || len(value) <= maxLength {
+		return value, false
+	}
+	if maxLength <= len(truncatedTagSuffix) {
+		return truncatedTagSuffix[:maxLength], true
+	}
+	end := maxLength - len(truncatedTagSuffix)
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end] + truncatedTagSuffix, true
+}
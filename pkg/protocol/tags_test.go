@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateTagValue(t *testing.T) {
+	cases := []struct {
+		value     string
+		maxLength int
+		expected  string
+		truncated bool
+	}{
+		{"/api/orders", 0, "/api/orders", false},
+		{"/api/orders", 11, "/api/orders", false},
+		{"/api/orders", 10, "/api/or...", true},
+		{"/api/orders", 2, "..", true},
+		// multibyte characters aren't split
+		{"заказы", 8, "за...", true},
+		{"заказы", 7, "за...", true},
+		{"заказы", 6, "з...", true},
+		{"заказы", 4, "...", true},
+		{"a€b", 4, "a...", true},
+	}
+	for _, c := range cases {
+		actual, truncated := truncateTagValue(c.value, c.maxLength)
+		if actual != c.expected || truncated != c.truncated {
+			t.Fatalf("value %q limited to %d: expected %q (truncated %t), got %q (truncated %t)",
+				c.value, c.maxLength, c.expected, c.truncated, actual, truncated)
+		}
+		if !utf8.ValidString(actual) {
+			t.Fatalf("value %q limited to %d: invalid UTF-8 %q", c.value, c.maxLength, actual)
+		}
+	}
+}
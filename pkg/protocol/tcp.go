@@ -1,7 +1,6 @@
 package protocol
 
 import (
-	"io"
 	"net"
 
 	"github.com/Lookyan/netramesh/pkg/log"
@@ -35,26 +34,30 @@ func (h *TCPHandler) HandleRequest(
 		}
 	}
 
-	buf := bufferPool.Get().([]byte)
-	written, err := io.CopyBuffer(w, r, buf)
-	bufferPool.Put(buf)
+	written, err := copyTCP(w, r)
 	h.logger.Debugf("Written: %d", written)
 	if err != nil {
-		h.logger.Debugf("Err CopyBuffer: %s", err.Error())
+		h.logger.Debugf("Err ReadFrom: %s", err.Error())
 	}
 	return w
 }
 
 func (h *TCPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
-	buf := bufferPool.Get().([]byte)
-	written, err := io.CopyBuffer(w, r, buf)
-	bufferPool.Put(buf)
+	written, err := copyTCP(w, r)
 	h.logger.Debugf("Written: %d", written)
 	if err != nil {
-		h.logger.Debugf("Err CopyBuffer: %s", err.Error())
+		h.logger.Debugf("Err ReadFrom: %s", err.Error())
 	}
 }
 
+// copyTCP copies r to w till EOF. ReadFrom of TCP connection reading another one is done with splice(2)
+// by Go runtime on Linux, so bytes are moved within kernel without being copied through user space buffer,
+// on other platforms ReadFrom falls back to generic copy. Both sides should be *net.TCPConn, wrapped reader
+// or writer (e.g. bufio or counting one) turns it into plain copy
+func copyTCP(w *net.TCPConn, r *net.TCPConn) (int64, error) {
+	return w.ReadFrom(r)
+}
+
 type NetTCPRequest struct {
 }
 
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+const benchmarkCopySize = 32 << 20
+
+// benchmarkCopy measures copy between two proxied TCP connections done by copyFn
+func benchmarkCopy(b *testing.B, copyFn func(w *net.TCPConn, r *net.TCPConn) (int64, error)) {
+	chunk := make([]byte, 64<<10)
+	b.SetBytes(benchmarkCopySize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		client, proxyIn := tcpConnPair(b)
+		proxyOut, upstream := tcpConnPair(b)
+		go func() {
+			for written := 0; written < benchmarkCopySize; written += len(chunk) {
+				if _, err := client.Write(chunk); err != nil {
+					break
+				}
+			}
+			client.Close()
+		}()
+		received := make(chan int64)
+		go func() {
+			n, _ := io.Copy(ioutil.Discard, upstream)
+			received <- n
+		}()
+		b.StartTimer()
+
+		if _, err := copyFn(proxyOut, proxyIn); err != nil {
+			b.Fatal(err)
+		}
+		proxyOut.CloseWrite()
+		if n := <-received; n != benchmarkCopySize {
+			b.Fatalf("expected %d bytes, got %d", benchmarkCopySize, n)
+		}
+
+		b.StopTimer()
+		proxyIn.Close()
+		proxyOut.Close()
+		upstream.Close()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkCopyTCP(b *testing.B) {
+	benchmarkCopy(b, copyTCP)
+}
+
+func BenchmarkCopyBuffer(b *testing.B) {
+	benchmarkCopy(b, func(w *net.TCPConn, r *net.TCPConn) (int64, error) {
+		buf := bufferPool.Get().([]byte)
+		defer bufferPool.Put(buf)
+		// writer hides ReadFrom of connection, so copy goes through buffer
+		return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{r}, buf)
+	})
+}
+
+func TestCopyTCP(t *testing.T) {
+	client, proxyIn := tcpConnPair(t)
+	proxyOut, upstream := tcpConnPair(t)
+	defer proxyIn.Close()
+	defer proxyOut.Close()
+	defer upstream.Close()
+
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	received := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(upstream)
+		received <- b
+	}()
+	written, err := copyTCP(proxyOut, proxyIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyOut.CloseWrite()
+	if got := <-received; written != int64(len(data)) || string(got) != string(data) {
+		t.Fatalf("expected %d bytes to be copied as is, written %d, received %d", len(data), written, len(got))
+	}
+}
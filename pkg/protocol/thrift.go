@@ -0,0 +1,719 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// Thrift message types
+const (
+	thriftCall      byte = 1
+	thriftReply     byte = 2
+	thriftException byte = 3
+	thriftOneway    byte = 4
+)
+
+// first bytes of message begin: strict binary protocol version and compact protocol id
+const (
+	thriftBinaryVersion0 byte = 0x80
+	thriftBinaryVersion1 byte = 0x01
+	thriftCompactID      byte = 0x82
+	thriftCompactVersion byte = 0x01
+)
+
+const (
+	// thriftMaxFrameLen is max frame length of framed transport, longer length means it isn't Thrift framing
+	thriftMaxFrameLen = 16 * 1024 * 1024
+	// thriftInspectLen limits bytes of frame parsed for message begin
+	thriftInspectLen = 1024
+	// thriftMaxNameLen is max length of method name
+	thriftMaxNameLen = 512
+	// thriftMaxDepth is max nesting of structs and containers skipped in unframed message
+	thriftMaxDepth = 64
+)
+
+var errThriftMalformed = errors.New("malformed thrift message")
+
+// ThriftHandler copies Thrift connection as is and reports span for every call,
+// replies are matched to calls by sequence id. Binary and compact protocols are supported
+// over framed and unframed transport, the latter requires skipping the whole message
+type ThriftHandler struct {
+	logger *log.Logger
+}
+
+// NewThriftHandler returns Thrift handler
+func NewThriftHandler(logger *log.Logger) *ThriftHandler {
+	return &ThriftHandler{
+		logger: logger,
+	}
+}
+
+// HandleRequest copies client messages to server
+func (h *ThriftHandler) HandleRequest(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) *net.TCPConn {
+
+	netThriftRequest := netRequest.(*NetThriftRequest)
+	if w == nil {
+		defer close(addrCh)
+		addrCh <- originalDst
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+	}
+	if isInboundConn {
+		netThriftRequest.setRemoteAddr(r.RemoteAddr().String())
+	} else {
+		netThriftRequest.setRemoteAddr(w.RemoteAddr().String())
+	}
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(bufioReader)
+
+	err := h.copyMessages(bufioReader, bufioWriter, func(message thriftMessage) {
+		if message.kind == thriftCall || message.kind == thriftOneway {
+			netThriftRequest.push(message)
+		}
+	})
+	if err == nil || err == io.EOF {
+		err = bufioWriter.Flush()
+	}
+	if err != nil && err != io.EOF {
+		h.logger.Debugf("Err copying Thrift calls: %s", err.Error())
+	}
+	return w
+}
+
+// HandleResponse copies server replies to client
+func (h *ThriftHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	netThriftRequest := netRequest.(*NetThriftRequest)
+	// calls without reply are finished when connection is closed
+	defer netThriftRequest.StopRequest()
+
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	defer writerPool.Put(bufioWriter)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(&flushingReader{r: r, w: bufioWriter})
+	defer readerPool.Put(bufioReader)
+
+	err := h.copyMessages(bufioReader, bufioWriter, func(message thriftMessage) {
+		if message.kind == thriftReply || message.kind == thriftException {
+			if call := netThriftRequest.pop(message.seqID); call != nil {
+				netThriftRequest.finish(call, false, message.kind == thriftException)
+			}
+		}
+	})
+	if err == nil || err == io.EOF {
+		err = bufioWriter.Flush()
+	}
+	if err != nil && err != io.EOF {
+		h.logger.Debugf("Err copying Thrift replies: %s", err.Error())
+	}
+}
+
+// copyMessages forwards messages from r to w, handle is called when message begin is read,
+// before the rest of message is written. Transport and protocol are recognized by the first message
+func (h *ThriftHandler) copyMessages(r *bufio.Reader, w *bufio.Writer, handle func(thriftMessage)) error {
+	first, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	switch first[0] {
+	case thriftBinaryVersion0:
+		return h.copyUnframed(r, w, false, handle)
+	case thriftCompactID:
+		return h.copyUnframed(r, w, true, handle)
+	}
+	prefix, err := r.Peek(6)
+	if err != nil && len(prefix) < 6 {
+		return h.passThrough(r, w)
+	}
+	length := binary.BigEndian.Uint32(prefix)
+	if length == 0 || length > thriftMaxFrameLen || !isThriftMessageStart(prefix[4:]) {
+		return h.passThrough(r, w)
+	}
+	return h.copyFramed(r, w, handle)
+}
+
+// copyFramed forwards frames, message begin is parsed from frame prefix
+func (h *ThriftHandler) copyFramed(r *bufio.Reader, w *bufio.Writer, handle func(thriftMessage)) error {
+	header := make([]byte, 4)
+	prefix := make([]byte, thriftInspectLen)
+	for {
+		n, err := io.ReadFull(r, header)
+		if _, err := w.Write(header[:n]); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length > thriftMaxFrameLen {
+			return h.passThrough(r, w)
+		}
+		n = int(length)
+		if n > thriftInspectLen {
+			n = thriftInspectLen
+		}
+		if _, err := io.ReadFull(r, prefix[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(prefix[:n]); err != nil {
+			return err
+		}
+		if message, err := readThriftMessageBegin(bytes.NewReader(prefix[:n])); err == nil {
+			handle(message)
+		}
+		if _, err := io.CopyN(w, r, int64(int(length)-n)); err != nil {
+			return err
+		}
+	}
+}
+
+// copyUnframed forwards messages which are parsed as they are copied to find where the next one starts,
+// connection is copied as is after the first malformed message
+func (h *ThriftHandler) copyUnframed(r *bufio.Reader, w *bufio.Writer, compact bool, handle func(thriftMessage)) error {
+	tee := &thriftTee{r: r, w: w}
+	for {
+		if _, err := r.Peek(1); err != nil {
+			return err
+		}
+		message, err := readThriftMessageBegin(tee)
+		if err == nil && message.compact != compact {
+			err = errThriftMalformed
+		}
+		if err == nil {
+			handle(message)
+			err = skipThriftStruct(tee, compact, 0)
+		}
+		if err == errThriftMalformed {
+			return h.passThrough(r, w)
+		}
+		if err != nil {
+			if err == io.EOF {
+				// connection can't be closed in the middle of message
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
+
+func (h *ThriftHandler) passThrough(r *bufio.Reader, w *bufio.Writer) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	buf := bufferPool.Get().([]byte)
+	_, err := io.CopyBuffer(w, r, buf)
+	bufferPool.Put(buf)
+	return err
+}
+
+// isThriftMessageStart reports whether prefix starts message begin of binary or compact protocol
+func isThriftMessageStart(prefix []byte) bool {
+	if len(prefix) < 2 {
+		return false
+	}
+	return prefix[0] == thriftBinaryVersion0 && prefix[1] == thriftBinaryVersion1 ||
+		prefix[0] == thriftCompactID && prefix[1]&0x1f == thriftCompactVersion
+}
+
+// isThriftPrefix reports whether prefix starts call of unframed or framed transport
+func isThriftPrefix(prefix []byte) bool {
+	if len(prefix) >= 6 && prefix[0] != thriftBinaryVersion0 && prefix[0] != thriftCompactID {
+		length := binary.BigEndian.Uint32(prefix)
+		if length == 0 || length > thriftMaxFrameLen {
+			return false
+		}
+		prefix = prefix[4:]
+	}
+	if !isThriftMessageStart(prefix) {
+		return false
+	}
+	var kind byte
+	if prefix[0] == thriftCompactID {
+		kind = prefix[1] >> 5
+	} else if len(prefix) >= 4 {
+		kind = prefix[3] & 0x07
+	} else {
+		return false
+	}
+	return kind == thriftCall || kind == thriftOneway
+}
+
+// thriftReader reads encoded values, bytes of unframed message are copied as they are read
+type thriftReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// thriftTee writes every byte read from r to w
+type thriftTee struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (t *thriftTee) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if _, err := t.w.Write(p[:n]); err != nil {
+		return n, err
+	}
+	return n, err
+}
+
+func (t *thriftTee) ReadByte() (byte, error) {
+	b, err := t.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	return b, t.w.WriteByte(b)
+}
+
+// thriftMessage is message begin: method name, message type and sequence id
+type thriftMessage struct {
+	name    string
+	kind    byte
+	seqID   int32
+	compact bool
+}
+
+// readThriftMessageBegin reads message begin of strict binary or compact protocol
+func readThriftMessageBegin(r thriftReader) (thriftMessage, error) {
+	var message thriftMessage
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return message, err
+	}
+	var nameLen uint64
+	switch {
+	case head[0] == thriftBinaryVersion0 && head[1] == thriftBinaryVersion1:
+		fields := make([]byte, 6)
+		if _, err := io.ReadFull(r, fields); err != nil {
+			return message, err
+		}
+		message.kind = fields[1] & 0x07
+		nameLen = uint64(binary.BigEndian.Uint32(fields[2:]))
+	case head[0] == thriftCompactID && head[1]&0x1f == thriftCompactVersion:
+		message.compact = true
+		message.kind = head[1] >> 5
+		seqID, err := readVarint(r)
+		if err != nil {
+			return message, err
+		}
+		message.seqID = int32(seqID)
+		if nameLen, err = readVarint(r); err != nil {
+			return message, err
+		}
+	default:
+		return message, errThriftMalformed
+	}
+	if nameLen > thriftMaxNameLen || message.kind < thriftCall || message.kind > thriftOneway {
+		return message, errThriftMalformed
+	}
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return message, err
+	}
+	message.name = string(name)
+	if !message.compact {
+		seqID := make([]byte, 4)
+		if _, err := io.ReadFull(r, seqID); err != nil {
+			return message, err
+		}
+		message.seqID = int32(binary.BigEndian.Uint32(seqID))
+	}
+	return message, nil
+}
+
+// readVarint reads unsigned LEB128 varint of compact protocol
+func readVarint(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, errThriftMalformed
+}
+
+// binary protocol field types
+const (
+	thriftBinaryStop   byte = 0
+	thriftBinaryBool   byte = 2
+	thriftBinaryByte   byte = 3
+	thriftBinaryDouble byte = 4
+	thriftBinaryI16    byte = 6
+	thriftBinaryI32    byte = 8
+	thriftBinaryI64    byte = 10
+	thriftBinaryString byte = 11
+	thriftBinaryStruct byte = 12
+	thriftBinaryMap    byte = 13
+	thriftBinarySet    byte = 14
+	thriftBinaryList   byte = 15
+	thriftBinaryUUID   byte = 16
+)
+
+// compact protocol field types, boolean field carries its value in type
+const (
+	thriftCompactStop   byte = 0
+	thriftCompactTrue   byte = 1
+	thriftCompactFalse  byte = 2
+	thriftCompactByte   byte = 3
+	thriftCompactI16    byte = 4
+	thriftCompactI32    byte = 5
+	thriftCompactI64    byte = 6
+	thriftCompactDouble byte = 7
+	thriftCompactBinary byte = 8
+	thriftCompactList   byte = 9
+	thriftCompactSet    byte = 10
+	thriftCompactMap    byte = 11
+	thriftCompactStruct byte = 12
+	thriftCompactUUID   byte = 13
+)
+
+// skipThriftStruct reads struct up to its stop field
+func skipThriftStruct(r thriftReader, compact bool, depth int) error {
+	if depth > thriftMaxDepth {
+		return errThriftMalformed
+	}
+	for {
+		fieldType, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if compact {
+			if fieldType == thriftCompactStop {
+				return nil
+			}
+			// zero delta means that field id follows as zigzag varint
+			if fieldType>>4 == 0 {
+				if _, err := readVarint(r); err != nil {
+					return err
+				}
+			}
+			if err := skipCompactValue(r, fieldType&0x0f, false, depth); err != nil {
+				return err
+			}
+			continue
+		}
+		if fieldType == thriftBinaryStop {
+			return nil
+		}
+		if err := skipBytes(r, 2); err != nil {
+			return err
+		}
+		if err := skipBinaryValue(r, fieldType, depth); err != nil {
+			return err
+		}
+	}
+}
+
+func skipBinaryValue(r thriftReader, valueType byte, depth int) error {
+	if size := binaryFixedSize(valueType); size > 0 {
+		return skipBytes(r, int64(size))
+	}
+	switch valueType {
+	case thriftBinaryString:
+		length, err := readBinaryLength(r)
+		if err != nil {
+			return err
+		}
+		return skipBytes(r, length)
+	case thriftBinaryStruct:
+		return skipThriftStruct(r, false, depth+1)
+	case thriftBinaryMap:
+		types := make([]byte, 2)
+		if _, err := io.ReadFull(r, types); err != nil {
+			return err
+		}
+		size, err := readBinaryLength(r)
+		if err != nil {
+			return err
+		}
+		return skipElements(size, depth, func() error {
+			if err := skipBinaryValue(r, types[0], depth+1); err != nil {
+				return err
+			}
+			return skipBinaryValue(r, types[1], depth+1)
+		})
+	case thriftBinarySet, thriftBinaryList:
+		elementType, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		size, err := readBinaryLength(r)
+		if err != nil {
+			return err
+		}
+		if elementSize := binaryFixedSize(elementType); elementSize > 0 {
+			return skipBytes(r, size*int64(elementSize))
+		}
+		return skipElements(size, depth, func() error { return skipBinaryValue(r, elementType, depth+1) })
+	}
+	return errThriftMalformed
+}
+
+// binaryFixedSize returns encoded size of fixed size type, it's 0 for the other types
+func binaryFixedSize(valueType byte) int {
+	switch valueType {
+	case thriftBinaryBool, thriftBinaryByte:
+		return 1
+	case thriftBinaryI16:
+		return 2
+	case thriftBinaryI32:
+		return 4
+	case thriftBinaryDouble, thriftBinaryI64:
+		return 8
+	case thriftBinaryUUID:
+		return 16
+	}
+	return 0
+}
+
+func readBinaryLength(r thriftReader) (int64, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	length := int32(binary.BigEndian.Uint32(b))
+	if length < 0 || length > thriftMaxFrameLen {
+		return 0, errThriftMalformed
+	}
+	return int64(length), nil
+}
+
+// skipCompactValue reads value of type, boolean element of container takes a byte unlike boolean field
+func skipCompactValue(r thriftReader, valueType byte, element bool, depth int) error {
+	switch valueType {
+	case thriftCompactTrue, thriftCompactFalse:
+		if element {
+			return skipBytes(r, 1)
+		}
+		return nil
+	case thriftCompactByte:
+		return skipBytes(r, 1)
+	case thriftCompactI16, thriftCompactI32, thriftCompactI64:
+		_, err := readVarint(r)
+		return err
+	case thriftCompactDouble:
+		return skipBytes(r, 8)
+	case thriftCompactUUID:
+		return skipBytes(r, 16)
+	case thriftCompactBinary:
+		length, err := readCompactLength(r)
+		if err != nil {
+			return err
+		}
+		return skipBytes(r, length)
+	case thriftCompactStruct:
+		return skipThriftStruct(r, true, depth+1)
+	case thriftCompactList, thriftCompactSet:
+		header, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		size := int64(header >> 4)
+		// size which doesn't fit into header follows it
+		if size == 15 {
+			if size, err = readCompactLength(r); err != nil {
+				return err
+			}
+		}
+		elementType := header & 0x0f
+		return skipElements(size, depth, func() error { return skipCompactValue(r, elementType, true, depth+1) })
+	case thriftCompactMap:
+		size, err := readCompactLength(r)
+		if err != nil || size == 0 {
+			return err
+		}
+		types, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		return skipElements(size, depth, func() error {
+			if err := skipCompactValue(r, types>>4, true, depth+1); err != nil {
+				return err
+			}
+			return skipCompactValue(r, types&0x0f, true, depth+1)
+		})
+	}
+	return errThriftMalformed
+}
+
+func readCompactLength(r thriftReader) (int64, error) {
+	length, err := readVarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if length > thriftMaxFrameLen {
+		return 0, errThriftMalformed
+	}
+	return int64(length), nil
+}
+
+func skipElements(size int64, depth int, skip func() error) error {
+	if depth >= thriftMaxDepth {
+		return errThriftMalformed
+	}
+	for i := int64(0); i < size; i++ {
+		if err := skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func skipBytes(r thriftReader, n int64) error {
+	if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// thriftPendingCall is traced call waiting for reply
+type thriftPendingCall struct {
+	name      string
+	seqID     int32
+	startTime time.Time
+}
+
+// NetThriftRequest keeps state of single Thrift connection, calls are matched to replies by sequence id.
+// Some clients send every call with the same sequence id, so calls of the same id are answered in order
+type NetThriftRequest struct {
+	isInbound bool
+	logger    *log.Logger
+
+	mu         sync.Mutex
+	remoteAddr string
+	pending    map[int32][]*thriftPendingCall
+}
+
+// NewNetThriftRequest returns state of Thrift connection accepted now
+func NewNetThriftRequest(logger *log.Logger, isInbound bool) *NetThriftRequest {
+	return &NetThriftRequest{
+		isInbound: isInbound,
+		logger:    logger,
+		pending:   make(map[int32][]*thriftPendingCall),
+	}
+}
+
+// StartRequest does nothing, calls are started when they are sent
+func (nr *NetThriftRequest) StartRequest() {}
+
+// StopRequest finishes calls which didn't get reply
+func (nr *NetThriftRequest) StopRequest() {
+	nr.mu.Lock()
+	pending := nr.pending
+	nr.pending = make(map[int32][]*thriftPendingCall)
+	nr.mu.Unlock()
+	for _, calls := range pending {
+		for _, call := range calls {
+			nr.finish(call, true, false)
+		}
+	}
+}
+
+// CleanUp does nothing, calls are finished when connection is closed
+func (nr *NetThriftRequest) CleanUp() {}
+
+func (nr *NetThriftRequest) setRemoteAddr(remoteAddr string) {
+	nr.mu.Lock()
+	nr.remoteAddr = remoteAddr
+	nr.mu.Unlock()
+}
+
+func (nr *NetThriftRequest) getRemoteAddr() string {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	return nr.remoteAddr
+}
+
+// push queues call waiting for reply, oneway call is finished right away
+func (nr *NetThriftRequest) push(message thriftMessage) {
+	call := &thriftPendingCall{
+		name:      message.name,
+		seqID:     message.seqID,
+		startTime: time.Now(),
+	}
+	if message.kind == thriftOneway {
+		nr.finish(call, false, false)
+		return
+	}
+	nr.mu.Lock()
+	nr.pending[call.seqID] = append(nr.pending[call.seqID], call)
+	nr.mu.Unlock()
+}
+
+// pop returns the oldest call of sequence id and forgets it
+func (nr *NetThriftRequest) pop(seqID int32) *thriftPendingCall {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	calls := nr.pending[seqID]
+	if len(calls) == 0 {
+		return nil
+	}
+	if len(calls) == 1 {
+		delete(nr.pending, seqID)
+	} else {
+		nr.pending[seqID] = calls[1:]
+	}
+	return calls[0]
+}
+
+// finish reports call span, timeout is set for call without reply and exception for EXCEPTION reply
+func (nr *NetThriftRequest) finish(call *thriftPendingCall, timeout bool, exception bool) {
+	span := opentracing.StartSpan(call.name, opentracing.StartTime(call.startTime))
+	if nr.isInbound {
+		span.SetTag("span.kind", "server")
+	} else {
+		span.SetTag("span.kind", "client")
+	}
+	span.SetTag("remote_addr", nr.getRemoteAddr())
+	span.SetTag("rpc.system", "thrift")
+	// multiplexed protocol prefixes method with service name
+	method := call.name
+	if i := strings.IndexByte(method, ':'); i >= 0 {
+		setStringTag(span, "rpc.service", method[:i])
+		method = method[i+1:]
+	}
+	setStringTag(span, "rpc.method", method)
+	if timeout {
+		span.SetTag("error", true)
+		span.SetTag("timeout", true)
+	}
+	if exception {
+		span.SetTag("error", true)
+	}
+	span.Finish()
+}
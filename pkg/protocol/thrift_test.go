@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// thriftBinaryMessage builds strict binary message with args struct of string, list of structs and map fields
+func thriftBinaryMessage(kind byte, name string, seqID int32) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{thriftBinaryVersion0, thriftBinaryVersion1, 0, kind})
+	binary.Write(&b, binary.BigEndian, int32(len(name)))
+	b.WriteString(name)
+	binary.Write(&b, binary.BigEndian, seqID)
+	// 1: string
+	b.Write([]byte{thriftBinaryString, 0, 1})
+	binary.Write(&b, binary.BigEndian, int32(5))
+	b.WriteString("alice")
+	// 2: list<struct{1: i64, 2: bool}>
+	b.Write([]byte{thriftBinaryList, 0, 2, thriftBinaryStruct})
+	binary.Write(&b, binary.BigEndian, int32(2))
+	for i := 0; i < 2; i++ {
+		b.Write([]byte{thriftBinaryI64, 0, 1, 0, 0, 0, 0, 0, 0, 0, byte(i)})
+		b.Write([]byte{thriftBinaryBool, 0, 2, 1})
+		b.WriteByte(thriftBinaryStop)
+	}
+	// 3: map<i32, string>
+	b.Write([]byte{thriftBinaryMap, 0, 3, thriftBinaryI32, thriftBinaryString})
+	binary.Write(&b, binary.BigEndian, int32(1))
+	b.Write([]byte{0, 0, 0, 7, 0, 0, 0, 2, 'o', 'k'})
+	b.WriteByte(thriftBinaryStop)
+	return b.Bytes()
+}
+
+// thriftCompactMessage builds compact message with args struct of binary, bool, list and map fields
+func thriftCompactMessage(kind byte, name string, seqID int32) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{thriftCompactID, kind<<5 | thriftCompactVersion, byte(seqID)})
+	b.WriteByte(byte(len(name)))
+	b.WriteString(name)
+	// 1: binary, field id delta is 1
+	b.Write([]byte{1<<4 | thriftCompactBinary, 5})
+	b.WriteString("alice")
+	// 2: bool true carried in type
+	b.WriteByte(1<<4 | thriftCompactTrue)
+	// 3: list<bool> of 2 elements, a byte each
+	b.Write([]byte{1<<4 | thriftCompactList, 2<<4 | thriftCompactTrue, 1, 2})
+	// 20: map<i32, struct{1: i64}> with long field id delta written as zigzag varint
+	b.Write([]byte{thriftCompactMap, 40, 1, thriftCompactI32<<4 | thriftCompactStruct, 14})
+	b.Write([]byte{1<<4 | thriftCompactI64, 0x80, 0x01, thriftCompactStop})
+	b.WriteByte(thriftCompactStop)
+	return b.Bytes()
+}
+
+func thriftFramed(message []byte) []byte {
+	frame := make([]byte, 4, 4+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	return append(frame, message...)
+}
+
+func TestThriftSpans(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		message func(kind byte, name string, seqID int32) []byte
+		framed  bool
+	}{
+		{"binary", thriftBinaryMessage, false},
+		{"framed binary", thriftBinaryMessage, true},
+		{"compact", thriftCompactMessage, false},
+		{"framed compact", thriftCompactMessage, true},
+	} {
+		tracer := mocktracer.New()
+		opentracing.SetGlobalTracer(tracer)
+		logger, err := log.Init("test", "error", os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := NewThriftHandler(logger)
+		nr := NewNetThriftRequest(logger, false)
+		message := func(kind byte, name string, seqID int32) []byte {
+			if c.framed {
+				return thriftFramed(c.message(kind, name, seqID))
+			}
+			return c.message(kind, name, seqID)
+		}
+
+		var client bytes.Buffer
+		client.Write(message(thriftCall, "getUser", 1))
+		client.Write(message(thriftOneway, "Users:ping", 2))
+		client.Write(message(thriftCall, "Users:deleteUser", 3))
+		client.Write(message(thriftCall, "listUsers", 4))
+		var forwarded bytes.Buffer
+		w := bufio.NewWriter(&forwarded)
+		if err := h.copyMessages(bufio.NewReader(bytes.NewReader(client.Bytes())), w, func(m thriftMessage) {
+			if m.kind == thriftCall || m.kind == thriftOneway {
+				nr.push(m)
+			}
+		}); err != io.EOF {
+			t.Fatalf("%s: expected EOF, got %v", c.name, err)
+		}
+		w.Flush()
+		if !bytes.Equal(forwarded.Bytes(), client.Bytes()) {
+			t.Fatalf("%s: client messages aren't copied as is", c.name)
+		}
+
+		var server bytes.Buffer
+		server.Write(message(thriftException, "Users:deleteUser", 3))
+		server.Write(message(thriftReply, "getUser", 1))
+		forwarded.Reset()
+		w.Reset(&forwarded)
+		if err := h.copyMessages(bufio.NewReader(bytes.NewReader(server.Bytes())), w, func(m thriftMessage) {
+			if call := nr.pop(m.seqID); call != nil {
+				nr.finish(call, false, m.kind == thriftException)
+			}
+		}); err != io.EOF {
+			t.Fatalf("%s: expected EOF, got %v", c.name, err)
+		}
+		w.Flush()
+		if !bytes.Equal(forwarded.Bytes(), server.Bytes()) {
+			t.Fatalf("%s: server messages aren't copied as is", c.name)
+		}
+		// listUsers is left without reply
+		nr.StopRequest()
+
+		spans := tracer.FinishedSpans()
+		expected := []struct {
+			operation string
+			service   interface{}
+			method    string
+			failed    bool
+		}{
+			{"Users:ping", "Users", "ping", false},
+			{"Users:deleteUser", "Users", "deleteUser", true},
+			{"getUser", nil, "getUser", false},
+			{"listUsers", nil, "listUsers", true},
+		}
+		if len(spans) != len(expected) {
+			t.Fatalf("%s: expected %d spans, got %d", c.name, len(expected), len(spans))
+		}
+		for i, e := range expected {
+			span := spans[i]
+			tags := span.Tags()
+			if span.OperationName != e.operation || tags["rpc.system"] != "thrift" || tags["rpc.method"] != e.method ||
+				tags["rpc.service"] != e.service || (tags["error"] == true) != e.failed {
+				t.Fatalf("%s: span %d: unexpected span %s %v", c.name, i, span.OperationName, tags)
+			}
+		}
+		if spans[3].Tag("timeout") != true {
+			t.Fatalf("%s: unexpected listUsers tags %v", c.name, spans[3].Tags())
+		}
+	}
+	opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+}
+
+func TestThriftSameSequenceIDAnsweredInOrder(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nr := NewNetThriftRequest(logger, false)
+	nr.push(thriftMessage{name: "first", kind: thriftCall})
+	nr.push(thriftMessage{name: "second", kind: thriftCall})
+	for _, expected := range []string{"first", "second"} {
+		if call := nr.pop(0); call == nil || call.name != expected {
+			t.Fatalf("expected %s call, got %v", expected, call)
+		}
+	}
+	if call := nr.pop(0); call != nil {
+		t.Fatalf("unexpected call %v", call)
+	}
+}
+
+func TestThriftOtherProtocolPassedThrough(t *testing.T) {
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewThriftHandler(logger)
+	for _, data := range [][]byte{
+		[]byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00\x00\x00\x00\x00\x00\x00\x00"),
+		// unframed binary message with unknown field type
+		append(thriftBinaryMessage(thriftCall, "getUser", 1)[:19], 0x7f, 0, 1, 0, 0),
+	} {
+		var forwarded bytes.Buffer
+		w := bufio.NewWriter(&forwarded)
+		if err := h.copyMessages(bufio.NewReader(bytes.NewReader(data)), w, func(thriftMessage) {}); err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+		if !bytes.Equal(forwarded.Bytes(), data) {
+			t.Fatalf("expected %q, got %q", data, forwarded.Bytes())
+		}
+	}
+	if isThriftPrefix([]byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00\x00\x00\x00\x00")) {
+		t.Fatal("TLS handshake is recognized as Thrift")
+	}
+	if isThriftPrefix(thriftBinaryMessage(thriftReply, "getUser", 1)) {
+		t.Fatal("reply is recognized as Thrift call")
+	}
+	for _, call := range [][]byte{
+		thriftBinaryMessage(thriftCall, "getUser", 1),
+		thriftCompactMessage(thriftCall, "getUser", 1),
+		thriftFramed(thriftBinaryMessage(thriftCall, "getUser", 1)),
+		thriftFramed(thriftCompactMessage(thriftCall, "getUser", 1)),
+	} {
+		if !isThriftPrefix(call[:sniffPrefixLength]) {
+			t.Fatalf("call %q isn't recognized as Thrift", call[:sniffPrefixLength])
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// routeTimeouts returns timeouts of request path, global ones are overridden by the longest matching prefix.
+// It returns false if there is no matching prefix
+func routeTimeouts(httpConfig config.HTTPConfig, path string) (config.RouteTimeouts, bool) {
+	timeouts := config.RouteTimeouts{Read: httpConfig.ReadTimeout, Write: httpConfig.WriteTimeout}
+	var route config.RouteTimeouts
+	matched := -1
+	for prefix, prefixTimeouts := range httpConfig.RouteTimeouts {
+		if len(prefix) > matched && strings.HasPrefix(path, prefix) {
+			route = prefixTimeouts
+			matched = len(prefix)
+		}
+	}
+	if matched < 0 {
+		return timeouts, false
+	}
+	if route.Read != config.InheritTimeout {
+		timeouts.Read = route.Read
+	}
+	if route.Write != config.InheritTimeout {
+		timeouts.Write = route.Write
+	}
+	timeouts.Total = route.Total
+	return timeouts, true
+}
+
+// setTimeouts applies timeouts of request route once its head is read, total timeout counts from now
+func (nr *NetHTTPRequest) setTimeouts(req *nhttp.Request, timeouts config.RouteTimeouts) {
+	nr.timingsMu.Lock()
+	defer nr.timingsMu.Unlock()
+	timing := nr.timing(req)
+	timing.timeouts, timing.timeoutsSet = timeouts, true
+	if timeouts.Total > 0 {
+		timing.deadline = time.Now().Add(timeouts.Total)
+	}
+}
+
+// requestTimeouts returns timeouts of request and its total deadline, zero deadline means there is none.
+// Global timeouts are returned for request without route timeouts set
+func (nr *NetHTTPRequest) requestTimeouts(req *nhttp.Request) (config.RouteTimeouts, time.Time) {
+	nr.timingsMu.Lock()
+	defer nr.timingsMu.Unlock()
+	if timing, ok := nr.timings[req]; ok && timing.timeoutsSet {
+		return timing.timeouts, timing.deadline
+	}
+	httpConfig := config.GetHTTPConfig()
+	return config.RouteTimeouts{Read: httpConfig.ReadTimeout, Write: httpConfig.WriteTimeout}, time.Time{}
+}
+
+// timeoutDeadline returns the earlier of timeout from now and total deadline, zero values mean no limit
+func timeoutDeadline(timeout time.Duration, total time.Time) time.Time {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if !total.IsZero() && (deadline.IsZero() || total.Before(deadline)) {
+		deadline = total
+	}
+	return deadline
+}
+
+// setRequestReadDeadline limits read of request or its response with read timeout and total deadline of request
+func (nr *NetHTTPRequest) setRequestReadDeadline(conn *net.TCPConn, req *nhttp.Request) {
+	timeouts, total := nr.requestTimeouts(req)
+	conn.SetReadDeadline(timeoutDeadline(timeouts.Read, total))
+}
+
+// setRequestWriteDeadline limits write of request or its response with write timeout and total deadline of request
+func (nr *NetHTTPRequest) setRequestWriteDeadline(conn *net.TCPConn, req *nhttp.Request) {
+	timeouts, total := nr.requestTimeouts(req)
+	conn.SetWriteDeadline(timeoutDeadline(timeouts.Write, total))
+}
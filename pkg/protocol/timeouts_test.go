@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Lookyan/netramesh/internal/config"
+)
+
+func TestRouteTimeouts(t *testing.T) {
+	httpConfig := config.HTTPConfig{
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: time.Second,
+		RouteTimeouts: map[string]config.RouteTimeouts{
+			"/reports":      {Read: time.Minute, Write: config.InheritTimeout, Total: 2 * time.Minute},
+			"/reports/poll": {Read: 0, Write: config.InheritTimeout},
+		},
+	}
+	tests := []struct {
+		path     string
+		timeouts config.RouteTimeouts
+		ok       bool
+	}{
+		{"/orders", config.RouteTimeouts{Read: 5 * time.Second, Write: time.Second}, false},
+		{"/reports/daily", config.RouteTimeouts{Read: time.Minute, Write: time.Second, Total: 2 * time.Minute}, true},
+		{"/reports/poll", config.RouteTimeouts{Read: 0, Write: time.Second}, true},
+	}
+	for _, tt := range tests {
+		timeouts, ok := routeTimeouts(httpConfig, tt.path)
+		if timeouts != tt.timeouts || ok != tt.ok {
+			t.Fatalf("%s: expected %+v %t, got %+v %t", tt.path, tt.timeouts, tt.ok, timeouts, ok)
+		}
+	}
+}
+
+func TestTimeoutDeadline(t *testing.T) {
+	total := time.Now().Add(time.Second)
+	if deadline := timeoutDeadline(time.Minute, total); !deadline.Equal(total) {
+		t.Fatalf("expected total deadline, got %s", deadline)
+	}
+	if deadline := timeoutDeadline(0, total); !deadline.Equal(total) {
+		t.Fatalf("expected total deadline without read timeout, got %s", deadline)
+	}
+	if deadline := timeoutDeadline(time.Millisecond, total); !deadline.Before(total) {
+		t.Fatalf("expected read timeout deadline, got %s", deadline)
+	}
+	if deadline := timeoutDeadline(0, time.Time{}); !deadline.IsZero() {
+		t.Fatalf("expected no deadline, got %s", deadline)
+	}
+}
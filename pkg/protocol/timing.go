@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// requestTiming breaks request duration down into waiting for upstream connection and for response
+type requestTiming struct {
+	// connectTime is wait for upstream connection, it's known for requests dialed by routing logic only
+	connectTime time.Duration
+	connected   bool
+	// sentAt is when request was written to upstream, time to first byte counts from it
+	sentAt    time.Time
+	ttfb      time.Duration
+	firstByte bool
+	// timeouts of request route and deadline of its total timeout
+	timeouts    config.RouteTimeouts
+	timeoutsSet bool
+	deadline    time.Time
+}
+
+func (nr *NetHTTPRequest) timing(req *nhttp.Request) *requestTiming {
+	timing, ok := nr.timings[req]
+	if !ok {
+		timing = &requestTiming{}
+		nr.timings[req] = timing
+	}
+	return timing
+}
+
+// setConnectTime remembers how long request waited for upstream connection
+func (nr *NetHTTPRequest) setConnectTime(req *nhttp.Request, connectTime time.Duration) {
+	nr.timingsMu.Lock()
+	defer nr.timingsMu.Unlock()
+	timing := nr.timing(req)
+	timing.connectTime, timing.connected = connectTime, true
+}
+
+// setRequestSent remembers when request was written to upstream, replayed request is timed from its last attempt
+func (nr *NetHTTPRequest) setRequestSent(req *nhttp.Request) {
+	nr.timingsMu.Lock()
+	defer nr.timingsMu.Unlock()
+	timing := nr.timing(req)
+	timing.sentAt, timing.firstByte = time.Now(), false
+}
+
+// setFirstByte remembers time to first byte of response when response head is read,
+// response coming before request is written (e.g. 100 Continue) isn't timed
+func (nr *NetHTTPRequest) setFirstByte(req *nhttp.Request) {
+	nr.timingsMu.Lock()
+	defer nr.timingsMu.Unlock()
+	timing, ok := nr.timings[req]
+	if !ok || timing.sentAt.IsZero() || timing.firstByte {
+		return
+	}
+	timing.ttfb, timing.firstByte = time.Since(timing.sentAt), true
+}
+
+// popTiming returns timing of request and forgets it
+func (nr *NetHTTPRequest) popTiming(req *nhttp.Request) (*requestTiming, bool) {
+	nr.timingsMu.Lock()
+	defer nr.timingsMu.Unlock()
+	timing, ok := nr.timings[req]
+	if ok {
+		delete(nr.timings, req)
+	}
+	return timing, ok
+}
+
+// tagTiming sets connect_time_ms and ttfb_ms tags of request span
+func (nr *NetHTTPRequest) tagTiming(span opentracing.Span, req *nhttp.Request) {
+	timing, ok := nr.popTiming(req)
+	if !ok {
+		return
+	}
+	if timing.connected {
+		span.SetTag("connect_time_ms", durationMilliseconds(timing.connectTime))
+	}
+	if timing.firstByte {
+		span.SetTag("ttfb_ms", durationMilliseconds(timing.ttfb))
+	}
+}
+
+func durationMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
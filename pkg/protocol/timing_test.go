@@ -0,0 +1,22 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectTimeAndTTFBTagged(t *testing.T) {
+	// routing mode without hedge rules sends request over single connection
+	_, body, span, _ := proxyHedged(t, 50*time.Millisecond)
+	if body != "slow" {
+		t.Fatalf("unexpected response body %q", body)
+	}
+	connectTime, ok := span.Tag("connect_time_ms").(float64)
+	if !ok || connectTime < 0 {
+		t.Fatalf("expected connect_time_ms tag, got %v", span.Tag("connect_time_ms"))
+	}
+	ttfb, ok := span.Tag("ttfb_ms").(float64)
+	if !ok || ttfb < 50 {
+		t.Fatalf("expected ttfb_ms tag of at least 50, got %v", span.Tag("ttfb_ms"))
+	}
+}
@@ -0,0 +1,265 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+const (
+	tlsRecordHeaderLength = 5
+	tlsRecordHandshake    = 0x16
+	// tlsMaxRecordLength is max length of plaintext record, ClientHello is never encrypted
+	tlsMaxRecordLength      = 1 << 14
+	tlsHandshakeClientHello = 0x01
+	tlsExtensionServerName  = 0x0000
+	tlsServerNameHostName   = 0x00
+)
+
+var (
+	errNotClientHello        = errors.New("connection doesn't start with TLS ClientHello")
+	errMalformedClientHello  = errors.New("malformed TLS ClientHello")
+	errFragmentedClientHello = errors.New("TLS ClientHello doesn't fit in the first record")
+)
+
+// TLSHandler passes TLS connections through without terminating them,
+// outbound connection is routed by server name client sends in ClientHello
+type TLSHandler struct {
+	logger *log.Logger
+	rules  []*routingRule
+}
+
+// NewTLSHandler returns TLS handler routing by configured SNI routes, connections aren't routed if they're malformed
+func NewTLSHandler(logger *log.Logger) *TLSHandler {
+	h := &TLSHandler{
+		logger: logger,
+	}
+	if routes := config.GetNetraConfig().TLSSNIRoutes; routes != "" {
+		rules, err := parseSNIRoutingRules(routes)
+		if err != nil {
+			logger.Errorf("SNI routes are ignored: %s", err.Error())
+		}
+		h.rules = rules
+	}
+	return h
+}
+
+// parseSNIRoutingRules parses legacy routing rules of server names, rules can't have path or mirror
+func parseSNIRoutingRules(value string) ([]*routingRule, error) {
+	rules, err := parseRoutingRules(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.match != nil || rule.mirror != "" {
+			return nil, fmt.Errorf("SNI route can't have path or mirror: '%s'", value)
+		}
+		if err := rule.validateTargets(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// HandleRequest reads ClientHello, routes connection by its server name and copies client side of connection
+// to upstream starting with ClientHello bytes
+func (h *TLSHandler) HandleRequest(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) *net.TCPConn {
+
+	netPassthroughRequest := netRequest.(*NetPassthroughRequest)
+	var hello []byte
+	if w == nil {
+		defer close(addrCh)
+		var sni string
+		var err error
+		if timeout := config.GetNetraConfig().ProtocolSniffTimeout; timeout > 0 {
+			r.SetReadDeadline(time.Now().Add(timeout))
+		}
+		hello, sni, err = readClientHello(r)
+		r.SetReadDeadline(time.Time{})
+		if err != nil {
+			h.logger.Debugf("Server name of TLS connection to %s isn't read: %s", originalDst, err.Error())
+		}
+		routed := routedRequest{addr: originalDst, originalDst: originalDst, source: routingSourceSNI}
+		if !isInboundConn && sni != "" {
+			routed.addr = h.route(sni, originalDst)
+		}
+		netPassthroughRequest.setTLS(sni, routed)
+		addrCh <- routed.addr
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+		if _, err := w.Write(hello); err != nil {
+			h.logger.Debugf("Err writing ClientHello: %s", err.Error())
+			return w
+		}
+	}
+	if isInboundConn {
+		netPassthroughRequest.setConnection(originalDst, r.RemoteAddr().String())
+	} else {
+		netPassthroughRequest.setConnection(originalDst, w.RemoteAddr().String())
+	}
+
+	written, err := copyTCP(w, r)
+	if err != nil {
+		h.logger.Debugf("Err ReadFrom: %s", err.Error())
+	}
+	netPassthroughRequest.stopDirection(true, int64(len(hello))+written)
+	return w
+}
+
+// HandleResponse copies upstream side of connection to client
+func (h *TLSHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	written, err := copyTCP(w, r)
+	if err != nil {
+		h.logger.Debugf("Err ReadFrom: %s", err.Error())
+	}
+	netRequest.(*NetPassthroughRequest).stopDirection(false, written)
+}
+
+// route returns destination of server name, target without port gets port of original destination
+func (h *TLSHandler) route(sni string, originalDst string) string {
+	_, target, ok := pickRoutingRule(h.rules, sni, func(*routingRule) bool { return true }, nil)
+	if !ok {
+		return originalDst
+	}
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	_, port, err := net.SplitHostPort(originalDst)
+	if err != nil {
+		return withDefaultPort(target)
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(target, "["), "]"), port)
+}
+
+// isTLSPrefix reports whether prefix starts TLS handshake record with ClientHello
+func isTLSPrefix(prefix []byte) bool {
+	return len(prefix) > tlsRecordHeaderLength && prefix[0] == tlsRecordHandshake && prefix[1] == 0x03 &&
+		prefix[2] <= 0x04 && prefix[tlsRecordHeaderLength] == tlsHandshakeClientHello
+}
+
+// readClientHello reads the first TLS record and returns server name of ClientHello it carries.
+// Bytes read are returned even on error, they should be forwarded as the connection start
+func readClientHello(r io.Reader) ([]byte, string, error) {
+	record := make([]byte, tlsRecordHeaderLength)
+	if n, err := io.ReadFull(r, record); err != nil {
+		return record[:n], "", err
+	}
+	length := int(binary.BigEndian.Uint16(record[3:]))
+	if record[0] != tlsRecordHandshake || record[1] != 0x03 || length > tlsMaxRecordLength {
+		return record, "", errNotClientHello
+	}
+	record = append(record, make([]byte, length)...)
+	if n, err := io.ReadFull(r, record[tlsRecordHeaderLength:]); err != nil {
+		return record[:tlsRecordHeaderLength+n], "", err
+	}
+	sni, err := parseClientHelloSNI(record[tlsRecordHeaderLength:])
+	return record, sni, err
+}
+
+// tlsCursor reads fields of handshake message
+type tlsCursor []byte
+
+// next returns the following n bytes
+func (c *tlsCursor) next(n int) ([]byte, bool) {
+	if len(*c) < n {
+		return nil, false
+	}
+	b := (*c)[:n]
+	*c = (*c)[n:]
+	return b, true
+}
+
+// vector returns the following vector of lengthSize bytes long length
+func (c *tlsCursor) vector(lengthSize int) (tlsCursor, bool) {
+	b, ok := c.next(lengthSize)
+	if !ok {
+		return nil, false
+	}
+	length := 0
+	for _, v := range b {
+		length = length<<8 | int(v)
+	}
+	v, ok := c.next(length)
+	return v, ok
+}
+
+// parseClientHelloSNI returns host name of server name extension of ClientHello handshake message,
+// it's empty if client hasn't sent it
+func parseClientHelloSNI(handshake []byte) (string, error) {
+	c := tlsCursor(handshake)
+	if t, ok := c.next(1); !ok || t[0] != tlsHandshakeClientHello {
+		return "", errNotClientHello
+	}
+	if len(c) >= 3 && int(c[0])<<16|int(c[1])<<8|int(c[2]) > len(c)-3 {
+		return "", errFragmentedClientHello
+	}
+	hello, ok := c.vector(3)
+	if !ok {
+		return "", errMalformedClientHello
+	}
+	// version and random
+	if _, ok := hello.next(2 + 32); !ok {
+		return "", errMalformedClientHello
+	}
+	// session id, cipher suites and compression methods
+	for _, lengthSize := range []int{1, 2, 1} {
+		if _, ok := hello.vector(lengthSize); !ok {
+			return "", errMalformedClientHello
+		}
+	}
+	if len(hello) == 0 {
+		return "", nil
+	}
+	extensions, ok := hello.vector(2)
+	if !ok {
+		return "", errMalformedClientHello
+	}
+	for len(extensions) > 0 {
+		extensionType, ok := extensions.next(2)
+		if !ok {
+			return "", errMalformedClientHello
+		}
+		data, ok := extensions.vector(2)
+		if !ok {
+			return "", errMalformedClientHello
+		}
+		if binary.BigEndian.Uint16(extensionType) != tlsExtensionServerName {
+			continue
+		}
+		names, ok := data.vector(2)
+		if !ok {
+			return "", errMalformedClientHello
+		}
+		for len(names) > 0 {
+			nameType, ok := names.next(1)
+			if !ok {
+				return "", errMalformedClientHello
+			}
+			name, ok := names.vector(2)
+			if !ok {
+				return "", errMalformedClientHello
+			}
+			if nameType[0] == tlsServerNameHostName {
+				return strings.ToLower(strings.TrimSuffix(string(name), ".")), nil
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// clientHello returns the first bytes TLS client sends to server name
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		client.Close()
+	}()
+	header := make([]byte, tlsRecordHeaderLength)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, record...)
+}
+
+func TestReadClientHello(t *testing.T) {
+	hello := clientHello(t, "API.Example.com")
+	if !isTLSPrefix(hello[:sniffPrefixLength]) {
+		t.Fatal("ClientHello isn't recognized as TLS")
+	}
+	if isTLSPrefix([]byte("GET / HTTP/1.1\r\n")) {
+		t.Fatal("HTTP request is recognized as TLS")
+	}
+	data, sni, err := readClientHello(bytes.NewReader(append(hello, "rest"...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sni != "api.example.com" || !bytes.Equal(data, hello) {
+		t.Fatalf("unexpected server name %s or ClientHello bytes", sni)
+	}
+
+	// IP address isn't sent as server name
+	if _, sni, err := readClientHello(bytes.NewReader(clientHello(t, "10.0.0.1"))); err != nil || sni != "" {
+		t.Fatalf("expected no server name, got %s %v", sni, err)
+	}
+	for _, data := range [][]byte{
+		[]byte("GET / HTTP/1.1\r\n\r\n"),
+		hello[:len(hello)-1],
+		// handshake length exceeds the record
+		append(append([]byte{}, hello[:6]...), 0xff, 0xff, 0xff),
+	} {
+		read, _, err := readClientHello(bytes.NewReader(data))
+		if err == nil {
+			t.Fatalf("expected error for %q", data)
+		}
+		// bytes read are forwarded, so none of them is lost
+		if !bytes.HasPrefix(data, read) {
+			t.Fatalf("expected prefix of %q, got %q", data, read)
+		}
+	}
+}
+
+func TestTLSHandlerRoutesByServerName(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := parseSNIRoutingRules("api.example.com=egress-a,~.*\\.example\\.org=egress-b:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &TLSHandler{logger: logger, rules: rules}
+	for _, c := range []struct {
+		sni      string
+		expected string
+	}{
+		{"api.example.com", "egress-a:443"},
+		{"www.example.org", "egress-b:8443"},
+		{"example.net", "10.0.0.1:443"},
+	} {
+		if addr := h.route(c.sni, "10.0.0.1:443"); addr != c.expected {
+			t.Fatalf("%s: expected %s, got %s", c.sni, c.expected, addr)
+		}
+	}
+	for _, value := range []string{"api.example.com/v2=egress", "api.example.com=egress|mirror=shadow", "api.example.com=:443"} {
+		if _, err := parseSNIRoutingRules(value); err == nil {
+			t.Fatalf("expected error for '%s'", value)
+		}
+	}
+
+	client, proxyIn := tcpConnPair(t)
+	proxyOut, upstream := tcpConnPair(t)
+	defer upstream.Close()
+	hello := clientHello(t, "api.example.com")
+	addrCh := make(chan string, 1)
+	connCh := make(chan *net.TCPConn, 1)
+	netRequest := NewNetPassthroughRequest(logger, false)
+	go func() {
+		if addr := <-addrCh; addr == "egress-a:443" {
+			connCh <- proxyOut
+		} else {
+			connCh <- nil
+		}
+	}()
+	go func() {
+		if w := h.HandleRequest(proxyIn, nil, connCh, addrCh, netRequest, false, "10.0.0.1:443"); w != nil {
+			w.CloseWrite()
+			h.HandleResponse(w, proxyIn, netRequest, false, false)
+			proxyIn.Close()
+		}
+	}()
+	client.Write(append(hello, "encrypted"...))
+	client.CloseWrite()
+	forwarded, err := io.ReadAll(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forwarded, append(hello, "encrypted"...)) {
+		t.Fatal("connection bytes aren't passed through as is")
+	}
+	upstream.Write([]byte("reply"))
+	upstream.Close()
+	if reply, err := io.ReadAll(client); err != nil || string(reply) != "reply" {
+		t.Fatalf("unexpected reply %q %v", reply, err)
+	}
+	client.Close()
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	tags := spans[0].Tags()
+	if tags["tls.sni"] != "api.example.com" || tags["routing.resolved_dst"] != "egress-a:443" ||
+		tags["bytes_sent"] != int64(len(hello)+len("encrypted")) || tags["bytes_received"] != int64(len("reply")) {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+}
@@ -0,0 +1,20 @@
+package protocol
+
+import (
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// keepTrailers makes trailers of chunked message be forwarded even if they aren't declared with Trailer header.
+// Declared trailers are forwarded anyway: body reader fills the message trailer map writer already holds,
+// but undeclared ones are read into a new map which writer never sees, so the empty map is set in advance
+func keepTrailers(trailer *nhttp.Header, transferEncoding []string) {
+	if *trailer != nil {
+		return
+	}
+	for _, te := range transferEncoding {
+		if te == "chunked" {
+			*trailer = nhttp.Header{}
+			return
+		}
+	}
+}
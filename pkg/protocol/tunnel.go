@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync/atomic"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+const tunnelEstablishedResponse = "HTTP/1.1 200 Connection Established\r\n\r\n"
+
+// tunnel serves CONNECT request: it's answered by netra itself and then connection bytes are copied as is
+// until either side is closed, tunnel target is request authority with routing logic and original destination otherwise
+func (h *HTTPHandler) tunnel(
+	r *net.TCPConn,
+	w *net.TCPConn,
+	connCh chan *net.TCPConn,
+	addrCh chan string,
+	req *nhttp.Request,
+	netHTTPRequest *NetHTTPRequest,
+	isInboundConn bool,
+	bufioHTTPReader *bufio.Reader) *net.TCPConn {
+	if addrCh != nil {
+		addrCh <- req.Host
+		w = <-connCh
+		if w == nil {
+			return w
+		}
+	}
+	if w == nil {
+		return nil
+	}
+	if isInboundConn {
+		netHTTPRequest.remoteAddr = r.RemoteAddr().String()
+	} else {
+		netHTTPRequest.remoteAddr = w.RemoteAddr().String()
+	}
+
+	// response side switches to copying before client gets a chance to send anything through tunnel
+	netHTTPRequest.StartTunnel(req)
+	if _, err := io.WriteString(r, tunnelEstablishedResponse); err != nil {
+		h.logger.Warning(err.Error())
+		netHTTPRequest.StopUpgrade()
+		return w
+	}
+
+	setReadDeadline(r, 0)
+	buf := bufferPool.Get().([]byte)
+	_, err := io.CopyBuffer(newCountingWriter(w, &netHTTPRequest.upgradeBytesSent), bufioHTTPReader, buf)
+	bufferPool.Put(buf)
+	if err != nil {
+		h.logger.Warning(err.Error())
+	}
+	netHTTPRequest.StopUpgrade()
+	return w
+}
+
+// StartTunnel starts span for connection tunneled with CONNECT request,
+// it's finished by StopUpgrade like upgraded connection one
+func (nr *NetHTTPRequest) StartTunnel(req *nhttp.Request) {
+	nr.upgradeMu.Lock()
+	defer nr.upgradeMu.Unlock()
+	atomic.StoreInt32(&nr.tunneling, 1)
+	if nr.upgradeClosed || nr.upgradeSpan != nil {
+		return
+	}
+	span := nr.startSpan(req)
+	nr.fillSpan(span, req, nil)
+	span.SetTag("http.status_code", nhttp.StatusOK)
+	span.SetTag("tunnel.authority", req.Host)
+	nr.upgradeSpan = span
+}
+
+// isTunneling reports whether connection is switched to tunnel
+func (nr *NetHTTPRequest) isTunneling() bool {
+	return atomic.LoadInt32(&nr.tunneling) == 1
+}
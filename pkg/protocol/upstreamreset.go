@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// upstreamResetErrorType is error.type tag of request whose upstream connection failed before response was forwarded
+const upstreamResetErrorType = "upstream_reset"
+
+// shortReadErrorType is error.type tag of request whose upstream closed connection before response body
+// of declared Content-Length is read
+const shortReadErrorType = "short_read"
+
+// isUpstreamReset reports whether upstream connection is closed or reset by upstream,
+// connection closed before response head is read completely is reported as unexpected EOF
+func isUpstreamReset(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// isShortRead reports whether response body is cut by upstream closing connection before its Content-Length is read,
+// reset connection isn't a short read
+func isShortRead(resp *nhttp.Response, err error) bool {
+	return resp.ContentLength > 0 && errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// forwardWriter passes response to client and remembers whether any byte is forwarded and whether client write failed,
+// so response error is known to be caused by upstream
+type forwardWriter struct {
+	w        io.Writer
+	written  int64
+	writeErr error
+}
+
+func (fw *forwardWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.written += int64(n)
+	if err != nil {
+		fw.writeErr = err
+	}
+	return n, err
+}
+
+// answersBadGateway reports whether request failed by upstream is answered with 502,
+// response which is partially forwarded can't be replaced, so client connection is closed instead
+func answersBadGateway(forwarded bool) bool {
+	httpConfig := config.GetHTTPConfig()
+	return !forwarded && httpConfig.UpstreamResetBadGateway && !httpConfig.ObserveOnly
+}
+
+// writeBadGateway answers request with empty 502 response
+func writeBadGateway(w io.Writer, req *nhttp.Request) (*nhttp.Response, error) {
+	resp := &nhttp.Response{
+		StatusCode:    nhttp.StatusBadGateway,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        nhttp.Header{},
+		ContentLength: 0,
+		Body:          nhttp.NoBody,
+		Close:         !isKeepAlive(req),
+		Request:       req,
+	}
+	bufioWriter := writerPool.Get().(*bufio.Writer)
+	bufioWriter.Reset(w)
+	err := resp.Write(bufioWriter)
+	if flushErr := bufioWriter.Flush(); err == nil {
+		err = flushErr
+	}
+	writerPool.Put(bufioWriter)
+	return resp, err
+}
+
+// failUpstream finishes request whose upstream connection failed before response head is read:
+// it's answered with 502 if it's enabled, otherwise client connection is closed
+func (h *HTTPHandler) failUpstream(w *net.TCPConn, req *nhttp.Request, netHTTPRequest *NetHTTPRequest) {
+	netHTTPRequest.setErrorType(req, upstreamResetErrorType)
+	if !answersBadGateway(false) {
+		netHTTPRequest.StopRequest()
+		w.Close()
+		return
+	}
+	resp, err := writeBadGateway(w, req)
+	if err != nil {
+		h.logger.Errorf("Error while writing response to w: %s", err.Error())
+	}
+	netHTTPRequest.SetHTTPResponse(resp)
+	netHTTPRequest.StopRequest()
+	if !isKeepAlive(req) {
+		w.CloseWrite()
+	}
+}
+
+func (nr *NetHTTPRequest) setErrorType(req *nhttp.Request, errorType string) {
+	nr.errorTypesMu.Lock()
+	nr.errorTypes[req] = errorType
+	nr.errorTypesMu.Unlock()
+}
+
+// popErrorType returns type of error request failed with and forgets it
+func (nr *NetHTTPRequest) popErrorType(req *nhttp.Request) (string, bool) {
+	nr.errorTypesMu.Lock()
+	defer nr.errorTypesMu.Unlock()
+	errorType, ok := nr.errorTypes[req]
+	if ok {
+		delete(nr.errorTypes, req)
+	}
+	return errorType, ok
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/patrickmn/go-cache"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// proxyUpstreamReset proxies request to upstream which writes partial response and closes connection,
+// it returns response client gets when 502 is enabled and span of request
+func proxyUpstreamReset(t *testing.T, badGateway bool, strictLength bool, partialResponse string) (*nhttp.Response, *mocktracer.MockSpan) {
+	httpConfig := config.GetHTTPConfig()
+	resetConfig := httpConfig
+	resetConfig.UpstreamResetBadGateway = badGateway
+	resetConfig.StrictResponseLength = strictLength
+	config.SetHTTPConfig(resetConfig)
+	defer config.SetHTTPConfig(httpConfig)
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	logger, err := log.Init("test", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, proxyIn := tcpConnPair(t)
+	proxyOut, upstream := tcpConnPair(t)
+	defer client.Close()
+	handler := NewHTTPHandler(logger, cache.New(time.Minute, time.Minute), cache.New(time.Minute, time.Minute))
+	netRequest := NewNetHTTPRequest(logger, false, cache.New(time.Minute, time.Minute))
+	go func() {
+		handler.HandleRequest(proxyIn, proxyOut, nil, nil, netRequest, false, "127.0.0.1:80")
+		proxyOut.Close()
+	}()
+	go func() {
+		handler.HandleResponse(proxyOut, proxyIn, netRequest, false, false)
+		proxyIn.Close()
+	}()
+	go func() {
+		defer upstream.Close()
+		if _, err := nhttp.ReadRequest(bufio.NewReader(upstream)); err != nil {
+			return
+		}
+		fmt.Fprint(upstream, partialResponse)
+	}()
+
+	if _, err := fmt.Fprint(client, "GET /orders HTTP/1.1\r\nHost: upstream\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var resp *nhttp.Response
+	if badGateway {
+		resp, err = nhttp.ReadResponse(bufio.NewReader(client), &nhttp.Request{Method: nhttp.MethodGet})
+		if err != nil {
+			t.Fatal(err)
+		}
+	} else if received, err := ioutil.ReadAll(client); err != nil || string(received) != partialResponse {
+		// client sees truncated response followed by connection close
+		t.Fatalf("expected client connection to be closed after %q, got %q, %v", partialResponse, received, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tracer.FinishedSpans()) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	return resp, spans[0]
+}
+
+func TestUpstreamReset(t *testing.T) {
+	for _, c := range []struct {
+		name            string
+		badGateway      bool
+		partialResponse string
+		errorType       string
+	}{
+		{"closed before response", true, "", upstreamResetErrorType},
+		{"closed in the middle of body", true, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc", shortReadErrorType},
+		{"closed in the middle of chunk", true, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\nabc", upstreamResetErrorType},
+		{"closed before response without 502", false, "", upstreamResetErrorType},
+		{"closed in the middle of body without 502", false, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc", shortReadErrorType},
+	} {
+		resp, span := proxyUpstreamReset(t, c.badGateway, true, c.partialResponse)
+		if c.badGateway && resp.StatusCode != nhttp.StatusBadGateway {
+			t.Fatalf("%s: expected 502, got %d", c.name, resp.StatusCode)
+		}
+		if span.Tag("error") != true || span.Tag("error.type") != c.errorType {
+			t.Fatalf("%s: unexpected tags %v", c.name, span.Tags())
+		}
+		if span.Tag("timeout") != nil {
+			t.Fatalf("%s: upstream reset is tagged as timeout", c.name)
+		}
+	}
+}
+
+func TestShortReadWithRelaxedResponseLength(t *testing.T) {
+	partialResponse := "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc"
+	// truncated response is passed to client even if 502 is enabled
+	resp, span := proxyUpstreamReset(t, true, false, partialResponse)
+	if resp.StatusCode != nhttp.StatusOK {
+		t.Fatalf("expected truncated response, got %d", resp.StatusCode)
+	}
+	if span.Tag("error") != nil || span.Tag("error.type") != nil {
+		t.Fatalf("truncated response is tagged as error: %v", span.Tags())
+	}
+	if span.Tag("http.status_code") != 200 {
+		t.Fatalf("unexpected tags %v", span.Tags())
+	}
+}
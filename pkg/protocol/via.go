@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// viaEntry returns Via entry of message received with protocol version by proxy named pseudonym,
+// protocol name is omitted since it's HTTP
+func viaEntry(protoMajor int, protoMinor int, pseudonym string) string {
+	version := strconv.Itoa(protoMajor)
+	if protoMajor < 2 {
+		version += "." + strconv.Itoa(protoMinor)
+	}
+	return version + " " + pseudonym
+}
+
+// addVia appends entry of proxy to Via header of forwarded message, the last header line is extended
+func addVia(header nhttp.Header, protoMajor int, protoMinor int, pseudonym string) {
+	entry := viaEntry(protoMajor, protoMinor, pseudonym)
+	if values := header["Via"]; len(values) > 0 {
+		values[len(values)-1] += ", " + entry
+		return
+	}
+	header["Via"] = []string{entry}
+}
+
+// countVia returns number of Via entries of proxy named pseudonym, e.g. `1.1 netramesh (comment)`
+func countVia(header nhttp.Header, pseudonym string) int {
+	count := 0
+	for _, value := range header["Via"] {
+		for _, entry := range strings.Split(value, ",") {
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], pseudonym) {
+				count++
+			}
+		}
+	}
+	return count
+}
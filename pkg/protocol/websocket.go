@@ -0,0 +1,275 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+
+	"github.com/Lookyan/netramesh/internal/config"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// WebSocket frame opcodes
+const (
+	wsContinuation byte = 0x0
+	wsText         byte = 0x1
+	wsBinary       byte = 0x2
+	wsClose        byte = 0x8
+	wsPing         byte = 0x9
+	wsPong         byte = 0xa
+)
+
+var wsOpcodeNames = map[byte]string{
+	wsContinuation: "continuation",
+	wsText:         "text",
+	wsBinary:       "binary",
+	wsClose:        "close",
+	wsPing:         "ping",
+	wsPong:         "pong",
+}
+
+// wsMaxSamples limits number of text messages sampled per connection direction
+const wsMaxSamples = 32
+
+// wsFrameObserver parses RFC 6455 frames of bytes written through it, bytes are passed on unchanged.
+// Frames are counted by opcode and payloads of text messages are sampled if sampleLimit is set
+type wsFrameObserver struct {
+	w           io.Writer
+	direction   string
+	sampleLimit int
+
+	mu sync.Mutex
+	// header of current frame, it's the longest possible one
+	header    [14]byte
+	headerLen int
+	inPayload bool
+	// current frame
+	opcode      byte
+	fin         bool
+	masked      bool
+	mask        [4]byte
+	payloadLeft uint64
+	payloadPos  uint64
+	// current message, its text payload is sampled across fragments
+	sampling        bool
+	sample          []byte
+	sampleTruncated bool
+	// broken is set when bytes aren't valid framing, they are passed on without parsing then
+	broken       bool
+	frames       map[string]int64
+	messages     int64
+	payloadBytes int64
+	samples      []opentracing.LogRecord
+}
+
+func newWSFrameObserver(w io.Writer, direction string, sampleLimit int) *wsFrameObserver {
+	return &wsFrameObserver{
+		w:           w,
+		direction:   direction,
+		sampleLimit: sampleLimit,
+		frames:      make(map[string]int64),
+	}
+}
+
+// Write passes bytes to the underlying writer and parses frames of written ones
+func (o *wsFrameObserver) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.mu.Lock()
+	o.observe(p[:n])
+	o.mu.Unlock()
+	return n, err
+}
+
+// wsHeaderLength returns frame header length by its second byte
+func wsHeaderLength(b byte) int {
+	n := 2
+	switch b & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if b&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func (o *wsFrameObserver) observe(p []byte) {
+	for len(p) > 0 && !o.broken {
+		if !o.inPayload {
+			need := 2
+			if o.headerLen >= 2 {
+				need = wsHeaderLength(o.header[1])
+			}
+			n := copy(o.header[o.headerLen:need], p)
+			o.headerLen += n
+			p = p[n:]
+			if o.headerLen >= 2 && o.headerLen == wsHeaderLength(o.header[1]) {
+				o.startFrame()
+			}
+			continue
+		}
+		n := uint64(len(p))
+		if n > o.payloadLeft {
+			n = o.payloadLeft
+		}
+		o.payload(p[:n])
+		p = p[n:]
+		o.payloadLeft -= n
+		o.payloadPos += n
+		if o.payloadLeft == 0 {
+			o.endFrame()
+		}
+	}
+}
+
+func (o *wsFrameObserver) startFrame() {
+	h := o.header[:o.headerLen]
+	o.headerLen = 0
+	o.fin = h[0]&0x80 != 0
+	compressed := h[0]&0x40 != 0
+	o.opcode = h[0] & 0x0f
+	o.masked = h[1]&0x80 != 0
+	length := uint64(h[1] & 0x7f)
+	rest := h[2:]
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		length = binary.BigEndian.Uint64(rest)
+		rest = rest[8:]
+	}
+	if o.masked {
+		copy(o.mask[:], rest)
+	}
+	// control frames can't be fragmented and have short payload, the most significant bit of length is 0
+	if (o.opcode >= wsClose && (!o.fin || length > 125)) || length>>63 != 0 {
+		o.broken = true
+		return
+	}
+
+	name, ok := wsOpcodeNames[o.opcode]
+	if !ok {
+		name = "reserved"
+	}
+	o.frames[name]++
+	o.payloadBytes += int64(length)
+	if o.opcode == wsText || o.opcode == wsBinary {
+		// new data message starts, compressed payload isn't readable
+		o.sampling = o.opcode == wsText && !compressed && o.sampleLimit > 0 && len(o.samples) < wsMaxSamples
+		o.sample, o.sampleTruncated = nil, false
+	}
+	o.payloadLeft, o.payloadPos = length, 0
+	o.inPayload = true
+	if length == 0 {
+		o.endFrame()
+	}
+}
+
+// payload samples payload of text message, client frames are unmasked
+func (o *wsFrameObserver) payload(p []byte) {
+	if !o.sampling || o.opcode >= wsClose {
+		return
+	}
+	for i, b := range p {
+		if len(o.sample) >= o.sampleLimit {
+			o.sampleTruncated = true
+			return
+		}
+		if o.masked {
+			b ^= o.mask[(o.payloadPos+uint64(i))%4]
+		}
+		o.sample = append(o.sample, b)
+	}
+}
+
+func (o *wsFrameObserver) endFrame() {
+	o.inPayload = false
+	// control frames may be interleaved with fragments of data message
+	if o.opcode >= wsClose || !o.fin {
+		return
+	}
+	o.messages++
+	if o.sampling {
+		o.samples = append(o.samples, newSpanEvent("websocket_text_message",
+			otlog.String("direction", o.direction),
+			otlog.String("payload", string(o.sample)),
+			otlog.Bool("truncated", o.sampleTruncated)))
+		o.sampling = false
+		o.sample = nil
+	}
+}
+
+// tagSpan sets frame counters of direction as span tags and returns sampled messages
+func (o *wsFrameObserver) tagSpan(span opentracing.Span) []opentracing.LogRecord {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	prefix := "websocket." + o.direction + "."
+	for name, count := range o.frames {
+		span.SetTag(prefix+"frames."+name, count)
+	}
+	span.SetTag(prefix+"messages", o.messages)
+	span.SetTag(prefix+"payload_bytes", o.payloadBytes)
+	return append([]opentracing.LogRecord(nil), o.samples...)
+}
+
+// wsSampleLimit returns size limit of sampled text messages of request path, it's 0 if path isn't sampled
+func wsSampleLimit(httpConfig config.HTTPConfig, path string) int {
+	for _, prefix := range httpConfig.WebSocketSamplePaths {
+		if strings.HasPrefix(path, prefix) {
+			return httpConfig.WebSocketSampleMaxBytes
+		}
+	}
+	return 0
+}
+
+// startFrameObservers sets up frame observers of websocket upgrade request if frame tracing is enabled
+func (nr *NetHTTPRequest) startFrameObservers(req *nhttp.Request) {
+	httpConfig := config.GetHTTPConfig()
+	if !httpConfig.WebSocketFramesEnabled || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return
+	}
+	limit := wsSampleLimit(httpConfig, req.URL.Path)
+	nr.upgradeMu.Lock()
+	defer nr.upgradeMu.Unlock()
+	// sent is client to server direction, received is server to client one
+	nr.framesSent = newWSFrameObserver(nil, "sent", limit)
+	nr.framesReceived = newWSFrameObserver(nil, "received", limit)
+}
+
+// observeFrames wraps writer of upgraded connection direction with its frame observer, if there is one
+func (nr *NetHTTPRequest) observeFrames(w io.Writer, sent bool) io.Writer {
+	nr.upgradeMu.Lock()
+	defer nr.upgradeMu.Unlock()
+	observer := nr.framesReceived
+	if sent {
+		observer = nr.framesSent
+	}
+	if observer == nil {
+		return w
+	}
+	observer.w = w
+	return observer
+}
+
+// tagFrames sets frame counters of upgraded connection and returns sampled messages in order of time,
+// nr.upgradeMu is held
+func (nr *NetHTTPRequest) tagFrames(span opentracing.Span) []opentracing.LogRecord {
+	var records []opentracing.LogRecord
+	for _, observer := range []*wsFrameObserver{nr.framesSent, nr.framesReceived} {
+		if observer != nil {
+			records = append(records, observer.tagSpan(span)...)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+	return records
+}
@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func wsFrame(fin bool, opcode byte, mask []byte, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestWSFrameObserver(t *testing.T) {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	long := strings.Repeat("x", 300)
+	var stream []byte
+	// fragmented text message with ping between fragments
+	stream = append(stream, wsFrame(false, wsText, mask, []byte("hello, "))...)
+	stream = append(stream, wsFrame(true, wsPing, mask, nil)...)
+	stream = append(stream, wsFrame(true, wsContinuation, mask, []byte("world"))...)
+	stream = append(stream, wsFrame(true, wsBinary, mask, []byte{1, 2, 3})...)
+	stream = append(stream, wsFrame(true, wsText, mask, []byte(long))...)
+	stream = append(stream, wsFrame(true, wsClose, mask, []byte{0x03, 0xe8})...)
+
+	var forwarded bytes.Buffer
+	observer := newWSFrameObserver(&forwarded, "sent", 16)
+	// headers and payloads are split across small writes
+	for i := 0; i < len(stream); i += 3 {
+		end := i + 3
+		if end > len(stream) {
+			end = len(stream)
+		}
+		if _, err := observer.Write(stream[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(forwarded.Bytes(), stream) {
+		t.Fatal("frames aren't passed on unchanged")
+	}
+
+	span := mocktracer.New().StartSpan("upgrade").(*mocktracer.MockSpan)
+	records := observer.tagSpan(span)
+	expected := map[string]interface{}{
+		"websocket.sent.frames.text":         int64(2),
+		"websocket.sent.frames.continuation": int64(1),
+		"websocket.sent.frames.ping":         int64(1),
+		"websocket.sent.frames.binary":       int64(1),
+		"websocket.sent.frames.close":        int64(1),
+		"websocket.sent.messages":            int64(3),
+		"websocket.sent.payload_bytes":       int64(7 + 5 + 3 + 300 + 2),
+	}
+	for tag, value := range expected {
+		if span.Tag(tag) != value {
+			t.Fatalf("expected tag %s=%v, got %v", tag, value, span.Tag(tag))
+		}
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 sampled messages, got %d", len(records))
+	}
+	fields := func(i int) map[string]interface{} {
+		m := make(map[string]interface{})
+		for _, f := range records[i].Fields {
+			m[f.Key()] = f.Value()
+		}
+		return m
+	}
+	if f := fields(0); f["payload"] != "hello, world" || f["truncated"] != false {
+		t.Fatalf("unexpected fragmented message sample %v", f)
+	}
+	if f := fields(1); f["payload"] != long[:16] || f["truncated"] != true {
+		t.Fatalf("unexpected long message sample %v", f)
+	}
+}
+
+func TestWSFrameObserverStopsOnMalformedFrame(t *testing.T) {
+	var forwarded bytes.Buffer
+	observer := newWSFrameObserver(&forwarded, "received", 0)
+	// fragmented control frame isn't valid
+	stream := append(wsFrame(false, wsPing, nil, nil), wsFrame(true, wsText, nil, []byte("ignored"))...)
+	observer.Write(stream)
+	if !bytes.Equal(forwarded.Bytes(), stream) {
+		t.Fatal("bytes aren't passed on unchanged")
+	}
+	span := mocktracer.New().StartSpan("upgrade").(*mocktracer.MockSpan)
+	observer.tagSpan(span)
+	if span.Tag("websocket.received.messages") != int64(0) || span.Tag("websocket.received.frames.text") != nil {
+		t.Fatalf("unexpected tags %v", span.Tags())
+	}
+}
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// buckets are spread over shards, so lookups of different keys don't contend on single mutex
+const shardCount = 32
+
+// bucket is a token bucket refilled with rate tokens per second up to burst
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+type shard struct {
+	mu      sync.RWMutex
+	buckets map[string]*bucket
+}
+
+// Limiter keeps token bucket per key, bucket parameters are passed on each call,
+// so they can be changed without losing bucket state
+type Limiter struct {
+	shards [shardCount]shard
+	now    func() time.Time
+}
+
+// New returns limiter without buckets, bucket is created full on the first key usage
+func New() *Limiter {
+	l := &Limiter{now: time.Now}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*bucket)
+	}
+	return l
+}
+
+// Allow takes token from bucket of key, rate is tokens per second and burst is bucket capacity.
+// If bucket is empty, false and time till the next token are returned
+func (l *Limiter) Allow(key string, rate float64, burst int) (bool, time.Duration) {
+	now := l.now()
+	b := l.bucket(key, burst, now)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	b.burst = burst
+	b.tokens = math.Min(float64(b.burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (l *Limiter) bucket(key string, burst int, now time.Time) *bucket {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	s := &l.shards[h.Sum32()%shardCount]
+
+	s.mu.RLock()
+	b, ok := s.buckets[key]
+	s.mu.RUnlock()
+	if ok {
+		return b
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok = s.buckets[key]; !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	return b
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBurst(t *testing.T) {
+	l := New()
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.Allow("/api", 1, 3); !allowed {
+			t.Fatalf("expected request %d within burst to be allowed", i)
+		}
+	}
+	allowed, retryAfter := l.Allow("/api", 1, 3)
+	if allowed {
+		t.Fatal("expected request over burst to be limited")
+	}
+	if retryAfter != time.Second {
+		t.Fatalf("expected retry after 1s, got %s", retryAfter)
+	}
+}
+
+func TestRefill(t *testing.T) {
+	l := New()
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		l.Allow("/api", 4, 2)
+	}
+	now = now.Add(100 * time.Millisecond)
+	allowed, retryAfter := l.Allow("/api", 4, 2)
+	if allowed {
+		t.Fatal("expected request to be limited before token is refilled")
+	}
+	if retryAfter != 150*time.Millisecond {
+		t.Fatalf("expected retry after 150ms, got %s", retryAfter)
+	}
+	now = now.Add(150 * time.Millisecond)
+	if allowed, _ := l.Allow("/api", 4, 2); !allowed {
+		t.Fatal("expected request to be allowed after token is refilled")
+	}
+
+	// bucket isn't refilled over burst after long idle period
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if allowed, _ := l.Allow("/api", 4, 2); !allowed {
+			t.Fatalf("expected request %d within burst to be allowed", i)
+		}
+	}
+	if allowed, _ := l.Allow("/api", 4, 2); allowed {
+		t.Fatal("expected request over burst to be limited")
+	}
+}
+
+func TestZeroRate(t *testing.T) {
+	l := New()
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	l.Allow("/api", 0, 1)
+	now = now.Add(time.Hour)
+	allowed, retryAfter := l.Allow("/api", 0, 1)
+	if allowed || retryAfter != 0 {
+		t.Fatalf("expected bucket without rate to never be refilled, got %v, %s", allowed, retryAfter)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	l := New()
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("/api/%d", i)
+		if allowed, _ := l.Allow(keys[i], 1, 1); !allowed {
+			t.Fatalf("expected first request of %s to be allowed", keys[i])
+		}
+	}
+	// every key has its own bucket
+	for _, key := range keys {
+		if allowed, _ := l.Allow(key, 1, 1); allowed {
+			t.Fatalf("expected second request of %s to be limited", key)
+		}
+	}
+
+	buckets, usedShards := 0, 0
+	for i := range l.shards {
+		buckets += len(l.shards[i].buckets)
+		if len(l.shards[i].buckets) > 0 {
+			usedShards++
+		}
+	}
+	if buckets != len(keys) {
+		t.Fatalf("expected %d buckets, got %d", len(keys), buckets)
+	}
+	if usedShards < shardCount/2 {
+		t.Fatalf("expected keys to be spread over shards, got %d shards used", usedShards)
+	}
+}
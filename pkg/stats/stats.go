@@ -0,0 +1,199 @@
+package stats
+
+import (
+	"container/list"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// slots is number of parts window is split to, the oldest part is dropped as window slides
+	slots = 6
+	// reservoirSize is max number of durations sampled per slot
+	reservoirSize = 64
+)
+
+// OperationStats is latency of operation over window, durations are in seconds
+type OperationStats struct {
+	Operation string  `json:"operation"`
+	Count     int64   `json:"count"`
+	P50       float64 `json:"p50"`
+	P90       float64 `json:"p90"`
+	P99       float64 `json:"p99"`
+}
+
+// Recorder keeps latency quantiles of at most maxOperations operations,
+// least recently observed operation is evicted to track a new one
+type Recorder struct {
+	mu            sync.Mutex
+	maxOperations int
+	slotDuration  time.Duration
+	operations    map[string]*list.Element
+	// lru is ordered from the most recently observed operation
+	lru *list.List
+	now func() time.Time
+}
+
+// operation is reservoir sample of durations observed in each slot of window
+type operation struct {
+	name  string
+	slots [slots]slot
+}
+
+type slot struct {
+	// epoch is number of slot since unix epoch, slot of older epoch is reset on observe
+	epoch   int64
+	count   int64
+	samples []time.Duration
+}
+
+// NewRecorder creates recorder of durations observed within window
+func NewRecorder(maxOperations int, window time.Duration) *Recorder {
+	slotDuration := window / slots
+	if slotDuration <= 0 {
+		slotDuration = 1
+	}
+	return &Recorder{
+		maxOperations: maxOperations,
+		slotDuration:  slotDuration,
+		operations:    make(map[string]*list.Element),
+		lru:           list.New(),
+		now:           time.Now,
+	}
+}
+
+// Observe adds duration of operation
+func (r *Recorder) Observe(name string, d time.Duration) {
+	if r.maxOperations <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var op *operation
+	if e, ok := r.operations[name]; ok {
+		r.lru.MoveToFront(e)
+		op = e.Value.(*operation)
+	} else {
+		if r.lru.Len() >= r.maxOperations {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.operations, oldest.Value.(*operation).name)
+		}
+		op = &operation{name: name}
+		r.operations[name] = r.lru.PushFront(op)
+	}
+
+	epoch := r.now().UnixNano() / int64(r.slotDuration)
+	s := &op.slots[epoch%slots]
+	if s.epoch != epoch {
+		s.epoch = epoch
+		s.count = 0
+		s.samples = s.samples[:0]
+	}
+	s.count++
+	if len(s.samples) < reservoirSize {
+		s.samples = append(s.samples, d)
+	} else if i := rand.Int63n(s.count); i < reservoirSize {
+		s.samples[i] = d
+	}
+}
+
+// Snapshot returns stats of operations observed within window sorted by operation name
+func (r *Recorder) Snapshot() []OperationStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	epoch := r.now().UnixNano() / int64(r.slotDuration)
+	result := make([]OperationStats, 0, len(r.operations))
+	for name, e := range r.operations {
+		op := e.Value.(*operation)
+		var count int64
+		var samples []weightedSample
+		for i := range op.slots {
+			s := &op.slots[i]
+			if s.epoch <= epoch-slots || len(s.samples) == 0 {
+				continue
+			}
+			count += s.count
+			// every sample stands for the same share of durations observed in its slot
+			weight := float64(s.count) / float64(len(s.samples))
+			for _, d := range s.samples {
+				samples = append(samples, weightedSample{d, weight})
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].duration < samples[j].duration })
+		result = append(result, OperationStats{
+			Operation: name,
+			Count:     count,
+			P50:       quantile(samples, count, 0.5).Seconds(),
+			P90:       quantile(samples, count, 0.9).Seconds(),
+			P99:       quantile(samples, count, 0.99).Seconds(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Operation < result[j].Operation })
+	return result
+}
+
+type weightedSample struct {
+	duration time.Duration
+	weight   float64
+}
+
+// quantile returns q quantile of sorted samples of count durations
+func quantile(samples []weightedSample, count int64, q float64) time.Duration {
+	rank := q * float64(count)
+	var cumulative float64
+	for _, s := range samples {
+		cumulative += s.weight
+		if cumulative >= rank {
+			return s.duration
+		}
+	}
+	return samples[len(samples)-1].duration
+}
+
+var (
+	mu       sync.Mutex
+	recorder *Recorder
+)
+
+// Init enables recording of durations served by Snapshot
+func Init(maxOperations int, window time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	if maxOperations > 0 {
+		recorder = NewRecorder(maxOperations, window)
+	}
+}
+
+// Enabled reports whether durations are recorded
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return recorder != nil
+}
+
+// Observe adds duration of operation if recording is enabled
+func Observe(name string, d time.Duration) {
+	mu.Lock()
+	r := recorder
+	mu.Unlock()
+	if r != nil {
+		r.Observe(name, d)
+	}
+}
+
+// Snapshot returns stats of operations observed within window, it's empty if recording isn't enabled
+func Snapshot() []OperationStats {
+	mu.Lock()
+	r := recorder
+	mu.Unlock()
+	if r == nil {
+		return []OperationStats{}
+	}
+	return r.Snapshot()
+}
@@ -0,0 +1,68 @@
+package stats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRecorderQuantiles(t *testing.T) {
+	r := NewRecorder(10, time.Minute)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	// durations are spread over all slots of window, every slot keeps all of its durations
+	for i := 0; i < slots; i++ {
+		if i > 0 {
+			now = now.Add(10 * time.Second)
+		}
+		for j := 1; j <= reservoirSize; j++ {
+			r.Observe("GET /orders", time.Duration(i*reservoirSize+j)*time.Millisecond)
+		}
+	}
+	snapshot := r.Snapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("expected 1 operation, got %v", snapshot)
+	}
+	s := snapshot[0]
+	expected := OperationStats{Operation: "GET /orders", Count: slots * reservoirSize, P50: 0.192, P90: 0.346, P99: 0.381}
+	if s != expected {
+		t.Fatalf("expected %+v, got %+v", expected, s)
+	}
+}
+
+func TestRecorderWindowSlides(t *testing.T) {
+	r := NewRecorder(10, time.Minute)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	r.Observe("GET /orders", time.Second)
+	now = now.Add(30 * time.Second)
+	r.Observe("GET /orders", 2*time.Second)
+	if s := r.Snapshot(); len(s) != 1 || s[0].Count != 2 {
+		t.Fatalf("expected both durations within window, got %+v", s)
+	}
+	now = now.Add(40 * time.Second)
+	if s := r.Snapshot(); len(s) != 1 || s[0].Count != 1 || s[0].P50 != 2 {
+		t.Fatalf("expected only last duration within window, got %+v", s)
+	}
+	now = now.Add(time.Minute)
+	if s := r.Snapshot(); len(s) != 0 {
+		t.Fatalf("expected no operations within window, got %+v", s)
+	}
+}
+
+func TestRecorderEvictsLeastRecentlyUsed(t *testing.T) {
+	r := NewRecorder(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		r.Observe(fmt.Sprintf("op%d", i), time.Millisecond)
+	}
+	// op0 is used again, so op1 is the least recently used one
+	r.Observe("op0", time.Millisecond)
+	r.Observe("op3", time.Millisecond)
+	var names []string
+	for _, s := range r.Snapshot() {
+		names = append(names, s.Operation)
+	}
+	if fmt.Sprint(names) != "[op0 op2 op3]" {
+		t.Fatalf("unexpected operations %v", names)
+	}
+}
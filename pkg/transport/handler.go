@@ -2,23 +2,51 @@ package transport
 
 import (
 	"container/list"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/patrickmn/go-cache"
 
 	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/connpool"
+	"github.com/Lookyan/netramesh/pkg/dnscache"
 	"github.com/Lookyan/netramesh/pkg/estabcache"
 	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
 	"github.com/Lookyan/netramesh/pkg/protocol"
 )
 
 const SO_ORIGINAL_DST = 80
 
+// rejectResponse answers inbound HTTP connection accepted over limit
+const rejectResponse = "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+
+// rejectTimeout limits time rejected connection is kept to send response
+const rejectTimeout = 100 * time.Millisecond
+
+// outboundPool keeps keep-alive connections to outbound destinations of routing logic between requests
+var outboundPool = connpool.NewPool(dialAddr)
+
+// destinationCache keeps resolved hosts of routing destinations
+var destinationCache = dnscache.New(dnscache.LookupIP, metrics.ObserveDNSCacheLookup)
+
+// poolSettings returns outbound connection pool settings from HTTP config
+func poolSettings(httpConfig config.HTTPConfig) connpool.Settings {
+	return connpool.Settings{
+		MaxIdle:     httpConfig.PoolMaxIdlePerHost,
+		IdleTimeout: httpConfig.PoolIdleTimeout,
+		MaxConns:    httpConfig.PoolMaxConnsPerHost,
+		WaitTimeout: httpConfig.PoolWaitTimeout,
+	}
+}
+
 var addrPool = &sync.Pool{
 	New: func() interface{} {
 		return make([]byte, 0, 20)
@@ -40,7 +68,8 @@ func TcpCopyRequest(
 	w = netHandler.HandleRequest(r, w, connCh, addrCh, netRequest, isInBoundConn, originalDst)
 	f.Close()
 	closeConn(logger, r)
-	if w != nil {
+	// upstream connections of routing logic are closed by it, pooled ones may already serve other requests
+	if w != nil && addrCh == nil {
 		closeConn(logger, w)
 	}
 }
@@ -60,6 +89,7 @@ func TcpCopyResponse(
 	closeConn(logger, w)
 }
 
+// HandleConnection proxies accepted client connection, it returns when connection is handled completely
 func HandleConnection(
 	logger *log.Logger,
 	conn *net.TCPConn,
@@ -83,38 +113,15 @@ func HandleConnection(
 		logger.Debug("Can't turn fd into non-blocking mode")
 	}
 
-	addr, err := syscall.GetsockoptIPv6Mreq(int(f.Fd()), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+	originalDstAddr, isInBoundConn, err := originalDestination(conn, f)
 	if err != nil {
 		f.Close()
 		closeConn(logger, conn)
 		return
 	}
 
-	ipBuilder := addrPool.Get().([]byte)
-	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[4]))...)
-	ipBuilder = append(ipBuilder, '.')
-	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[5]))...)
-	ipBuilder = append(ipBuilder, '.')
-	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[6]))...)
-	ipBuilder = append(ipBuilder, '.')
-	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[7]))...)
-	ipv4 := string(ipBuilder)
-	ipBuilder = ipBuilder[:0]
-	addrPool.Put(ipBuilder)
-	port := uint16(addr.Multiaddr[2])<<8 + uint16(addr.Multiaddr[3])
-
-	isInBoundConn := ipv4 == strings.Split(conn.LocalAddr().String(), ":")[0]
-
-	dstAddrBuilder := addrPool.Get().([]byte)
-	dstAddrBuilder = append(dstAddrBuilder, ipv4...)
-	dstAddrBuilder = append(dstAddrBuilder, ':')
-	dstAddrBuilder = append(dstAddrBuilder, strconv.Itoa(int(port))...)
-	originalDstAddr := string(dstAddrBuilder)
-	dstAddrBuilder = dstAddrBuilder[:0]
-	addrPool.Put(dstAddrBuilder)
-
 	// determine protocol and choose logic
-	p := protocol.Determine(originalDstAddr)
+	p := protocol.DetectProtocol(conn, originalDstAddr)
 	netRequest := protocol.GetNetRequest(p, isInBoundConn, logger, tracingContextMapping)
 	netHandler := protocol.GetNetworkHandler(p, logger, tracingContextMapping)
 
@@ -138,12 +145,18 @@ func HandleConnection(
 
 		callCh := make(chan func(), 10)
 		wg := sync.WaitGroup{}
+		// response routines are waited for after upstream connections are closed
+		defer wg.Wait()
 		go func() {
 			for f := range callCh {
 				f()
 				wg.Done()
 			}
 		}()
+		// upstream connections waiting for response are closed when client connection is done
+		inUse := newConnSet()
+		defer inUse.closeAll(logger)
+		pooledHandler, canPool := netHandler.(protocol.PooledResponseHandler)
 		for {
 			dstAddr := <-addrCh
 			if dstAddr == "" {
@@ -154,19 +167,17 @@ func HandleConnection(
 				return
 			}
 
-			tcpDstAddr, err := net.ResolveTCPAddr("tcp", dstAddr)
-			if err != nil {
-				logger.Warningf("Error while resolving tcp addr %s", originalDstAddr)
-				connCh <- nil
-				f.Close()
-				closeConn(logger, conn)
-				close(connCh)
-				close(callCh)
-				return
+			// only outbound destinations are pooled, inbound ones are local application
+			settings := poolSettings(config.GetHTTPConfig())
+			pooled := canPool && !isInBoundConn && settings.Enabled()
+			var targetConn *net.TCPConn
+			if pooled {
+				targetConn, err = outboundPool.Get(dstAddr, settings)
+			} else {
+				targetConn, err = dialAddr(dstAddr)
 			}
-			targetConn, err := net.DialTCP("tcp", nil, tcpDstAddr)
 			if err != nil {
-				logger.Warning(err.Error())
+				logger.Warningf("Error while connecting to %s: %s", dstAddr, err.Error())
 				connCh <- nil
 				f.Close()
 				closeConn(logger, conn)
@@ -175,9 +186,18 @@ func HandleConnection(
 				return
 			}
 
+			inUse.add(targetConn)
 			connCh <- targetConn
 			respRoutine := func() {
+				if pooled {
+					reusable := pooledHandler.HandlePooledResponse(targetConn, conn, netRequest, isInBoundConn)
+					// connection closed with client one isn't returned
+					reusable = inUse.remove(targetConn) && reusable
+					outboundPool.Put(dstAddr, targetConn, reusable, poolSettings(config.GetHTTPConfig()))
+					return
+				}
 				netHandler.HandleResponse(targetConn, conn, netRequest, isInBoundConn, true)
+				inUse.remove(targetConn)
 				closeConn(logger, targetConn)
 			}
 			wg.Add(1)
@@ -193,7 +213,7 @@ func HandleConnection(
 			closeConn(logger, conn)
 			return
 		}
-		targetConn, err := net.DialTCP("tcp", nil, tcpDstAddr)
+		targetConn, err := dialTCP(tcpDstAddr)
 		if err != nil {
 			logger.Warning(err.Error())
 			f.Close()
@@ -201,7 +221,13 @@ func HandleConnection(
 			return
 		}
 
-		go TcpCopyRequest(
+		responseDone := make(chan struct{})
+		go func() {
+			TcpCopyResponse(logger, targetConn, conn, netRequest, netHandler, isInBoundConn, f)
+			close(responseDone)
+		}()
+
+		TcpCopyRequest(
 			logger,
 			conn,
 			targetConn,
@@ -212,13 +238,131 @@ func HandleConnection(
 			f,
 			nil,
 			originalDstAddr)
-
-		go TcpCopyResponse(logger, targetConn, conn, netRequest, netHandler, isInBoundConn, f)
+		<-responseDone
 	}
 
 	//ec.Remove(dstAddr)
 }
 
+// RejectConnection closes client connection accepted over limit,
+// inbound HTTP client is answered with 503 before connection is closed
+func RejectConnection(logger *log.Logger, conn *net.TCPConn) {
+	defer closeConn(logger, conn)
+	f, err := conn.File()
+	if err != nil {
+		return
+	}
+	originalDstAddr, isInBoundConn, err := originalDestination(conn, f)
+	f.Close()
+	if err != nil || !isInBoundConn || protocol.Determine(originalDstAddr) != protocol.HTTPProto {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if _, err := io.WriteString(conn, rejectResponse); err != nil {
+		logger.Debugf("Error while rejecting connection: %s", err.Error())
+		return
+	}
+	// unread request would make close reset connection before client reads response
+	conn.CloseWrite()
+	io.Copy(ioutil.Discard, conn)
+}
+
+// originalDestination returns address connection was redirected from and whether it's inbound one,
+// f is file of connection
+func originalDestination(conn *net.TCPConn, f *os.File) (string, bool, error) {
+	addr, err := syscall.GetsockoptIPv6Mreq(int(f.Fd()), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+	if err != nil {
+		return "", false, err
+	}
+
+	ipBuilder := addrPool.Get().([]byte)
+	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[4]))...)
+	ipBuilder = append(ipBuilder, '.')
+	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[5]))...)
+	ipBuilder = append(ipBuilder, '.')
+	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[6]))...)
+	ipBuilder = append(ipBuilder, '.')
+	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[7]))...)
+	ipv4 := string(ipBuilder)
+	ipBuilder = ipBuilder[:0]
+	addrPool.Put(ipBuilder)
+	port := uint16(addr.Multiaddr[2])<<8 + uint16(addr.Multiaddr[3])
+
+	isInBoundConn := ipv4 == strings.Split(conn.LocalAddr().String(), ":")[0]
+
+	dstAddrBuilder := addrPool.Get().([]byte)
+	dstAddrBuilder = append(dstAddrBuilder, ipv4...)
+	dstAddrBuilder = append(dstAddrBuilder, ':')
+	dstAddrBuilder = append(dstAddrBuilder, strconv.Itoa(int(port))...)
+	originalDstAddr := string(dstAddrBuilder)
+	dstAddrBuilder = dstAddrBuilder[:0]
+	addrPool.Put(dstAddrBuilder)
+	return originalDstAddr, isInBoundConn, nil
+}
+
+// dialAddr resolves addr and connects to it
+func dialAddr(addr string) (*net.TCPConn, error) {
+	httpConfig := config.GetHTTPConfig()
+	tcpAddr, err := destinationCache.Resolve(addr, dnscache.Settings{
+		TTL:         httpConfig.DNSCacheTTL,
+		NegativeTTL: httpConfig.DNSCacheNegativeTTL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dialTCP(tcpAddr)
+}
+
+// connSet is upstream connections borrowed by client connection
+type connSet struct {
+	mu    sync.Mutex
+	conns map[*net.TCPConn]struct{}
+}
+
+func newConnSet() *connSet {
+	return &connSet{conns: make(map[*net.TCPConn]struct{})}
+}
+
+func (cs *connSet) add(conn *net.TCPConn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.conns[conn] = struct{}{}
+}
+
+// remove forgets connection and reports whether it wasn't closed by closeAll
+func (cs *connSet) remove(conn *net.TCPConn) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.conns[conn]; !ok {
+		return false
+	}
+	delete(cs.conns, conn)
+	return true
+}
+
+// closeAll closes connections which aren't released yet
+func (cs *connSet) closeAll(logger *log.Logger) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for conn := range cs.conns {
+		closeConn(logger, conn)
+	}
+	cs.conns = make(map[*net.TCPConn]struct{})
+}
+
+// dialTCP connects to addr respecting configured connect timeout
+func dialTCP(addr *net.TCPAddr) (*net.TCPConn, error) {
+	timeout := config.GetHTTPConfig().ConnectTimeout
+	if timeout <= 0 {
+		return net.DialTCP("tcp", nil, addr)
+	}
+	conn, err := net.DialTimeout("tcp", addr.String(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
 func closeConn(logger *log.Logger, conn *net.TCPConn) {
 	logger.Debug("Closing conn")
 	// Important to close read operations